@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tanishqv/bnb-bookings/internal/importer"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
+)
+
+// runCommand runs a command given after the flags, instead of starting the server, and
+// returns the exit code
+func runCommand(args []string, db repository.DatabaseRepo, out io.Writer) int {
+	switch args[0] {
+	case "import":
+		return importCommand(args[1:], db, out)
+	}
+
+	fmt.Fprintf(out, "unknown command %q, expected import\n", args[0])
+	return 2
+}
+
+// importCommand imports reservations from a CSV file:
+//
+//	bookings [flags] import [-dryrun] [-result result.csv] reservations.csv
+func importCommand(args []string, db repository.DatabaseRepo, out io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dryrun", false, "Check the file without importing anything")
+	resultPath := fs.String("result", "", "Write the file back with the status and errors of each row to this path")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "usage: bookings [flags] import [-dryrun] [-result result.csv] reservations.csv")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer f.Close()
+
+	result, err := importer.Run(db, f, *dryRun)
+
+	for _, row := range result.Rows {
+		for _, e := range row.Errors {
+			fmt.Fprintf(out, "line %d: %s\n", row.Line, e)
+		}
+	}
+
+	if *resultPath != "" && len(result.Rows) > 0 {
+		if werr := writeImportResult(*resultPath, result); werr != nil {
+			fmt.Fprintln(out, "cannot write result file:", werr)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(out, "import failed:", err)
+		return 1
+	}
+
+	switch {
+	case result.Failed() > 0:
+		fmt.Fprintf(out, "%d of %d row(s) have errors, nothing was imported\n", result.Failed(), len(result.Rows))
+		return 1
+	case result.DryRun:
+		fmt.Fprintf(out, "%d row(s) are valid, nothing was imported in a dry run\n", len(result.Rows))
+	default:
+		fmt.Fprintf(out, "%d reservation(s) imported\n", result.Imported)
+	}
+
+	return 0
+}
+
+func writeImportResult(path string, result importer.Result) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = result.WriteCSV(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
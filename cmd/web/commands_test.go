@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+)
+
+func TestRunCommand_Import(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.csv")
+	_ = os.WriteFile(valid, []byte("first-name,last-name,email,room,arrival,departure\nJohn,Smith,john@smith.com,1,2030-01-01,2030-01-03\n"), 0o600)
+	invalid := filepath.Join(dir, "invalid.csv")
+	_ = os.WriteFile(invalid, []byte("first-name,last-name,email,room,arrival,departure\nJohn,Smith,john,1,2030-01-01,2030-01-03\n"), 0o600)
+	resultPath := filepath.Join(dir, "result.csv")
+
+	tests := []struct {
+		name     string
+		args     []string
+		code     int
+		expected string
+	}{
+		{"dry run", []string{"import", "-dryrun", valid}, 0, "1 row(s) are valid"},
+		{"import", []string{"import", valid}, 0, "1 reservation(s) imported"},
+		{"row errors", []string{"import", "-result", resultPath, invalid}, 1, "line 2: email: Invalid email address"},
+		{"missing file", []string{"import", filepath.Join(dir, "missing.csv")}, 1, "no such file"},
+		{"no file", []string{"import"}, 2, "usage: bookings"},
+		{"unknown command", []string{"export"}, 2, "unknown command"},
+	}
+
+	var app config.AppConfig
+	for _, e := range tests {
+		var out bytes.Buffer
+		code := runCommand(e.args, dbrepo.NewTestRepo(&app), &out)
+		if code != e.code {
+			t.Errorf("%s: expected exit code %d, got %d", e.name, e.code, code)
+		}
+		if !strings.Contains(out.String(), e.expected) {
+			t.Errorf("%s: expected output to contain %q, got %q", e.name, e.expected, out.String())
+		}
+	}
+
+	result, err := os.ReadFile(resultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result), "2,error,email: Invalid email address") {
+		t.Errorf("unexpected result file %s", result)
+	}
+}
@@ -1,27 +1,54 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
 	"github.com/tanishqv/bnb-bookings/internal/driver"
 	"github.com/tanishqv/bnb-bookings/internal/handlers"
 	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/holds"
+	"github.com/tanishqv/bnb-bookings/internal/icalsync"
+	"github.com/tanishqv/bnb-bookings/internal/invoice"
+	"github.com/tanishqv/bnb-bookings/internal/mailer"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/outbox"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
+	"github.com/tanishqv/bnb-bookings/internal/reminders"
 	"github.com/tanishqv/bnb-bookings/internal/render"
+	"github.com/tanishqv/bnb-bookings/internal/sessionstore"
 
 	_ "github.com/jackc/pgx/v5"
 )
 
 const portNumber = ":8080"
 
+const (
+	// shutdownTimeout is how long the requests in flight have to finish on shutdown
+	shutdownTimeout = 15 * time.Second
+	// mailDrainTimeout is how long the mail workers have to finish the messages they are sending
+	// on shutdown; the messages still queued in the outbox are sent after the next start
+	mailDrainTimeout = 10 * time.Second
+	// workerStopTimeout is how long the background jobs have to finish the run in progress on
+	// shutdown, such as a calendar sync
+	workerStopTimeout = 15 * time.Second
+)
+
 var app config.AppConfig
 var session *scs.SessionManager
 var infoLog *log.Logger
@@ -33,12 +60,41 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.SQL.Close()
 
-	defer close(app.MailChan)
+	// A command after the flags, such as import, runs instead of the server
+	if args := flag.Args(); len(args) > 0 {
+		code := runCommand(args, handlers.Repo.DB, os.Stdout)
+		db.SQL.Close()
+		os.Exit(code)
+	}
+
+	fmt.Println("Starting mail outbox...")
+	stopMail := make(chan struct{})
+	mailDone := outbox.New(handlers.Repo.DB, app.Mailer.Send, app.ErrorLog, app.MailWorkers).Start(stopMail)
+
+	// The background jobs that use the database are stopped together on shutdown
+	stopWorkers := make(chan struct{})
+
+	fmt.Println("Starting calendar sync...")
+	syncDone := icalsync.New(handlers.Repo.DB, app.ErrorLog).Start(app.CalendarSyncInterval, stopWorkers)
+
+	fmt.Println("Starting reservation hold reaper...")
+	holdsDone := holds.New(handlers.Repo.DB, app.InfoLog, app.ErrorLog).Start(time.Minute, stopWorkers)
+	ratesDone := app.ExchangeRates.Reload(handlers.Repo.DB.AllExchangeRates, time.Minute, stopWorkers, app.ErrorLog)
 
-	fmt.Println("Starting mail listener...")
-	listenForMail()
+	sessionsDone := make(chan struct{})
+	go func() {
+		<-stopWorkers
+		session.Store.(sessionstore.Store).StopCleanup()
+		close(sessionsDone)
+	}()
+
+	workersDone := []<-chan struct{}{syncDone, holdsDone, ratesDone, sessionsDone}
+
+	// Balances are only paid online, and so only reminded of, with a payment gateway
+	if app.Payments != nil {
+		workersDone = append(workersDone, reminders.New(handlers.Repo.DB, app.ErrorLog, app.BaseURL, app.BalanceReminderDays).Start(time.Hour, stopWorkers))
+	}
 
 	fmt.Printf("Starting application on %s\n", portNumber)
 
@@ -47,8 +103,79 @@ func main() {
 		Handler: routes(&app),
 	}
 
-	err = srv.ListenAndServe()
-	log.Fatal(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := serve(ctx, srv, db, stopMail, mailDone, stopWorkers, workersDone...)
+	stop()
+	os.Exit(code)
+}
+
+// serve runs the server until ctx is done, on SIGINT or SIGTERM, then shuts down in order: it
+// stops taking requests and waits for those in flight, waits for the mail workers to finish
+// the messages they are sending, stops the background jobs and waits for the runs in progress,
+// and closes the database. It returns the exit code, 1 if the server failed or a step did not
+// finish in time.
+func serve(ctx context.Context, srv *http.Server, db *driver.DB, stopMail chan struct{}, mailDone <-chan struct{},
+	stopWorkers chan struct{}, workersDone ...<-chan struct{}) int {
+	code := 0
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		errorLog.Println(err)
+		code = 1
+	case <-ctx.Done():
+		infoLog.Println("Shutting down...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		errorLog.Println("cannot finish the requests in flight:", err)
+		code = 1
+	}
+
+	close(stopMail)
+	select {
+	case <-mailDone:
+		infoLog.Println("Mail workers stopped")
+	case <-time.After(mailDrainTimeout):
+		errorLog.Println("cannot finish sending mail in time, the messages will be sent after restarting")
+		code = 1
+	}
+
+	close(stopWorkers)
+	if waitAll(workerStopTimeout, workersDone...) {
+		infoLog.Println("Background jobs stopped")
+	} else {
+		errorLog.Println("cannot stop the background jobs in time")
+		code = 1
+	}
+
+	if err := db.SQL.Close(); err != nil {
+		errorLog.Println("cannot close the database:", err)
+		code = 1
+	}
+
+	return code
+}
+
+// waitAll waits for every channel in done to be closed and reports whether they all were
+// within timeout
+func waitAll(timeout time.Duration, done ...<-chan struct{}) bool {
+	deadline := time.After(timeout)
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
 }
 
 func run() (*driver.DB, error) {
@@ -66,6 +193,30 @@ func run() (*driver.DB, error) {
 	dbPass := flag.String("dbpwd", "", "Database password")
 	dbPort := flag.String("dbport", "5432", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database SSL settings (disable, prefer, require)")
+	mailTransport := flag.String("mailtransport", "smtp", "How mail is sent (smtp, file, log)")
+	mailHost := flag.String("mailhost", "localhost", "SMTP server host")
+	mailPort := flag.Int("mailport", 1025, "SMTP server port")
+	mailUser := flag.String("mailuser", "", "SMTP user name")
+	mailPass := flag.String("mailpwd", "", "SMTP password")
+	mailEncryption := flag.String("mailencryption", "none", "SMTP encryption (none, starttls, tls)")
+	mailFrom := flag.String("mailfrom", "", "Sender of all mail, such as \"Fort Smythe BnB <bookings@fsbnb.com>\", instead of each message's own")
+	mailDir := flag.String("maildir", "mail", "Directory the file mail transport writes .eml files to")
+	dkimKey := flag.String("dkimkey", "", "PEM file of the RSA private key mail is DKIM signed with, for the domain of -mailfrom")
+	dkimSelector := flag.String("dkimselector", "default", "DKIM selector of the signing key")
+	mailWorkers := flag.Int("mailworkers", 2, "Number of outbox workers sending mail at once")
+	calendarSync := flag.Duration("icalsync", 15*time.Minute, "Interval between external calendar syncs")
+	baseURL := flag.String("baseurl", "http://localhost"+portNumber, "Public URL of the site, used for links in emails")
+	reminderDays := flag.Int("reminderdays", 7, "Days before the balance due date to email a reminder")
+	paymentGateway := flag.String("paymentgateway", "", "Payment gateway provider (fake, for development only); without one reservations are confirmed straight away and paid for at the property")
+	paymentSecret := flag.String("paymentsecret", "", "Payment gateway webhook signing secret")
+	propertyName := flag.String("propertyname", "Fort Smythe BnB", "Property name printed on invoices")
+	propertyAddress := flag.String("propertyaddress", "", "Property address printed on invoices, lines separated by \\n")
+	propertyEmail := flag.String("propertyemail", "manager@fsbnb.com", "Property email printed on invoices")
+	propertyTaxID := flag.String("propertytaxid", "", "Property tax ID printed on invoices")
+	baseCurrency := flag.String("currency", payments.DefaultCurrency, "Currency prices are stored and charged in")
+	sessionStore := flag.String("sessionstore", "postgres", "Where sessions are kept (memory, postgres)")
+	sessionCleanup := flag.Duration("sessioncleanup", 5*time.Minute, "Interval between removals of expired sessions")
+	twoFactorRoles := flag.String("twofactorroles", "owner,manager", "Roles that must use two-factor authentication, comma separated, such as owner,front-desk")
 
 	flag.Parse()
 
@@ -74,12 +225,45 @@ func run() (*driver.DB, error) {
 		os.Exit(1)
 	}
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
+	// The fake gateway accepts any valid looking card without charging it
+	if *paymentGateway == "fake" && *inProduction {
+		return nil, errors.New("the fake payment gateway cannot be used in production")
+	}
+
+	if !currency.ValidCode(*baseCurrency) {
+		return nil, fmt.Errorf("invalid currency code %q", *baseCurrency)
+	}
+	pricing.SetDecimals(currency.Decimals(*baseCurrency))
+
+	if *mailWorkers < 1 {
+		return nil, fmt.Errorf("mailworkers must be at least 1, got %d", *mailWorkers)
+	}
+
+	app.TwoFactorRoles = make(map[int]bool)
+	for _, name := range strings.Split(*twoFactorRoles, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		level, ok := rbac.ParseRole(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid role %q in twofactorroles", name)
+		}
+		app.TwoFactorRoles[level] = true
+	}
 
 	// Change to true when in production
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.CalendarSyncInterval = *calendarSync
+	app.MailWorkers = *mailWorkers
+	app.BaseURL = strings.TrimSuffix(*baseURL, "/")
+	app.BalanceReminderDays = *reminderDays
+	app.Property = invoice.Property{
+		Name:    *propertyName,
+		Address: strings.ReplaceAll(*propertyAddress, `\n`, "\n"),
+		Email:   *propertyEmail,
+		TaxID:   *propertyTaxID,
+	}
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -95,6 +279,41 @@ func run() (*driver.DB, error) {
 
 	app.Session = session
 
+	var err error
+	if *paymentGateway != "" {
+		app.Payments, err = payments.New(*paymentGateway, *paymentSecret)
+		if err != nil {
+			app.ErrorLog.Println("cannot set up payment gateway")
+			return nil, err
+		}
+	} else {
+		app.InfoLog.Println("No payment gateway, reservations are confirmed without payment")
+	}
+
+	mailConfig := mailer.Config{
+		Transport:    *mailTransport,
+		Host:         *mailHost,
+		Port:         *mailPort,
+		Username:     *mailUser,
+		Password:     *mailPass,
+		Encryption:   *mailEncryption,
+		From:         *mailFrom,
+		DKIMSelector: *dkimSelector,
+		Dir:          *mailDir,
+	}
+	if *dkimKey != "" {
+		mailConfig.DKIMKey, err = os.ReadFile(*dkimKey)
+		if err != nil {
+			app.ErrorLog.Println("cannot read DKIM key")
+			return nil, err
+		}
+	}
+	app.Mailer, err = mailer.New(mailConfig, app.InfoLog)
+	if err != nil {
+		app.ErrorLog.Println("cannot set up mailer")
+		return nil, err
+	}
+
 	// Connecting to database
 	app.InfoLog.Println("Connecting to database...")
 	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
@@ -104,6 +323,13 @@ func run() (*driver.DB, error) {
 	}
 	app.InfoLog.Println("Connected to database!")
 
+	store, err := sessionstore.New(*sessionStore, db.SQL, *sessionCleanup, app.ErrorLog)
+	if err != nil {
+		app.ErrorLog.Println("cannot set up session store")
+		return nil, err
+	}
+	session.Store = store
+
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
 		app.ErrorLog.Println("cannot create template cache")
@@ -114,6 +340,15 @@ func run() (*driver.DB, error) {
 
 	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
+
+	app.ExchangeRates = currency.NewRates(*baseCurrency)
+	rates, err := repo.DB.AllExchangeRates()
+	if err != nil {
+		app.ErrorLog.Println("cannot load exchange rates")
+		return nil, err
+	}
+	app.ExchangeRates.Set(rates)
+
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
 
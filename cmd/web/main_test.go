@@ -1,6 +1,15 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/tanishqv/bnb-bookings/internal/driver"
+)
 
 func TestRun(t *testing.T) {
 	_, err := run()
@@ -8,3 +17,50 @@ func TestRun(t *testing.T) {
 		t.Errorf("failed run()")
 	}
 }
+
+func TestServe(t *testing.T) {
+	infoLog = log.New(io.Discard, "", 0)
+	errorLog = log.New(io.Discard, "", 0)
+
+	tests := []struct {
+		tcName       string
+		addr         string
+		signal       bool
+		expectedCode int
+	}{
+		{"shut down on a signal", "127.0.0.1:0", true, 0},
+		{"server failure", "127.0.0.1:-1", false, 1},
+	}
+
+	for _, e := range tests {
+		sqlDB, err := sql.Open("pgx", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if e.signal {
+			cancel()
+		}
+
+		stopMail := make(chan struct{})
+		mailDone := make(chan struct{})
+		go func() {
+			<-stopMail
+			close(mailDone)
+		}()
+
+		stopWorkers := make(chan struct{})
+		workerDone := make(chan struct{})
+		go func() {
+			<-stopWorkers
+			close(workerDone)
+		}()
+
+		code := serve(ctx, &http.Server{Addr: e.addr}, &driver.DB{SQL: sqlDB}, stopMail, mailDone, stopWorkers, workerDone)
+		cancel()
+		if code != e.expectedCode {
+			t.Errorf("failed %s: expected exit code %d, but got %d", e.tcName, e.expectedCode, code)
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/justinas/nosurf"
+	"github.com/tanishqv/bnb-bookings/internal/handlers"
 	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 )
 
 // NoSurf adds CSRF protection to all POST requests
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
 
+	// The gateway signs its webhook calls instead
+	csrfHandler.ExemptPath("/payments/webhook")
+
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
@@ -25,15 +34,105 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
-// Auth checks if the session is
+// Auth checks if the session is of a staff user, who can use the admin tool, and who has set up
+// two-factor authentication if their role requires it
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !helpers.IsAuthenticated(r) {
+		user, ok, err := refreshUser(r)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		if !ok {
 			session.Put(r.Context(), "error", "Log in required to see content")
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
 
+		if !helpers.IsStaff(r) {
+			session.Put(r.Context(), "error", "The admin area is for staff only")
+			http.Redirect(w, r, "/account/stays", http.StatusSeeOther)
+			return
+		}
+
+		if app.TwoFactorRoles[user.AccessLevel] && !user.TwoFactorEnabled() {
+			session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+			http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lastSeenInterval is how often the time a session was last used is updated
+const lastSeenInterval = time.Minute
+
+// refreshUser reports whether the session is of a user who can still log in, and updates the
+// access level in the session, so deactivating a user or changing their role takes effect at
+// once. Sessions of users who were deactivated, or who changed their password since logging in,
+// are ended. It returns the user too.
+func refreshUser(r *http.Request) (models.User, bool, error) {
+	if !helpers.IsAuthenticated(r) {
+		return models.User{}, false, nil
+	}
+
+	user, err := handlers.Repo.DB.GetUserByID(session.GetInt(r.Context(), "user-id"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.Active()) {
+		return user, false, session.Destroy(r.Context())
+	}
+	if err != nil {
+		return user, false, err
+	}
+
+	// Changing the password ends the sessions that logged in with the old one
+	loggedInAt := session.GetInt64(r.Context(), "logged-in-at")
+	if !user.PasswordChangedAt.IsZero() && loggedInAt < user.PasswordChangedAt.UnixNano() {
+		return user, false, session.Destroy(r.Context())
+	}
+
+	session.Put(r.Context(), "access-level", user.AccessLevel)
+
+	// The time the session was last used is only updated now and then, as it saves the session
+	if time.Since(time.Unix(0, session.GetInt64(r.Context(), "last-seen-at"))) > lastSeenInterval {
+		session.Put(r.Context(), "last-seen-at", time.Now().UnixNano())
+	}
+	return user, true, nil
+}
+
+// Can checks if the role of the staff user logged in has a permission, and sends them back to
+// their first admin page if not. It is used on admin routes, after Auth.
+func Can(permission rbac.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accessLevel := session.GetInt(r.Context(), "access-level")
+			if !rbac.Can(accessLevel, permission) {
+				session.Put(r.Context(), "error", "You do not have permission to do that")
+				http.Redirect(w, r, rbac.Home(accessLevel), http.StatusSeeOther)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AccountAuth checks if the session is of a user logged in, guest or staff
+func AccountAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok, err := refreshUser(r)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		if !ok {
+			session.Put(r.Context(), "error", "Log in to see your account")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/tanishqv/bnb-bookings/internal/config"
 	"github.com/tanishqv/bnb-bookings/internal/handlers"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 )
 
 func routes(app *config.AppConfig) http.Handler {
@@ -33,10 +34,47 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/make-reservation", handlers.Repo.Reservation)
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
+	mux.Get("/payment", handlers.Repo.Payment)
+	mux.Post("/payment", handlers.Repo.PostPayment)
+	mux.Post("/payments/webhook", handlers.Repo.PaymentWebhook)
+	mux.Get("/pay/{token}", handlers.Repo.PayReservation)
+	mux.Get("/manage/{token}", handlers.Repo.ManageReservation)
+	mux.Post("/manage/{token}/cancel", handlers.Repo.PostCancelReservation)
+	mux.Get("/manage/{token}/invoice", handlers.Repo.GuestInvoice)
+
+	mux.Get("/currency", handlers.Repo.SetCurrency)
 
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
+	mux.Get("/user/login/two-factor", handlers.Repo.ShowLoginTwoFactor)
+	mux.Post("/user/login/two-factor", handlers.Repo.PostLoginTwoFactor)
 	mux.Get("/user/logout", handlers.Repo.Logout)
+	mux.Get("/user/register", handlers.Repo.ShowRegister)
+	mux.Post("/user/register", handlers.Repo.PostRegister)
+	mux.Get("/user/verify", handlers.Repo.VerifyEmail)
+	mux.Get("/user/set-password", handlers.Repo.ShowSetPassword)
+	mux.Post("/user/set-password", handlers.Repo.PostSetPassword)
+	mux.Get("/user/forgot-password", handlers.Repo.ShowForgotPassword)
+	mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", handlers.Repo.ShowResetPassword)
+	mux.Post("/user/reset-password", handlers.Repo.PostResetPassword)
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(AccountAuth)
+
+		mux.Get("/stays", handlers.Repo.MyStays)
+		mux.Get("/profile", handlers.Repo.ShowProfile)
+		mux.Post("/profile", handlers.Repo.PostProfile)
+		mux.Get("/two-factor", handlers.Repo.ShowTwoFactor)
+		mux.Post("/two-factor", handlers.Repo.PostEnableTwoFactor)
+		mux.Post("/two-factor/recovery-codes", handlers.Repo.PostRecoveryCodes)
+		mux.Post("/two-factor/disable", handlers.Repo.PostDisableTwoFactor)
+		mux.Get("/sessions", handlers.Repo.ShowSessions)
+		mux.Post("/sessions/revoke-others", handlers.Repo.PostRevokeOtherSessions)
+		mux.Post("/sessions/{id}/revoke", handlers.Repo.PostRevokeSession)
+	})
+
+	mux.Get("/ical/rooms/{id}.ics", handlers.Repo.ICalRoomFeed)
 
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -44,16 +82,76 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(Auth)
 
-		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
-		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
-		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
-		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
-		mux.Get("/process-reservation/{src}/{id}/process", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/delete", handlers.Repo.AdminDeleteReservation)
+		mux.With(Can(rbac.ViewReports)).Get("/dashboard", handlers.Repo.AdminDashboard)
+		mux.With(Can(rbac.ViewReservations)).Get("/search", handlers.Repo.AdminSearch)
+		mux.With(Can(rbac.ViewReservations)).Get("/search-json", handlers.Repo.AdminSearchJSON)
+		mux.With(Can(rbac.ViewReservations)).Get("/reservations-new", handlers.Repo.AdminNewReservations)
+		mux.With(Can(rbac.ViewReservations)).Get("/reservations-all", handlers.Repo.AdminAllReservations)
+		mux.With(Can(rbac.ExportReservations)).Get("/reservations/export", handlers.Repo.AdminExportReservations)
+		mux.With(Can(rbac.ImportReservations)).Get("/import", handlers.Repo.AdminImport)
+		mux.With(Can(rbac.ImportReservations)).Post("/import", handlers.Repo.AdminPostImport)
+		mux.With(Can(rbac.ImportReservations)).Get("/import/result", handlers.Repo.AdminImportResult)
+
+		mux.With(Can(rbac.ViewReservations)).Get("/guests", handlers.Repo.AdminGuests)
+		mux.With(Can(rbac.ViewReservations)).Get("/guests/{id}", handlers.Repo.AdminShowGuest)
+		mux.With(Can(rbac.EditGuests)).Post("/guests/{id}", handlers.Repo.AdminPostGuest)
+		mux.With(Can(rbac.ViewCalendar)).Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
+		mux.With(Can(rbac.BlockRooms)).Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.With(Can(rbac.EditReservations)).Get("/process-reservation/{src}/{id}/process", handlers.Repo.AdminProcessReservation)
+		mux.With(Can(rbac.DeleteReservations)).Get("/delete-reservation/{src}/{id}/delete", handlers.Repo.AdminDeleteReservation)
+
+		mux.With(Can(rbac.ViewReservations)).Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+		mux.With(Can(rbac.ViewReservations)).Get("/reservations/{id}/invoice", handlers.Repo.AdminInvoice)
+		mux.With(Can(rbac.EditReservations)).Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/ical-sources", handlers.Repo.AdminICalSources)
+		mux.With(Can(rbac.ManageSettings)).Post("/ical-sources", handlers.Repo.AdminPostICalSource)
+		mux.With(Can(rbac.ManageSettings)).Post("/ical-sources/{id}/sync", handlers.Repo.AdminSyncICalSource)
+		mux.With(Can(rbac.ManageSettings)).Post("/ical-sources/{id}/delete", handlers.Repo.AdminDeleteICalSource)
+
+		mux.With(Can(rbac.ManagePayments)).Post("/payments/{id}/capture", handlers.Repo.AdminCapturePayment)
+		mux.With(Can(rbac.ManagePayments)).Post("/payments/{id}/refund", handlers.Repo.AdminRefundPayment)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/deposit-policies", handlers.Repo.AdminDepositPolicies)
+		mux.With(Can(rbac.ManageSettings)).Post("/deposit-policies", handlers.Repo.AdminPostDepositPolicy)
+		mux.With(Can(rbac.ViewReservations)).Get("/balances-due", handlers.Repo.AdminBalancesDue)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/cancellation-policies", handlers.Repo.AdminCancellationPolicies)
+		mux.With(Can(rbac.ManageSettings)).Post("/cancellation-policies", handlers.Repo.AdminPostCancellationPolicy)
+		mux.With(Can(rbac.ManageSettings)).Post("/cancellation-policies/{id}/delete", handlers.Repo.AdminDeleteCancellationPolicy)
+		mux.With(Can(rbac.ManageSettings)).Post("/cancellation-policies/rooms", handlers.Repo.AdminPostRoomCancellationPolicy)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/promotions", handlers.Repo.AdminPromotions)
+		mux.With(Can(rbac.ManageSettings)).Post("/promotions", handlers.Repo.AdminPostPromotion)
+		mux.With(Can(rbac.ManageSettings)).Post("/promotions/{id}/toggle", handlers.Repo.AdminTogglePromotion)
+		mux.With(Can(rbac.ManageSettings)).Post("/promotions/{id}/delete", handlers.Repo.AdminDeletePromotion)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/fees", handlers.Repo.AdminFees)
+		mux.With(Can(rbac.ManageSettings)).Post("/fees", handlers.Repo.AdminPostFee)
+		mux.With(Can(rbac.ViewReports)).Get("/fees/report", handlers.Repo.AdminFeeReport)
+		mux.With(Can(rbac.ManageSettings)).Post("/fees/{id}/toggle", handlers.Repo.AdminToggleFee)
+		mux.With(Can(rbac.ManageSettings)).Post("/fees/{id}/delete", handlers.Repo.AdminDeleteFee)
+
+		mux.With(Can(rbac.ManageSettings)).Get("/exchange-rates", handlers.Repo.AdminExchangeRates)
+		mux.With(Can(rbac.ManageSettings)).Post("/exchange-rates", handlers.Repo.AdminPostExchangeRate)
+		mux.With(Can(rbac.ManageSettings)).Post("/exchange-rates/import", handlers.Repo.AdminImportExchangeRates)
+		mux.With(Can(rbac.ManageSettings)).Post("/exchange-rates/{id}/delete", handlers.Repo.AdminDeleteExchangeRate)
+
+		mux.With(Can(rbac.ManagePayments)).Post("/cancel-reservation/{src}/{id}/cancel", handlers.Repo.AdminCancelReservation)
 
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		mux.With(Can(rbac.ManageUsers)).Get("/users", handlers.Repo.AdminUsers)
+		mux.With(Can(rbac.ManageUsers)).Post("/users", handlers.Repo.AdminInviteUser)
+		mux.With(Can(rbac.ManageUsers)).Get("/users/{id}", handlers.Repo.AdminShowUser)
+		mux.With(Can(rbac.ManageUsers)).Post("/users/{id}", handlers.Repo.AdminPostUser)
+		mux.With(Can(rbac.ManageUsers)).Post("/users/{id}/deactivate", handlers.Repo.AdminDeactivateUser)
+		mux.With(Can(rbac.ManageUsers)).Post("/users/{id}/reactivate", handlers.Repo.AdminReactivateUser)
+		mux.With(Can(rbac.ManageUsers)).Post("/users/{id}/reset-two-factor", handlers.Repo.AdminResetTwoFactor)
+		mux.With(Can(rbac.ManageUsers)).Post("/users/{id}/unlock", handlers.Repo.AdminUnlockAccount)
+		mux.With(Can(rbac.ManageUsers)).Get("/locked-accounts", handlers.Repo.AdminLockedAccounts)
+		mux.With(Can(rbac.ManageMail)).Get("/outbox", handlers.Repo.AdminOutbox)
+		mux.With(Can(rbac.ManageMail)).Get("/outbox/{id}", handlers.Repo.AdminShowOutboxMessage)
+		mux.With(Can(rbac.ManageMail)).Post("/outbox/{id}/resend", handlers.Repo.AdminResendOutboxMessage)
+		mux.With(Can(rbac.ManageMail)).Post("/outbox/{id}/discard", handlers.Repo.AdminDiscardOutboxMessage)
 	})
 
 	return mux
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/handlers"
+	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 )
 
 func TestRoutes(t *testing.T) {
@@ -19,3 +28,158 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("type is not *chi.Mux, type is %T", v)
 	}
 }
+
+// adminRoutePermissions is the permission each admin route needs
+var adminRoutePermissions = map[string]rbac.Permission{
+	"GET /admin/dashboard":                              rbac.ViewReports,
+	"GET /admin/search":                                 rbac.ViewReservations,
+	"GET /admin/search-json":                            rbac.ViewReservations,
+	"GET /admin/reservations-new":                       rbac.ViewReservations,
+	"GET /admin/reservations-all":                       rbac.ViewReservations,
+	"GET /admin/reservations/export":                    rbac.ExportReservations,
+	"GET /admin/import":                                 rbac.ImportReservations,
+	"POST /admin/import":                                rbac.ImportReservations,
+	"GET /admin/import/result":                          rbac.ImportReservations,
+	"GET /admin/guests":                                 rbac.ViewReservations,
+	"GET /admin/guests/{id}":                            rbac.ViewReservations,
+	"POST /admin/guests/{id}":                           rbac.EditGuests,
+	"GET /admin/reservations-calendar":                  rbac.ViewCalendar,
+	"POST /admin/reservations-calendar":                 rbac.BlockRooms,
+	"GET /admin/process-reservation/{src}/{id}/process": rbac.EditReservations,
+	"GET /admin/delete-reservation/{src}/{id}/delete":   rbac.DeleteReservations,
+	"GET /admin/reservations/{src}/{id}/show":           rbac.ViewReservations,
+	"GET /admin/reservations/{id}/invoice":              rbac.ViewReservations,
+	"POST /admin/reservations/{src}/{id}":               rbac.EditReservations,
+	"GET /admin/ical-sources":                           rbac.ManageSettings,
+	"POST /admin/ical-sources":                          rbac.ManageSettings,
+	"POST /admin/ical-sources/{id}/sync":                rbac.ManageSettings,
+	"POST /admin/ical-sources/{id}/delete":              rbac.ManageSettings,
+	"POST /admin/payments/{id}/capture":                 rbac.ManagePayments,
+	"POST /admin/payments/{id}/refund":                  rbac.ManagePayments,
+	"GET /admin/deposit-policies":                       rbac.ManageSettings,
+	"POST /admin/deposit-policies":                      rbac.ManageSettings,
+	"GET /admin/balances-due":                           rbac.ViewReservations,
+	"GET /admin/cancellation-policies":                  rbac.ManageSettings,
+	"POST /admin/cancellation-policies":                 rbac.ManageSettings,
+	"POST /admin/cancellation-policies/{id}/delete":     rbac.ManageSettings,
+	"POST /admin/cancellation-policies/rooms":           rbac.ManageSettings,
+	"GET /admin/promotions":                             rbac.ManageSettings,
+	"POST /admin/promotions":                            rbac.ManageSettings,
+	"POST /admin/promotions/{id}/toggle":                rbac.ManageSettings,
+	"POST /admin/promotions/{id}/delete":                rbac.ManageSettings,
+	"GET /admin/fees":                                   rbac.ManageSettings,
+	"POST /admin/fees":                                  rbac.ManageSettings,
+	"GET /admin/fees/report":                            rbac.ViewReports,
+	"POST /admin/fees/{id}/toggle":                      rbac.ManageSettings,
+	"POST /admin/fees/{id}/delete":                      rbac.ManageSettings,
+	"GET /admin/exchange-rates":                         rbac.ManageSettings,
+	"POST /admin/exchange-rates":                        rbac.ManageSettings,
+	"POST /admin/exchange-rates/import":                 rbac.ManageSettings,
+	"POST /admin/exchange-rates/{id}/delete":            rbac.ManageSettings,
+	"POST /admin/cancel-reservation/{src}/{id}/cancel":  rbac.ManagePayments,
+	"GET /admin/users":                                  rbac.ManageUsers,
+	"POST /admin/users":                                 rbac.ManageUsers,
+	"GET /admin/users/{id}":                             rbac.ManageUsers,
+	"POST /admin/users/{id}":                            rbac.ManageUsers,
+	"POST /admin/users/{id}/deactivate":                 rbac.ManageUsers,
+	"POST /admin/users/{id}/reactivate":                 rbac.ManageUsers,
+	"POST /admin/users/{id}/reset-two-factor":           rbac.ManageUsers,
+	"POST /admin/users/{id}/unlock":                     rbac.ManageUsers,
+	"GET /admin/locked-accounts":                        rbac.ManageUsers,
+	"GET /admin/outbox":                                 rbac.ManageMail,
+	"GET /admin/outbox/{id}":                            rbac.ManageMail,
+	"POST /admin/outbox/{id}/resend":                    rbac.ManageMail,
+	"POST /admin/outbox/{id}/discard":                   rbac.ManageMail,
+}
+
+// TestRoutes_Permissions sends a user in every role, a deactivated user and someone not logged
+// in to every admin route through the route's middleware, and checks who gets through to the
+// handler
+func TestRoutes_Permissions(t *testing.T) {
+	session = scs.New()
+	app.Session = session
+	helpers.NewHelpers(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+
+	users, err := handlers.Repo.DB.AllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions has a session cookie for each user, who should have the permissions of their role
+	type login struct {
+		cookie      *http.Cookie
+		accessLevel int
+		active      bool
+	}
+	sessions := map[string]login{"anonymous": {}}
+	roles := make(map[int]bool)
+	for _, user := range users {
+		ctx, _ := session.Load(context.Background(), "")
+		session.Put(ctx, "user-id", user.ID)
+		// The middleware looks up the role rather than trusting the session
+		session.Put(ctx, "access-level", models.AccessLevelOwner)
+		token, _, err := session.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[user.Email] = login{
+			cookie:      &http.Cookie{Name: session.Cookie.Name, Value: token},
+			accessLevel: user.AccessLevel,
+			active:      user.Active(),
+		}
+		roles[user.AccessLevel] = true
+	}
+	for _, role := range rbac.Roles {
+		if !roles[role.AccessLevel] {
+			t.Errorf("no test user is %s", role.Name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	err = chi.Walk(routes(&app).(*chi.Mux), func(method, route string, _ http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/admin/") {
+			return nil
+		}
+
+		key := method + " " + route
+		seen[key] = true
+		permission, ok := adminRoutePermissions[key]
+		if !ok {
+			t.Errorf("%s: no permission expected for the route", key)
+			return nil
+		}
+
+		for name, login := range sessions {
+			reached := false
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+			for i := len(middlewares) - 1; i >= 0; i-- {
+				handler = middlewares[i](handler)
+			}
+
+			// The request is always a GET so the CSRF check lets it through
+			req := httptest.NewRequest("GET", route, nil)
+			if login.cookie != nil {
+				req.AddCookie(login.cookie)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			expected := login.cookie != nil && login.active && rbac.Can(login.accessLevel, permission)
+			if reached != expected {
+				t.Errorf("%s as %s: expected access %t, got %t", key, name, expected, reached)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range adminRoutePermissions {
+		if !seen[key] {
+			t.Errorf("%s: route not found", key)
+		}
+	}
+}
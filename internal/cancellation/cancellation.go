@@ -0,0 +1,145 @@
+package cancellation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule refunds RefundPercent of the stay when cancelled at least DaysBefore days before arrival
+type Rule struct {
+	DaysBefore    int
+	RefundPercent int
+}
+
+// Policy is a set of cancellation rules, ordered by DaysBefore, longest notice first
+type Policy struct {
+	Rules []Rule
+}
+
+// FullRefund applies to rooms without a cancellation policy: a full refund up to and including the day of arrival
+var FullRefund = Policy{Rules: []Rule{{DaysBefore: 0, RefundPercent: 100}}}
+
+// Parse parses rules written as "days:percent" pairs, e.g. "30:100, 7:50"
+func Parse(s string) (Policy, error) {
+	var p Policy
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		days, percent, ok := strings.Cut(part, ":")
+		if !ok {
+			return p, fmt.Errorf("rule %q is not in days:percent form", part)
+		}
+
+		d, err := strconv.Atoi(strings.TrimSpace(days))
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("rule %q has an invalid number of days", part)
+		}
+
+		pct, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(percent), "%")))
+		if err != nil || pct < 0 || pct > 100 {
+			return p, fmt.Errorf("rule %q has an invalid refund percentage", part)
+		}
+
+		p.Rules = append(p.Rules, Rule{DaysBefore: d, RefundPercent: pct})
+	}
+
+	if len(p.Rules) == 0 {
+		return p, errors.New("policy has no rules")
+	}
+
+	sort.SliceStable(p.Rules, func(i, j int) bool {
+		return p.Rules[i].DaysBefore > p.Rules[j].DaysBefore
+	})
+
+	for i := 1; i < len(p.Rules); i++ {
+		if p.Rules[i].DaysBefore == p.Rules[i-1].DaysBefore {
+			return p, fmt.Errorf("more than one rule for %d days", p.Rules[i].DaysBefore)
+		}
+	}
+
+	return p, nil
+}
+
+// String returns the rules in the form accepted by Parse
+func (p Policy) String() string {
+	parts := make([]string, 0, len(p.Rules))
+	for _, r := range p.Rules {
+		parts = append(parts, fmt.Sprintf("%d:%d", r.DaysBefore, r.RefundPercent))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Describe returns the policy in words for guests
+func (p Policy) Describe() string {
+	parts := make([]string, 0, len(p.Rules)+1)
+
+	for _, r := range p.Rules {
+		refund := fmt.Sprintf("%d%% refund", r.RefundPercent)
+		switch r.RefundPercent {
+		case 100:
+			refund = "Full refund"
+		case 0:
+			refund = "No refund"
+		}
+
+		when := fmt.Sprintf("at least %d days before arrival", r.DaysBefore)
+		switch r.DaysBefore {
+		case 0:
+			when = "up to and including the day of arrival"
+		case 1:
+			when = "at least 1 day before arrival"
+		}
+
+		parts = append(parts, fmt.Sprintf("%s if cancelled %s", refund, when))
+	}
+
+	if len(p.Rules) > 0 && p.Rules[len(p.Rules)-1].RefundPercent > 0 {
+		parts = append(parts, "no refund after that")
+	}
+
+	s := strings.Join(parts, "; ") + "."
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// RefundPercent returns the percentage of the stay refunded when cancelling at the given time
+func (p Policy) RefundPercent(start, at time.Time) int {
+	days := DaysBefore(start, at)
+
+	for _, r := range p.Rules {
+		if days >= r.DaysBefore {
+			return r.RefundPercent
+		}
+	}
+
+	return 0
+}
+
+// Calculate returns the refund owed and the penalty kept when a stay costing total, of
+// which paid has been paid, is cancelled at the given time. The penalty is the share of
+// the total the policy does not refund; the guest gets back whatever they paid above it.
+func Calculate(p Policy, total, paid int, start, at time.Time) (refund, penalty int) {
+	penalty = total * (100 - p.RefundPercent(start, at)) / 100
+
+	refund = paid - penalty
+	if refund < 0 {
+		refund = 0
+	}
+
+	return refund, penalty
+}
+
+// DaysBefore returns the number of whole days between the calendar date of at and arrival
+func DaysBefore(start, at time.Time) int {
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	arrival := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+
+	return int(arrival.Sub(day).Hours() / 24)
+}
@@ -0,0 +1,71 @@
+package cancellation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse("7:50, 30:100 ,0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.String() != "30:100, 7:50, 0:0" {
+		t.Errorf("unexpected rules %s", p.String())
+	}
+
+	for _, s := range []string{"", "30", "x:100", "30:150", "-1:50", "30:100, 30:50"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestPolicy_Describe(t *testing.T) {
+	p, _ := Parse("30:100, 7:50")
+
+	expected := "Full refund if cancelled at least 30 days before arrival; 50% refund if cancelled at least 7 days before arrival; no refund after that."
+	if got := p.Describe(); got != expected {
+		t.Errorf("unexpected description %q", got)
+	}
+
+	if got := FullRefund.Describe(); got != "Full refund if cancelled up to and including the day of arrival; no refund after that." {
+		t.Errorf("unexpected description %q", got)
+	}
+
+	// As described, the day of arrival itself is still refunded
+	start := time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC)
+	if got := FullRefund.RefundPercent(start, start.Add(15*time.Hour)); got != 100 {
+		t.Errorf("expected full refund on the day of arrival, got %d%%", got)
+	}
+	if got := FullRefund.RefundPercent(start, start.AddDate(0, 0, 1)); got != 0 {
+		t.Errorf("expected no refund after arrival, got %d%%", got)
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	p, _ := Parse("30:100, 7:50")
+	start := time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name            string
+		at              time.Time
+		paid            int
+		expectedRefund  int
+		expectedPenalty int
+	}{
+		{"well ahead", time.Date(2050, 1, 1, 18, 0, 0, 0, time.UTC), 50000, 50000, 0},
+		{"exactly 30 days", time.Date(2050, 1, 30, 23, 0, 0, 0, time.UTC), 50000, 50000, 0},
+		{"half refund", time.Date(2050, 2, 15, 0, 0, 0, 0, time.UTC), 50000, 25000, 25000},
+		{"deposit only, half refund", time.Date(2050, 2, 15, 0, 0, 0, 0, time.UTC), 10000, 0, 25000},
+		{"too late", time.Date(2050, 2, 28, 0, 0, 0, 0, time.UTC), 50000, 0, 50000},
+	}
+
+	for _, e := range tests {
+		refund, penalty := Calculate(p, 50000, e.paid, start, e.at)
+		if refund != e.expectedRefund || penalty != e.expectedPenalty {
+			t.Errorf("%s: expected refund %d and penalty %d, got %d and %d", e.name, e.expectedRefund, e.expectedPenalty, refund, penalty)
+		}
+	}
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"html/template"
 	"log"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
-	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
+	"github.com/tanishqv/bnb-bookings/internal/invoice"
+	"github.com/tanishqv/bnb-bookings/internal/mailer"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
 )
 
 // AppConfig holds the application config
@@ -16,5 +20,24 @@ type AppConfig struct {
 	Session       *scs.SessionManager
 	InfoLog       *log.Logger
 	ErrorLog      *log.Logger
-	MailChan      chan models.MailData
+	Payments      payments.Gateway
+
+	CalendarSyncInterval time.Duration
+
+	// Mailer sends the messages of the outbox; MailWorkers is how many at once
+	Mailer      mailer.Mailer
+	MailWorkers int
+
+	// BaseURL is the public address of the site, used for links in emails
+	BaseURL             string
+	BalanceReminderDays int
+
+	// Property is printed on invoices
+	Property invoice.Property
+
+	// ExchangeRates converts prices from the base currency for display
+	ExchangeRates *currency.Rates
+
+	// TwoFactorRoles are the access levels that must use two-factor authentication
+	TwoFactorRoles map[int]bool
 }
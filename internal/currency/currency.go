@@ -0,0 +1,231 @@
+package currency
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+)
+
+// symbols are the currency signs shown before amounts; other currencies show their code after the amount
+var symbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"INR": "₹",
+	"AUD": "A$",
+	"CAD": "C$",
+}
+
+// zeroDecimal are the currencies without minor units
+var zeroDecimal = map[string]bool{
+	"JPY": true,
+	"KRW": true,
+	"VND": true,
+	"CLP": true,
+	"ISK": true,
+}
+
+// ValidCode reports whether code looks like an ISO 4217 currency code
+func ValidCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimals returns the number of minor unit digits of a currency
+func Decimals(code string) int {
+	if zeroDecimal[code] {
+		return 0
+	}
+	return 2
+}
+
+// Format formats an amount in the minor units of a currency, such as "$12.50" or "12.50 CHF"
+func Format(amount int, code string) string {
+	number := pricing.FormatDecimal(amount, Decimals(code))
+
+	if s, ok := symbols[code]; ok {
+		if strings.HasPrefix(number, "-") {
+			return "-" + s + number[1:]
+		}
+		return s + number
+	}
+	return number + " " + code
+}
+
+// Convert converts an amount in the minor units of one currency to the minor units of
+// another, given how many units of the target currency one unit of the source buys
+func Convert(amount int, from, to string, rate float64) int {
+	major := float64(amount) / math.Pow10(Decimals(from))
+	return int(math.Round(major * rate * math.Pow10(Decimals(to))))
+}
+
+// Rates holds the exchange rates from the base currency, safe for concurrent use
+type Rates struct {
+	mu    sync.RWMutex
+	base  string
+	rates map[string]float64
+}
+
+// NewRates returns the rates for a base currency, with no other currencies yet
+func NewRates(base string) *Rates {
+	return &Rates{
+		base:  base,
+		rates: make(map[string]float64),
+	}
+}
+
+// Base returns the currency prices are stored and charged in
+func (r *Rates) Base() string {
+	return r.base
+}
+
+// Set replaces the exchange rates
+func (r *Rates) Set(rates []models.ExchangeRate) {
+	m := make(map[string]float64)
+	for _, er := range rates {
+		if er.Currency != r.base && er.Rate > 0 {
+			m[er.Currency] = er.Rate
+		}
+	}
+
+	r.mu.Lock()
+	r.rates = m
+	r.mu.Unlock()
+}
+
+// Reload replaces the rates with those load returns every interval in the background until
+// stop is closed, so that rates saved on another instance are picked up. The returned channel
+// is closed once it has stopped.
+func (r *Rates) Reload(load func() ([]models.ExchangeRate, error), interval time.Duration, stop <-chan struct{}, errorLog *log.Logger) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+
+			rates, err := load()
+			if err != nil {
+				errorLog.Println("cannot reload exchange rates:", err)
+				continue
+			}
+			r.Set(rates)
+		}
+	}()
+
+	return done
+}
+
+// Rate returns how many units of code one unit of the base currency buys
+func (r *Rates) Rate(code string) (float64, bool) {
+	if code == r.base {
+		return 1, true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rate, ok := r.rates[code]
+	return rate, ok
+}
+
+// Codes returns the base currency followed by the other currencies in alphabetical order
+func (r *Rates) Codes() []string {
+	r.mu.RLock()
+	codes := make([]string, 0, len(r.rates))
+	for code := range r.rates {
+		codes = append(codes, code)
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(codes)
+	return append([]string{r.base}, codes...)
+}
+
+// Display converts an amount in the base currency to code and formats it. Amounts
+// in currencies without a rate are shown in the base currency.
+func (r *Rates) Display(amount int, code string) string {
+	rate, ok := r.Rate(code)
+	if !ok || code == r.base {
+		return Format(amount, r.base)
+	}
+	return Format(Convert(amount, r.base, code, rate), code)
+}
+
+// ParseCSV reads exchange rates as "currency,rate" lines. A header line is skipped.
+func ParseCSV(in io.Reader) ([]models.ExchangeRate, error) {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rates []models.ExchangeRate
+	seen := make(map[string]bool)
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(record) != 2 {
+			return nil, fmt.Errorf("line %d: expected currency,rate", line)
+		}
+
+		code := strings.ToUpper(strings.TrimSpace(record[0]))
+		value := strings.TrimSpace(record[1])
+
+		if line == 1 && !ValidCode(code) {
+			// header
+			continue
+		}
+		if !ValidCode(code) {
+			return nil, fmt.Errorf("line %d: invalid currency code %q", line, record[0])
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, value)
+		}
+
+		if seen[code] {
+			return nil, fmt.Errorf("line %d: %s is listed more than once", line, code)
+		}
+		seen[code] = true
+
+		rates = append(rates, models.ExchangeRate{Currency: code, Rate: rate})
+	}
+
+	if len(rates) == 0 {
+		return nil, errors.New("no exchange rates found")
+	}
+
+	return rates, nil
+}
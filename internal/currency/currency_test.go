@@ -0,0 +1,146 @@
+package currency
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func TestFormat(t *testing.T) {
+	var tests = []struct {
+		amount   int
+		code     string
+		expected string
+	}{
+		{1250, "USD", "$12.50"},
+		{-1250, "EUR", "-€12.50"},
+		{1250, "CHF", "12.50 CHF"},
+		{1250, "JPY", "¥1250"},
+	}
+
+	for _, e := range tests {
+		if got := Format(e.amount, e.code); got != e.expected {
+			t.Errorf("Format(%d, %s): expected %s, got %s", e.amount, e.code, e.expected, got)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var tests = []struct {
+		amount   int
+		from     string
+		to       string
+		rate     float64
+		expected int
+	}{
+		{10000, "USD", "EUR", 0.92, 9200},
+		{10000, "USD", "JPY", 149.5, 14950},
+		{333, "USD", "GBP", 0.79, 263},
+		{15000, "JPY", "USD", 0.0067, 10050},
+	}
+
+	for _, e := range tests {
+		if got := Convert(e.amount, e.from, e.to, e.rate); got != e.expected {
+			t.Errorf("Convert(%d %s to %s): expected %d, got %d", e.amount, e.from, e.to, e.expected, got)
+		}
+	}
+}
+
+func TestRates(t *testing.T) {
+	r := NewRates("USD")
+	r.Set([]models.ExchangeRate{
+		{Currency: "GBP", Rate: 0.79},
+		{Currency: "EUR", Rate: 0.92},
+		{Currency: "USD", Rate: 2},
+		{Currency: "XXX", Rate: 0},
+	})
+
+	if codes := r.Codes(); !reflect.DeepEqual(codes, []string{"USD", "EUR", "GBP"}) {
+		t.Errorf("unexpected codes %v", codes)
+	}
+
+	if rate, ok := r.Rate("USD"); !ok || rate != 1 {
+		t.Errorf("expected the base currency to have rate 1, got %v", rate)
+	}
+
+	if got := r.Display(10000, "EUR"); got != "€92.00" {
+		t.Errorf("expected €92.00, got %s", got)
+	}
+
+	if got := r.Display(10000, "CHF"); got != "$100.00" {
+		t.Errorf("expected an unknown currency to show the base amount, got %s", got)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	in := "currency,rate\neur, 0.92\n\nGBP,0.79\n"
+
+	rates, err := ParseCSV(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []models.ExchangeRate{{Currency: "EUR", Rate: 0.92}, {Currency: "GBP", Rate: 0.79}}
+	if !reflect.DeepEqual(rates, expected) {
+		t.Errorf("expected %v, got %v", expected, rates)
+	}
+}
+
+func TestParseCSV_Invalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"header only", "currency,rate\n"},
+		{"bad code", "EUR,0.92\nEURO,1\n"},
+		{"bad rate", "EUR,abc\n"},
+		{"negative rate", "EUR,-1\n"},
+		{"too many fields", "EUR,0.92,x\n"},
+		{"duplicate", "EUR,0.92\nEUR,0.93\n"},
+	}
+
+	for _, e := range tests {
+		if _, err := ParseCSV(strings.NewReader(e.in)); err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestRates_Reload(t *testing.T) {
+	r := NewRates("USD")
+
+	loads := make(chan struct{}, 1)
+	load := func() ([]models.ExchangeRate, error) {
+		select {
+		case loads <- struct{}{}:
+		default:
+		}
+		return []models.ExchangeRate{{Currency: "EUR", Rate: 0.9}}, nil
+	}
+
+	stop := make(chan struct{})
+	done := r.Reload(load, time.Millisecond, stop, log.New(io.Discard, "", 0))
+
+	select {
+	case <-loads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the rates to be reloaded")
+	}
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reload to stop")
+	}
+
+	if rate, ok := r.Rate("EUR"); !ok || rate != 0.9 {
+		t.Errorf("expected the reloaded EUR rate, got %v %v", rate, ok)
+	}
+}
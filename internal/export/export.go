@@ -0,0 +1,153 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/xlsx"
+)
+
+// Export formats
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// Columns are the headings of the exported reservation columns
+var Columns = []string{
+	"ID", "First Name", "Last Name", "Email", "Phone", "Room", "Status",
+	"Arrival", "Departure", "Nights", "Guests",
+	"Total", "Discount", "Paid", "Refunded", "Outstanding",
+	"Processed", "Booked",
+}
+
+// Status returns the status of a reservation
+func Status(res models.Reservation) string {
+	switch {
+	case res.Cancelled():
+		return models.StatusCancelled
+	case !res.Confirmed():
+		return models.StatusPending
+	case res.Processed == 1:
+		return models.StatusProcessed
+	}
+	return models.StatusNew
+}
+
+// Row returns the exported values of a reservation, in the order of Columns. Amounts are
+// xlsx.Decimals in the major unit of the currency.
+func Row(res models.Reservation) []interface{} {
+	return []interface{}{
+		res.ID,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.Room.RoomName,
+		Status(res),
+		res.StartDate,
+		res.EndDate,
+		pricing.Nights(res.StartDate, res.EndDate),
+		res.Guests,
+		amount(res.TotalAmount),
+		amount(res.DiscountAmount),
+		amount(res.PaidAmount),
+		amount(res.RefundedAmount),
+		amount(res.OutstandingAmount()),
+		res.Processed == 1,
+		res.CreatedAt,
+	}
+}
+
+func amount(minor int) xlsx.Decimal {
+	return xlsx.Decimal(float64(minor) / math.Pow10(pricing.Decimals()))
+}
+
+// Writer writes exported rows in one of the formats
+type Writer interface {
+	WriteHeader([]string) error
+	WriteRow([]interface{}) error
+	Close() error
+}
+
+// NewWriter returns a writer for format, which must be FormatCSV or FormatXLSX
+func NewWriter(w io.Writer, format, sheetName string) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatXLSX:
+		xw, err := xlsx.NewWriter(w, sheetName, pricing.Decimals())
+		if err != nil {
+			return nil, err
+		}
+		return xw, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// ContentType returns the MIME type of a format
+func ContentType(format string) string {
+	if format == FormatXLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// csvWriter writes rows as CSV, with dates as YYYY-MM-DD and amounts with two decimals
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) WriteHeader(headings []string) error {
+	return c.w.Write(headings)
+}
+
+func (c *csvWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			record[i] = escapeFormula(v)
+		case int:
+			record[i] = strconv.Itoa(v)
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case xlsx.Decimal:
+			record[i] = strconv.FormatFloat(float64(v), 'f', pricing.Decimals(), 64)
+		case bool:
+			record[i] = strconv.FormatBool(v)
+		case time.Time:
+			if !v.IsZero() {
+				record[i] = v.Format("2006-01-02")
+			}
+		default:
+			return fmt.Errorf("csv: cannot write a value of type %T", v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// escapeFormula stops spreadsheets treating text typed in by guests as a formula. Phone
+// numbers such as +1 (555) 123-4567 are left alone.
+func escapeFormula(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if (s[0] == '+' || s[0] == '-') && strings.Trim(s[1:], "0123456789 ()-.") == "" {
+		return s
+	}
+	return "'" + s
+}
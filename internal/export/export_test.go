@@ -0,0 +1,126 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func testReservation() models.Reservation {
+	return models.Reservation{
+		ID:             7,
+		FirstName:      "John",
+		LastName:       "=HYPERLINK(\"http://evil\")",
+		Email:          "john@smith.com",
+		Phone:          "+1 (555) 123-4567",
+		StartDate:      time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:        time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		CreatedAt:      time.Date(2049, 12, 1, 10, 30, 0, 0, time.UTC),
+		ConfirmedAt:    time.Date(2049, 12, 1, 10, 35, 0, 0, time.UTC),
+		Room:           models.Room{RoomName: "General's Quarters"},
+		Processed:      1,
+		TotalAmount:    20050,
+		PaidAmount:     5000,
+		DiscountAmount: 1000,
+		Guests:         2,
+	}
+}
+
+func TestStatus(t *testing.T) {
+	res := testReservation()
+	if got := Status(res); got != models.StatusProcessed {
+		t.Errorf("expected %s, got %s", models.StatusProcessed, got)
+	}
+
+	res.Processed = 0
+	if got := Status(res); got != models.StatusNew {
+		t.Errorf("expected %s, got %s", models.StatusNew, got)
+	}
+
+	res.ConfirmedAt = time.Time{}
+	if got := Status(res); got != models.StatusPending {
+		t.Errorf("expected %s, got %s", models.StatusPending, got)
+	}
+
+	res.CancelledAt = time.Now()
+	if got := Status(res); got != models.StatusCancelled {
+		t.Errorf("expected %s, got %s", models.StatusCancelled, got)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatCSV, "Reservations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = w.WriteHeader(Columns)
+	if err = w.WriteRow(Row(testReservation())); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], "ID,First Name,Last Name") {
+		t.Errorf("unexpected header %s", lines[0])
+	}
+
+	expected := `7,John,"'=HYPERLINK(""http://evil"")",john@smith.com,+1 (555) 123-4567,General's Quarters,processed,` +
+		`2050-01-01,2050-01-03,2,2,200.50,10.00,50.00,0.00,150.50,true,2049-12-01`
+	if lines[1] != expected {
+		t.Errorf("unexpected row\n got %s\nwant %s", lines[1], expected)
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatXLSX, "Reservations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = w.WriteHeader(Columns)
+	if err = w.WriteRow(Row(testReservation())); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("PK")) {
+		t.Error("expected a zip file")
+	}
+}
+
+func TestNewWriter_UnknownFormat(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, "pdf", ""); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestEscapeFormula(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"Smith":        "Smith",
+		"=1+2":         "'=1+2",
+		"@SUM(A1)":     "'@SUM(A1)",
+		"-2+3":         "'-2+3",
+		"+44 20 7946":  "+44 20 7946",
+		"-":            "-",
+		"+cmd|' /C'!A": "'+cmd|' /C'!A",
+	}
+	for in, want := range tests {
+		if got := escapeFormula(in); got != want {
+			t.Errorf("escapeFormula(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
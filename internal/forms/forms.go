@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/asaskevich/govalidator"
 )
@@ -59,3 +61,44 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// MinPasswordLength is the fewest characters a password can have
+const MinPasswordLength = 8
+
+// commonPasswords are passwords long and mixed enough to pass, but among the first guessed
+var commonPasswords = map[string]bool{
+	"password1": true, "password123": true, "passw0rd": true, "p@ssw0rd": true, "p@ssword": true,
+	"qwerty123": true, "abc12345": true, "abcd1234": true, "1q2w3e4r": true, "letmein1": true,
+	"welcome1": true, "welcome123": true, "admin123": true, "iloveyou1": true, "trustno1": true,
+}
+
+// IsStrongPassword checks that a password is at least MinPasswordLength characters long, mixes
+// letters with numbers or symbols, and is not a common password
+func (f *Form) IsStrongPassword(field string) bool {
+	x := f.Get(field)
+
+	if utf8.RuneCountInString(x) < MinPasswordLength {
+		f.Errors.Add(field, fmt.Sprintf("Use at least %d characters", MinPasswordLength))
+		return false
+	}
+
+	var letters, others bool
+	for _, r := range x {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else if !unicode.IsSpace(r) {
+			others = true
+		}
+	}
+	if !letters || !others {
+		f.Errors.Add(field, "Mix letters with numbers or symbols")
+		return false
+	}
+
+	if commonPasswords[strings.ToLower(x)] {
+		f.Errors.Add(field, "This password is too common, choose another")
+		return false
+	}
+
+	return true
+}
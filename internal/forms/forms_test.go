@@ -125,3 +125,24 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("got valid for invalid email address")
 	}
 }
+
+func TestForm_IsStrongPassword(t *testing.T) {
+	tests := map[string]string{
+		"":                        "Use at least 8 characters",
+		"short1!":                 "Use at least 8 characters",
+		"lettersonly":             "Mix letters with numbers or symbols",
+		"1234567890":              "Mix letters with numbers or symbols",
+		"Password123":             "This password is too common, choose another",
+		"long-enough":             "",
+		"correct horse battery 9": "",
+		"ünïcødé1":                "",
+	}
+
+	for password, expected := range tests {
+		form := New(url.Values{"passwd": {password}})
+		valid := form.IsStrongPassword("passwd")
+		if valid != (expected == "") || form.Errors.Get("passwd") != expected {
+			t.Errorf("%q: expected error %q, got %q", password, expected, form.Errors.Get("passwd"))
+		}
+	}
+}
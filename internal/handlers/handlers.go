@@ -1,21 +1,49 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/tanishqv/bnb-bookings/internal/cancellation"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
 	"github.com/tanishqv/bnb-bookings/internal/driver"
+	"github.com/tanishqv/bnb-bookings/internal/export"
 	"github.com/tanishqv/bnb-bookings/internal/forms"
 	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/holds"
+	"github.com/tanishqv/bnb-bookings/internal/ical"
+	"github.com/tanishqv/bnb-bookings/internal/icalsync"
+	"github.com/tanishqv/bnb-bookings/internal/importer"
+	"github.com/tanishqv/bnb-bookings/internal/invoice"
+	"github.com/tanishqv/bnb-bookings/internal/lockout"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/promotions"
+	"github.com/tanishqv/bnb-bookings/internal/qrcode"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 	"github.com/tanishqv/bnb-bookings/internal/render"
+	"github.com/tanishqv/bnb-bookings/internal/reports"
 	"github.com/tanishqv/bnb-bookings/internal/repository"
 	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+	"github.com/tanishqv/bnb-bookings/internal/totp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Handlers may not use template cache, but the config may be updated with things that makes the application run better
@@ -24,6 +52,9 @@ import (
 // Repo is the repository used by the handlers
 var Repo *Repository
 
+// maxGuests is the largest party a single reservation can be made for
+const maxGuests = 20
+
 // Repository is the repository type
 type Repository struct {
 	App *config.AppConfig
@@ -89,6 +120,28 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	res.Room.RoomName = room.RoomName
 
+	fees, err := m.DB.AllFees()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot get fees from database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	if res.Guests < 1 {
+		res.Guests = 1
+	}
+
+	// Guests who are logged in book with the details saved in their account
+	if res.Email == "" && helpers.IsAuthenticated(r) {
+		user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+		if err == nil && user.IsGuest() {
+			res.FirstName = user.FirstName
+			res.LastName = user.LastName
+			res.Email = user.Email
+			res.Phone = user.Phone
+		}
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	sd := res.StartDate.Format("2006-01-02")
@@ -97,9 +150,13 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	stringMap := make(map[string]string)
 	stringMap["start-date"] = sd
 	stringMap["end-date"] = ed
+	stringMap["cancellation-policy"] = m.describeCancellationPolicy(room)
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	quote := pricing.NewQuote(room, res.StartDate, res.EndDate)
+	quote.AddFees(fees, res.Guests)
+	data["quote"] = quote
 
 	render.RenderTemplate(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 		Form:      forms.New(nil),
@@ -138,12 +195,48 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reservation.Room = room
+	quote := pricing.NewQuote(room, reservation.StartDate, reservation.EndDate)
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first-name", "last-name", "email", "phone-number")
 	form.MinLength("first-name", 3)
 	form.IsEmail("email")
 
+	reservation.Guests = 1
+	if form.Has("guests") {
+		guests, err := strconv.Atoi(r.Form.Get("guests"))
+		if err != nil || guests < 1 || guests > maxGuests {
+			form.Errors.Add("guests", fmt.Sprintf("Enter between 1 and %d guests", maxGuests))
+		} else {
+			reservation.Guests = guests
+		}
+	}
+
+	reservation.PromotionID = 0
+	reservation.DiscountAmount = 0
+	if code := promotions.Normalize(r.Form.Get("promo-code")); code != "" {
+		promotion, err := m.applyPromotion(code, reservation, &quote)
+		if err != nil {
+			form.Errors.Add("promo-code", err.Error())
+		} else {
+			reservation.PromotionID = promotion.ID
+			reservation.DiscountAmount = quote.Discount
+		}
+	}
+
+	fees, err := m.DB.AllFees()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot get fees from database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	quote.AddFees(fees, reservation.Guests)
+	reservation.TotalAmount = quote.Total
+	reservation.Charges = reservationCharges(quote)
+
 	if !form.Valid() {
 		sd := reservation.StartDate.Format("2006-01-02")
 		ed := reservation.EndDate.Format("2006-01-02")
@@ -151,9 +244,11 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		stringMap := make(map[string]string)
 		stringMap["start-date"] = sd
 		stringMap["end-date"] = ed
+		stringMap["cancellation-policy"] = m.describeCancellationPolicy(room)
 
 		data := make(map[string]interface{})
 		data["reservation"] = reservation
+		data["quote"] = quote
 		render.RenderTemplate(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 			Form:      form,
 			Data:      data,
@@ -162,30 +257,77 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservation.AccessToken, err = helpers.RandomToken()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	now := time.Now()
+	if m.paymentsEnabled() {
+		reservation.Schedule = pricing.NewSchedule(room, reservation.TotalAmount, reservation.StartDate, now)
+	}
+
+	// Stays with nothing to pay up front, or nothing to pay online, are confirmed straight away,
+	// and the emails are queued with the reservation, so they are sent if and only if it is
+	// saved. The others hold the room while the guest pays, and are released if they do not in time.
+	confirmed := !m.paymentsEnabled() || reservation.AmountDueBy(now) == 0
+	if confirmed {
+		reservation.ConfirmedAt = now
+		reservation.Emails = m.reservationEmails(reservation)
+	} else {
+		reservation.HoldExpiresAt = now.Add(holds.Duration)
+	}
+
 	newReservationID, err := m.DB.InsertReservation(reservation)
+	if errors.Is(err, repository.ErrPromotionUsedUp) {
+		m.App.Session.Put(r.Context(), "error", "This promo code was fully redeemed while you were booking, please book without it")
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		m.App.ErrorLog.Println(err)
 		m.App.Session.Put(r.Context(), "error", "cannot insert reservation into the database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
+	reservation.Emails = nil
 
-	restriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1, // Type: Reservation
+	reservation.ID = newReservationID
+	for i := range reservation.Schedule {
+		reservation.Schedule[i].ReservationID = newReservationID
 	}
 
-	err = m.DB.InsertRoomRestriction(restriction)
-	if err != nil {
-		m.App.ErrorLog.Println(err)
-		m.App.Session.Put(r.Context(), "error", "cannot insert room restriction")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	if confirmed {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
 		return
 	}
 
+	http.Redirect(w, r, "/payment", http.StatusSeeOther)
+}
+
+// queueMail queues an email message in the outbox, from where it is sent, and tried again until
+// it is if sending fails
+func (m *Repository) queueMail(msg models.MailData) {
+	if err := m.DB.QueueMail(msg); err != nil {
+		m.App.ErrorLog.Printf("cannot queue mail to %s: %v", msg.To, err)
+	}
+}
+
+// sendReservationEmails sends the reservation confirmation to the guest and the notification to the property owner
+func (m *Repository) sendReservationEmails(reservation models.Reservation) {
+	for _, msg := range m.reservationEmails(reservation) {
+		m.queueMail(msg)
+	}
+}
+
+// reservationEmails builds the reservation confirmation to the guest and the notification to
+// the property owner
+func (m *Repository) reservationEmails(reservation models.Reservation) []models.MailData {
+	manageURL := fmt.Sprintf("%s/manage/%s", m.App.BaseURL, reservation.AccessToken)
+
 	// Send email notification to guest
 	htmlMessage := fmt.Sprintf(`
 		<strong>Reservation Confirmation</strong>
@@ -195,22 +337,35 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		<div style="text-align:center !important;">
 			<strong>Room</strong>: %s <br>
 			<strong>Duration</strong>: %s to %s <br>
+			<strong>Total</strong>: %s <br>
 		</div>
+		<strong>Cancellation policy</strong>: %s <br>
+		You can view or cancel your reservation at <a href="%s">%s</a>.
 	`,
 		reservation.FirstName+" "+reservation.LastName,
 		reservation.Room.RoomName,
 		reservation.StartDate.Format("2006-01-02"),
-		reservation.EndDate.Format("2006-01-02"))
+		reservation.EndDate.Format("2006-01-02"),
+		pricing.FormatAmount(reservation.TotalAmount),
+		m.describeCancellationPolicy(reservation.Room),
+		manageURL, manageURL)
+
+	cal := reservationCalendar(reservation)
 
 	msg := models.MailData{
 		To:      reservation.Email,
 		From:    "manager@fsbnb.com",
 		Subject: "Reservation Confirmation",
 		Content: htmlMessage,
+		Attachments: []models.MailAttachment{
+			{
+				Name:     "reservation.ics",
+				MimeType: "text/calendar",
+				Data:     cal.Bytes(),
+			},
+		},
 	}
 
-	m.App.MailChan <- msg
-
 	// Send email notification to property owner
 	htmlMessage = fmt.Sprintf(`
 		<strong>Reservation Notification</strong>
@@ -228,17 +383,12 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		reservation.StartDate.Format("2006-01-02"),
 		reservation.EndDate.Format("2006-01-02"))
 
-	msg = models.MailData{
+	return []models.MailData{msg, {
 		To:      "property-owner@fsbnb.com",
 		From:    "manager@fsbnb.com",
 		Subject: "Reservation Notification",
 		Content: htmlMessage,
-	}
-
-	m.App.MailChan <- msg
-
-	m.App.Session.Put(r.Context(), "reservation", reservation)
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	}}
 }
 
 // Availability renders the search availability form
@@ -418,6 +568,12 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// A reservation is only confirmed once what is due up front has been paid
+	if reservation.AmountDueBy(time.Now()) > 0 {
+		http.Redirect(w, r, "/payment", http.StatusSeeOther)
+		return
+	}
+
 	m.App.Session.Remove(r.Context(), "reservation")
 
 	data := make(map[string]interface{})
@@ -539,362 +695,4621 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Too many failures block logins before the password is checked, the same way whether or
+	// not an account has the email address
+	subject := strings.ToLower(strings.TrimSpace(email))
+	ip := helpers.ClientIP(r)
+
+	blocked, err := m.loginBlocked(subject, ip)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if blocked {
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, wait a few minutes and try again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
 	id, _, err := m.DB.Authenticate(email, password)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
+		if err = m.recordLoginFailure(subject, ip); err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
 		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "user-id", id)
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if user.IsGuest() && user.EmailVerifiedAt.IsZero() {
+		m.App.Session.Put(r.Context(), "error", "Please confirm your email address with the link we sent you")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// Users with two-factor authentication are logged in once they enter a code too
+	if user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "two-factor-user-id", id)
+		m.App.Session.Put(r.Context(), "two-factor-expires-at", time.Now().Add(twoFactorLoginTTL).UnixNano())
+		m.App.Session.Put(r.Context(), "two-factor-attempts", 0)
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.logIn(w, r, user)
 }
 
-// Logout logs a user out
-func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.Destroy(r.Context())
+// logIn puts a user who has proved who they are in the session, and sends them to their first
+// page. Staff whose role requires two-factor authentication set it up first.
+func (m *Repository) logIn(w http.ResponseWriter, r *http.Request, user models.User) {
 	_ = m.App.Session.RenewToken(r.Context())
 
-	m.App.Session.Put(r.Context(), "flash", "Logged out successfully")
-	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
-}
+	if err := m.DB.ClearLoginFailures(models.ThrottleAccount, strings.ToLower(user.Email)); err != nil {
+		m.App.ErrorLog.Println(err)
+	}
 
-// AdminDashboard renders the admin dashboard
-func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.RenderTemplate(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
-}
+	m.App.Session.Put(r.Context(), "user-id", user.ID)
+	m.App.Session.Put(r.Context(), "access-level", user.AccessLevel)
+	m.App.Session.Put(r.Context(), "logged-in-at", time.Now().UnixNano())
+	m.App.Session.Put(r.Context(), "last-seen-at", time.Now().UnixNano())
+	m.App.Session.Put(r.Context(), "login-ip", helpers.ClientIP(r))
+	m.App.Session.Put(r.Context(), "user-agent", r.UserAgent())
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 
-// AdminAllReservations shows all reservations in admin tool
-func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
-	if err != nil {
-		helpers.ServerError(w, err)
-		return
+	switch {
+	case user.IsGuest():
+		http.Redirect(w, r, "/account/stays", http.StatusSeeOther)
+	case m.App.TwoFactorRoles[user.AccessLevel] && !user.TwoFactorEnabled():
+		m.App.Session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
+}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
+// loginThrottle is a scope failed logins are counted in, with its lockout policy
+type loginThrottle struct {
+	scope, subject string
+	policy         lockout.Policy
+}
 
-	render.RenderTemplate(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
+// loginThrottles are the scopes failed logins are counted in, for an email address and a client
+// IP address
+func loginThrottles(email, ip string) []loginThrottle {
+	return []loginThrottle{
+		{models.ThrottleAccount, email, lockout.Account},
+		{models.ThrottleIP, ip, lockout.IP},
+	}
 }
 
-// AdminNewReservations shows all new reservations in admin tool
-func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
-	if err != nil {
-		helpers.ServerError(w, err)
-		return
+// loginBlocked reports whether logins with an email address, in lower case, or from a client
+// IP address are blocked after too many failures
+func (m *Repository) loginBlocked(email, ip string) (bool, error) {
+	for _, t := range loginThrottles(email, ip) {
+		throttle, err := m.DB.GetLoginThrottle(t.scope, t.subject)
+		if err != nil {
+			return false, err
+		}
+		if time.Now().Before(throttle.BlockedUntil) {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
+// recordLoginFailure counts a failed login with an email address, in lower case, and from a
+// client IP address, and blocks further logins as the lockout policies say. The owner of an
+// account that locks out is told by email.
+func (m *Repository) recordLoginFailure(email, ip string) error {
+	now := time.Now()
+	for _, t := range loginThrottles(email, ip) {
+		failures, err := m.DB.RecordLoginFailure(t.scope, t.subject, now.Add(-lockout.Reset))
+		if err != nil {
+			return err
+		}
 
-	render.RenderTemplate(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
+		until, locked := t.policy.Block(failures, now)
+		if until.IsZero() {
+			continue
+		}
+		if err = m.DB.BlockLogins(t.scope, t.subject, until, locked); err != nil {
+			return err
+		}
+
+		if t.scope == models.ThrottleAccount && failures == t.policy.MaxAttempts {
+			if err = m.sendLockoutEmail(email, failures); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// AdminShowReservation shows the reservation in the amdin tool
-func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+// sendLockoutEmail tells the owner of an account, if there is one, that it is locked out
+func (m *Repository) sendLockoutEmail(email string, failures int) error {
+	user, err := m.DB.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
-		helpers.ServerError(w, err)
-		return
+		return err
+	}
+	if !user.Active() {
+		return nil
 	}
 
-	src := exploded[3]
+	link := fmt.Sprintf("%s/user/forgot-password", m.App.BaseURL)
+	m.queueMail(models.MailData{
+		To:      user.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Your account is locked",
+		Content: fmt.Sprintf(`
+		<strong>Your account is locked</strong>
+		<hr>
+		Dear %s, <br>
+		There were %d failed attempts to log in to your Fort Smythe BnB account, so logging in is
+		locked for %d minutes. <br>
+		If it was you, wait and try again, or reset your password: <a href="%s">%s</a> <br>
+		If it was not you, someone may be trying to guess your password. Choosing a new, strong
+		password keeps your account safe.
+	`, user.FirstName, failures, int(lockout.Account.Lockout.Minutes()), link, link),
+	})
 
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	return nil
+}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+// Two-factor authentication: after the password, a login waits twoFactorLoginTTL for a code,
+// with at most maxTwoFactorAttempts tries. Users get recoveryCodeCount recovery codes.
+const (
+	twoFactorLoginTTL    = 5 * time.Minute
+	maxTwoFactorAttempts = 5
+	recoveryCodeCount    = 10
+)
 
-	stringMap["month"] = month
-	stringMap["year"] = year
+// twoFactorLogin returns the ID of the user whose password was checked in this session and who
+// has yet to enter a code, if they still have time to
+func (m *Repository) twoFactorLogin(r *http.Request) (int, bool) {
+	id := m.App.Session.GetInt(r.Context(), "two-factor-user-id")
+	expiresAt := m.App.Session.GetInt64(r.Context(), "two-factor-expires-at")
+	return id, id != 0 && time.Now().UnixNano() < expiresAt
+}
 
-	res, err := m.DB.GetReservationByID(id)
-	if err != nil {
-		helpers.ServerError(w, err)
+// clearTwoFactorLogin forgets the login waiting for a code
+func (m *Repository) clearTwoFactorLogin(r *http.Request) {
+	m.App.Session.Remove(r.Context(), "two-factor-user-id")
+	m.App.Session.Remove(r.Context(), "two-factor-expires-at")
+	m.App.Session.Remove(r.Context(), "two-factor-attempts")
+}
+
+// ShowLoginTwoFactor shows the second step of logging in, where users with two-factor
+// authentication enter a code from their app or a recovery code
+func (m *Repository) ShowLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := m.twoFactorLogin(r); !ok {
+		m.clearTwoFactorLogin(r)
+		m.App.Session.Put(r.Context(), "error", "Log in with your email address and password first")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservation"] = res
-
-	render.RenderTemplate(w, r, "admin-reservation-show.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		Form:      forms.New(nil),
+	render.RenderTemplate(w, r, "login-two-factor.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
 	})
 }
 
-func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		helpers.ServerError(w, err)
+// PostLoginTwoFactor checks the code of the second step of logging in and logs the user in
+func (m *Repository) PostLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.twoFactorLogin(r)
+	if !ok {
+		m.clearTwoFactorLogin(r)
+		m.App.Session.Put(r.Context(), "error", "Your login has expired, log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
-	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+	err := r.ParseForm()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	src := exploded[3]
-
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
-
-	res, err := m.DB.GetReservationByID(id)
+	user, err := m.DB.GetUserByID(id)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	res.FirstName = r.Form.Get("first-name")
-	res.LastName = r.Form.Get("last-name")
-	res.Email = r.Form.Get("email")
-	res.Phone = r.Form.Get("phone-number")
+	subject := strings.ToLower(user.Email)
+	ip := helpers.ClientIP(r)
 
-	err = m.DB.UpdateReservation(res)
+	blocked, err := m.loginBlocked(subject, ip)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
-
-	month := r.Form.Get("month")
-	year := r.Form.Get("year")
-
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	if blocked {
+		m.clearTwoFactorLogin(r)
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, wait a few minutes and try again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
 	}
-}
 
-// AdminReservationsCalendar displays the reservation calendar
-func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
-	now := time.Now()
+	form := forms.New(r.PostForm)
+	form.Required("code")
 
-	if r.URL.Query().Get("y") != "" {
-		year, err := strconv.Atoi(r.URL.Query().Get("y"))
+	if form.Valid() {
+		ok, err := m.checkSecondFactor(user, r.Form.Get("code"))
 		if err != nil {
 			helpers.ServerError(w, err)
 			return
 		}
-
-		month, err := strconv.Atoi(r.URL.Query().Get("m"))
-		if err != nil {
-			helpers.ServerError(w, err)
-			return
+		if !ok {
+			// Wrong codes count as failed logins too, so codes cannot be guessed by logging in again
+			if err = m.recordLoginFailure(subject, ip); err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			attempts := m.App.Session.GetInt(r.Context(), "two-factor-attempts") + 1
+			if attempts >= maxTwoFactorAttempts {
+				m.clearTwoFactorLogin(r)
+				m.App.Session.Put(r.Context(), "error", "Too many incorrect codes, log in again")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			}
+			m.App.Session.Put(r.Context(), "two-factor-attempts", attempts)
+			form.Errors.Add("code", "This code is not correct")
 		}
+	}
 
-		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	if !form.Valid() {
+		render.RenderTemplate(w, r, "login-two-factor.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
 	}
 
-	data := make(map[string]interface{})
-	data["now"] = now
+	m.clearTwoFactorLogin(r)
+	m.logIn(w, r, user)
+}
 
-	next := now.AddDate(0, 1, 0)
-	last := now.AddDate(0, -1, 0)
+// checkSecondFactor reports whether code is a current code from the authenticator app of a
+// user or one of their recovery codes. Each code works once.
+func (m *Repository) checkSecondFactor(user models.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
 
-	nextMonth := next.Format("01")
-	nextMonthYear := next.Format("2006")
+	var err error
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		err = m.DB.UseTOTPStep(user.ID, step)
+	} else {
+		err = m.DB.UseRecoveryCode(user.ID, helpers.HashToken(normalizeRecoveryCode(code)))
+	}
 
-	lastMonth := last.Format("01")
-	lastMonthYear := last.Format("2006")
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
 
-	stringMap := make(map[string]string)
-	stringMap["next_month"] = nextMonth
-	stringMap["next_month_year"] = nextMonthYear
-	stringMap["last_month"] = lastMonth
-	stringMap["last_month_year"] = lastMonthYear
+// newRecoveryCodes returns recoveryCodeCount random recovery codes, like "x7kqm-2vbnc", and the
+// hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, helpers.HashToken(code))
+	}
+	return codes, hashes, nil
+}
 
-	stringMap["this_month"] = now.Format("01")
-	stringMap["this_month_year"] = now.Format("2006")
+// normalizeRecoveryCode returns a recovery code as it was hashed, without dashes or spaces
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
 
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+// Accounts: the link to confirm an email address works for verificationTokenTTL, the link in an
+// invitation for invitationTokenTTL and the link to reset a password for resetTokenTTL
+const (
+	verificationTokenTTL = 48 * time.Hour
+	invitationTokenTTL   = 7 * 24 * time.Hour
+	resetTokenTTL        = time.Hour
+)
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
+// checkNewPassword checks a new password against the password policy, and its confirmation
+func checkNewPassword(form *forms.Form, field, confirmField string) {
+	form.IsStrongPassword(field)
+	if form.Has(confirmField) && form.Get(confirmField) != form.Get(field) {
+		form.Errors.Add(confirmField, "Passwords do not match")
+	}
+}
 
-	rooms, err := m.DB.AllRooms()
-	if err != nil {
+// hashPassword hashes a password to be stored
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	return string(hash), err
+}
+
+// ShowRegister shows the form to create a guest account
+func (m *Repository) ShowRegister(w http.ResponseWriter, r *http.Request) {
+	render.RenderTemplate(w, r, "register.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostRegister creates a guest account and emails a link to confirm the email address. Someone
+// registering an address that already has an account is told the same, and the owner of the
+// address is emailed instead, so the form does not reveal who has an account.
+func (m *Repository) PostRegister(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user := models.User{
+		FirstName:   strings.TrimSpace(r.Form.Get("first-name")),
+		LastName:    strings.TrimSpace(r.Form.Get("last-name")),
+		Email:       strings.TrimSpace(r.Form.Get("email")),
+		Phone:       strings.TrimSpace(r.Form.Get("phone")),
+		AccessLevel: models.AccessLevelGuest,
+	}
+	password := r.Form.Get("passwd")
+
+	form := forms.New(r.PostForm)
+	form.Required("first-name", "last-name", "email", "passwd", "passwd-confirm")
+	form.MinLength("first-name", 3)
+	form.IsEmail("email")
+	checkNewPassword(form, "passwd", "passwd-confirm")
+
+	if !form.Valid() {
+		render.RenderTemplate(w, r, "register.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	existing, err := m.DB.GetUserByEmail(user.Email)
+	switch {
+	case err == nil:
+		m.queueMail(models.MailData{
+			To:      existing.Email,
+			From:    "manager@fsbnb.com",
+			Subject: "You already have an account",
+			Content: fmt.Sprintf(`
+		<strong>You already have an account</strong>
+		<hr>
+		Someone, hopefully you, tried to create an account at Fort Smythe BnB with this email address,
+		which already has one. You can <a href="%s/user/login">log in</a> instead.
+	`, m.App.BaseURL),
+		})
+	case errors.Is(err, sql.ErrNoRows):
+		user.Password, err = hashPassword(password)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		user.ID, err = m.DB.InsertUser(user)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		if err = m.sendVerificationEmail(user); err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	default:
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Check your email for a link to confirm your address")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// sendVerificationEmail emails a user a single use link to confirm their email address
+func (m *Repository) sendVerificationEmail(user models.User) error {
+	token, err := helpers.RandomToken()
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertUserToken(models.UserToken{
+		UserID:    user.ID,
+		Purpose:   models.TokenVerifyEmail,
+		TokenHash: helpers.HashToken(token),
+		ExpiresAt: time.Now().Add(verificationTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/verify?token=%s", m.App.BaseURL, token)
+	m.queueMail(models.MailData{
+		To:      user.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Confirm your email address",
+		Content: fmt.Sprintf(`
+		<strong>Welcome to Fort Smythe BnB</strong>
+		<hr>
+		Dear %s, <br>
+		Please confirm your email address to finish creating your account:
+		<a href="%s">%s</a> <br>
+		The link works once, within %d hours. Reservations you have already made with this
+		address will appear in your account.
+	`, user.FirstName, link, link, int(verificationTokenTTL.Hours())),
+		Sensitive: true,
+	})
+
+	return nil
+}
+
+// VerifyEmail confirms a guest's email address with the token emailed to them, which also
+// claims their earlier reservations made with the same address
+func (m *Repository) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token, err := m.DB.UseUserToken(models.TokenVerifyEmail, helpers.HashToken(r.URL.Query().Get("token")))
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if err = m.DB.VerifyUserEmail(token.UserID); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Your email address is confirmed, you can now log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// MyStays lists the upcoming and past reservations of the guest logged in
+func (m *Repository) MyStays(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user-id")
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	page, err := m.DB.SearchReservations(models.ReservationFilter{UserID: userID, Desc: true})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	today := time.Now().Truncate(24 * time.Hour)
+	var upcoming, past []models.Reservation
+	for _, res := range page.Reservations {
+		if res.EndDate.Before(today) {
+			past = append(past, res)
+		} else {
+			// Soonest first
+			upcoming = append([]models.Reservation{res}, upcoming...)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["upcoming"] = upcoming
+	data["past"] = past
+
+	render.RenderTemplate(w, r, "account-stays.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// ShowProfile shows the form where users change their own details and password
+func (m *Repository) ShowProfile(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{
+		"first-name": {user.FirstName},
+		"last-name":  {user.LastName},
+		"email":      {user.Email},
+		"phone":      {user.Phone},
+	})
+	render.RenderTemplate(w, r, "profile.page.tmpl", &models.TemplateData{
+		Form: form,
+	})
+}
+
+// PostProfile saves the details of the user logged in, and their password when they set a new
+// one. Their current password must be given. A new email address must be confirmed.
+func (m *Repository) PostProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first-name", "last-name", "email", "current-passwd")
+	form.IsEmail("email")
+	if form.Has("passwd") {
+		checkNewPassword(form, "passwd", "passwd-confirm")
+	}
+
+	m.checkCurrentPassword(form, user)
+
+	emailChanged := m.checkEmailChange(form, user)
+
+	if !form.Valid() {
+		render.RenderTemplate(w, r, "profile.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	user.FirstName = strings.TrimSpace(r.Form.Get("first-name"))
+	user.LastName = strings.TrimSpace(r.Form.Get("last-name"))
+	user.Email = strings.TrimSpace(r.Form.Get("email"))
+	user.Phone = strings.TrimSpace(r.Form.Get("phone"))
+	if emailChanged {
+		user.EmailVerifiedAt = time.Time{}
+	}
+
+	if err = m.DB.UpdateUser(user); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save profile")
+		http.Redirect(w, r, "/account/profile", http.StatusSeeOther)
+		return
+	}
+
+	if form.Has("passwd") {
+		hash, err := hashPassword(r.Form.Get("passwd"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if err = m.DB.UpdateUserPassword(user.ID, hash); err != nil {
+			m.App.ErrorLog.Println(err)
+			m.App.Session.Put(r.Context(), "error", "cannot change password")
+			http.Redirect(w, r, "/account/profile", http.StatusSeeOther)
+			return
+		}
+
+		// Sessions from before the change end, except this one
+		_ = m.App.Session.RenewToken(r.Context())
+		m.App.Session.Put(r.Context(), "logged-in-at", time.Now().UnixNano())
+	}
+
+	message := "Profile saved"
+	if emailChanged {
+		if err = m.sendVerificationEmail(user); err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		message = "Profile saved. Check your email for a link to confirm your new address"
+	}
+
+	m.App.Session.Put(r.Context(), "flash", message)
+	http.Redirect(w, r, "/account/profile", http.StatusSeeOther)
+}
+
+// checkCurrentPassword adds an error to a form when the current password entered in it is not
+// the password of a user
+func (m *Repository) checkCurrentPassword(form *forms.Form, user models.User) {
+	if !form.Has("current-passwd") {
+		return
+	}
+	id, _, err := m.DB.Authenticate(user.Email, form.Get("current-passwd"))
+	if err != nil || id != user.ID {
+		form.Errors.Add("current-passwd", "Your current password is not correct")
+	}
+}
+
+// checkEmailChange reports whether the email address in a form is a new one for a user, and adds
+// an error to the form when another user has it already
+func (m *Repository) checkEmailChange(form *forms.Form, user models.User) bool {
+	email := strings.TrimSpace(form.Get("email"))
+	if email == "" || strings.EqualFold(email, user.Email) {
+		return false
+	}
+
+	other, err := m.DB.GetUserByEmail(email)
+	if err == nil && other.ID != user.ID {
+		form.Errors.Add("email", "Another account has this email address")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.App.ErrorLog.Println(err)
+		form.Errors.Add("email", "Cannot check the email address, try again")
+	}
+	return true
+}
+
+// ShowSetPassword shows the form where an invited user chooses their password
+func (m *Repository) ShowSetPassword(w http.ResponseWriter, r *http.Request) {
+	m.showPasswordForm(w, r, models.TokenSetPassword, "/user/set-password", "Choose your password")
+}
+
+// PostSetPassword sets the password of an invited user with the token from their invitation
+func (m *Repository) PostSetPassword(w http.ResponseWriter, r *http.Request) {
+	m.postPasswordForm(w, r, models.TokenSetPassword, "/user/set-password", "Choose your password",
+		"Your password is set, you can now log in")
+}
+
+// ShowForgotPassword shows the form to ask for a link to reset a password
+func (m *Repository) ShowForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.RenderTemplate(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a link to reset the password to the address entered, if it is of an
+// active account. The answer is the same either way, so it does not tell who has an account.
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.RenderTemplate(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	user, err := m.DB.GetUserByEmail(strings.TrimSpace(r.Form.Get("email")))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		helpers.ServerError(w, err)
+		return
+	case user.Active():
+		if err = m.sendResetEmail(user); err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "If an account has this email address, we have sent it a link to reset the password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// sendResetEmail emails a user a single use link to reset their password
+func (m *Repository) sendResetEmail(user models.User) error {
+	token, err := helpers.RandomToken()
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertUserToken(models.UserToken{
+		UserID:    user.ID,
+		Purpose:   models.TokenResetPassword,
+		TokenHash: helpers.HashToken(token),
+		ExpiresAt: time.Now().Add(resetTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/reset-password?token=%s", m.App.BaseURL, token)
+	m.queueMail(models.MailData{
+		To:      user.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Reset your password",
+		Content: fmt.Sprintf(`
+		<strong>Reset your password</strong>
+		<hr>
+		Dear %s, <br>
+		Someone asked to reset the password of your Fort Smythe BnB account. To choose a new one,
+		follow this link: <a href="%s">%s</a> <br>
+		The link works once, within %d minutes. If you did not ask for it, you can ignore this email.
+	`, user.FirstName, link, link, int(resetTokenTTL.Minutes())),
+		Sensitive: true,
+	})
+
+	return nil
+}
+
+// ShowResetPassword shows the form where a user who forgot their password chooses a new one
+func (m *Repository) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
+	m.showPasswordForm(w, r, models.TokenResetPassword, "/user/reset-password", "Reset your password")
+}
+
+// PostResetPassword sets a new password with the token from a reset email, which logs the user
+// out everywhere else
+func (m *Repository) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	m.postPasswordForm(w, r, models.TokenResetPassword, "/user/reset-password", "Reset your password",
+		"Your password is reset, you can now log in")
+}
+
+// showPasswordForm shows the form to choose a password with an emailed token for a purpose,
+// posted to action
+func (m *Repository) showPasswordForm(w http.ResponseWriter, r *http.Request, purpose, action, title string) {
+	token := r.URL.Query().Get("token")
+
+	_, err := m.DB.GetUserToken(purpose, helpers.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	render.RenderTemplate(w, r, "set-password.page.tmpl", &models.TemplateData{
+		Form:      forms.New(nil),
+		StringMap: map[string]string{"token": token, "action": action, "title": title},
+	})
+}
+
+// postPasswordForm sets a password with an emailed token for a purpose, and flashes a message
+func (m *Repository) postPasswordForm(w http.ResponseWriter, r *http.Request, purpose, action, title, flash string) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	token := r.Form.Get("token")
+
+	form := forms.New(r.PostForm)
+	form.Required("passwd", "passwd-confirm")
+	checkNewPassword(form, "passwd", "passwd-confirm")
+
+	if !form.Valid() {
+		render.RenderTemplate(w, r, "set-password.page.tmpl", &models.TemplateData{
+			Form:      form,
+			StringMap: map[string]string{"token": token, "action": action, "title": title},
+		})
+		return
+	}
+
+	hash, err := hashPassword(r.Form.Get("passwd"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.SetPasswordWithToken(purpose, helpers.HashToken(token), hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ShowTwoFactor shows the two-factor authentication of the user logged in: how to set it up
+// with a QR code to scan into an authenticator app, or, once it is on, their recovery codes left
+func (m *Repository) ShowTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderTwoFactor(w, r, user, forms.New(nil))
+}
+
+func (m *Repository) renderTwoFactor(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["required"] = m.App.TwoFactorRoles[user.AccessLevel]
+
+	if user.TwoFactorEnabled() {
+		count, err := m.DB.CountRecoveryCodes(user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["recoveryCodes"] = count
+	} else {
+		// The secret is kept in the session until a code from it is entered
+		secret := m.App.Session.GetString(r.Context(), "totp-secret")
+		if secret == "" {
+			var err error
+			secret, err = totp.NewSecret()
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "totp-secret", secret)
+		}
+
+		qr, err := qrcode.SVG(totp.URI(m.App.Property.Name, user.Email, secret), "QR code to scan with an authenticator app", 200)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["qrcode"] = qr
+		data["secret"] = formatSecret(secret)
+	}
+
+	render.RenderTemplate(w, r, "two-factor.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// formatSecret splits a secret into groups of four characters, to type it into an app
+func formatSecret(secret string) string {
+	var groups []string
+	for len(secret) > 4 {
+		groups = append(groups, secret[:4])
+		secret = secret[4:]
+	}
+	return strings.Join(append(groups, secret), " ")
+}
+
+// PostEnableTwoFactor turns on two-factor authentication for the user logged in once they enter a
+// code from their app, and shows their recovery codes
+func (m *Repository) PostEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	secret := m.App.Session.GetString(r.Context(), "totp-secret")
+	if user.TwoFactorEnabled() || secret == "" {
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+
+	step, ok := totp.Validate(secret, strings.TrimSpace(r.Form.Get("code")), time.Now())
+	if form.Has("code") && !ok {
+		form.Errors.Add("code", "This code is not correct, check the time on your phone is right")
+	}
+
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, form)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if err = m.DB.EnableTwoFactor(user.ID, secret, step, hashes); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot turn on two-factor authentication")
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "totp-secret")
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is on")
+	m.renderRecoveryCodes(w, r, codes)
+}
+
+// PostRecoveryCodes replaces the recovery codes of the user logged in, after checking their
+// password, and shows the new ones
+func (m *Repository) PostRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled() {
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("current-passwd")
+	m.checkCurrentPassword(form, user)
+
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, form)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if err = m.DB.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot make new recovery codes")
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "New recovery codes made, the old ones no longer work")
+	m.renderRecoveryCodes(w, r, codes)
+}
+
+// renderRecoveryCodes shows recovery codes, the only time they are shown
+func (m *Repository) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	data := make(map[string]interface{})
+	data["codes"] = codes
+
+	render.RenderTemplate(w, r, "recovery-codes.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// PostDisableTwoFactor turns off two-factor authentication for the user logged in, after
+// checking their password, unless their role requires it
+func (m *Repository) PostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if m.App.TwoFactorRoles[user.AccessLevel] {
+		m.App.Session.Put(r.Context(), "error", "Your role requires two-factor authentication")
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if !user.TwoFactorEnabled() {
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("current-passwd")
+	m.checkCurrentPassword(form, user)
+
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, form)
+		return
+	}
+
+	if err = m.DB.DisableTwoFactor(user.ID); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot turn off two-factor authentication")
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+}
+
+// sessionID identifies a session on the sessions page without showing its token
+func sessionID(token string) string {
+	return helpers.HashToken(token)[:16]
+}
+
+// userSessions returns the sessions a user is logged in with, the current one first, then the
+// most recently used
+func (m *Repository) userSessions(r *http.Request, userID int) ([]models.UserSession, error) {
+	current := m.App.Session.Token(r.Context())
+
+	var sessions []models.UserSession
+	err := m.App.Session.Iterate(r.Context(), func(ctx context.Context) error {
+		if m.App.Session.GetInt(ctx, "user-id") != userID {
+			return nil
+		}
+
+		token := m.App.Session.Token(ctx)
+		s := models.UserSession{
+			ID:         sessionID(token),
+			Current:    token == current,
+			IP:         m.App.Session.GetString(ctx, "login-ip"),
+			UserAgent:  m.App.Session.GetString(ctx, "user-agent"),
+			LoggedInAt: time.Unix(0, m.App.Session.GetInt64(ctx, "logged-in-at")),
+			LastSeenAt: time.Unix(0, m.App.Session.GetInt64(ctx, "last-seen-at")),
+			ExpiresAt:  m.App.Session.Deadline(ctx),
+		}
+		if s.LastSeenAt.Before(s.LoggedInAt) {
+			s.LastSeenAt = s.LoggedInAt
+		}
+		sessions = append(sessions, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Current != sessions[j].Current {
+			return sessions[i].Current
+		}
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// revokeSessions ends the sessions of a user, other than the current one, whose ID matches, and
+// returns how many it ended
+func (m *Repository) revokeSessions(r *http.Request, userID int, match func(id string) bool) (int, error) {
+	current := m.App.Session.Token(r.Context())
+
+	revoked := 0
+	err := m.App.Session.Iterate(r.Context(), func(ctx context.Context) error {
+		token := m.App.Session.Token(ctx)
+		if token == current || m.App.Session.GetInt(ctx, "user-id") != userID || !match(sessionID(token)) {
+			return nil
+		}
+
+		revoked++
+		return m.App.Session.Destroy(ctx)
+	})
+	return revoked, err
+}
+
+// ShowSessions shows the sessions the user is logged in with, so they can log out of the others
+func (m *Repository) ShowSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := m.userSessions(r, m.App.Session.GetInt(r.Context(), "user-id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["sessions"] = sessions
+
+	render.RenderTemplate(w, r, "sessions.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// PostRevokeSession logs the user out of one of their other sessions
+func (m *Repository) PostRevokeSession(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id := exploded[3]
+
+	userID := m.App.Session.GetInt(r.Context(), "user-id")
+	revoked, err := m.revokeSessions(r, userID, func(sid string) bool {
+		return subtle.ConstantTimeCompare([]byte(sid), []byte(id)) == 1
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if revoked == 0 {
+		m.App.Session.Put(r.Context(), "error", "That session has already ended")
+		http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Session logged out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// PostRevokeOtherSessions logs the user out of all their sessions but the current one
+func (m *Repository) PostRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user-id")
+	revoked, err := m.revokeSessions(r, userID, func(string) bool { return true })
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if revoked == 0 {
+		m.App.Session.Put(r.Context(), "flash", "You have no other sessions")
+		http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Logged out of your other sessions")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// Logout logs a user out
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+
+	m.App.Session.Put(r.Context(), "flash", "Logged out successfully")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// maxReportDays is the longest date range the dashboard reports cover
+const maxReportDays = 3 * 366
+
+// AdminDashboard renders the admin dashboard with occupancy and revenue reports for a date
+// range, by default the last twelve months
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start := thisMonth.AddDate(0, -11, 0)
+	end := thisMonth.AddDate(0, 1, -1)
+
+	layout := "2006-01-02"
+	if s := r.URL.Query().Get("start"); s != "" {
+		var err error
+		start, err = time.Parse(layout, s)
+		if err != nil {
+			helpers.ClientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+	if e := r.URL.Query().Get("end"); e != "" {
+		var err error
+		end, err = time.Parse(layout, e)
+		if err != nil {
+			helpers.ClientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The end date is the last night included
+	to := end.AddDate(0, 0, 1)
+	if !to.After(start) || to.Sub(start) > maxReportDays*24*time.Hour {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stays, err := m.DB.StaysByDate(start, to)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	blocks, err := m.DB.BlocksByDate(start, to)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	report := reports.Build(start, to, rooms, stays, blocks)
+
+	percent := func(v float64) string { return fmt.Sprintf("%.0f%%", v) }
+	amount := func(v float64) string { return pricing.FormatAmount(int(v)) }
+
+	var occupancy, revenue, revPAR, roomOccupancy []reports.Bar
+	for _, month := range report.Months {
+		occupancy = append(occupancy, reports.Bar{Label: month.Label, Value: month.Occupancy()})
+		revenue = append(revenue, reports.Bar{Label: month.Label, Value: float64(month.Revenue)})
+		revPAR = append(revPAR, reports.Bar{Label: month.Label, Value: float64(month.RevPAR())})
+	}
+	for _, room := range report.Rooms {
+		roomOccupancy = append(roomOccupancy, reports.Bar{Label: room.Label, Value: room.Occupancy()})
+	}
+
+	data := make(map[string]interface{})
+	data["report"] = report
+	data["occupancyChart"] = reports.BarChart("Occupancy by month", occupancy, percent)
+	data["revenueChart"] = reports.BarChart("Room revenue by month", revenue, amount)
+	data["revparChart"] = reports.BarChart("RevPAR by month", revPAR, amount)
+	data["roomChart"] = reports.BarChart("Occupancy by room", roomOccupancy, percent)
+
+	stringMap := make(map[string]string)
+	stringMap["start"] = start.Format(layout)
+	stringMap["end"] = end.Format(layout)
+
+	render.RenderTemplate(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// reservationsPerPage is the number of reservations on a page of the admin lists
+const reservationsPerPage = 25
+
+// AdminAllReservations shows all reservations in admin tool, a page at a time, filtered
+// and sorted by the query string
+func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	m.renderReservations(w, r, "all", "admin-all-reservations.page.tmpl", nil)
+}
+
+// reservationFilter reads a reservation filter from the query string: q, status, processed,
+// room, start and end dates of the stay, sort, dir and the after cursor
+func reservationFilter(r *http.Request) (models.ReservationFilter, error) {
+	var filter models.ReservationFilter
+	q := r.URL.Query()
+
+	filter.Query = strings.TrimSpace(q.Get("q"))
+
+	switch status := q.Get("status"); status {
+	case "", models.StatusPending, models.StatusNew, models.StatusProcessed, models.StatusCancelled, models.StatusActive:
+		filter.Status = status
+	default:
+		return filter, fmt.Errorf("unknown status %q", status)
+	}
+
+	switch q.Get("processed") {
+	case "":
+	case "1":
+		processed := true
+		filter.Processed = &processed
+	case "0":
+		processed := false
+		filter.Processed = &processed
+	default:
+		return filter, errors.New("processed must be 0 or 1")
+	}
+
+	if room := q.Get("room"); room != "" {
+		id, err := strconv.Atoi(room)
+		if err != nil {
+			return filter, err
+		}
+		filter.RoomID = id
+	}
+
+	layout := "2006-01-02"
+	if start := q.Get("start"); start != "" {
+		t, err := time.Parse(layout, start)
+		if err != nil {
+			return filter, err
+		}
+		filter.Start = t
+	}
+	if end := q.Get("end"); end != "" {
+		t, err := time.Parse(layout, end)
+		if err != nil {
+			return filter, err
+		}
+		filter.End = t
+	}
+
+	switch sort := q.Get("sort"); sort {
+	case "", models.SortArrival, models.SortDeparture, models.SortName, models.SortBooked, models.SortTotal:
+		filter.Sort = sort
+	default:
+		return filter, fmt.Errorf("unknown sort order %q", sort)
+	}
+
+	switch q.Get("dir") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, errors.New("dir must be asc or desc")
+	}
+
+	filter.After = q.Get("after")
+
+	return filter, nil
+}
+
+// renderReservations renders a page of a reservation list. src is the list the reservations
+// are shown from, and restrict, if not nil, narrows down the filter the list can show.
+func (m *Repository) renderReservations(w http.ResponseWriter, r *http.Request, src, tmpl string, restrict func(*models.ReservationFilter)) {
+	filter, err := reservationFilter(r)
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	if restrict != nil {
+		restrict(&filter)
+	}
+	filter.Limit = reservationsPerPage
+
+	page, err := m.DB.SearchReservations(filter)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// Links keep the filter; a new sort order or filter starts again from the first page
+	params := r.URL.Query()
+	params.Del("after")
+	link := func(set ...string) string {
+		v := url.Values{}
+		for key, values := range params {
+			if values[0] != "" {
+				v.Set(key, values[0])
+			}
+		}
+		for i := 0; i+1 < len(set); i += 2 {
+			v.Set(set[i], set[i+1])
+		}
+		if len(v) == 0 {
+			return r.URL.Path
+		}
+		return r.URL.Path + "?" + v.Encode()
+	}
+
+	sort := filter.Sort
+	if sort == "" {
+		sort = models.SortArrival
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+	stringMap["sort"] = sort
+	for _, key := range []string{"q", "status", "processed", "room", "start", "end"} {
+		stringMap[key] = params.Get(key)
+	}
+	for _, key := range []string{models.SortArrival, models.SortDeparture, models.SortName, models.SortBooked, models.SortTotal} {
+		dir := "asc"
+		if key == sort && !filter.Desc {
+			dir = "desc"
+		}
+		stringMap["sort-"+key] = link("sort", key, "dir", dir)
+	}
+	if filter.Desc {
+		stringMap["dir"] = "desc"
+	}
+	if filter.After != "" {
+		stringMap["first"] = link()
+	}
+	if page.Next != "" {
+		stringMap["next"] = link("after", page.Next)
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = page.Reservations
+	data["rooms"] = rooms
+
+	render.RenderTemplate(w, r, tmpl, &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// Global admin search: queries shorter than minSearchLength find nothing, and each kind of
+// result is limited to searchPageLimit on the results page and searchSuggestLimit in the
+// suggestions under the search box
+const (
+	minSearchLength    = 2
+	searchPageLimit    = 20
+	searchSuggestLimit = 5
+)
+
+// searchResult is one link in the results of a global admin search
+type searchResult struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	URL    string `json:"url"`
+}
+
+// searchGroup holds the search results of one kind
+type searchGroup struct {
+	Name    string         `json:"name"`
+	Results []searchResult `json:"results"`
+}
+
+// search runs a global admin search and groups the results into reservations, guests and
+// rooms, leaving out empty groups
+func (m *Repository) search(q string, limit int) ([]searchGroup, error) {
+	var groups []searchGroup
+	if len([]rune(q)) < minSearchLength {
+		return groups, nil
+	}
+
+	results, err := m.DB.Search(q, limit)
+	if err != nil {
+		return groups, err
+	}
+
+	var reservations []searchResult
+	for _, res := range results.Reservations {
+		detail := fmt.Sprintf("%s, %s to %s", res.Room.RoomName, render.HumanDate(res.StartDate), render.HumanDate(res.EndDate))
+		if res.Cancelled() {
+			detail += ", cancelled"
+		}
+		reservations = append(reservations, searchResult{
+			Title:  fmt.Sprintf("#%d %s, %s", res.ID, res.LastName, res.FirstName),
+			Detail: detail,
+			URL:    fmt.Sprintf("/admin/reservations/all/%d/show", res.ID),
+		})
+	}
+
+	var guests []searchResult
+	for _, g := range results.Guests {
+		detail := g.Email
+		if g.Phone != "" {
+			detail += ", " + g.Phone
+		}
+		guests = append(guests, searchResult{
+			Title:  g.FirstName + " " + g.LastName,
+			Detail: fmt.Sprintf("%s, %d reservation(s)", detail, g.ReservationCount),
+			URL:    fmt.Sprintf("/admin/guests/%d", g.ID),
+		})
+	}
+
+	var rooms []searchResult
+	for _, rm := range results.Rooms {
+		rooms = append(rooms, searchResult{
+			Title:  rm.RoomName,
+			Detail: "Reservations of this room",
+			URL:    fmt.Sprintf("/admin/reservations-all?room=%d", rm.ID),
+		})
+	}
+
+	for _, g := range []searchGroup{{"Reservations", reservations}, {"Guests", guests}, {"Rooms", rooms}} {
+		if len(g.Results) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// AdminSearch shows the reservations, guests and rooms matching the q query parameter
+func (m *Repository) AdminSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	groups, err := m.search(q, searchPageLimit)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["search"] = q
+	if len([]rune(q)) < minSearchLength {
+		stringMap["hint"] = fmt.Sprintf("Enter at least %d characters: a name, email address, phone number or room.", minSearchLength)
+	}
+
+	data := make(map[string]interface{})
+	data["groups"] = groups
+
+	render.RenderTemplate(w, r, "admin-search.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminSearchJSON returns the first few results of a global admin search as JSON, for the
+// suggestions under the search box
+func (m *Repository) AdminSearchJSON(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	groups, err := m.search(q, searchSuggestLimit)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if groups == nil {
+		groups = []searchGroup{}
+	}
+
+	out, _ := json.MarshalIndent(struct {
+		Query  string        `json:"query"`
+		Groups []searchGroup `json:"groups"`
+	}{q, groups}, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// AdminExportReservations downloads the reservations matching the filter in the query string
+// as CSV or, with format=xlsx, as an Excel workbook. Rows are written as they are read from
+// the database rather than loaded all at once.
+func (m *Repository) AdminExportReservations(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if format != export.FormatCSV && format != export.FormatXLSX {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	filter, err := reservationFilter(r)
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The response is only started once the first row is read, so a failing query can
+	// still be reported as an error
+	var out export.Writer
+	begin := func() error {
+		if out != nil {
+			return nil
+		}
+
+		filename := fmt.Sprintf("reservations-%s.%s", time.Now().Format("2006-01-02"), format)
+		w.Header().Set("Content-Type", export.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+		var err error
+		out, err = export.NewWriter(w, format, "Reservations")
+		if err != nil {
+			return err
+		}
+		return out.WriteHeader(export.Columns)
+	}
+
+	err = m.DB.EachReservation(filter, func(res models.Reservation) error {
+		if err := begin(); err != nil {
+			return err
+		}
+		return out.WriteRow(export.Row(res))
+	})
+	if err != nil {
+		if out == nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.ErrorLog.Println("reservation export failed:", err)
+		return
+	}
+
+	if err = begin(); err != nil {
+		m.App.ErrorLog.Println("reservation export failed:", err)
+		return
+	}
+	if err = out.Close(); err != nil {
+		m.App.ErrorLog.Println("reservation export failed:", err)
+	}
+}
+
+// maxImportSize is the largest reservation import file accepted
+const maxImportSize = 10 << 20
+
+// AdminImport shows the page for importing reservations from a CSV file
+func (m *Repository) AdminImport(w http.ResponseWriter, r *http.Request) {
+	render.RenderTemplate(w, r, "admin-import.page.tmpl", &models.TemplateData{
+		Data: make(map[string]interface{}),
+	})
+}
+
+// AdminPostImport imports reservations from an uploaded CSV file, or only checks them in
+// a dry run, and shows the outcome of each row
+func (m *Repository) AdminPostImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot read upload")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "choose a CSV file to import")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	dryRun := r.Form.Get("dry-run") == "1"
+	result, err := importer.Run(m.DB, file, dryRun)
+	if err != nil && len(result.Rows) == 0 {
+		m.App.Session.Put(r.Context(), "error", "cannot import reservations: "+err.Error())
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	// Keep the result file for download
+	var buf bytes.Buffer
+	if werr := result.WriteCSV(&buf); werr == nil {
+		m.App.Session.Put(r.Context(), "import-result", buf.Bytes())
+	}
+
+	td := &models.TemplateData{Data: make(map[string]interface{})}
+	td.Data["result"] = result
+
+	switch {
+	case err != nil:
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "nothing was imported: "+err.Error())
+	case result.Failed() > 0:
+		m.App.Session.Put(r.Context(), "error",
+			fmt.Sprintf("%d of %d row(s) have errors, nothing was imported", result.Failed(), len(result.Rows)))
+	case dryRun:
+		m.App.Session.Put(r.Context(), "flash",
+			fmt.Sprintf("%d row(s) are valid, nothing was imported in a dry run", len(result.Rows)))
+	default:
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d reservation(s) imported", result.Imported))
+	}
+
+	render.RenderTemplate(w, r, "admin-import.page.tmpl", td)
+}
+
+// AdminImportResult downloads the outcome of the last import as a CSV file
+func (m *Repository) AdminImportResult(w http.ResponseWriter, r *http.Request) {
+	result := m.App.Session.GetBytes(r.Context(), "import-result")
+	if result == nil {
+		m.App.Session.Put(r.Context(), "error", "there is no import result to download")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="import-result.csv"`)
+	_, _ = w.Write(result)
+}
+
+// AdminNewReservations shows the reservations not yet processed or cancelled in admin tool,
+// a page at a time, filtered and sorted by the query string
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	m.renderReservations(w, r, "new", "admin-new-reservations.page.tmpl", func(f *models.ReservationFilter) {
+		processed := false
+		f.Processed = &processed
+		f.Status = models.StatusActive
+	})
+}
+
+// AdminShowReservation shows the reservation in the amdin tool
+func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	stringMap["month"] = month
+	stringMap["year"] = year
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	resPayments, err := m.DB.GetPaymentsByReservationID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	schedule, err := m.DB.GetScheduleByReservationID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["payments"] = resPayments
+	data["schedule"] = schedule
+
+	// The reservation is still shown if its guest cannot be loaded
+	if res.GuestID > 0 {
+		guest, err := m.DB.GetGuestByID(res.GuestID)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		} else {
+			data["guest"] = guest
+		}
+	}
+
+	render.RenderTemplate(w, r, "admin-reservation-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	res.FirstName = r.Form.Get("first-name")
+	res.LastName = r.Form.Get("last-name")
+	res.Email = r.Form.Get("email")
+	res.Phone = r.Form.Get("phone-number")
+
+	err = m.DB.UpdateReservation(res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	month := r.Form.Get("month")
+	year := r.Form.Get("year")
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminReservationsCalendar displays the reservation calendar
+func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	if r.URL.Query().Get("y") != "" {
+		year, err := strconv.Atoi(r.URL.Query().Get("y"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		month, err := strconv.Atoi(r.URL.Query().Get("m"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	data := make(map[string]interface{})
+	data["now"] = now
+
+	next := now.AddDate(0, 1, 0)
+	last := now.AddDate(0, -1, 0)
+
+	nextMonth := next.Format("01")
+	nextMonthYear := next.Format("2006")
+
+	lastMonth := last.Format("01")
+	lastMonthYear := last.Format("2006")
+
+	stringMap := make(map[string]string)
+	stringMap["next_month"] = nextMonth
+	stringMap["next_month_year"] = nextMonthYear
+	stringMap["last_month"] = lastMonth
+	stringMap["last_month_year"] = lastMonthYear
+
+	stringMap["this_month"] = now.Format("01")
+	stringMap["this_month_year"] = now.Format("2006")
+
+	currentYear, currentMonth, _ := now.Date()
+	currentLocation := now.Location()
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	intMap := make(map[string]int)
+	intMap["days_in_month"] = lastOfMonth.Day()
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data["rooms"] = rooms
+
+	for _, x := range rooms {
+		reservationMap := make(map[string]int)
+		blockMap := make(map[string]int)
+
+		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
+			reservationMap[d.Format("2006-01-2")] = 0
+			blockMap[d.Format("2006-01-2")] = 0
+		}
+
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		for _, y := range restrictions {
+			if y.ReservationID > 0 {
+				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
+					reservationMap[d.Format("2006-01-2")] = y.ReservationID
+				}
+			} else {
+				// Blocks imported from external calendars may span several nights
+				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
+				for d := y.StartDate.AddDate(0, 0, 1); d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					blockMap[d.Format("2006-01-2")] = y.ID
+				}
+			}
+		}
+
+		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
+		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+
+		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	}
+
+	render.RenderTemplate(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// AdminProcessReservation marks a reservation as processed
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	err = m.DB.UpdateProcessedForReservation(id, 1)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminDeleteReservation deletes a cancelled reservation. Reservations that are not cancelled
+// have to go through the cancellation policy first, so that guests are refunded, and ones
+// with payments or an invoice are kept for the accounts.
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	err = m.DB.DeleteReservation(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "Only cancelled reservations can be deleted, cancel it first")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrReservationHasPayments) {
+		m.App.Session.Put(r.Context(), "error", "Reservations with payments or an invoice cannot be deleted, they are kept for the accounts")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "error deleting reservation")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation deleted")
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminPostReservationsCalendar handles post of reservation calendar
+func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	year, _ := strconv.Atoi(r.Form.Get("y"))
+	month, _ := strconv.Atoi(r.Form.Get("m"))
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	for _, x := range rooms {
+		currMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
+
+		for date, id := range currMap {
+			if val, ok := currMap[date]; ok {
+				if val > 0 {
+					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, date)) {
+						err = m.DB.DeleteBlockByID(id)
+						if err != nil {
+							m.App.ErrorLog.Println(err)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for name := range r.PostForm {
+		if strings.HasPrefix(name, "add_block") {
+			exploded := strings.Split(name, "_")
+			roomID, _ := strconv.Atoi(exploded[2])
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+
+			t, _ := time.Parse("2006-01-2", exploded[3])
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+
+			err = m.DB.InsertBlockForRoom(roomID, t)
+			if err != nil {
+				m.App.ErrorLog.Println(err)
+				m.App.Session.Put(r.Context(), "error", "cannot insert block restriction into the database")
+				http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+				return
+			}
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+}
+
+// ICalRoomFeed serves the reservations and blocks of a room as an iCalendar feed
+func (m *Repository) ICalRoomFeed(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(strings.TrimSuffix(path.Base(r.URL.Path), ".ics"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if room.ICalToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(room.ICalToken)) != 1 {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	// Feeds cover the past year and the next two years
+	now := time.Now()
+	start := now.AddDate(-1, 0, 0)
+	end := now.AddDate(2, 0, 0)
+
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(roomID, start, end)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	cal := ical.Calendar{
+		ProdID: icalProdID,
+		Name:   room.RoomName,
+	}
+
+	for _, x := range restrictions {
+		if x.ReservationID > 0 {
+			cal.Events = append(cal.Events, ical.Event{
+				UID:         ical.ReservationUID(x.ReservationID, icalDomain),
+				Summary:     "Reserved",
+				Description: fmt.Sprintf("Reservation #%d", x.ReservationID),
+				Start:       x.StartDate,
+				End:         x.EndDate,
+			})
+		} else {
+			cal.Events = append(cal.Events, ical.Event{
+				UID:     ical.BlockUID(x.ID, icalDomain),
+				Summary: "Blocked",
+				Start:   x.StartDate,
+				End:     x.EndDate,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"room-%d.ics\"", roomID))
+	err = cal.Write(w)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+const (
+	icalProdID = "-//Fort Smythe BnB//Bookings//EN"
+	icalDomain = "fsbnb.com"
+)
+
+// reservationCalendar builds a calendar holding a single reservation
+func reservationCalendar(res models.Reservation) *ical.Calendar {
+	return &ical.Calendar{
+		ProdID: icalProdID,
+		Events: []ical.Event{
+			{
+				UID:         ical.ReservationUID(res.ID, icalDomain),
+				Summary:     fmt.Sprintf("Stay at Fort Smythe BnB - %s", res.Room.RoomName),
+				Description: fmt.Sprintf("Reservation #%d for %s %s", res.ID, res.FirstName, res.LastName),
+				Start:       res.StartDate,
+				End:         res.EndDate,
+			},
+		},
+	}
+}
+
+// AdminICalSources shows the external calendars and their sync status
+func (m *Repository) AdminICalSources(w http.ResponseWriter, r *http.Request) {
+	sources, err := m.DB.AllICalSources()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["sources"] = sources
+	data["rooms"] = rooms
+
+	render.RenderTemplate(w, r, "admin-ical-sources.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostICalSource registers an external calendar for a room
+func (m *Repository) AdminPostICalSource(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "url", "room-id")
+
+	roomID, err := strconv.Atoi(r.Form.Get("room-id"))
+	if err != nil && form.Has("room-id") {
+		form.Errors.Add("room-id", "Invalid room")
+	}
+
+	if !form.Valid() {
+		sources, err := m.DB.AllICalSources()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		rooms, err := m.DB.AllRooms()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		data := make(map[string]interface{})
+		data["sources"] = sources
+		data["rooms"] = rooms
+
+		render.RenderTemplate(w, r, "admin-ical-sources.page.tmpl", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	source := models.ICalSource{
+		RoomID: roomID,
+		Name:   r.Form.Get("name"),
+		URL:    strings.TrimSpace(r.Form.Get("url")),
+	}
+
+	source.ID, err = m.DB.InsertICalSource(source)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save external calendar")
+		http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+		return
+	}
+
+	// Import the calendar straight away rather than waiting for the next scheduled sync
+	err = icalsync.New(m.DB, m.App.ErrorLog).Sync(source)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "warning", "External calendar saved, but the first sync failed")
+		http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "External calendar saved")
+	http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+}
+
+// AdminSyncICalSource syncs one external calendar on demand
+func (m *Repository) AdminSyncICalSource(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	source, err := m.DB.GetICalSourceByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot find external calendar")
+		http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+		return
+	}
+
+	err = icalsync.New(m.DB, m.App.ErrorLog).Sync(source)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Sync failed: "+err.Error())
+		http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "External calendar synced")
+	http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+}
+
+// AdminDeleteICalSource removes an external calendar along with its imported blocks
+func (m *Repository) AdminDeleteICalSource(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteICalSource(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "error deleting external calendar")
+		http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "External calendar deleted")
+	http.Redirect(w, r, "/admin/ical-sources", http.StatusSeeOther)
+}
+
+// Payment renders the payment form for the reservation in the session
+func (m *Repository) Payment(w http.ResponseWriter, r *http.Request) {
+	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || reservation.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "cannot get reservation from session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	if !m.paymentsEnabled() || reservation.NextPaymentAmount(time.Now()) <= 0 {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	m.renderPayment(w, r, reservation, forms.New(nil))
+}
+
+// PostPayment authorizes and captures the payment for the reservation in the session
+func (m *Repository) PostPayment(w http.ResponseWriter, r *http.Request) {
+	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || reservation.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "cannot get reservation from session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot parse form")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	if !m.paymentsEnabled() || reservation.NextPaymentAmount(time.Now()) <= 0 {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("card-name", "card-number", "card-exp-month", "card-exp-year", "card-cvc")
+
+	expMonth, err := strconv.Atoi(r.Form.Get("card-exp-month"))
+	if err != nil && form.Has("card-exp-month") {
+		form.Errors.Add("card-exp-month", "Invalid month")
+	}
+
+	expYear, err := strconv.Atoi(r.Form.Get("card-exp-year"))
+	if err != nil && form.Has("card-exp-year") {
+		form.Errors.Add("card-exp-year", "Invalid year")
+	}
+
+	if !form.Valid() {
+		m.renderPayment(w, r, reservation, form)
+		return
+	}
+
+	card := payments.Card{
+		Name:     r.Form.Get("card-name"),
+		Number:   strings.ReplaceAll(r.Form.Get("card-number"), " ", ""),
+		ExpMonth: expMonth,
+		ExpYear:  expYear,
+		CVC:      r.Form.Get("card-cvc"),
+	}
+
+	// Payments for a reservation are taken one at a time, for what the database says is still
+	// due, so that submitting the form twice or paying in a second tab cannot charge the guest twice
+	started := false
+	err = m.DB.LockReservationPayments(reservation.ID, func() error {
+		started = true
+		m.takePayment(w, r, reservation, card, form)
+		return nil
+	})
+	if err != nil && started {
+		m.App.ErrorLog.Printf("cannot release payment lock of reservation %d: %v", reservation.ID, err)
+	} else if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot take payment, please try again")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	}
+}
+
+// takePayment charges the card for what is due on the reservation, reloaded from the database,
+// and confirms the reservation with its first payment
+func (m *Repository) takePayment(w http.ResponseWriter, r *http.Request, reservation models.Reservation, card payments.Card, form *forms.Form) {
+	current, err := m.DB.GetReservationByID(reservation.ID)
+	if err == nil {
+		current.Schedule, err = m.DB.GetScheduleByReservationID(reservation.ID)
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot get reservation from database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	// The room is only held for a while before the first payment, and released once it expires
+	if current.Cancelled() {
+		m.App.Session.Remove(r.Context(), "reservation")
+		if current.Confirmed() {
+			m.App.Session.Put(r.Context(), "error", "This reservation has been cancelled")
+		} else {
+			m.App.Session.Put(r.Context(), "error", "Your reservation was not paid for in time and the room was released, please book again")
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	reservation.PaidAmount = current.PaidAmount
+	reservation.RefundedAmount = current.RefundedAmount
+	reservation.ConfirmedAt = current.ConfirmedAt
+	reservation.HoldExpiresAt = current.HoldExpiresAt
+	reservation.Schedule = current.Schedule
+
+	amount := reservation.NextPaymentAmount(time.Now())
+	if amount <= 0 {
+		m.App.Session.Put(r.Context(), "reservation", reservation)
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	err = m.voidAuthorizations(r.Context(), reservation.ID)
+	if err != nil {
+		m.App.ErrorLog.Println("cannot void earlier authorizations:", err)
+		form.Errors.Add("card-number", "An earlier payment is still being processed, please contact us")
+		m.renderPayment(w, r, reservation, form)
+		return
+	}
+
+	auth, err := m.App.Payments.Authorize(r.Context(), payments.AuthorizeRequest{
+		Amount:      amount,
+		Currency:    m.App.ExchangeRates.Base(),
+		Card:        card,
+		Description: fmt.Sprintf("Reservation #%d", reservation.ID),
+	})
+	if err != nil {
+		m.App.InfoLog.Println("payment authorization failed:", err)
+		form.Errors.Add("card-number", "Payment failed: "+err.Error())
+		m.renderPayment(w, r, reservation, form)
+		return
+	}
+
+	payment := models.Payment{
+		ReservationID: reservation.ID,
+		Gateway:       m.App.Payments.Name(),
+		Reference:     auth.Reference,
+		CardLast4:     card.Last4(),
+		Amount:        auth.Amount,
+		Currency:      m.App.ExchangeRates.Base(),
+		Status:        payments.StatusAuthorized,
+	}
+
+	// An authorization that cannot be captured is voided, so that trying again does not leave
+	// the guest's card with several holds
+	captured, err := m.App.Payments.Capture(r.Context(), auth.Reference, amount)
+	if err == nil {
+		payment.Amount = captured.Amount
+		payment.Status = payments.StatusCaptured
+	} else {
+		m.App.ErrorLog.Println("payment capture failed:", err)
+		if _, err = m.App.Payments.Void(r.Context(), auth.Reference); err == nil {
+			payment.Status = payments.StatusVoided
+		} else {
+			m.App.ErrorLog.Println("cannot void payment authorization:", err)
+		}
+	}
+
+	payment.ID, err = m.DB.InsertPayment(payment)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save payment, please contact us")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	if payment.Status != payments.StatusCaptured {
+		form.Errors.Add("card-number", "Payment could not be completed, please try again")
+		m.renderPayment(w, r, reservation, form)
+		return
+	}
+
+	reservation.PaidAmount += payment.Amount
+
+	if !reservation.Confirmed() {
+		err = m.confirmReservation(reservation.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The hold expired while the guest was paying
+			m.refundPayment(r.Context(), payment)
+			m.App.Session.Remove(r.Context(), "reservation")
+			m.App.Session.Put(r.Context(), "error", "Your reservation was not paid for in time and the room was released, your payment has been refunded")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			m.App.ErrorLog.Println("cannot confirm reservation:", err)
+		}
+
+		reservation.ConfirmedAt = time.Now()
+		reservation.HoldExpiresAt = time.Time{}
+	}
+
+	m.issueInvoice(reservation.ID)
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+	m.sendPaymentReceipt(reservation, payment)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// confirmReservation confirms a reservation with its first captured payment, however it was
+// captured, and sends the reservation emails the first time. It returns sql.ErrNoRows if the
+// reservation was cancelled.
+func (m *Repository) confirmReservation(id int) error {
+	confirmed, err := m.DB.ConfirmReservation(id)
+	if err != nil || !confirmed {
+		return err
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.ErrorLog.Printf("cannot send the emails of reservation %d: %v", id, err)
+		return nil
+	}
+	m.sendReservationEmails(res)
+
+	return nil
+}
+
+// voidAuthorizations voids the payments of a reservation that were authorized but not captured
+func (m *Repository) voidAuthorizations(ctx context.Context, reservationID int) error {
+	existing, err := m.DB.GetPaymentsByReservationID(reservationID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range existing {
+		if p.Status != payments.StatusAuthorized {
+			continue
+		}
+
+		if _, err = m.App.Payments.Void(ctx, p.Reference); err != nil {
+			return err
+		}
+
+		p.Status = payments.StatusVoided
+		if err = m.DB.UpdatePayment(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refundPayment refunds what is left of a captured payment in full
+func (m *Repository) refundPayment(ctx context.Context, payment models.Payment) {
+	refunded, err := m.App.Payments.Refund(ctx, payment.Reference, payment.Amount-payment.RefundedAmount)
+	if err != nil {
+		m.App.ErrorLog.Printf("cannot refund payment %d: %v", payment.ID, err)
+		return
+	}
+
+	payment.RefundedAmount = refunded.Refunded
+	payment.Status = refunded.Status
+	if err = m.DB.UpdatePayment(payment); err != nil {
+		m.App.ErrorLog.Printf("cannot record refund of payment %d: %v", payment.ID, err)
+	}
+}
+
+// renderPayment renders the payment form
+func (m *Repository) renderPayment(w http.ResponseWriter, r *http.Request, reservation models.Reservation, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["start-date"] = reservation.StartDate.Format("2006-01-02")
+	stringMap["end-date"] = reservation.EndDate.Format("2006-01-02")
+
+	data := make(map[string]interface{})
+	data["reservation"] = reservation
+	data["amount"] = reservation.NextPaymentAmount(time.Now())
+
+	render.RenderTemplate(w, r, "payment.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// paymentsEnabled reports whether a payment gateway is configured. Without one, reservations
+// are confirmed when they are made and paid for at the property.
+func (m *Repository) paymentsEnabled() bool {
+	return m.App.Payments != nil
+}
+
+// PaymentWebhook receives payment status notifications from the gateway
+func (m *Repository) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if !m.paymentsEnabled() {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	event, err := m.App.Payments.VerifyWebhook(payload, r.Header.Get("X-Signature"))
+	if err != nil {
+		m.App.InfoLog.Println("rejected payment webhook:", err)
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	payment, err := m.DB.GetPaymentByReference(event.Reference)
+	if err != nil {
+		m.App.InfoLog.Println("payment webhook for unknown reference:", event.Reference)
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	next := payment
+	switch event.Type {
+	case payments.EventCaptured:
+		next.Status = payments.StatusCaptured
+		if event.Amount > 0 {
+			next.Amount = event.Amount
+		}
+	case payments.EventRefunded:
+		next.RefundedAmount = event.Amount
+		if next.RefundedAmount >= next.Amount {
+			next.Status = payments.StatusRefunded
+		}
+	case payments.EventFailed:
+		next.Status = payments.StatusFailed
+	default:
+		// Acknowledge events we don't act on so the gateway stops retrying
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Events arriving late or replayed must not undo what has happened to the payment since
+	if !payments.CanTransition(payment.Status, next.Status) || next.RefundedAmount < payment.RefundedAmount {
+		m.App.InfoLog.Printf("rejected payment webhook %s for payment %d, which is %s", event.Type, payment.ID, payment.Status)
+		helpers.ClientError(w, http.StatusConflict)
+		return
+	}
+	payment = next
+
+	err = m.DB.UpdatePayment(payment)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// A payment captured by the gateway confirms the reservation it holds the room for
+	if payment.Status == payments.StatusCaptured {
+		err = m.confirmReservation(payment.ReservationID)
+		if errors.Is(err, sql.ErrNoRows) {
+			m.App.ErrorLog.Printf("payment %d captured for cancelled reservation %d", payment.ID, payment.ReservationID)
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		m.issueInvoice(payment.ReservationID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminCapturePayment captures an authorized payment
+func (m *Repository) AdminCapturePayment(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	payment, err := m.DB.GetPaymentByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", r.Form.Get("src"), payment.ReservationID)
+
+	if !m.paymentsEnabled() {
+		m.App.Session.Put(r.Context(), "error", "No payment gateway is configured")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if payment.Status != payments.StatusAuthorized {
+		m.App.Session.Put(r.Context(), "error", "Only authorized payments can be captured")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	captured, err := m.App.Payments.Capture(r.Context(), payment.Reference, payment.Amount)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Capture failed: "+err.Error())
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	payment.Amount = captured.Amount
+	payment.Status = payments.StatusCaptured
+
+	err = m.DB.UpdatePayment(payment)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.confirmReservation(payment.ReservationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "warning", "Payment captured, but the reservation is cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.issueInvoice(payment.ReservationID)
+
+	m.App.Session.Put(r.Context(), "flash", "Payment captured")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminRefundPayment refunds some or all of a captured payment
+func (m *Repository) AdminRefundPayment(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	payment, err := m.DB.GetPaymentByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", r.Form.Get("src"), payment.ReservationID)
+
+	if !m.paymentsEnabled() {
+		m.App.Session.Put(r.Context(), "error", "No payment gateway is configured")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	amount, err := pricing.ParseAmount(r.Form.Get("amount"))
+	if err != nil || amount <= 0 || amount > payment.Amount-payment.RefundedAmount {
+		m.App.Session.Put(r.Context(), "error", "Invalid refund amount")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	refunded, err := m.App.Payments.Refund(r.Context(), payment.Reference, amount)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Refund failed: "+err.Error())
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	payment.RefundedAmount = refunded.Refunded
+	payment.Status = refunded.Status
+
+	err = m.DB.UpdatePayment(payment)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Payment refunded")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// sendPaymentReceipt emails the guest a receipt for a payment with their invoice attached
+func (m *Repository) sendPaymentReceipt(reservation models.Reservation, payment models.Payment) {
+	htmlMessage := fmt.Sprintf(`
+		<strong>Payment Received</strong>
+		<hr>
+		Dear %s, <br>
+		We have received your payment for your reservation at Fort Smythe BnB. <br>
+		<div style="text-align:center !important;">
+			<strong>Room</strong>: %s <br>
+			<strong>Duration</strong>: %s to %s <br>
+			<strong>Amount paid</strong>: %s <br>
+			<strong>Remaining balance</strong>: %s <br>
+		</div>
+	`,
+		reservation.FirstName+" "+reservation.LastName,
+		reservation.Room.RoomName,
+		reservation.StartDate.Format("2006-01-02"),
+		reservation.EndDate.Format("2006-01-02"),
+		pricing.FormatAmount(payment.Amount),
+		pricing.FormatAmount(reservation.OutstandingAmount()))
+
+	msg := models.MailData{
+		To:      reservation.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Payment Received",
+		Content: htmlMessage,
+	}
+
+	inv, pdf, err := m.invoiceFor(reservation)
+	if err != nil {
+		m.App.ErrorLog.Println("cannot attach invoice to receipt:", err)
+	} else {
+		msg.Attachments = append(msg.Attachments, models.MailAttachment{
+			Name:     inv.Filename(),
+			MimeType: "application/pdf",
+			Data:     pdf,
+		})
+	}
+
+	m.queueMail(msg)
+}
+
+// PayReservation loads a reservation from the link in a balance reminder and sends the guest to the payment form
+func (m *Repository) PayReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	token := strings.SplitN(exploded[2], "?", 2)[0]
+
+	reservation, err := m.DB.GetReservationByAccessToken(token)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Reservation not found")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if reservation.Cancelled() {
+		m.App.Session.Put(r.Context(), "error", "This reservation has been cancelled")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if !m.paymentsEnabled() {
+		m.App.Session.Put(r.Context(), "error", "Online payment is not available, please pay at the property")
+		http.Redirect(w, r, "/manage/"+token, http.StatusSeeOther)
+		return
+	}
+
+	reservation.Schedule, err = m.DB.GetScheduleByReservationID(reservation.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if reservation.OutstandingAmount() <= 0 {
+		m.App.Session.Put(r.Context(), "flash", "Your reservation is paid in full")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+	http.Redirect(w, r, "/payment", http.StatusSeeOther)
+}
+
+// AdminDepositPolicies shows the deposit policy of every room
+func (m *Repository) AdminDepositPolicies(w http.ResponseWriter, r *http.Request) {
+	m.renderDepositPolicies(w, r, forms.New(nil))
+}
+
+// AdminPostDepositPolicy updates the deposit policy of a room
+func (m *Repository) AdminPostDepositPolicy(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room-id", "balance-due-days")
+
+	room := models.Room{
+		DepositType: r.Form.Get("deposit-type"),
+	}
+
+	room.ID, err = strconv.Atoi(r.Form.Get("room-id"))
+	if err != nil && form.Has("room-id") {
+		form.Errors.Add("room-id", "Invalid room")
+	}
+
+	room.BalanceDueDays, err = strconv.Atoi(r.Form.Get("balance-due-days"))
+	if (err != nil || room.BalanceDueDays < 0) && form.Has("balance-due-days") {
+		form.Errors.Add("balance-due-days", "Enter a number of days")
+	}
+
+	switch room.DepositType {
+	case "":
+	case pricing.DepositPercent:
+		room.DepositValue, err = strconv.Atoi(r.Form.Get("deposit-value"))
+		if err != nil || room.DepositValue < 0 || room.DepositValue > 100 {
+			form.Errors.Add("deposit-value", "Enter a percentage between 0 and 100")
+		}
+	case pricing.DepositFixed:
+		room.DepositValue, err = pricing.ParseAmount(r.Form.Get("deposit-value"))
+		if err != nil {
+			form.Errors.Add("deposit-value", "Enter an amount such as 50.00")
+		}
+	default:
+		form.Errors.Add("deposit-type", "Invalid deposit type")
+	}
+
+	if !form.Valid() {
+		m.renderDepositPolicies(w, r, form)
+		return
+	}
+
+	err = m.DB.UpdateRoomDepositPolicy(room)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save deposit policy")
+		http.Redirect(w, r, "/admin/deposit-policies", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Deposit policy saved")
+	http.Redirect(w, r, "/admin/deposit-policies", http.StatusSeeOther)
+}
+
+// renderDepositPolicies renders the deposit policy page
+func (m *Repository) renderDepositPolicies(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.RenderTemplate(w, r, "admin-deposit-policies.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminBalancesDue shows the balances still to be paid, soonest due first
+func (m *Repository) AdminBalancesDue(w http.ResponseWriter, r *http.Request) {
+	balances, err := m.DB.BalancesDue()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	total := 0
+	for _, b := range balances {
+		total += b.Reservation.OutstandingAmount()
+	}
+
+	data := make(map[string]interface{})
+	data["balances"] = balances
+
+	intMap := make(map[string]int)
+	intMap["total"] = total
+
+	stringMap := make(map[string]string)
+	stringMap["today"] = time.Now().Format("2006-01-02")
+
+	render.RenderTemplate(w, r, "admin-balances-due.page.tmpl", &models.TemplateData{
+		Data:      data,
+		IntMap:    intMap,
+		StringMap: stringMap,
+	})
+}
+
+// cancellationPolicy returns the cancellation policy that applies to a room
+func (m *Repository) cancellationPolicy(room models.Room) (cancellation.Policy, error) {
+	if room.CancellationPolicyID == 0 {
+		return cancellation.FullRefund, nil
+	}
+
+	cp, err := m.DB.GetCancellationPolicyByID(room.CancellationPolicyID)
+	if err != nil {
+		return cancellation.Policy{}, err
+	}
+
+	return cancellation.Parse(cp.Rules)
+}
+
+// describeCancellationPolicy returns a room's cancellation policy in words, or nothing if it cannot be loaded
+func (m *Repository) describeCancellationPolicy(room models.Room) string {
+	policy, err := m.cancellationPolicy(room)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return ""
+	}
+
+	return policy.Describe()
+}
+
+// errRefundFailed is returned by cancelReservation when the cancellation was recorded but
+// the guest could not be refunded in full
+var errRefundFailed = errors.New("reservation cancelled, but the refund failed")
+
+// cancelReservation applies the room's cancellation policy to a reservation. The cancellation
+// and the refund owed are recorded first, releasing the room, and the guest's payments are
+// then refunded by that amount. It returns sql.ErrNoRows if the reservation was already
+// cancelled, and an error wrapping errRefundFailed if the refund did not go through.
+func (m *Repository) cancelReservation(ctx context.Context, res models.Reservation) (models.Reservation, error) {
+	policy, err := m.cancellationPolicy(res.Room)
+	if err != nil {
+		return res, err
+	}
+
+	now := time.Now()
+	res.CancellationRefund, res.CancellationPenalty = cancellation.Calculate(policy, res.TotalAmount, res.PaidAmount-res.RefundedAmount, res.StartDate, now)
+	res.CancelledAt = now
+
+	err = m.DB.CancelReservation(res)
+	if err != nil {
+		return res, err
+	}
+
+	resPayments, err := m.DB.GetPaymentsByReservationID(res.ID)
+	if err != nil {
+		return res, fmt.Errorf("%w: %v", errRefundFailed, err)
+	}
+
+	remaining := res.CancellationRefund
+	for _, p := range resPayments {
+		if remaining == 0 {
+			break
+		}
+		if p.Status != payments.StatusCaptured {
+			continue
+		}
+
+		amount := p.Amount - p.RefundedAmount
+		if amount > remaining {
+			amount = remaining
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		if !m.paymentsEnabled() {
+			return res, fmt.Errorf("%w: no payment gateway is configured", errRefundFailed)
+		}
+
+		refunded, err := m.App.Payments.Refund(ctx, p.Reference, amount)
+		if err != nil {
+			return res, fmt.Errorf("%w: %v", errRefundFailed, err)
+		}
+
+		p.RefundedAmount = refunded.Refunded
+		p.Status = refunded.Status
+		if err = m.DB.UpdatePayment(p); err != nil {
+			return res, fmt.Errorf("%w: %v", errRefundFailed, err)
+		}
+
+		remaining -= amount
+	}
+
+	return res, nil
+}
+
+// sendCancellationEmail confirms a cancellation to the guest
+func (m *Repository) sendCancellationEmail(res models.Reservation) {
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Cancelled</strong>
+		<hr>
+		Dear %s, <br>
+		Your reservation at Fort Smythe BnB has been cancelled. <br>
+		<div style="text-align:center !important;">
+			<strong>Room</strong>: %s <br>
+			<strong>Duration</strong>: %s to %s <br>
+			<strong>Cancellation fee</strong>: %s <br>
+			<strong>Refund</strong>: %s <br>
+		</div>
+	`,
+		res.FirstName+" "+res.LastName,
+		res.Room.RoomName,
+		res.StartDate.Format("2006-01-02"),
+		res.EndDate.Format("2006-01-02"),
+		pricing.FormatAmount(res.CancellationPenalty),
+		pricing.FormatAmount(res.CancellationRefund))
+
+	m.queueMail(models.MailData{
+		To:      res.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Reservation Cancelled",
+		Content: htmlMessage,
+	})
+}
+
+// ManageReservation shows a guest their reservation and what cancelling it would refund
+func (m *Repository) ManageReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	token := strings.SplitN(exploded[2], "?", 2)[0]
+
+	res, err := m.DB.GetReservationByAccessToken(token)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Reservation not found")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	policy, err := m.cancellationPolicy(res.Room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	refund, penalty := cancellation.Calculate(policy, res.TotalAmount, res.PaidAmount-res.RefundedAmount, res.StartDate, time.Now())
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+	stringMap["cancellation-policy"] = policy.Describe()
+
+	intMap := make(map[string]int)
+	intMap["refund"] = refund
+	intMap["penalty"] = penalty
+
+	render.RenderTemplate(w, r, "manage-reservation.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
+
+// PostCancelReservation cancels a reservation on the guest's request
+func (m *Repository) PostCancelReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	token := exploded[2]
+
+	res, err := m.DB.GetReservationByAccessToken(token)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Reservation not found")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	back := fmt.Sprintf("/manage/%s", token)
+
+	if res.Cancelled() {
+		m.App.Session.Put(r.Context(), "warning", "This reservation has already been cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if !res.StartDate.After(time.Now()) {
+		m.App.Session.Put(r.Context(), "error", "Reservations cannot be cancelled after arrival, please contact us")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	res, err = m.cancelReservation(r.Context(), res)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "warning", "This reservation has already been cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, errRefundFailed) {
+		m.App.ErrorLog.Println(err)
+		m.sendCancellationEmail(res)
+		m.App.Session.Put(r.Context(), "warning", "Reservation cancelled, but your refund could not be issued yet, we will be in touch")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Your reservation could not be cancelled, please contact us")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	m.sendCancellationEmail(res)
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Reservation cancelled, %s will be refunded", pricing.FormatAmount(res.CancellationRefund)))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminCancelReservation cancels a reservation, applying the room's cancellation policy
+func (m *Repository) AdminCancelReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	if year := r.Form.Get("y"); year != "" {
+		back = fmt.Sprintf("%s?y=%s&m=%s", back, year, r.Form.Get("m"))
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if res.Cancelled() {
+		m.App.Session.Put(r.Context(), "warning", "Reservation is already cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	res, err = m.cancelReservation(r.Context(), res)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "warning", "Reservation is already cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, errRefundFailed) {
+		m.App.ErrorLog.Println(err)
+		m.sendCancellationEmail(res)
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Reservation cancelled, but the refund of %s failed, refund it from the payments below",
+			pricing.FormatAmount(res.CancellationRefund)))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "error cancelling reservation")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	m.sendCancellationEmail(res)
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Reservation cancelled: refunded %s, kept %s",
+		pricing.FormatAmount(res.CancellationRefund), pricing.FormatAmount(res.CancellationPenalty)))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminCancellationPolicies lists the cancellation policies and which room uses which
+func (m *Repository) AdminCancellationPolicies(w http.ResponseWriter, r *http.Request) {
+	m.renderCancellationPolicies(w, r, forms.New(nil))
+}
+
+// AdminPostCancellationPolicy adds a cancellation policy
+func (m *Repository) AdminPostCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "rules")
+
+	policy, err := cancellation.Parse(r.Form.Get("rules"))
+	if err != nil && form.Has("rules") {
+		form.Errors.Add("rules", err.Error())
+	}
+
+	if !form.Valid() {
+		m.renderCancellationPolicies(w, r, form)
+		return
+	}
+
+	_, err = m.DB.InsertCancellationPolicy(models.CancellationPolicy{
+		Name:  r.Form.Get("name"),
+		Rules: policy.String(),
+	})
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save cancellation policy")
+		http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Cancellation policy added")
+	http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+}
+
+// AdminDeleteCancellationPolicy deletes a cancellation policy
+func (m *Repository) AdminDeleteCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteCancellationPolicy(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot delete cancellation policy")
+		http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Cancellation policy deleted")
+	http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+}
+
+// AdminPostRoomCancellationPolicy attaches a cancellation policy to a room
+func (m *Repository) AdminPostRoomCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomID, err := strconv.Atoi(r.Form.Get("room-id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	policyID, _ := strconv.Atoi(r.Form.Get("policy-id"))
+
+	err = m.DB.UpdateRoomCancellationPolicy(roomID, policyID)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot update room")
+		http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room updated")
+	http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+}
+
+// renderCancellationPolicies renders the cancellation policy page
+func (m *Repository) renderCancellationPolicies(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	policies, err := m.DB.AllCancellationPolicies()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	descriptions := make(map[string]string)
+	for _, cp := range policies {
+		if p, err := cancellation.Parse(cp.Rules); err == nil {
+			descriptions[strconv.Itoa(cp.ID)] = p.Describe()
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["policies"] = policies
+	data["rooms"] = rooms
+
+	render.RenderTemplate(w, r, "admin-cancellation-policies.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: descriptions,
+		Form:      form,
+	})
+}
+
+// applyPromotion looks up a promo code, checks it against the reservation and applies its discount to the quote
+func (m *Repository) applyPromotion(code string, res models.Reservation, quote *pricing.Quote) (models.Promotion, error) {
+	promotion, err := m.DB.GetPromotionByCode(code)
+	if err != nil {
+		return promotion, errors.New("unknown promo code")
+	}
+
+	uses, emailUses, err := m.DB.PromotionUsage(promotion.ID, res.Email)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return promotion, errors.New("cannot check promo code, please try again")
+	}
+
+	err = promotions.Check(promotion, res.RoomID, quote.Nights, time.Now(), uses, emailUses)
+	if err != nil {
+		return promotion, err
+	}
+
+	quote.ApplyDiscount("Promo code "+promotion.Code, promotions.Discount(promotion, quote.Total))
+	return promotion, nil
+}
+
+// AdminPromotions lists the promo codes with their usage statistics
+func (m *Repository) AdminPromotions(w http.ResponseWriter, r *http.Request) {
+	m.renderPromotions(w, r, forms.New(nil))
+}
+
+// AdminPostPromotion adds a promo code
+func (m *Repository) AdminPostPromotion(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "discount-type", "discount-value")
+
+	promotion := models.Promotion{
+		Code:         promotions.Normalize(r.Form.Get("code")),
+		Description:  r.Form.Get("description"),
+		DiscountType: r.Form.Get("discount-type"),
+		Active:       true,
+	}
+
+	switch promotion.DiscountType {
+	case promotions.TypePercent:
+		promotion.DiscountValue, err = strconv.Atoi(r.Form.Get("discount-value"))
+		if err != nil || promotion.DiscountValue < 1 || promotion.DiscountValue > 100 {
+			form.Errors.Add("discount-value", "Enter a percentage between 1 and 100")
+		}
+	case promotions.TypeFixed:
+		promotion.DiscountValue, err = pricing.ParseAmount(r.Form.Get("discount-value"))
+		if err != nil || promotion.DiscountValue <= 0 {
+			form.Errors.Add("discount-value", "Enter an amount such as 25.00")
+		}
+	default:
+		if form.Has("discount-type") {
+			form.Errors.Add("discount-type", "Invalid discount type")
+		}
+	}
+
+	layout := "2006-01-02"
+	for field, date := range map[string]*time.Time{"valid-from": &promotion.ValidFrom, "valid-until": &promotion.ValidUntil} {
+		if form.Has(field) {
+			*date, err = time.Parse(layout, r.Form.Get(field))
+			if err != nil {
+				form.Errors.Add(field, "Enter a date as YYYY-MM-DD")
+			}
+		}
+	}
+	if !promotion.ValidFrom.IsZero() && !promotion.ValidUntil.IsZero() && promotion.ValidUntil.Before(promotion.ValidFrom) {
+		form.Errors.Add("valid-until", "Must not be before the start date")
+	}
+
+	for field, n := range map[string]*int{"min-nights": &promotion.MinNights, "max-uses": &promotion.MaxUses, "max-uses-per-email": &promotion.MaxUsesPerEmail} {
+		if form.Has(field) {
+			*n, err = strconv.Atoi(r.Form.Get(field))
+			if err != nil || *n < 0 {
+				form.Errors.Add(field, "Enter a whole number, or leave empty for no limit")
+			}
+		}
+	}
+
+	for _, v := range r.Form["room-ids"] {
+		roomID, err := strconv.Atoi(v)
+		if err != nil {
+			form.Errors.Add("room-ids", "Invalid room")
+			break
+		}
+		promotion.RoomIDs = append(promotion.RoomIDs, roomID)
+	}
+
+	if !form.Valid() {
+		m.renderPromotions(w, r, form)
+		return
+	}
+
+	_, err = m.DB.InsertPromotion(promotion)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save promo code")
+		http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Promo code added")
+	http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+}
+
+// AdminTogglePromotion activates or deactivates a promo code
+func (m *Repository) AdminTogglePromotion(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	active := r.PostForm.Get("active") == "1"
+
+	err = m.DB.UpdatePromotionActive(id, active)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot update promo code")
+		http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+		return
+	}
+
+	if active {
+		m.App.Session.Put(r.Context(), "flash", "Promo code activated")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Promo code deactivated")
+	}
+	http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+}
+
+// AdminDeletePromotion deletes a promo code
+func (m *Repository) AdminDeletePromotion(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeletePromotion(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot delete promo code")
+		http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Promo code deleted")
+	http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+}
+
+// renderPromotions renders the promo code page
+func (m *Repository) renderPromotions(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	promos, err := m.DB.AllPromotions()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomNames := make(map[string]string)
+	for _, room := range rooms {
+		roomNames[strconv.Itoa(room.ID)] = room.RoomName
+	}
+
+	data := make(map[string]interface{})
+	data["promotions"] = promos
+	data["rooms"] = rooms
+
+	render.RenderTemplate(w, r, "admin-promotions.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: roomNames,
+		Form:      form,
+	})
+}
+
+// reservationCharges returns the lines of a quote as charges to store with the reservation
+func reservationCharges(quote pricing.Quote) []models.ReservationCharge {
+	var charges []models.ReservationCharge
+	for _, l := range quote.Lines {
+		charges = append(charges, models.ReservationCharge{
+			Kind:        l.Kind,
+			Name:        l.Name,
+			Description: l.Description,
+			Amount:      l.Amount,
+		})
+	}
+	return charges
+}
+
+// invoiceLines returns the charges of a reservation as printed on its invoice
+func invoiceLines(res models.Reservation) []pricing.LineItem {
+	if len(res.Charges) > 0 {
+		var lines []pricing.LineItem
+		for _, c := range res.Charges {
+			lines = append(lines, pricing.LineItem{
+				Kind:        c.Kind,
+				Name:        c.Name,
+				Description: c.Description,
+				Amount:      c.Amount,
+			})
+		}
+		return lines
+	}
+
+	// Reservations made before charges were stored are priced again from the room
+	quote := pricing.NewQuote(res.Room, res.StartDate, res.EndDate)
+	quote.ApplyDiscount("Promo code discount", res.DiscountAmount)
+
+	// The room price may have changed since the booking; the amount charged is what counts
+	if quote.Total != res.TotalAmount {
+		return []pricing.LineItem{
+			{
+				Description: fmt.Sprintf("Accommodation, %d night(s)", quote.Nights),
+				Amount:      res.TotalAmount,
+			},
+		}
+	}
+
+	return quote.Lines
+}
+
+// issueInvoice issues the invoice of a reservation once it is paid for
+func (m *Repository) issueInvoice(reservationID int) {
+	if _, err := m.DB.IssueInvoice(reservationID); err != nil {
+		m.App.ErrorLog.Printf("cannot issue invoice for reservation %d: %v", reservationID, err)
+	}
+}
+
+// invoiceFor returns the invoice issued for a reservation, rendered
+func (m *Repository) invoiceFor(res models.Reservation) (invoice.Invoice, []byte, error) {
+	var inv invoice.Invoice
+
+	number, err := m.DB.GetInvoiceByReservationID(res.ID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	payments, err := m.DB.GetPaymentsByReservationID(res.ID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	inv = invoice.Invoice{
+		Number:      number.Number,
+		IssuedAt:    number.IssuedAt,
+		Property:    m.App.Property,
+		Reservation: res,
+		Lines:       invoiceLines(res),
+		Payments:    payments,
+	}
+
+	return inv, invoice.Render(inv), nil
+}
+
+// writeInvoice sends the invoice of a reservation as a PDF download, or goes back if no
+// invoice has been issued for it yet
+func (m *Repository) writeInvoice(w http.ResponseWriter, r *http.Request, res models.Reservation, back string) {
+	inv, pdf, err := m.invoiceFor(res)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "warning", "No invoice has been issued yet, it is issued once a payment is received")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, inv.Filename()))
+	w.Write(pdf)
+}
+
+// AdminInvoice downloads the invoice of a reservation
+func (m *Repository) AdminInvoice(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Reservation not found")
+		http.Redirect(w, r, "/admin/reservations-all", http.StatusSeeOther)
+		return
+	}
+
+	m.writeInvoice(w, r, res, fmt.Sprintf("/admin/reservations/all/%d/show", res.ID))
+}
+
+// GuestInvoice downloads the invoice of a reservation from the guest's manage page
+func (m *Repository) GuestInvoice(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	token := exploded[2]
+
+	res, err := m.DB.GetReservationByAccessToken(token)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Reservation not found")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.writeInvoice(w, r, res, fmt.Sprintf("/manage/%s", token))
+}
+
+// AdminFees lists the taxes and fees charged on bookings
+func (m *Repository) AdminFees(w http.ResponseWriter, r *http.Request) {
+	m.renderFees(w, r, forms.New(nil))
+}
+
+// AdminPostFee adds a tax or fee
+func (m *Repository) AdminPostFee(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "kind", "amount")
+
+	fee := models.Fee{
+		Name:   r.Form.Get("name"),
+		Kind:   r.Form.Get("kind"),
+		IsTax:  r.Form.Get("is-tax") == "1",
+		Active: true,
+	}
+
+	if !pricing.ValidFeeKind(fee.Kind) && form.Has("kind") {
+		form.Errors.Add("kind", "Invalid fee type")
+	}
+
+	// Percentages are stored in hundredths of a percent, so 7.5 is stored as 750
+	if fee.Kind == pricing.FeePercent {
+		fee.Amount, err = pricing.ParseDecimal(r.Form.Get("amount"), 2)
+	} else {
+		fee.Amount, err = pricing.ParseAmount(r.Form.Get("amount"))
+	}
+	if (err != nil || fee.Amount <= 0) && form.Has("amount") {
+		form.Errors.Add("amount", "Enter an amount such as 2.50, or a percentage such as 7.5")
+	}
+
+	if !form.Valid() {
+		m.renderFees(w, r, form)
+		return
+	}
+
+	_, err = m.DB.InsertFee(fee)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save fee")
+		http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Fee added")
+	http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+}
+
+// AdminToggleFee starts or stops charging a tax or fee on new bookings
+func (m *Repository) AdminToggleFee(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	active := r.PostForm.Get("active") == "1"
+
+	err = m.DB.UpdateFeeActive(id, active)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot update fee")
+		http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+		return
+	}
+
+	if active {
+		m.App.Session.Put(r.Context(), "flash", "Fee activated")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Fee deactivated")
+	}
+	http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+}
+
+// AdminDeleteFee deletes a tax or fee
+func (m *Repository) AdminDeleteFee(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteFee(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot delete fee")
+		http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Fee deleted")
+	http.Redirect(w, r, "/admin/fees", http.StatusSeeOther)
+}
+
+// renderFees renders the taxes and fees page
+func (m *Repository) renderFees(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	fees, err := m.DB.AllFees()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	descriptions := make(map[string]string)
+	for _, f := range fees {
+		descriptions[strconv.Itoa(f.ID)] = pricing.DescribeFee(f)
+	}
+
+	data := make(map[string]interface{})
+	data["fees"] = fees
+
+	render.RenderTemplate(w, r, "admin-fees.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: descriptions,
+		Form:      form,
+	})
+}
+
+// AdminFeeReport shows the taxes and fees charged per month of a year, for remittance
+func (m *Repository) AdminFeeReport(w http.ResponseWriter, r *http.Request) {
+	year := time.Now().Year()
+	if y := r.URL.Query().Get("y"); y != "" {
+		var err error
+		year, err = strconv.Atoi(y)
+		if err != nil {
+			helpers.ClientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	totals, err := m.DB.FeeTotalsByMonth(year)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// Totals for the whole year, in the order each tax or fee first appears
+	var yearly []models.FeeTotal
+	index := make(map[string]int)
+	for _, t := range totals {
+		key := t.Kind + "/" + t.Name
+		i, ok := index[key]
+		if !ok {
+			i = len(yearly)
+			index[key] = i
+			yearly = append(yearly, models.FeeTotal{Kind: t.Kind, Name: t.Name})
+		}
+		yearly[i].Reservations += t.Reservations
+		yearly[i].Amount += t.Amount
+	}
+
+	data := make(map[string]interface{})
+	data["totals"] = totals
+	data["yearly"] = yearly
+
+	intMap := make(map[string]int)
+	intMap["year"] = year
+	intMap["prev"] = year - 1
+	intMap["next"] = year + 1
+
+	render.RenderTemplate(w, r, "admin-fee-report.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// SetCurrency changes the currency prices are shown in and returns to the page the visitor came from
+func (m *Repository) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(r.URL.Query().Get("code"))
+	if _, ok := m.App.ExchangeRates.Rate(code); ok {
+		m.App.Session.Put(r.Context(), "currency", code)
+	}
+
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && strings.HasPrefix(ref.Path, "/") {
+		back = ref.RequestURI()
+	}
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminExchangeRates lists the exchange rates used to show prices in other currencies
+func (m *Repository) AdminExchangeRates(w http.ResponseWriter, r *http.Request) {
+	m.renderExchangeRates(w, r, forms.New(nil))
+}
+
+// AdminPostExchangeRate adds or updates the exchange rate of one currency
+func (m *Repository) AdminPostExchangeRate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("currency", "rate")
+
+	code := strings.ToUpper(strings.TrimSpace(r.Form.Get("currency")))
+	if form.Has("currency") && (!currency.ValidCode(code) || code == m.App.ExchangeRates.Base()) {
+		form.Errors.Add("currency", "Enter a three letter currency code other than "+m.App.ExchangeRates.Base())
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(r.Form.Get("rate")), 64)
+	if form.Has("rate") && (err != nil || rate <= 0) {
+		form.Errors.Add("rate", "Enter a positive number such as 0.92")
+	}
+
+	if !form.Valid() {
+		m.renderExchangeRates(w, r, form)
+		return
+	}
+
+	m.saveExchangeRates(w, r, []models.ExchangeRate{{Currency: code, Rate: rate}})
+}
+
+// AdminImportExchangeRates adds or updates exchange rates from an uploaded "currency,rate" CSV file
+func (m *Repository) AdminImportExchangeRates(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot read upload")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "choose a CSV file to import")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	rates, err := currency.ParseCSV(file)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "cannot import exchange rates: "+err.Error())
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	var valid []models.ExchangeRate
+	for _, er := range rates {
+		if er.Currency != m.App.ExchangeRates.Base() {
+			valid = append(valid, er)
+		}
+	}
+
+	m.saveExchangeRates(w, r, valid)
+}
+
+// saveExchangeRates stores exchange rates and starts showing prices with them
+func (m *Repository) saveExchangeRates(w http.ResponseWriter, r *http.Request, rates []models.ExchangeRate) {
+	err := m.DB.SaveExchangeRates(rates)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save exchange rates")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	m.reloadExchangeRates()
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d exchange rate(s) saved", len(rates)))
+	http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+}
+
+// AdminDeleteExchangeRate deletes an exchange rate, so prices are no longer shown in that currency
+func (m *Repository) AdminDeleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteExchangeRate(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot delete exchange rate")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	m.reloadExchangeRates()
+
+	m.App.Session.Put(r.Context(), "flash", "Exchange rate deleted")
+	http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+}
+
+// reloadExchangeRates refreshes the rates used for display from the database
+func (m *Repository) reloadExchangeRates() {
+	rates, err := m.DB.AllExchangeRates()
+	if err != nil {
+		m.App.ErrorLog.Println("cannot reload exchange rates:", err)
+		return
+	}
+	m.App.ExchangeRates.Set(rates)
+}
+
+// renderExchangeRates renders the exchange rates page
+func (m *Repository) renderExchangeRates(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	rates, err := m.DB.AllExchangeRates()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rates"] = rates
+
+	// The rates are shown converting 100 of the base currency, in its minor units
+	intMap := make(map[string]int)
+	intMap["sample"], _ = pricing.ParseAmount("100")
+
+	render.RenderTemplate(w, r, "admin-exchange-rates.page.tmpl", &models.TemplateData{
+		Data:   data,
+		Form:   form,
+		IntMap: intMap,
+	})
+}
+
+// guestsPerPage is the number of guests on a page of the guest list
+const guestsPerPage = 50
+
+// AdminGuests lists guests in order of name, a page at a time, filtered by the q and tag
+// query parameters
+func (m *Repository) AdminGuests(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := models.GuestFilter{
+		Query: strings.TrimSpace(q.Get("q")),
+		Tag:   q.Get("tag"),
+		After: q.Get("after"),
+		Limit: guestsPerPage,
+	}
+	if filter.Tag != "" && !validGuestTag(filter.Tag) {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	page, err := m.DB.SearchGuests(filter)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	params := url.Values{}
+	if filter.Query != "" {
+		params.Set("q", filter.Query)
+	}
+	if filter.Tag != "" {
+		params.Set("tag", filter.Tag)
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["q"] = filter.Query
+	stringMap["tag"] = filter.Tag
+	if filter.After != "" {
+		stringMap["first"] = "/admin/guests?" + params.Encode()
+	}
+	if page.Next != "" {
+		params.Set("after", page.Next)
+		stringMap["next"] = "/admin/guests?" + params.Encode()
+	}
+
+	data := make(map[string]interface{})
+	data["guests"] = page.Guests
+	data["tags"] = models.GuestTags
+
+	render.RenderTemplate(w, r, "admin-guests.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminShowGuest shows a guest with all their stays
+func (m *Repository) AdminShowGuest(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	guest, err := m.DB.GetGuestByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stays, err := m.DB.SearchReservations(models.ReservationFilter{GuestID: id, Desc: true})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["stays"] = stays.Reservations
+	data["tags"] = models.GuestTags
+
+	render.RenderTemplate(w, r, "admin-guest-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostGuest saves the notes and tags of a guest
+func (m *Repository) AdminPostGuest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	guest, err := m.DB.GetGuestByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	guest.Notes = strings.TrimSpace(r.Form.Get("notes"))
+	guest.Tags = nil
+	for _, tag := range r.Form["tags"] {
+		if !validGuestTag(tag) {
+			helpers.ClientError(w, http.StatusBadRequest)
+			return
+		}
+		guest.Tags = append(guest.Tags, tag)
+	}
+
+	redirect := fmt.Sprintf("/admin/guests/%d", id)
+
+	err = m.DB.UpdateGuest(guest)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save guest")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Guest saved")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// validGuestTag reports whether tag is one of the guest tags
+func validGuestTag(tag string) bool {
+	for _, t := range models.GuestTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminUsers lists the users, with a form to invite a new member of staff
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	m.renderUsers(w, r, forms.New(nil))
+}
+
+// AdminInviteUser adds a member of staff and emails them a link to choose their password
+func (m *Repository) AdminInviteUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user := models.User{
+		FirstName: strings.TrimSpace(r.Form.Get("first-name")),
+		LastName:  strings.TrimSpace(r.Form.Get("last-name")),
+		Email:     strings.TrimSpace(r.Form.Get("email")),
+		Phone:     strings.TrimSpace(r.Form.Get("phone")),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first-name", "last-name", "email", "access-level")
+	form.IsEmail("email")
+
+	user.AccessLevel, err = strconv.Atoi(r.Form.Get("access-level"))
+	if form.Has("access-level") && (err != nil || !rbac.IsStaff(user.AccessLevel)) {
+		form.Errors.Add("access-level", "Choose a staff role")
+	}
+
+	if form.Has("email") {
+		_, err = m.DB.GetUserByEmail(user.Email)
+		if err == nil {
+			form.Errors.Add("email", "There is already an account with this email address")
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		m.renderUsers(w, r, form)
+		return
+	}
+
+	// Nobody knows the password until the user chooses their own
+	password, err := helpers.RandomToken()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	user.Password, err = hashPassword(password)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user.ID, err = m.DB.InsertUser(user)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot invite user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if err = m.sendInvitation(user); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Invitation sent to %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// sendInvitation emails a new member of staff a single use link to choose their password
+func (m *Repository) sendInvitation(user models.User) error {
+	token, err := helpers.RandomToken()
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertUserToken(models.UserToken{
+		UserID:    user.ID,
+		Purpose:   models.TokenSetPassword,
+		TokenHash: helpers.HashToken(token),
+		ExpiresAt: time.Now().Add(invitationTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/set-password?token=%s", m.App.BaseURL, token)
+	m.queueMail(models.MailData{
+		To:      user.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "You are invited to Fort Smythe BnB",
+		Content: fmt.Sprintf(`
+		<strong>Welcome to the team</strong>
+		<hr>
+		Dear %s, <br>
+		An account has been created for you at Fort Smythe BnB, as %s.
+		Choose your password to start: <a href="%s">%s</a> <br>
+		The link works once, within %d days.
+	`, user.FirstName, rbac.RoleName(user.AccessLevel), link, link, int(invitationTokenTTL.Hours()/24)),
+		Sensitive: true,
+	})
+
+	return nil
+}
+
+func (m *Repository) renderUsers(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	users, err := m.DB.AllUsers()
+	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	data["rooms"] = rooms
+	data := make(map[string]interface{})
+	data["users"] = users
+	data["roles"] = rbac.Roles
 
-	for _, x := range rooms {
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
+	render.RenderTemplate(w, r, "admin-users.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
 
-		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
+// AdminShowUser shows the form to edit a user
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-		restrictions, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
-		if err != nil {
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{
+		"first-name":   {user.FirstName},
+		"last-name":    {user.LastName},
+		"email":        {user.Email},
+		"phone":        {user.Phone},
+		"access-level": {strconv.Itoa(user.AccessLevel)},
+	})
+	m.renderUser(w, r, user, form)
+}
+
+func (m *Repository) renderUser(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	throttle, err := m.DB.GetLoginThrottle(models.ThrottleAccount, strings.ToLower(user.Email))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["locked"] = throttle.Locked(time.Now())
+	data["throttle"] = throttle
+	data["user"] = user
+	data["roles"] = rbac.Roles
+	data["self"] = user.ID == m.App.Session.GetInt(r.Context(), "user-id")
+	data["twoFactorRequired"] = m.App.TwoFactorRoles[user.AccessLevel]
+
+	render.RenderTemplate(w, r, "admin-user-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminPostUser saves the details and role of a user. Users cannot change their own role, so
+// there is always an owner. A new email address must be confirmed.
+func (m *Repository) AdminPostUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first-name", "last-name", "email", "access-level")
+	form.IsEmail("email")
+
+	accessLevel, err := strconv.Atoi(r.Form.Get("access-level"))
+	if form.Has("access-level") && (err != nil || rbac.RoleName(accessLevel) == "Unknown") {
+		form.Errors.Add("access-level", "Choose a role")
+	} else if accessLevel != user.AccessLevel && id == m.App.Session.GetInt(r.Context(), "user-id") {
+		form.Errors.Add("access-level", "You cannot change your own role")
+	}
+
+	emailChanged := m.checkEmailChange(form, user)
+
+	if !form.Valid() {
+		m.renderUser(w, r, user, form)
+		return
+	}
+
+	user.FirstName = strings.TrimSpace(r.Form.Get("first-name"))
+	user.LastName = strings.TrimSpace(r.Form.Get("last-name"))
+	user.Email = strings.TrimSpace(r.Form.Get("email"))
+	user.Phone = strings.TrimSpace(r.Form.Get("phone"))
+	user.AccessLevel = accessLevel
+	if emailChanged {
+		user.EmailVerifiedAt = time.Time{}
+	}
+
+	redirect := fmt.Sprintf("/admin/users/%d", id)
+
+	if err = m.DB.UpdateUser(user); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot save user")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if emailChanged {
+		if err = m.sendVerificationEmail(user); err != nil {
 			helpers.ServerError(w, err)
 			return
 		}
+	}
 
-		for _, y := range restrictions {
-			if y.ReservationID > 0 {
-				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = y.ReservationID
-				}
-			} else {
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
-			}
-		}
+	m.App.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
 
-		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+// AdminDeactivateUser stops a user logging in. Their sessions end at their next request.
+func (m *Repository) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, false)
+}
 
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+// AdminReactivateUser lets a deactivated user log in again
+func (m *Repository) AdminReactivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, true)
+}
+
+// AdminLockedAccounts lists the accounts locked out after too many failed logins
+func (m *Repository) AdminLockedAccounts(w http.ResponseWriter, r *http.Request) {
+	throttles, err := m.DB.LockedAccounts()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
 
-	render.RenderTemplate(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
+	data := make(map[string]interface{})
+	data["throttles"] = throttles
+
+	stringMap := make(map[string]string)
+	stringMap["lockout"] = fmt.Sprintf("%d minutes", int(lockout.Account.Lockout.Minutes()))
+	stringMap["maxAttempts"] = strconv.Itoa(lockout.Account.MaxAttempts)
+
+	render.RenderTemplate(w, r, "admin-locked-accounts.page.tmpl", &models.TemplateData{
 		Data:      data,
-		IntMap:    intMap,
+		StringMap: stringMap,
 	})
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+// AdminUnlockAccount lets a user locked out after too many failed logins log in again at once,
+// and goes back to the locked accounts when asked to, otherwise to the user
+func (m *Repository) AdminUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+	id, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	src := exploded[3]
+	redirect := fmt.Sprintf("/admin/users/%d", id)
+	if r.Form.Get("back") == "locked-accounts" {
+		redirect = "/admin/locked-accounts"
+	}
 
-	err = m.DB.UpdateProcessedForReservation(id, 1)
+	user, err := m.DB.GetUserByID(id)
 	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if err = m.DB.ClearLoginFailures(models.ThrottleAccount, strings.ToLower(user.Email)); err != nil {
 		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot unlock account")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	m.App.Session.Put(r.Context(), "flash", "Account unlocked")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
+// AdminResetTwoFactor turns off two-factor authentication for a user who lost their app and
+// recovery codes, so they can log in with their password and set it up again
+func (m *Repository) AdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	redirect := fmt.Sprintf("/admin/users/%d", id)
+
+	if err = m.DB.DisableTwoFactor(id); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot reset two-factor authentication")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
 	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
-// AdminDeleteReservation deletes a reservation
-func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+func (m *Repository) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
 	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+	id, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	src := exploded[3]
+	redirect := fmt.Sprintf("/admin/users/%d", id)
 
-	err = m.DB.DeleteReservation(id)
+	if id == m.App.Session.GetInt(r.Context(), "user-id") {
+		m.App.Session.Put(r.Context(), "error", "You cannot deactivate your own account")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if active {
+		err = m.DB.ReactivateUser(id)
+	} else {
+		err = m.DB.DeactivateUser(id)
+	}
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "error deleting reservation")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot update user")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
 		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	if active {
+		m.App.Session.Put(r.Context(), "flash", "User reactivated")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "User deactivated")
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation deleted")
+// outboxStatuses are the statuses the outbox page filters messages by
+var outboxStatuses = []string{models.OutboxPending, models.OutboxDead, models.OutboxSent, models.OutboxDiscarded}
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+// AdminOutbox lists the latest email messages in the outbox, with the status in the query
+// string, or all of them
+func (m *Repository) AdminOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	messages, err := m.DB.AllOutboxMessages(status)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
+
+	data := make(map[string]interface{})
+	data["messages"] = messages
+	data["statuses"] = outboxStatuses
+
+	stringMap := make(map[string]string)
+	stringMap["status"] = status
+
+	render.RenderTemplate(w, r, "admin-outbox.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
 }
 
-// AdminPostReservationsCalendar handles post of reservation calendar
-func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// AdminShowOutboxMessage shows an email message in the outbox, and why sending it failed
+func (m *Repository) AdminShowOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	year, _ := strconv.Atoi(r.Form.Get("y"))
-	month, _ := strconv.Atoi(r.Form.Get("m"))
+	msg, err := m.DB.GetOutboxMessage(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	rooms, err := m.DB.AllRooms()
+	data := make(map[string]interface{})
+	data["message"] = msg
+
+	render.RenderTemplate(w, r, "admin-outbox-show.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminResendOutboxMessage queues an email message in the outbox to be sent again straight away,
+// such as a dead message once the mail server is fixed
+func (m *Repository) AdminResendOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	form := forms.New(r.PostForm)
-	for _, x := range rooms {
-		currMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
+	msg, err := m.DB.GetOutboxMessage(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-		for date, id := range currMap {
-			if val, ok := currMap[date]; ok {
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, date)) {
-						err = m.DB.DeleteBlockByID(id)
-						if err != nil {
-							m.App.ErrorLog.Println(err)
-						}
-					}
-				}
-			}
-		}
+	redirect := fmt.Sprintf("/admin/outbox/%d", id)
+	if msg.Mail.Sensitive && msg.Status != models.OutboxPending {
+		m.App.Session.Put(r.Context(), "error", "This message had a private link and was cleared, the user can ask for a new one")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
 	}
 
-	for name := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			if err != nil {
-				helpers.ServerError(w, err)
-				return
-			}
+	if err = m.DB.ResendOutboxMessage(id); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot resend message")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
 
-			t, _ := time.Parse("2006-01-2", exploded[3])
-			if err != nil {
-				helpers.ServerError(w, err)
-				return
-			}
+	m.App.Session.Put(r.Context(), "flash", "Message queued to be sent again")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
 
-			err = m.DB.InsertBlockForRoom(roomID, t)
-			if err != nil {
-				m.App.ErrorLog.Println(err)
-				m.App.Session.Put(r.Context(), "error", "cannot insert block restriction into the database")
-				http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-				return
-			}
-		}
+// AdminDiscardOutboxMessage gives up on sending an email message in the outbox
+func (m *Repository) AdminDiscardOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	msg, err := m.DB.GetOutboxMessage(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/outbox/%d", id)
+	if msg.Status != models.OutboxPending && msg.Status != models.OutboxDead {
+		m.App.Session.Put(r.Context(), "error", "Only messages not sent yet can be discarded")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if err = m.DB.DiscardOutboxMessage(id); err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "cannot discard message")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Message discarded")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
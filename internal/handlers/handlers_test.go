@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,6 +16,8 @@ import (
 
 	"github.com/tanishqv/bnb-bookings/internal/driver"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
+	"github.com/tanishqv/bnb-bookings/internal/totp"
 )
 
 var tests = []struct {
@@ -31,14 +35,97 @@ var tests = []struct {
 	{"non existent route", "/non-existent/route", "GET", http.StatusNotFound},
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/logout", "GET", http.StatusOK},
+	{"register", "/user/register", "GET", http.StatusOK},
+	{"verify email", "/user/verify?token=valid-token", "GET", http.StatusOK},
+	{"verify email with invalid token", "/user/verify?token=invalid", "GET", http.StatusOK},
+	{"verify email database failure", "/user/verify?token=failing-token", "GET", http.StatusInternalServerError},
+	{"set password", "/user/set-password?token=valid-token", "GET", http.StatusOK},
+	{"set password with invalid token", "/user/set-password?token=invalid", "GET", http.StatusOK},
+	{"two-factor login without password", "/user/login/two-factor", "GET", http.StatusOK},
+	{"forgot password", "/user/forgot-password", "GET", http.StatusOK},
+	{"reset password", "/user/reset-password?token=valid-token", "GET", http.StatusOK},
+	{"reset password with invalid token", "/user/reset-password?token=invalid", "GET", http.StatusOK},
+	{"ical room feed", "/ical/rooms/1.ics?token=test-token", "GET", http.StatusOK},
+	{"ical room feed with invalid token", "/ical/rooms/1.ics?token=invalid", "GET", http.StatusNotFound},
+	{"ical room feed without token", "/ical/rooms/1.ics", "GET", http.StatusNotFound},
+	{"ical non existent room feed", "/ical/rooms/3.ics?token=test-token", "GET", http.StatusNotFound},
 	{"admin dashboard", "/admin/dashboard", "GET", http.StatusOK},
+	{"admin dashboard for dates", "/admin/dashboard?start=2050-01-01&end=2050-03-31", "GET", http.StatusOK},
+	{"admin dashboard with invalid start", "/admin/dashboard?start=x", "GET", http.StatusBadRequest},
+	{"admin dashboard with invalid end", "/admin/dashboard?end=2050-02-30", "GET", http.StatusBadRequest},
+	{"admin dashboard with end before start", "/admin/dashboard?start=2050-02-01&end=2050-01-01", "GET", http.StatusBadRequest},
+	{"admin dashboard with long range", "/admin/dashboard?start=2050-01-01&end=2060-01-01", "GET", http.StatusBadRequest},
+	{"admin dashboard stays failure", "/admin/dashboard?start=1000-01-01&end=1000-01-31", "GET", http.StatusInternalServerError},
+	{"admin dashboard blocks failure", "/admin/dashboard?start=1001-01-01&end=1001-01-31", "GET", http.StatusInternalServerError},
 	{"admin new reservations", "/admin/reservations-new", "GET", http.StatusOK},
 	{"admin all reservations", "/admin/reservations-all", "GET", http.StatusOK},
+	{"search reservations", "/admin/reservations-all?q=smith&status=active&processed=0&room=1&start=2050-01-01&end=2050-12-31&sort=name&dir=desc&after=2", "GET", http.StatusOK},
+	{"search new reservations", "/admin/reservations-new?q=doe&sort=total", "GET", http.StatusOK},
+	{"search reservations with unknown sort", "/admin/reservations-all?sort=colour", "GET", http.StatusBadRequest},
+	{"search reservations with unknown direction", "/admin/reservations-all?dir=up", "GET", http.StatusBadRequest},
+	{"search reservations with unknown status", "/admin/reservations-all?status=paid", "GET", http.StatusBadRequest},
+	{"search reservations with invalid processed", "/admin/reservations-all?processed=maybe", "GET", http.StatusBadRequest},
+	{"search reservations with invalid date", "/admin/reservations-new?end=2050-02-30", "GET", http.StatusBadRequest},
+	{"search reservations with invalid cursor", "/admin/reservations-all?after=bad", "GET", http.StatusBadRequest},
+	{"search reservations database failure", "/admin/reservations-all?room=1000", "GET", http.StatusInternalServerError},
+	{"admin search", "/admin/search?q=smith", "GET", http.StatusOK},
+	{"admin search without query", "/admin/search", "GET", http.StatusOK},
+	{"admin search database failure", "/admin/search?q=fail", "GET", http.StatusInternalServerError},
+	{"admin search json", "/admin/search-json?q=doe", "GET", http.StatusOK},
+	{"admin search json database failure", "/admin/search-json?q=fail", "GET", http.StatusInternalServerError},
+	{"admin guests", "/admin/guests", "GET", http.StatusOK},
+	{"admin guests search", "/admin/guests?q=smith&tag=vip&after=2", "GET", http.StatusOK},
+	{"admin guests with unknown tag", "/admin/guests?tag=gold", "GET", http.StatusBadRequest},
+	{"admin guests with invalid cursor", "/admin/guests?after=bad", "GET", http.StatusBadRequest},
+	{"admin guests database failure", "/admin/guests?q=fail", "GET", http.StatusInternalServerError},
+	{"admin show guest", "/admin/guests/1", "GET", http.StatusOK},
+	{"admin show missing guest", "/admin/guests/3", "GET", http.StatusInternalServerError},
 	{"admin show reservation from all", "/admin/reservations/all/1/show", "GET", http.StatusOK},
 	{"admin show reservation form new", "/admin/reservations/new/1/show", "GET", http.StatusOK},
 	{"admin show reservation from calendar", "/admin/reservations/cal/1/show", "GET", http.StatusOK},
 	{"admin show reservations calendar", "/admin/reservations-calendar", "GET", http.StatusOK},
 	{"admin show reservations calendar with params", "/admin/reservations-calendar?y=2023&m=3", "GET", http.StatusOK},
+	{"admin external calendars", "/admin/ical-sources", "GET", http.StatusOK},
+	{"admin deposit policies", "/admin/deposit-policies", "GET", http.StatusOK},
+	{"admin balances due", "/admin/balances-due", "GET", http.StatusOK},
+	{"pay balance", "/pay/valid-token", "GET", http.StatusOK},
+	{"pay balance with invalid token", "/pay/invalid-token", "GET", http.StatusOK},
+	{"manage reservation", "/manage/valid-token", "GET", http.StatusOK},
+	{"manage reservation with invalid token", "/manage/invalid-token", "GET", http.StatusOK},
+	{"admin cancellation policies", "/admin/cancellation-policies", "GET", http.StatusOK},
+	{"admin promotions", "/admin/promotions", "GET", http.StatusOK},
+	{"admin invoice", "/admin/reservations/1/invoice", "GET", http.StatusOK},
+	{"admin invoice failure", "/admin/reservations/1000/invoice", "GET", http.StatusInternalServerError},
+	{"admin invoice not issued yet", "/admin/reservations/2/invoice", "GET", http.StatusOK},
+	{"guest invoice", "/manage/valid-token/invoice", "GET", http.StatusOK},
+	{"guest invoice with invalid token", "/manage/invalid-token/invoice", "GET", http.StatusOK},
+	{"admin fees", "/admin/fees", "GET", http.StatusOK},
+	{"admin fee report", "/admin/fees/report", "GET", http.StatusOK},
+	{"admin fee report for year", "/admin/fees/report?y=2050", "GET", http.StatusOK},
+	{"admin fee report with invalid year", "/admin/fees/report?y=x", "GET", http.StatusBadRequest},
+	{"admin fee report database failure", "/admin/fees/report?y=1000", "GET", http.StatusInternalServerError},
+	{"admin exchange rates", "/admin/exchange-rates", "GET", http.StatusOK},
+	{"export reservations", "/admin/reservations/export", "GET", http.StatusOK},
+	{"admin import", "/admin/import", "GET", http.StatusOK},
+	{"admin import result without an import", "/admin/import/result", "GET", http.StatusOK},
+	{"export reservations as xlsx", "/admin/reservations/export?format=xlsx&status=new&start=2050-01-01&end=2050-12-31", "GET", http.StatusOK},
+	{"export reservations with unknown format", "/admin/reservations/export?format=pdf", "GET", http.StatusBadRequest},
+	{"export reservations with unknown status", "/admin/reservations/export?status=paid", "GET", http.StatusBadRequest},
+	{"export reservations with invalid room", "/admin/reservations/export?room=x", "GET", http.StatusBadRequest},
+	{"export reservations with invalid date", "/admin/reservations/export?start=2050-13-01", "GET", http.StatusBadRequest},
+	{"export reservations database failure", "/admin/reservations/export?room=1000", "GET", http.StatusInternalServerError},
+	{"set currency", "/currency?code=EUR", "GET", http.StatusOK},
+	{"admin users", "/admin/users", "GET", http.StatusOK},
+	{"admin show user", "/admin/users/5", "GET", http.StatusOK},
+	{"admin show locked user", "/admin/users/6", "GET", http.StatusOK},
+	{"admin show missing user", "/admin/users/1000", "GET", http.StatusInternalServerError},
+	{"admin locked accounts", "/admin/locked-accounts", "GET", http.StatusOK},
+	{"admin outbox", "/admin/outbox", "GET", http.StatusOK},
+	{"admin outbox dead messages", "/admin/outbox?status=dead", "GET", http.StatusOK},
+	{"admin outbox database failure", "/admin/outbox?status=fail", "GET", http.StatusInternalServerError},
+	{"admin show outbox message", "/admin/outbox/2", "GET", http.StatusOK},
+	{"admin show sensitive outbox message", "/admin/outbox/3", "GET", http.StatusOK},
+	{"admin show missing outbox message", "/admin/outbox/1000", "GET", http.StatusInternalServerError},
 }
 
 // TestHandlers tests all GET routes
@@ -169,7 +256,7 @@ var postReservationTests = []struct {
 			"phone-number": {"123456789"},
 		},
 		expectedStatusCode: http.StatusSeeOther,
-		expectedURL:        "/reservation-summary",
+		expectedURL:        "/payment",
 	},
 	{
 		tcName:      "reservation not in session",
@@ -262,6 +349,125 @@ var postReservationTests = []struct {
 		expectedStatusCode: http.StatusTemporaryRedirect,
 		expectedURL:        "/",
 	},
+	{
+		tcName: "promo code used up while booking",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"promo-code":   {"lastone"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/make-reservation",
+	},
+	{
+		tcName: "valid promo code",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"promo-code":   {"winter10"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/payment",
+	},
+	{
+		tcName: "unknown promo code",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"promo-code":   {"NOPE"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "unknown promo code",
+	},
+	{
+		tcName: "expired promo code",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"promo-code":   {"EXPIRED"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "this promo code has expired",
+	},
+	{
+		tcName: "fully redeemed promo code",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"promo-code":   {"USEDUP"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "this promo code has been fully redeemed",
+	},
+	{
+		tcName: "invalid number of guests",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-02"},
+			"first-name":   {"John"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"guests":       {"0"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter between 1 and 20 guests",
+	},
+	{
+		tcName: "fees charged per guest",
+		reservation: models.Reservation{
+			RoomID: 1,
+		},
+		postedData: url.Values{
+			"start-date":   {"2050-01-01"},
+			"end-date":     {"2050-01-03"},
+			"first-name":   {"J"},
+			"last-name":    {"Smith"},
+			"email":        {"john@smith.com"},
+			"phone-number": {"123456789"},
+			"guests":       {"3"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "City tax (3 guest(s) x 2 night(s) x 2.50)",
+	},
 }
 
 // TestRepository_PostReservation tests the PostReservation handler
@@ -723,6 +929,34 @@ var postShowLoginTests = []struct {
 		"",
 		"/",
 	},
+	{
+		"guest credentials",
+		"john@smith.com",
+		http.StatusSeeOther,
+		"",
+		"/account/stays",
+	},
+	{
+		"two-factor credentials",
+		"manager@fsbnb.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login/two-factor",
+	},
+	{
+		"two-factor required but not set up",
+		"desk@fsbnb.com",
+		http.StatusSeeOther,
+		"",
+		"/account/two-factor",
+	},
+	{
+		"unverified guest",
+		"new@guest.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login",
+	},
 	{
 		"invalid credentials",
 		"someone@somewhere.co",
@@ -782,6 +1016,94 @@ func TestRepository_PostShowLogin(t *testing.T) {
 	}
 }
 
+// postShowLoginThrottleTests is the test data for the login throttling of the PostShowLogin handler
+var postShowLoginThrottleTests = []struct {
+	tcName             string
+	email              string
+	passwd             string
+	remoteAddr         string
+	expectedStatusCode int
+	expectedURL        string
+	expectedMessage    string
+}{
+	{
+		tcName:             "account blocked",
+		email:              "blocked@fsbnb.com",
+		passwd:             "admin",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Too many failed logins",
+	},
+	{
+		tcName:             "client IP address blocked",
+		email:              "admin@fsbnb.com",
+		passwd:             "admin",
+		remoteAddr:         "192.0.2.66:1234",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Too many failed logins",
+	},
+	{
+		tcName:             "wrong password locking the account out",
+		email:              "admin@fsbnb.com",
+		passwd:             "wrong-password",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Invalid login credentials",
+	},
+	{
+		tcName:             "wrong password of an unknown email address",
+		email:              "nobody@fsbnb.com",
+		passwd:             "wrong-password",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Invalid login credentials",
+	},
+	{
+		tcName:             "database failure",
+		email:              "fail@fsbnb.com",
+		passwd:             "admin",
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestRepository_PostShowLoginThrottle tests that PostShowLogin throttles failed logins
+func TestRepository_PostShowLoginThrottle(t *testing.T) {
+	for _, e := range postShowLoginThrottleTests {
+		postedData := url.Values{"email": {e.email}, "passwd": {e.passwd}}
+		req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		if e.remoteAddr != "" {
+			req.RemoteAddr = e.remoteAddr
+		}
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		Repo.PostShowLogin(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedMessage != "" {
+			message := session.PopString(ctx, "error")
+			if !strings.Contains(message, e.expectedMessage) {
+				t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+			}
+		}
+	}
+}
+
 // adminPostShowReservationTests is the test data for the AdminPostShowReservation handler
 var adminPostShowReservationTests = []struct {
 	tcName             string
@@ -917,6 +1239,7 @@ var adminDeleteReservationTests = []struct {
 	roomID             int
 	queryParams        string
 	expectedStatusCode int
+	expectedLocation   string
 }{
 	{
 		tcName:             "delete reservation back to new",
@@ -937,6 +1260,20 @@ var adminDeleteReservationTests = []struct {
 		queryParams:        "y=2023&m=02",
 		expectedStatusCode: http.StatusSeeOther,
 	},
+	{
+		tcName:             "delete reservation that is not cancelled",
+		from:               "all",
+		roomID:             2,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations/all/2/show",
+	},
+	{
+		tcName:             "delete reservation that has been paid for",
+		from:               "all",
+		roomID:             5,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations/all/5/show",
+	},
 	{
 		tcName:             "delete reservation error from new",
 		from:               "new",
@@ -966,6 +1303,12 @@ func TestRepository_AdminDeleteReservation(t *testing.T) {
 		if respRecorder.Code != e.expectedStatusCode {
 			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
 		}
+
+		if e.expectedLocation != "" {
+			if location := respRecorder.Header().Get("Location"); location != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.tcName, e.expectedLocation, location)
+			}
+		}
 	}
 }
 
@@ -1073,10 +1416,2694 @@ func TestRepository_AdminPostReservationsCalendar(t *testing.T) {
 	}
 }
 
-func getCtx(req *http.Request) context.Context {
-	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
-	if err != nil {
-		app.ErrorLog.Println(err)
+// adminPostICalSourceTests is the test data for the AdminPostICalSource handler
+var adminPostICalSourceTests = []struct {
+	tcName             string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName: "valid source with failing first sync",
+		postedData: url.Values{
+			"room-id": {"1"},
+			"name":    {"Partner site"},
+			"url":     {"/non-existent/calendar.ics"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/ical-sources",
+	},
+	{
+		tcName: "missing url",
+		postedData: url.Values{
+			"room-id": {"1"},
+			"name":    {"Partner site"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/admin/ical-sources"`,
+	},
+	{
+		tcName: "invalid room",
+		postedData: url.Values{
+			"room-id": {"invalid"},
+			"name":    {"Partner site"},
+			"url":     {"https://example.com/calendar.ics"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/admin/ical-sources"`,
+	},
+	{
+		tcName: "database insert failure",
+		postedData: url.Values{
+			"room-id": {"1000"},
+			"name":    {"Partner site"},
+			"url":     {"https://example.com/calendar.ics"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/ical-sources",
+	},
+}
+
+// TestRepository_AdminPostICalSource tests the AdminPostICalSource handler
+func TestRepository_AdminPostICalSource(t *testing.T) {
+	for _, e := range adminPostICalSourceTests {
+		req, _ := http.NewRequest("POST", "/admin/ical-sources", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		handler := http.HandlerFunc(Repo.AdminPostICalSource)
+		respRecorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// adminICalSourceActionTests is the test data for the AdminSyncICalSource and AdminDeleteICalSource handlers
+var adminICalSourceActionTests = []struct {
+	tcName  string
+	url     string
+	handler func(*Repository, http.ResponseWriter, *http.Request)
+}{
+	{"sync source", "/admin/ical-sources/1/sync", (*Repository).AdminSyncICalSource},
+	{"sync non existent source", "/admin/ical-sources/1000/sync", (*Repository).AdminSyncICalSource},
+	{"delete source", "/admin/ical-sources/1/delete", (*Repository).AdminDeleteICalSource},
+	{"delete source failure", "/admin/ical-sources/1000/delete", (*Repository).AdminDeleteICalSource},
+}
+
+// TestRepository_AdminICalSourceActions tests the AdminSyncICalSource and AdminDeleteICalSource handlers
+func TestRepository_AdminICalSourceActions(t *testing.T) {
+	for _, e := range adminICalSourceActionTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, http.StatusSeeOther, respRecorder.Code)
+		}
+
+		actualLoc, _ := respRecorder.Result().Location()
+		if actualLoc.String() != "/admin/ical-sources" {
+			t.Errorf("failed %s: expected location /admin/ical-sources, but got location %s", e.tcName, actualLoc.String())
+		}
+	}
+}
+
+// paymentTests is the test data for the PostPayment handler
+var paymentTests = []struct {
+	tcName             string
+	reservation        models.Reservation
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName:      "valid card",
+		reservation: models.Reservation{ID: 1, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242 4242 4242 4242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/reservation-summary",
+	},
+	{
+		tcName:      "balance payment",
+		reservation: models.Reservation{ID: 1, RoomID: 1, TotalAmount: 50000, PaidAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242424242424242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/reservation-summary",
+	},
+	{
+		tcName:      "declined card",
+		reservation: models.Reservation{ID: 1, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {payments.DeclinedCardNumber},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "card declined",
+	},
+	{
+		tcName:      "missing card details",
+		reservation: models.Reservation{ID: 1, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-exp-month": {"xx"},
+			"card-exp-year":  {"2099"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/payment"`,
+	},
+	{
+		tcName:      "hold expired before payment",
+		reservation: models.Reservation{ID: 3, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242424242424242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/",
+	},
+	{
+		tcName:      "hold expired while paying",
+		reservation: models.Reservation{ID: 2, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242424242424242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/",
+	},
+	{
+		tcName:      "earlier authorization cannot be voided",
+		reservation: models.Reservation{ID: 4, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242424242424242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "still being processed",
+	},
+	{
+		tcName:      "database insert failure for payment",
+		reservation: models.Reservation{ID: 1000, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {"4242424242424242"},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusTemporaryRedirect,
+		expectedURL:        "/",
+	},
+	{
+		tcName:      "paid in another tab",
+		reservation: models.Reservation{ID: 5, RoomID: 1, TotalAmount: 10000},
+		postedData: url.Values{
+			"card-name":      {"John Smith"},
+			"card-number":    {payments.DeclinedCardNumber},
+			"card-exp-month": {"12"},
+			"card-exp-year":  {"2099"},
+			"card-cvc":       {"123"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/reservation-summary",
+	},
+	{
+		tcName:             "already paid",
+		reservation:        models.Reservation{ID: 1, RoomID: 1, TotalAmount: 10000, PaidAmount: 10000},
+		postedData:         url.Values{},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/reservation-summary",
+	},
+	{
+		tcName:             "reservation not in session",
+		reservation:        models.Reservation{},
+		postedData:         url.Values{},
+		expectedStatusCode: http.StatusTemporaryRedirect,
+		expectedURL:        "/",
+	},
+}
+
+// TestRepository_PostPayment tests the PostPayment handler
+func TestRepository_PostPayment(t *testing.T) {
+	for _, e := range paymentTests {
+		req, _ := http.NewRequest("POST", "/payment", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		if e.reservation.ID > 0 {
+			e.reservation.StartDate = time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+			e.reservation.EndDate = time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC)
+			session.Put(ctx, "reservation", e.reservation)
+		}
+
+		handler := http.HandlerFunc(Repo.PostPayment)
+		respRecorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestRepository_Payment tests the Payment handler
+func TestRepository_Payment(t *testing.T) {
+	reservation := models.Reservation{
+		ID:          1,
+		RoomID:      1,
+		TotalAmount: 10000,
+		Room: models.Room{
+			ID:       1,
+			RoomName: "General's Quarters",
+			Price:    10000,
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "/payment", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", reservation)
+
+	respRecorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.Payment)
+	handler.ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Errorf("Payment handler returned wrong response code: got %d, wanted %d", respRecorder.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(respRecorder.Body.String(), "Pay $100.00") {
+		t.Error("expected payment page to show the amount due")
+	}
+
+	// Reservation not in session
+	req, _ = http.NewRequest("GET", "/payment", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Payment handler returned wrong response code: got %d, wanted %d", respRecorder.Code, http.StatusTemporaryRedirect)
+	}
+}
+
+// TestRepository_WithoutPaymentGateway tests that reservations are confirmed straight away
+// when no payment gateway is configured, and that the payment pages are not offered
+func TestRepository_WithoutPaymentGateway(t *testing.T) {
+	gateway := app.Payments
+	app.Payments = nil
+	defer func() { app.Payments = gateway }()
+
+	postedData := url.Values{
+		"start-date":   {"2050-01-01"},
+		"end-date":     {"2050-01-02"},
+		"first-name":   {"John"},
+		"last-name":    {"Smith"},
+		"email":        {"john@smith.com"},
+		"phone-number": {"123456789"},
+	}
+	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	session.Put(ctx, "reservation", models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+	})
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostReservation).ServeHTTP(respRecorder, req)
+
+	if loc := respRecorder.Header().Get("Location"); respRecorder.Code != http.StatusSeeOther || loc != "/reservation-summary" {
+		t.Errorf("expected the reservation to be confirmed, got %d to %s", respRecorder.Code, loc)
+	}
+	res, _ := session.Get(ctx, "reservation").(models.Reservation)
+	if !res.Confirmed() || len(res.Schedule) != 0 {
+		t.Errorf("expected a confirmed reservation with no payment schedule, got %+v", res)
+	}
+
+	// The payment page is skipped
+	req, _ = http.NewRequest("GET", "/payment", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", models.Reservation{ID: 1, RoomID: 1, TotalAmount: 10000})
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.Payment).ServeHTTP(respRecorder, req)
+
+	if loc := respRecorder.Header().Get("Location"); respRecorder.Code != http.StatusSeeOther || loc != "/reservation-summary" {
+		t.Errorf("expected the payment page to be skipped, got %d to %s", respRecorder.Code, loc)
+	}
+
+	// There is no gateway to send webhooks
+	req, _ = http.NewRequest("POST", "/payments/webhook", strings.NewReader(`{"type":"payment.captured","reference":"txn_1"}`))
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.PaymentWebhook).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusNotFound {
+		t.Errorf("expected the webhook to be not found, got %d", respRecorder.Code)
+	}
+}
+
+// paymentWebhookTests is the test data for the PaymentWebhook handler
+var paymentWebhookTests = []struct {
+	tcName             string
+	payload            string
+	signature          string
+	expectedStatusCode int
+}{
+	{"valid captured event", `{"type":"payment.captured","reference":"txn_authorized","amount":10000}`, "", http.StatusOK},
+	{"replayed captured event", `{"type":"payment.captured","reference":"txn_1","amount":10000}`, "", http.StatusOK},
+	{"valid refund event", `{"type":"payment.refunded","reference":"txn_1","amount":5000}`, "", http.StatusOK},
+	{"valid failed event", `{"type":"payment.failed","reference":"txn_authorized"}`, "", http.StatusOK},
+	{"failed event after capture", `{"type":"payment.failed","reference":"txn_1"}`, "", http.StatusConflict},
+	{"ignored event", `{"type":"payment.created","reference":"txn_1"}`, "", http.StatusOK},
+	{"unknown reference", `{"type":"payment.captured","reference":"unknown"}`, "", http.StatusNotFound},
+	{"invalid signature", `{"type":"payment.captured","reference":"txn_1"}`, "bad", http.StatusBadRequest},
+}
+
+// TestRepository_PaymentWebhook tests the PaymentWebhook handler
+func TestRepository_PaymentWebhook(t *testing.T) {
+	gateway := app.Payments.(*payments.FakeGateway)
+
+	for _, e := range paymentWebhookTests {
+		req, _ := http.NewRequest("POST", "/payments/webhook", strings.NewReader(e.payload))
+
+		signature := e.signature
+		if signature == "" {
+			signature = gateway.Sign([]byte(e.payload))
+		}
+		req.Header.Set("X-Signature", signature)
+
+		handler := http.HandlerFunc(Repo.PaymentWebhook)
+		respRecorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+	}
+}
+
+// adminPaymentActionTests is the test data for the AdminCapturePayment and AdminRefundPayment handlers
+var adminPaymentActionTests = []struct {
+	tcName             string
+	url                string
+	postedData         url.Values
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	expectedStatusCode int
+	expectedURL        string
+}{
+	{
+		"capture payment that is not authorized", "/admin/payments/1/capture", url.Values{"src": {"all"}},
+		(*Repository).AdminCapturePayment, http.StatusSeeOther, "/admin/reservations/all/1/show",
+	},
+	{
+		"capture non existent payment", "/admin/payments/1000/capture", url.Values{"src": {"all"}},
+		(*Repository).AdminCapturePayment, http.StatusInternalServerError, "",
+	},
+	{
+		"refund invalid amount", "/admin/payments/1/refund", url.Values{"src": {"new"}, "amount": {"500.00"}},
+		(*Repository).AdminRefundPayment, http.StatusSeeOther, "/admin/reservations/new/1/show",
+	},
+	{
+		"refund rejected by gateway", "/admin/payments/1/refund", url.Values{"src": {"new"}, "amount": {"50.00"}},
+		(*Repository).AdminRefundPayment, http.StatusSeeOther, "/admin/reservations/new/1/show",
+	},
+	{
+		"refund non existent payment", "/admin/payments/1000/refund", url.Values{"src": {"new"}, "amount": {"50.00"}},
+		(*Repository).AdminRefundPayment, http.StatusInternalServerError, "",
+	},
+}
+
+// TestRepository_AdminPaymentActions tests the AdminCapturePayment and AdminRefundPayment handlers
+func TestRepository_AdminPaymentActions(t *testing.T) {
+	for _, e := range adminPaymentActionTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+	}
+}
+
+// adminPostDepositPolicyTests is the test data for the AdminPostDepositPolicy handler
+var adminPostDepositPolicyTests = []struct {
+	tcName             string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName:             "percentage deposit",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {"percent"}, "deposit-value": {"25"}, "balance-due-days": {"14"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/deposit-policies",
+	},
+	{
+		tcName:             "fixed deposit",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {"fixed"}, "deposit-value": {"50.00"}, "balance-due-days": {"30"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/deposit-policies",
+	},
+	{
+		tcName:             "no deposit",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {""}, "balance-due-days": {"0"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/deposit-policies",
+	},
+	{
+		tcName:             "percentage out of range",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {"percent"}, "deposit-value": {"150"}, "balance-due-days": {"14"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a percentage between 0 and 100",
+	},
+	{
+		tcName:             "invalid deposit type",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {"weekly"}, "balance-due-days": {"14"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid deposit type",
+	},
+	{
+		tcName:             "missing balance due days",
+		postedData:         url.Values{"room-id": {"1"}, "deposit-type": {""}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+	{
+		tcName:             "database update failure",
+		postedData:         url.Values{"room-id": {"1000"}, "deposit-type": {""}, "balance-due-days": {"14"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/deposit-policies",
+	},
+}
+
+// TestRepository_AdminPostDepositPolicy tests the AdminPostDepositPolicy handler
+func TestRepository_AdminPostDepositPolicy(t *testing.T) {
+	for _, e := range adminPostDepositPolicyTests {
+		req, _ := http.NewRequest("POST", "/admin/deposit-policies", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		handler := http.HandlerFunc(Repo.AdminPostDepositPolicy)
+		respRecorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestRepository_PayReservation tests the PayReservation handler
+func TestRepository_PayReservation(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/pay/valid-token", nil)
+	req.RequestURI = "/pay/valid-token"
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.PayReservation)
+	handler.ServeHTTP(respRecorder, req)
+
+	actualLoc, _ := respRecorder.Result().Location()
+	if respRecorder.Code != http.StatusSeeOther || actualLoc.String() != "/payment" {
+		t.Errorf("expected redirect to /payment, got %d %s", respRecorder.Code, actualLoc)
+	}
+
+	res, ok := session.Get(ctx, "reservation").(models.Reservation)
+	if !ok || res.NextPaymentAmount(time.Now()) != 40000 {
+		t.Errorf("expected reservation with balance of 40000 in session, got %+v", res)
+	}
+
+	req, _ = http.NewRequest("GET", "/pay/invalid-token", nil)
+	req.RequestURI = "/pay/invalid-token"
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(respRecorder, req)
+
+	actualLoc, _ = respRecorder.Result().Location()
+	if actualLoc.String() != "/" {
+		t.Errorf("expected redirect to / for invalid token, got %s", actualLoc)
+	}
+}
+
+// cancellationActionTests is the test data for the cancellation handlers
+var cancellationActionTests = []struct {
+	tcName             string
+	method             string
+	url                string
+	postedData         url.Values
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName:             "guest cancels reservation",
+		method:             "POST",
+		url:                "/manage/valid-token/cancel",
+		handler:            (*Repository).PostCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/manage/valid-token",
+	},
+	{
+		tcName:             "guest cancels with invalid token",
+		method:             "POST",
+		url:                "/manage/invalid-token/cancel",
+		handler:            (*Repository).PostCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/",
+	},
+	{
+		tcName:             "admin cancels reservation",
+		method:             "POST",
+		url:                "/admin/cancel-reservation/all/1/cancel",
+		handler:            (*Repository).AdminCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/reservations/all/1/show",
+	},
+	{
+		tcName:             "admin cancels reservation from calendar",
+		method:             "POST",
+		url:                "/admin/cancel-reservation/cal/1/cancel",
+		postedData:         url.Values{"y": {"2050"}, "m": {"01"}},
+		handler:            (*Repository).AdminCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/reservations/cal/1/show?y=2050&m=01",
+	},
+	{
+		tcName:             "admin cancel failure",
+		method:             "POST",
+		url:                "/admin/cancel-reservation/all/1000/cancel",
+		handler:            (*Repository).AdminCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/reservations/all/1000/show",
+	},
+	{
+		tcName:             "admin cancels reservation cancelled meanwhile",
+		method:             "POST",
+		url:                "/admin/cancel-reservation/all/2/cancel",
+		handler:            (*Repository).AdminCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/reservations/all/2/show",
+	},
+	{
+		tcName:             "admin cancel refund failure",
+		method:             "POST",
+		url:                "/admin/cancel-reservation/all/5/cancel",
+		handler:            (*Repository).AdminCancelReservation,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/reservations/all/5/show",
+	},
+	{
+		tcName:             "add cancellation policy",
+		method:             "POST",
+		url:                "/admin/cancellation-policies",
+		postedData:         url.Values{"name": {"Moderate"}, "rules": {"30:100, 7:50"}},
+		handler:            (*Repository).AdminPostCancellationPolicy,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/cancellation-policies",
+	},
+	{
+		tcName:             "add cancellation policy with invalid rules",
+		method:             "POST",
+		url:                "/admin/cancellation-policies",
+		postedData:         url.Values{"name": {"Moderate"}, "rules": {"30:150"}},
+		handler:            (*Repository).AdminPostCancellationPolicy,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "invalid refund percentage",
+	},
+	{
+		tcName:             "add cancellation policy database failure",
+		method:             "POST",
+		url:                "/admin/cancellation-policies",
+		postedData:         url.Values{"name": {"fail"}, "rules": {"7:50"}},
+		handler:            (*Repository).AdminPostCancellationPolicy,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/cancellation-policies",
+	},
+	{
+		tcName:             "delete cancellation policy",
+		method:             "POST",
+		url:                "/admin/cancellation-policies/1/delete",
+		handler:            (*Repository).AdminDeleteCancellationPolicy,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/cancellation-policies",
+	},
+	{
+		tcName:             "attach cancellation policy to room",
+		method:             "POST",
+		url:                "/admin/cancellation-policies/rooms",
+		postedData:         url.Values{"room-id": {"1"}, "policy-id": {"1"}},
+		handler:            (*Repository).AdminPostRoomCancellationPolicy,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/cancellation-policies",
+	},
+	{
+		tcName:             "attach cancellation policy to invalid room",
+		method:             "POST",
+		url:                "/admin/cancellation-policies/rooms",
+		postedData:         url.Values{"room-id": {"x"}, "policy-id": {"1"}},
+		handler:            (*Repository).AdminPostRoomCancellationPolicy,
+		expectedStatusCode: http.StatusBadRequest,
+	},
+}
+
+// TestRepository_CancellationActions tests the cancellation handlers
+func TestRepository_CancellationActions(t *testing.T) {
+	for _, e := range cancellationActionTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// promotionActionTests is the test data for the promo code admin handlers
+var promotionActionTests = []struct {
+	tcName             string
+	method             string
+	url                string
+	postedData         url.Values
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName: "add percentage promo code",
+		method: "POST",
+		url:    "/admin/promotions",
+		postedData: url.Values{
+			"code":           {"summer"},
+			"discount-type":  {"percent"},
+			"discount-value": {"15"},
+			"valid-from":     {"2050-06-01"},
+			"valid-until":    {"2050-08-31"},
+			"min-nights":     {"2"},
+			"room-ids":       {"1", "2"},
+		},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "add fixed promo code",
+		method:             "POST",
+		url:                "/admin/promotions",
+		postedData:         url.Values{"code": {"TENOFF"}, "discount-type": {"fixed"}, "discount-value": {"10.00"}},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "add promo code with invalid percentage",
+		method:             "POST",
+		url:                "/admin/promotions",
+		postedData:         url.Values{"code": {"BIG"}, "discount-type": {"percent"}, "discount-value": {"150"}},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a percentage between 1 and 100",
+	},
+	{
+		tcName: "add promo code ending before it starts",
+		method: "POST",
+		url:    "/admin/promotions",
+		postedData: url.Values{
+			"code":           {"BACKWARDS"},
+			"discount-type":  {"percent"},
+			"discount-value": {"10"},
+			"valid-from":     {"2050-06-01"},
+			"valid-until":    {"2050-05-01"},
+		},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Must not be before the start date",
+	},
+	{
+		tcName:             "add promo code with invalid usage cap",
+		method:             "POST",
+		url:                "/admin/promotions",
+		postedData:         url.Values{"code": {"CAP"}, "discount-type": {"percent"}, "discount-value": {"10"}, "max-uses": {"x"}},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a whole number",
+	},
+	{
+		tcName:             "add promo code database failure",
+		method:             "POST",
+		url:                "/admin/promotions",
+		postedData:         url.Values{"code": {"fail"}, "discount-type": {"percent"}, "discount-value": {"10"}},
+		handler:            (*Repository).AdminPostPromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "deactivate promo code",
+		method:             "POST",
+		url:                "/admin/promotions/1/toggle",
+		postedData:         url.Values{"active": {"0"}},
+		handler:            (*Repository).AdminTogglePromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "toggle promo code database failure",
+		method:             "POST",
+		url:                "/admin/promotions/1000/toggle",
+		postedData:         url.Values{"active": {"1"}},
+		handler:            (*Repository).AdminTogglePromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "delete promo code",
+		method:             "POST",
+		url:                "/admin/promotions/1/delete",
+		handler:            (*Repository).AdminDeletePromotion,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/promotions",
+	},
+	{
+		tcName:             "delete promo code with invalid id",
+		method:             "POST",
+		url:                "/admin/promotions/x/delete",
+		handler:            (*Repository).AdminDeletePromotion,
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestRepository_PromotionActions tests the promo code admin handlers
+func TestRepository_PromotionActions(t *testing.T) {
+	for _, e := range promotionActionTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestRepository_GuestInvoice tests that the guest invoice is sent as a PDF download
+func TestRepository_GuestInvoice(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/manage/valid-token/invoice", nil)
+	req.RequestURI = "/manage/valid-token/invoice"
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.GuestInvoice)
+	handler.ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Errorf("GuestInvoice returned wrong response code: got %d, wanted %d", respRecorder.Code, http.StatusOK)
+	}
+
+	if ct := respRecorder.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("expected content type application/pdf, got %s", ct)
+	}
+
+	if cd := respRecorder.Header().Get("Content-Disposition"); !strings.Contains(cd, "INV-000042.pdf") {
+		t.Errorf("expected invoice file name in %s", cd)
+	}
+
+	if !strings.HasPrefix(respRecorder.Body.String(), "%PDF-") {
+		t.Error("expected a PDF document")
+	}
+}
+
+// feeActionTests is the test data for the tax and fee admin handlers
+var feeActionTests = []struct {
+	tcName             string
+	method             string
+	url                string
+	postedData         url.Values
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName:             "add per guest night tax",
+		method:             "POST",
+		url:                "/admin/fees",
+		postedData:         url.Values{"name": {"City tax"}, "kind": {"per_guest_night"}, "amount": {"2.50"}, "is-tax": {"1"}},
+		handler:            (*Repository).AdminPostFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "add percentage tax",
+		method:             "POST",
+		url:                "/admin/fees",
+		postedData:         url.Values{"name": {"VAT"}, "kind": {"percent"}, "amount": {"7.5"}, "is-tax": {"1"}},
+		handler:            (*Repository).AdminPostFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "add fee with invalid type",
+		method:             "POST",
+		url:                "/admin/fees",
+		postedData:         url.Values{"name": {"Cleaning"}, "kind": {"per_room"}, "amount": {"50"}},
+		handler:            (*Repository).AdminPostFee,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid fee type",
+	},
+	{
+		tcName:             "add fee with invalid amount",
+		method:             "POST",
+		url:                "/admin/fees",
+		postedData:         url.Values{"name": {"Cleaning"}, "kind": {"per_stay"}, "amount": {"fifty"}},
+		handler:            (*Repository).AdminPostFee,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter an amount such as 2.50",
+	},
+	{
+		tcName:             "add fee database failure",
+		method:             "POST",
+		url:                "/admin/fees",
+		postedData:         url.Values{"name": {"fail"}, "kind": {"per_stay"}, "amount": {"50"}},
+		handler:            (*Repository).AdminPostFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "activate fee",
+		method:             "POST",
+		url:                "/admin/fees/1/toggle",
+		postedData:         url.Values{"active": {"1"}},
+		handler:            (*Repository).AdminToggleFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "toggle fee database failure",
+		method:             "POST",
+		url:                "/admin/fees/1000/toggle",
+		postedData:         url.Values{"active": {"0"}},
+		handler:            (*Repository).AdminToggleFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "delete fee",
+		method:             "POST",
+		url:                "/admin/fees/1/delete",
+		handler:            (*Repository).AdminDeleteFee,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/fees",
+	},
+	{
+		tcName:             "monthly fee report",
+		method:             "GET",
+		url:                "/admin/fees/report?y=2050",
+		handler:            (*Repository).AdminFeeReport,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "March 2050",
+	},
+}
+
+// TestRepository_FeeActions tests the tax and fee admin handlers
+func TestRepository_FeeActions(t *testing.T) {
+	for _, e := range feeActionTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestRepository_AdminDashboard tests the reports shown on the admin dashboard
+func TestRepository_AdminDashboard(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/dashboard?start=2050-01-01&end=2050-01-10", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminDashboard).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+
+	// Two of nine available nights sold for 200.00
+	html := respRecorder.Body.String()
+	for _, e := range []string{"22.2%", "2 / 9", "<svg", "Occupancy by month", "Major&#39;s Quarters", "Jan 2050", "100.00"} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected dashboard to contain %s", e)
+		}
+	}
+}
+
+// TestRepository_AdminExportReservations tests the contents of a reservation export
+func TestRepository_AdminExportReservations(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations/export", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminExportReservations).ServeHTTP(respRecorder, req)
+
+	if got := respRecorder.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("unexpected content type %s", got)
+	}
+	if got := respRecorder.Header().Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="reservations-`) {
+		t.Errorf("unexpected content disposition %s", got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(respRecorder.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %d lines", len(lines))
+	}
+	if !strings.HasPrefix(lines[1], "1,John,Smith,john@smith.com,,General's Quarters,new,2050-01-01,2050-01-03,2,") {
+		t.Errorf("unexpected row %s", lines[1])
+	}
+	if !strings.Contains(lines[2], ",cancelled,") {
+		t.Errorf("expected the second reservation to be cancelled: %s", lines[2])
+	}
+
+	// Only the cancelled reservation, as a workbook
+	req, _ = http.NewRequest("GET", "/admin/reservations/export?status=cancelled&format=xlsx", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminExportReservations).ServeHTTP(respRecorder, req)
+
+	if got := respRecorder.Header().Get("Content-Type"); got != "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
+		t.Errorf("unexpected content type %s", got)
+	}
+	if !strings.HasPrefix(respRecorder.Body.String(), "PK") {
+		t.Error("expected an xlsx file")
+	}
+}
+
+// TestRepository_AdminAllReservations tests searching, sorting and paging reservations
+func TestRepository_AdminAllReservations(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations-all?q=smith&sort=name&dir=desc", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminAllReservations).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+
+	html := respRecorder.Body.String()
+	for _, e := range []string{
+		"/admin/reservations/all/1/show",
+		`href="/admin/reservations-all?dir=asc&amp;q=smith&amp;sort=name"`,
+		`href="/admin/reservations-all?dir=asc&amp;q=smith&amp;sort=total"`,
+		`name="q" value="smith"`,
+	} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected reservations page to contain %s", e)
+		}
+	}
+	if strings.Contains(html, "/admin/reservations/all/2/show") {
+		t.Error("expected only reservations matching the search")
+	}
+	if strings.Contains(html, "First page") {
+		t.Error("did not expect a link to the first page")
+	}
+
+	// The second page links back to the first
+	req, _ = http.NewRequest("GET", "/admin/reservations-all?after=2", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminAllReservations).ServeHTTP(respRecorder, req)
+
+	html = respRecorder.Body.String()
+	if !strings.Contains(html, `href="/admin/reservations-all">&laquo; First page`) {
+		t.Error("expected a link to the first page")
+	}
+	if strings.Contains(html, "/admin/reservations/all/1/show") {
+		t.Error("expected the first page to be skipped")
+	}
+}
+
+// TestRepository_AdminSearch tests the grouped results of a global admin search
+func TestRepository_AdminSearch(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/search?q=SMITH", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminSearch).ServeHTTP(respRecorder, req)
+
+	html := respRecorder.Body.String()
+	for _, e := range []string{
+		"<h5 class=\"mt-4\">Reservations</h5>",
+		"/admin/reservations/all/1/show",
+		"#1 Smith, John",
+		"<h5 class=\"mt-4\">Guests</h5>",
+		"/admin/guests/1",
+		"john@smith.com, 1 reservation(s)",
+	} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected search results to contain %s", e)
+		}
+	}
+	if strings.Contains(html, "Rooms</h5>") || strings.Contains(html, "Doe") {
+		t.Error("expected only matching results")
+	}
+
+	// Too short to search
+	req, _ = http.NewRequest("GET", "/admin/search?q=s", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminSearch).ServeHTTP(respRecorder, req)
+
+	if !strings.Contains(respRecorder.Body.String(), "Enter at least 2 characters") {
+		t.Error("expected a hint for a short query")
+	}
+}
+
+// TestRepository_AdminSearchJSON tests the search suggestions
+func TestRepository_AdminSearchJSON(t *testing.T) {
+	tests := []struct {
+		query          string
+		expectedGroups []string
+		expectedURL    string
+	}{
+		{"major", []string{"Rooms"}, "/admin/reservations-all?room=1"},
+		{"jane", []string{"Reservations", "Guests"}, "/admin/reservations/all/2/show"},
+		{"nobody", []string{}, ""},
+		{"j", []string{}, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/search-json?q="+e.query, nil)
+		req = req.WithContext(getCtx(req))
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminSearchJSON).ServeHTTP(respRecorder, req)
+
+		var resp struct {
+			Query  string        `json:"query"`
+			Groups []searchGroup `json:"groups"`
+		}
+		if err := json.Unmarshal(respRecorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: failed to parse json: %s", e.query, err)
+		}
+
+		if resp.Query != e.query {
+			t.Errorf("%s: unexpected query %s", e.query, resp.Query)
+		}
+		var names []string
+		for _, g := range resp.Groups {
+			names = append(names, g.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(e.expectedGroups, ",") {
+			t.Errorf("%s: expected groups %v, got %v", e.query, e.expectedGroups, names)
+		}
+		if e.expectedURL != "" && resp.Groups[0].Results[0].URL != e.expectedURL {
+			t.Errorf("%s: expected first result %s, got %s", e.query, e.expectedURL, resp.Groups[0].Results[0].URL)
+		}
+	}
+}
+
+// TestRepository_AdminPostImport tests importing reservations from an uploaded CSV file
+func TestRepository_AdminPostImport(t *testing.T) {
+	header := "first-name,last-name,email,room,arrival,departure\n"
+	tests := []struct {
+		name               string
+		csv                string
+		dryRun             bool
+		expectedStatusCode int
+		expectedHTML       string
+		expectedMessage    string
+	}{
+		{"dry run", header + "John,Smith,john@smith.com,1,2030-01-01,2030-01-03\n", true, http.StatusOK, "Dry run: 1 row(s), 0 with errors", "1 row(s) are valid"},
+		{"import", header + "John,Smith,john@smith.com,1,2030-01-01,2030-01-03\n", false, http.StatusOK, "Imported", "1 reservation(s) imported"},
+		{"row errors", header + "John,Smith,john,1,2030-01-01,2030-01-03\n", false, http.StatusOK, "email: Invalid email address", "1 of 1 row(s) have errors"},
+		{"database failure", header + "John,Fail,john@smith.com,1,2030-01-01,2030-01-03\n", false, http.StatusOK, "Not imported", "nothing was imported: import failed"},
+		{"missing columns", "first-name\nJohn\n", false, http.StatusSeeOther, "", "cannot import reservations: missing column(s)"},
+	}
+
+	for _, e := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "reservations.csv")
+		_, _ = fw.Write([]byte(e.csv))
+		if e.dryRun {
+			_ = mw.WriteField("dry-run", "1")
+		}
+		_ = mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminPostImport).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, respRecorder.Code)
+		}
+		if !strings.Contains(respRecorder.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s", e.name, e.expectedHTML)
+		}
+
+		// Messages are shown on the page, or kept for the page redirected to
+		if !strings.Contains(respRecorder.Body.String()+session.PopString(ctx, "error"), e.expectedMessage) {
+			t.Errorf("failed %s: expected message %s", e.name, e.expectedMessage)
+		}
+
+		if e.expectedStatusCode == http.StatusOK && session.GetBytes(ctx, "import-result") == nil {
+			t.Errorf("failed %s: expected the result file to be kept", e.name)
+		}
+	}
+
+	// No file uploaded
+	req, _ := http.NewRequest("POST", "/admin/import", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminPostImport).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusSeeOther {
+		t.Errorf("expected code %d without a file, but got %d", http.StatusSeeOther, respRecorder.Code)
+	}
+}
+
+// TestRepository_AdminImportResult tests downloading the result of an import
+func TestRepository_AdminImportResult(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/import/result", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "import-result", []byte("line,status,errors\n2,ok,\n"))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminImportResult).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Errorf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+	if got := respRecorder.Header().Get("Content-Disposition"); got != `attachment; filename="import-result.csv"` {
+		t.Errorf("unexpected content disposition %s", got)
+	}
+	if respRecorder.Body.String() != "line,status,errors\n2,ok,\n" {
+		t.Errorf("unexpected result file %s", respRecorder.Body.String())
+	}
+}
+
+// exchangeRateActionTests is the test data for the exchange rate admin handlers
+var exchangeRateActionTests = []struct {
+	tcName             string
+	method             string
+	url                string
+	postedData         url.Values
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	expectedStatusCode int
+	expectedURL        string
+	expectedHTML       string
+}{
+	{
+		tcName:             "add exchange rate",
+		method:             "POST",
+		url:                "/admin/exchange-rates",
+		postedData:         url.Values{"currency": {"gbp"}, "rate": {"0.79"}},
+		handler:            (*Repository).AdminPostExchangeRate,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/exchange-rates",
+	},
+	{
+		tcName:             "add exchange rate with invalid currency",
+		method:             "POST",
+		url:                "/admin/exchange-rates",
+		postedData:         url.Values{"currency": {"EURO"}, "rate": {"0.9"}},
+		handler:            (*Repository).AdminPostExchangeRate,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a three letter currency code other than USD",
+	},
+	{
+		tcName:             "add exchange rate for base currency",
+		method:             "POST",
+		url:                "/admin/exchange-rates",
+		postedData:         url.Values{"currency": {"USD"}, "rate": {"1"}},
+		handler:            (*Repository).AdminPostExchangeRate,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a three letter currency code other than USD",
+	},
+	{
+		tcName:             "add exchange rate with invalid rate",
+		method:             "POST",
+		url:                "/admin/exchange-rates",
+		postedData:         url.Values{"currency": {"GBP"}, "rate": {"-1"}},
+		handler:            (*Repository).AdminPostExchangeRate,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter a positive number such as 0.92",
+	},
+	{
+		tcName:             "add exchange rate database failure",
+		method:             "POST",
+		url:                "/admin/exchange-rates",
+		postedData:         url.Values{"currency": {"XXX"}, "rate": {"1.5"}},
+		handler:            (*Repository).AdminPostExchangeRate,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/exchange-rates",
+	},
+	{
+		tcName:             "delete exchange rate",
+		method:             "POST",
+		url:                "/admin/exchange-rates/1/delete",
+		handler:            (*Repository).AdminDeleteExchangeRate,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/exchange-rates",
+	},
+	{
+		tcName:             "delete exchange rate database failure",
+		method:             "POST",
+		url:                "/admin/exchange-rates/1000/delete",
+		handler:            (*Repository).AdminDeleteExchangeRate,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/exchange-rates",
+	},
+}
+
+// TestRepository_ExchangeRateActions tests the exchange rate admin handlers
+func TestRepository_ExchangeRateActions(t *testing.T) {
+	for _, e := range exchangeRateActionTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := respRecorder.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestRepository_AdminImportExchangeRates tests importing exchange rates from a CSV upload
+func TestRepository_AdminImportExchangeRates(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		message string
+	}{
+		{"valid file", "currency,rate\nEUR,0.91\nGBP,0.79\n", "2 exchange rate(s) saved"},
+		{"invalid file", "EUR,zero\n", "cannot import exchange rates"},
+		{"database failure", "XXX,1.5\n", "cannot save exchange rates"},
+	}
+
+	for _, e := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "rates.csv")
+		_, _ = fw.Write([]byte(e.csv))
+		_ = mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/exchange-rates/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminImportExchangeRates).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, respRecorder.Code)
+		}
+
+		message := session.PopString(ctx, "flash") + session.PopString(ctx, "error")
+		if !strings.Contains(message, e.message) {
+			t.Errorf("failed %s: expected message %q, got %q", e.name, e.message, message)
+		}
+	}
+
+	// No file uploaded
+	req, _ := http.NewRequest("POST", "/admin/exchange-rates/import", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminImportExchangeRates).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusSeeOther {
+		t.Errorf("expected code %d without a file, but got %d", http.StatusSeeOther, respRecorder.Code)
+	}
+}
+
+// TestRepository_SetCurrency tests choosing the currency prices are shown in
+func TestRepository_SetCurrency(t *testing.T) {
+	tests := []struct {
+		name             string
+		url              string
+		referer          string
+		expectedCurrency string
+		expectedURL      string
+	}{
+		{"known currency", "/currency?code=eur", "http://example.com/rooms/generals-quarters?x=1", "EUR", "/rooms/generals-quarters?x=1"},
+		{"unknown currency", "/currency?code=ZZZ", "", "", "/"},
+		{"other site referer", "/currency?code=EUR", "http://evil.com/phish", "EUR", "/"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req.Host = "example.com"
+		if e.referer != "" {
+			req.Header.Set("Referer", e.referer)
+		}
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.SetCurrency).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, respRecorder.Code)
+		}
+
+		actualLoc, _ := respRecorder.Result().Location()
+		if actualLoc.String() != e.expectedURL {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedURL, actualLoc.String())
+		}
+
+		if got := session.GetString(ctx, "currency"); got != e.expectedCurrency {
+			t.Errorf("failed %s: expected currency %q, got %q", e.name, e.expectedCurrency, got)
+		}
+	}
+}
+
+func getCtx(req *http.Request) context.Context {
+	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	return ctx
+}
+
+// guestActionTests is the test data for the guest admin handlers
+var guestActionTests = []struct {
+	tcName             string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedMessage    string
+}{
+	{
+		tcName:             "save guest",
+		url:                "/admin/guests/1",
+		postedData:         url.Values{"notes": {"Late arrival"}, "tags": {"vip", "do-not-book"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/guests/1",
+		expectedMessage:    "Guest saved",
+	},
+	{
+		tcName:             "save guest with unknown tag",
+		url:                "/admin/guests/1",
+		postedData:         url.Values{"tags": {"gold"}},
+		expectedStatusCode: http.StatusBadRequest,
+	},
+	{
+		tcName:             "save missing guest",
+		url:                "/admin/guests/3",
+		postedData:         url.Values{"notes": {"Hello"}},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "save guest database failure",
+		url:                "/admin/guests/2",
+		postedData:         url.Values{"notes": {"Hello"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/guests/2",
+		expectedMessage:    "cannot save guest",
+	},
+}
+
+// TestRepository_AdminPostGuest tests saving the notes and tags of a guest
+func TestRepository_AdminPostGuest(t *testing.T) {
+	for _, e := range guestActionTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminPostGuest).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedMessage != "" {
+			message := session.PopString(ctx, "flash") + session.PopString(ctx, "error")
+			if message != e.expectedMessage {
+				t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+			}
+		}
+	}
+}
+
+// TestRepository_AdminShowGuest tests the guest profile with its stays
+func TestRepository_AdminShowGuest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/guests/1", nil)
+	req.RequestURI = "/admin/guests/1"
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminShowGuest).ServeHTTP(respRecorder, req)
+
+	html := respRecorder.Body.String()
+	for _, e := range []string{
+		"John Smith",
+		"/admin/reservations/all/1/show",
+		"Prefers a quiet room",
+		`<span class="badge bg-warning text-dark">VIP</span>`,
+		`value="vip" id="tag-vip"
+                        checked`,
+		"50.00",
+	} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected guest page to contain %s", e)
+		}
+	}
+	if strings.Contains(html, "/admin/reservations/all/2/show") {
+		t.Error("expected only the guest's own stays")
+	}
+
+	// The guest is linked from their reservations
+	req, _ = http.NewRequest("GET", "/admin/reservations/all/1/show", nil)
+	req.RequestURI = "/admin/reservations/all/1/show"
+	req = req.WithContext(getCtx(req))
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminShowReservation).ServeHTTP(respRecorder, req)
+
+	if !strings.Contains(respRecorder.Body.String(), `<a href="/admin/guests/1">John Smith</a>`) {
+		t.Error("expected the reservation to link to its guest")
+	}
+}
+
+// registerTests is the test data for the PostRegister handler
+var registerTests = []struct {
+	tcName             string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{
+		tcName:             "new account",
+		postedData:         url.Values{"email": {"jane@doe.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		tcName:             "existing account",
+		postedData:         url.Values{"email": {"John@Smith.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		tcName:             "passwords do not match",
+		postedData:         url.Values{"email": {"jane@doe.com"}, "passwd-confirm": {"something-else"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Passwords do not match",
+	},
+	{
+		tcName:             "short password",
+		postedData:         url.Values{"email": {"jane@doe.com"}, "passwd": {"short"}, "passwd-confirm": {"short"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Use at least 8 characters",
+	},
+	{
+		tcName:             "invalid email",
+		postedData:         url.Values{"email": {"jane"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid email address",
+	},
+	{
+		tcName:             "lookup failure",
+		postedData:         url.Values{"email": {"fail@fsbnb.com"}},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "insert failure",
+		postedData:         url.Values{"email": {"jane@doe.com"}, "last-name": {"Fail"}},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestRepository_PostRegister tests creating a guest account
+func TestRepository_PostRegister(t *testing.T) {
+	for _, e := range registerTests {
+		postedData := url.Values{
+			"first-name":     {"Jane"},
+			"last-name":      {"Doe"},
+			"passwd":         {"long-enough"},
+			"passwd-confirm": {"long-enough"},
+		}
+		for k, v := range e.postedData {
+			postedData[k] = v
+		}
+
+		req, _ := http.NewRequest("POST", "/user/register", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostRegister).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedStatusCode == http.StatusSeeOther {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != "/user/login" {
+				t.Errorf("failed %s: expected location /user/login, but got location %s", e.tcName, actualLoc.String())
+			}
+			// New and existing accounts get the same answer
+			if message := session.PopString(ctx, "flash"); message != "Check your email for a link to confirm your address" {
+				t.Errorf("failed %s: unexpected message %s", e.tcName, message)
+			}
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(respRecorder.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s but did not", e.tcName, e.expectedHTML)
+		}
+	}
+}
+
+// TestRepository_MyStays tests the reservations listed in a guest's account
+func TestRepository_MyStays(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/account/stays", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user-id", 2)
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.MyStays).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+
+	html := respRecorder.Body.String()
+	for _, e := range []string{"Welcome back, John", "/manage/valid-token"} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected my stays to contain %s", e)
+		}
+	}
+	if strings.Contains(html, "Jane") {
+		t.Error("expected only the guest's own stays")
+	}
+
+	// Without an account
+	req, _ = http.NewRequest("GET", "/account/stays", nil)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder = httptest.NewRecorder()
+	http.HandlerFunc(Repo.MyStays).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d without a user, but got %d", http.StatusInternalServerError, respRecorder.Code)
+	}
+}
+
+// TestRepository_ReservationForGuest tests that a guest's details are filled in when they book
+func TestRepository_ReservationForGuest(t *testing.T) {
+	reservation := models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+	}
+
+	req, _ := http.NewRequest("GET", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", reservation)
+	session.Put(ctx, "user-id", 2)
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.Reservation).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+	if !strings.Contains(respRecorder.Body.String(), `value="john@smith.com"`) {
+		t.Error("expected the guest's email address to be filled in")
+	}
+
+	res := session.Get(ctx, "reservation").(models.Reservation)
+	if res.FirstName != "John" || res.LastName != "Smith" || res.Phone != "555-1234" {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+}
+
+// TestRepository_AdminShowReservationActions tests that a reservation only offers the actions
+// the role of the user can take
+func TestRepository_AdminShowReservationActions(t *testing.T) {
+	tests := []struct {
+		accessLevel int
+		expected    []string
+		hidden      []string
+	}{
+		{models.AccessLevelOwner, []string{`id="cancel-form"`, `value="Save"`, "/admin/dashboard"}, []string{`onclick="DeleteRes(`}},
+		{models.AccessLevelFrontDesk, []string{`value="Save"`, "/admin/reservations-all"}, []string{`onclick="DeleteRes(`, `id="cancel-form"`, "/admin/dashboard", "/admin/fees"}},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/reservations/all/1/show", nil)
+		req.RequestURI = "/admin/reservations/all/1/show"
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user-id", 1)
+		session.Put(ctx, "access-level", e.accessLevel)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminShowReservation).ServeHTTP(respRecorder, req)
+
+		html := respRecorder.Body.String()
+		for _, s := range e.expected {
+			if !strings.Contains(html, s) {
+				t.Errorf("access level %d: expected to find %s", e.accessLevel, s)
+			}
+		}
+		for _, s := range e.hidden {
+			if strings.Contains(html, s) {
+				t.Errorf("access level %d: expected not to find %s", e.accessLevel, s)
+			}
+		}
+	}
+}
+
+// userActionTests is the test data for the handlers that change users, run as user 1, the owner
+var userActionTests = []struct {
+	tcName             string
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedMessage    string
+}{
+	{
+		tcName:  "invite user",
+		handler: (*Repository).AdminInviteUser,
+		url:     "/admin/users",
+		postedData: url.Values{"first-name": {"Nina"}, "last-name": {"New"}, "email": {"nina@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users",
+		expectedMessage:    "Invitation sent to nina@fsbnb.com",
+	},
+	{
+		tcName:  "invite existing user",
+		handler: (*Repository).AdminInviteUser,
+		url:     "/admin/users",
+		postedData: url.Values{"first-name": {"John"}, "last-name": {"Smith"}, "email": {"john@smith.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "There is already an account with this email address",
+	},
+	{
+		tcName:  "invite guest",
+		handler: (*Repository).AdminInviteUser,
+		url:     "/admin/users",
+		postedData: url.Values{"first-name": {"Nina"}, "last-name": {"New"}, "email": {"nina@fsbnb.com"},
+			"access-level": {"0"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Choose a staff role",
+	},
+	{
+		tcName:  "invite user database failure",
+		handler: (*Repository).AdminInviteUser,
+		url:     "/admin/users",
+		postedData: url.Values{"first-name": {"Nina"}, "last-name": {"Fail"}, "email": {"nina@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users",
+		expectedMessage:    "cannot invite user",
+	},
+	{
+		tcName:  "save user",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/5",
+		postedData: url.Values{"first-name": {"Fred"}, "last-name": {"Desk"}, "email": {"desk@fsbnb.com"},
+			"access-level": {"4"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/5",
+		expectedMessage:    "User saved",
+	},
+	{
+		tcName:  "save user with new email",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/5",
+		postedData: url.Values{"first-name": {"Fred"}, "last-name": {"Desk"}, "email": {"fred@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/5",
+		expectedMessage:    "User saved",
+	},
+	{
+		tcName:  "save user with email of another user",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/5",
+		postedData: url.Values{"first-name": {"Fred"}, "last-name": {"Desk"}, "email": {"Admin@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Another account has this email address",
+	},
+	{
+		tcName:  "save user with unknown role",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/5",
+		postedData: url.Values{"first-name": {"Fred"}, "last-name": {"Desk"}, "email": {"desk@fsbnb.com"},
+			"access-level": {"9"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Choose a role",
+	},
+	{
+		tcName:  "change own role",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/1",
+		postedData: url.Values{"first-name": {"Admin"}, "last-name": {"User"}, "email": {"admin@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "You cannot change your own role",
+	},
+	{
+		tcName:  "save user database failure",
+		handler: (*Repository).AdminPostUser,
+		url:     "/admin/users/5",
+		postedData: url.Values{"first-name": {"Fred"}, "last-name": {"Fail"}, "email": {"desk@fsbnb.com"},
+			"access-level": {"2"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/5",
+		expectedMessage:    "cannot save user",
+	},
+	{
+		tcName:             "save missing user",
+		handler:            (*Repository).AdminPostUser,
+		url:                "/admin/users/1000",
+		postedData:         url.Values{},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "deactivate user",
+		handler:            (*Repository).AdminDeactivateUser,
+		url:                "/admin/users/5/deactivate",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/5",
+		expectedMessage:    "User deactivated",
+	},
+	{
+		tcName:             "deactivate self",
+		handler:            (*Repository).AdminDeactivateUser,
+		url:                "/admin/users/1/deactivate",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/1",
+		expectedMessage:    "You cannot deactivate your own account",
+	},
+	{
+		tcName:             "deactivate user database failure",
+		handler:            (*Repository).AdminDeactivateUser,
+		url:                "/admin/users/1000/deactivate",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/1000",
+		expectedMessage:    "cannot update user",
+	},
+	{
+		tcName:             "reset two-factor authentication",
+		handler:            (*Repository).AdminResetTwoFactor,
+		url:                "/admin/users/4/reset-two-factor",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/4",
+		expectedMessage:    "Two-factor authentication reset",
+	},
+	{
+		tcName:             "reset two-factor authentication database failure",
+		handler:            (*Repository).AdminResetTwoFactor,
+		url:                "/admin/users/1000/reset-two-factor",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/1000",
+		expectedMessage:    "cannot reset two-factor authentication",
+	},
+	{
+		tcName:             "unlock account",
+		handler:            (*Repository).AdminUnlockAccount,
+		url:                "/admin/users/6/unlock",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/6",
+		expectedMessage:    "Account unlocked",
+	},
+	{
+		tcName:             "unlock account from the locked accounts",
+		handler:            (*Repository).AdminUnlockAccount,
+		url:                "/admin/users/6/unlock",
+		postedData:         url.Values{"back": {"locked-accounts"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/locked-accounts",
+		expectedMessage:    "Account unlocked",
+	},
+	{
+		tcName:             "unlock missing user",
+		handler:            (*Repository).AdminUnlockAccount,
+		url:                "/admin/users/1000/unlock",
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "reactivate user",
+		handler:            (*Repository).AdminReactivateUser,
+		url:                "/admin/users/7/reactivate",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/users/7",
+		expectedMessage:    "User reactivated",
+	},
+	{
+		tcName:             "save profile",
+		handler:            (*Repository).PostProfile,
+		url:                "/account/profile",
+		postedData:         url.Values{"first-name": {"Admin"}, "last-name": {"User"}, "email": {"admin@fsbnb.com"}, "current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/profile",
+		expectedMessage:    "Profile saved",
+	},
+	{
+		tcName:  "save profile with new email and password",
+		handler: (*Repository).PostProfile,
+		url:     "/account/profile",
+		postedData: url.Values{"first-name": {"Admin"}, "last-name": {"User"}, "email": {"owner@fsbnb.com"},
+			"passwd": {"long-enough"}, "passwd-confirm": {"long-enough"}, "current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/profile",
+		expectedMessage:    "Profile saved. Check your email for a link to confirm your new address",
+	},
+	{
+		tcName:             "save profile with wrong password",
+		handler:            (*Repository).PostProfile,
+		url:                "/account/profile",
+		postedData:         url.Values{"first-name": {"Admin"}, "last-name": {"User"}, "email": {"admin@fsbnb.com"}, "current-passwd": {"wrong-password"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Your current password is not correct",
+	},
+	{
+		tcName:  "save profile with mismatched passwords",
+		handler: (*Repository).PostProfile,
+		url:     "/account/profile",
+		postedData: url.Values{"first-name": {"Admin"}, "last-name": {"User"}, "email": {"admin@fsbnb.com"},
+			"passwd": {"long-enough"}, "passwd-confirm": {"different"}, "current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Passwords do not match",
+	},
+	{
+		tcName:             "save profile database failure",
+		handler:            (*Repository).PostProfile,
+		url:                "/account/profile",
+		postedData:         url.Values{"first-name": {"Admin"}, "last-name": {"Fail"}, "email": {"admin@fsbnb.com"}, "current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/profile",
+		expectedMessage:    "cannot save profile",
+	},
+	{
+		tcName:             "set password",
+		handler:            (*Repository).PostSetPassword,
+		url:                "/user/set-password",
+		postedData:         url.Values{"token": {"valid-token"}, "passwd": {"long-enough"}, "passwd-confirm": {"long-enough"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Your password is set, you can now log in",
+	},
+	{
+		tcName:             "set short password",
+		handler:            (*Repository).PostSetPassword,
+		url:                "/user/set-password",
+		postedData:         url.Values{"token": {"valid-token"}, "passwd": {"short"}, "passwd-confirm": {"short"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Use at least 8 characters",
+	},
+	{
+		tcName:             "set password with invalid token",
+		handler:            (*Repository).PostSetPassword,
+		url:                "/user/set-password",
+		postedData:         url.Values{"token": {"invalid"}, "passwd": {"long-enough"}, "passwd-confirm": {"long-enough"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "This link is invalid or has expired",
+	},
+	{
+		tcName:             "set password database failure",
+		handler:            (*Repository).PostSetPassword,
+		url:                "/user/set-password",
+		postedData:         url.Values{"token": {"failing-token"}, "passwd": {"long-enough"}, "passwd-confirm": {"long-enough"}},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "set common password",
+		handler:            (*Repository).PostSetPassword,
+		url:                "/user/set-password",
+		postedData:         url.Values{"token": {"valid-token"}, "passwd": {"password1"}, "passwd-confirm": {"password1"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "This password is too common, choose another",
+	},
+	{
+		tcName:             "forgot password",
+		handler:            (*Repository).PostForgotPassword,
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"john@smith.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "If an account has this email address, we have sent it a link to reset the password",
+	},
+	{
+		tcName:             "forgot password of unknown email",
+		handler:            (*Repository).PostForgotPassword,
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"nobody@fsbnb.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "If an account has this email address, we have sent it a link to reset the password",
+	},
+	{
+		tcName:             "forgot password of deactivated user",
+		handler:            (*Repository).PostForgotPassword,
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"gone@fsbnb.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "If an account has this email address, we have sent it a link to reset the password",
+	},
+	{
+		tcName:             "forgot password with invalid email",
+		handler:            (*Repository).PostForgotPassword,
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"john"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Invalid email address",
+	},
+	{
+		tcName:             "forgot password database failure",
+		handler:            (*Repository).PostForgotPassword,
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"fail@fsbnb.com"}},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "reset password",
+		handler:            (*Repository).PostResetPassword,
+		url:                "/user/reset-password",
+		postedData:         url.Values{"token": {"valid-token"}, "passwd": {"new-pass-42"}, "passwd-confirm": {"new-pass-42"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Your password is reset, you can now log in",
+	},
+	{
+		tcName:             "reset password with weak password",
+		handler:            (*Repository).PostResetPassword,
+		url:                "/user/reset-password",
+		postedData:         url.Values{"token": {"valid-token"}, "passwd": {"onlyletters"}, "passwd-confirm": {"onlyletters"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Mix letters with numbers or symbols",
+	},
+	{
+		tcName:             "reset password with invalid token",
+		handler:            (*Repository).PostResetPassword,
+		url:                "/user/reset-password",
+		postedData:         url.Values{"token": {"invalid"}, "passwd": {"new-pass-42"}, "passwd-confirm": {"new-pass-42"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "This link is invalid or has expired",
+	},
+}
+
+// TestRepository_UserActions tests inviting and editing users, profiles and setting passwords
+func TestRepository_UserActions(t *testing.T) {
+	for _, e := range userActionTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user-id", 1)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedMessage != "" {
+			message := session.PopString(ctx, "flash") + session.PopString(ctx, "error") + respRecorder.Body.String()
+			if !strings.Contains(message, e.expectedMessage) {
+				t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+			}
+		}
+	}
+}
+
+// testTOTPCode returns the current code of the manager's authenticator app in the test repository
+func testTOTPCode() string {
+	code, _ := totp.Code("JBSWY3DPEHPK3PXP", totp.Step(time.Now()))
+	return code
+}
+
+// currentTOTPCode in the posted data of a two-factor test is replaced by the current code of the
+// manager's authenticator app when the test runs, as codes expire after a minute or so
+const currentTOTPCode = "current-totp-code"
+
+// twoFactorTests is the test data for the second step of logging in and setting up two-factor
+// authentication. userID is the user logged in, loginUserID the user whose password was checked
+// and attempts their incorrect codes so far, and secret the secret being set up.
+var twoFactorTests = []struct {
+	tcName             string
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	url                string
+	userID             int
+	loginUserID        int
+	attempts           int
+	secret             string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedURL        string
+	expectedMessage    string
+}{
+	{
+		tcName:             "log in with code",
+		handler:            (*Repository).PostLoginTwoFactor,
+		url:                "/user/login/two-factor",
+		loginUserID:        4,
+		postedData:         url.Values{"code": {currentTOTPCode}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/",
+		expectedMessage:    "Logged in successfully",
+	},
+	{
+		tcName:             "log in with recovery code",
+		handler:            (*Repository).PostLoginTwoFactor,
+		url:                "/user/login/two-factor",
+		loginUserID:        4,
+		postedData:         url.Values{"code": {"ABCDE-FGHIJ"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/",
+		expectedMessage:    "Logged in successfully",
+	},
+	{
+		tcName:             "log in with wrong code",
+		handler:            (*Repository).PostLoginTwoFactor,
+		url:                "/user/login/two-factor",
+		loginUserID:        4,
+		postedData:         url.Values{"code": {"12345"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "This code is not correct",
+	},
+	{
+		tcName:             "log in with too many wrong codes",
+		handler:            (*Repository).PostLoginTwoFactor,
+		url:                "/user/login/two-factor",
+		loginUserID:        4,
+		attempts:           4,
+		postedData:         url.Values{"code": {"12345"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Too many incorrect codes, log in again",
+	},
+	{
+		tcName:             "log in without password",
+		handler:            (*Repository).PostLoginTwoFactor,
+		url:                "/user/login/two-factor",
+		postedData:         url.Values{"code": {currentTOTPCode}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/user/login",
+		expectedMessage:    "Your login has expired, log in again",
+	},
+	{
+		tcName:             "turn on",
+		handler:            (*Repository).PostEnableTwoFactor,
+		url:                "/account/two-factor",
+		userID:             1,
+		secret:             "JBSWY3DPEHPK3PXP",
+		postedData:         url.Values{"code": {currentTOTPCode}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Your recovery codes",
+	},
+	{
+		tcName:             "turn on with wrong code",
+		handler:            (*Repository).PostEnableTwoFactor,
+		url:                "/account/two-factor",
+		userID:             1,
+		secret:             "JBSWY3DPEHPK3PXP",
+		postedData:         url.Values{"code": {"12345"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "This code is not correct",
+	},
+	{
+		tcName:             "turn on without secret",
+		handler:            (*Repository).PostEnableTwoFactor,
+		url:                "/account/two-factor",
+		userID:             1,
+		postedData:         url.Values{"code": {currentTOTPCode}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/two-factor",
+	},
+	{
+		tcName:             "new recovery codes",
+		handler:            (*Repository).PostRecoveryCodes,
+		url:                "/account/two-factor/recovery-codes",
+		userID:             4,
+		postedData:         url.Values{"current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Your recovery codes",
+	},
+	{
+		tcName:             "new recovery codes with wrong password",
+		handler:            (*Repository).PostRecoveryCodes,
+		url:                "/account/two-factor/recovery-codes",
+		userID:             4,
+		postedData:         url.Values{"current-passwd": {"wrong-password"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Your current password is not correct",
+	},
+	{
+		tcName:             "new recovery codes when off",
+		handler:            (*Repository).PostRecoveryCodes,
+		url:                "/account/two-factor/recovery-codes",
+		userID:             1,
+		postedData:         url.Values{"current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/two-factor",
+	},
+	{
+		tcName:             "turn off",
+		handler:            (*Repository).PostDisableTwoFactor,
+		url:                "/account/two-factor/disable",
+		userID:             4,
+		postedData:         url.Values{"current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/two-factor",
+		expectedMessage:    "Two-factor authentication is off",
+	},
+	{
+		tcName:             "turn off with wrong password",
+		handler:            (*Repository).PostDisableTwoFactor,
+		url:                "/account/two-factor/disable",
+		userID:             4,
+		postedData:         url.Values{"current-passwd": {"wrong-password"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMessage:    "Your current password is not correct",
+	},
+	{
+		tcName:             "turn off when the role requires it",
+		handler:            (*Repository).PostDisableTwoFactor,
+		url:                "/account/two-factor/disable",
+		userID:             5,
+		postedData:         url.Values{"current-passwd": {"admin"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/account/two-factor",
+		expectedMessage:    "Your role requires two-factor authentication",
+	},
+}
+
+// TestRepository_TwoFactor tests logging in with a second factor and setting it up
+func TestRepository_TwoFactor(t *testing.T) {
+	for _, e := range twoFactorTests {
+		body := strings.ReplaceAll(e.postedData.Encode(), currentTOTPCode, testTOTPCode())
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(body))
+		req.RequestURI = e.url
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		if e.userID != 0 {
+			session.Put(ctx, "user-id", e.userID)
+		}
+		if e.loginUserID != 0 {
+			session.Put(ctx, "two-factor-user-id", e.loginUserID)
+			session.Put(ctx, "two-factor-expires-at", time.Now().Add(time.Minute).UnixNano())
+			session.Put(ctx, "two-factor-attempts", e.attempts)
+		}
+		if e.secret != "" {
+			session.Put(ctx, "totp-secret", e.secret)
+		}
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, err := respRecorder.Result().Location()
+			if err != nil {
+				t.Errorf("failed %s: expected location %s, but got none", e.tcName, e.expectedURL)
+			} else if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedMessage != "" {
+			message := session.PopString(ctx, "flash") + session.PopString(ctx, "error") + respRecorder.Body.String()
+			if !strings.Contains(message, e.expectedMessage) {
+				t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+			}
+		}
+
+		if e.loginUserID != 0 && e.expectedURL == "/" && session.GetInt(ctx, "user-id") != e.loginUserID {
+			t.Errorf("failed %s: expected user %d to be logged in", e.tcName, e.loginUserID)
+		}
+	}
+}
+
+// TestRepository_ShowTwoFactor tests that users without two-factor authentication are shown a
+// QR code to set it up, and users with it the recovery codes they have left
+func TestRepository_ShowTwoFactor(t *testing.T) {
+	tests := []struct {
+		userID   int
+		expected []string
+	}{
+		{1, []string{`<svg class="qrcode"`, `action="/account/two-factor"`}},
+		{4, []string{"You have 10 unused recovery codes", `action="/account/two-factor/disable"`}},
+		{5, []string{`<svg class="qrcode"`, "Your role requires two-factor authentication"}},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/account/two-factor", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user-id", e.userID)
+
+		respRecorder := httptest.NewRecorder()
+		http.HandlerFunc(Repo.ShowTwoFactor).ServeHTTP(respRecorder, req)
+
+		if respRecorder.Code != http.StatusOK {
+			t.Fatalf("user %d: expected code %d, but got %d", e.userID, http.StatusOK, respRecorder.Code)
+		}
+		for _, html := range e.expected {
+			if !strings.Contains(respRecorder.Body.String(), html) {
+				t.Errorf("user %d: expected page to contain %s", e.userID, html)
+			}
+		}
+	}
+}
+
+// TestRepository_ShowProfile tests that the profile form has the details of the user logged in
+func TestRepository_ShowProfile(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/account/profile", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user-id", 2)
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowProfile).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+	for _, e := range []string{`value="john@smith.com"`, `value="555-1234"`} {
+		if !strings.Contains(respRecorder.Body.String(), e) {
+			t.Errorf("expected profile to contain %s", e)
+		}
+	}
+}
+
+// testSession saves a session of a user logged in with a browser and returns its token
+func testSession(t *testing.T, userID int, userAgent string) string {
+	ctx, err := session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Put(ctx, "user-id", userID)
+	session.Put(ctx, "logged-in-at", time.Now().UnixNano())
+	session.Put(ctx, "login-ip", "192.0.2.10")
+	session.Put(ctx, "user-agent", userAgent)
+
+	token, _, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// postSessionAction posts to a sessions page action from the session with a token, and returns
+// the response and the message flashed
+func postSessionAction(handler http.HandlerFunc, uri, token string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest("POST", uri, nil)
+	req.RequestURI = uri
+	req.Header.Set("X-Session", token)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	respRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(respRecorder, req)
+	return respRecorder, session.PopString(ctx, "flash") + session.PopString(ctx, "error")
+}
+
+// TestRepository_Sessions tests listing a user's sessions and logging out of the others
+func TestRepository_Sessions(t *testing.T) {
+	current := testSession(t, 5, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0")
+	phone := testSession(t, 5, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1")
+	tablet := testSession(t, 5, "Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0 Safari/537.36")
+	someoneElse := testSession(t, 1, "")
+
+	req, _ := http.NewRequest("GET", "/account/sessions", nil)
+	req.Header.Set("X-Session", current)
+	req = req.WithContext(getCtx(req))
+
+	respRecorder := httptest.NewRecorder()
+	http.HandlerFunc(Repo.ShowSessions).ServeHTTP(respRecorder, req)
+
+	if respRecorder.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, respRecorder.Code)
+	}
+	html := respRecorder.Body.String()
+	for _, e := range []string{"Firefox on Windows", "Safari on iOS", "Chrome on Android", "This session",
+		"/account/sessions/" + sessionID(phone) + "/revoke"} {
+		if !strings.Contains(html, e) {
+			t.Errorf("expected sessions page to contain %s", e)
+		}
+	}
+	for _, token := range []string{current, someoneElse} {
+		if strings.Contains(html, sessionID(token)) {
+			t.Errorf("expected no log out button for session %s", sessionID(token))
+		}
+	}
+
+	tests := []struct {
+		tcName          string
+		handler         http.HandlerFunc
+		url             string
+		expectedMessage string
+	}{
+		{"log out of a session", Repo.PostRevokeSession, "/account/sessions/" + sessionID(phone) + "/revoke", "Session logged out"},
+		{"log out of an ended session", Repo.PostRevokeSession, "/account/sessions/" + sessionID(phone) + "/revoke", "That session has already ended"},
+		{"log out of the current session", Repo.PostRevokeSession, "/account/sessions/" + sessionID(current) + "/revoke", "That session has already ended"},
+		{"log out of another user's session", Repo.PostRevokeSession, "/account/sessions/" + sessionID(someoneElse) + "/revoke", "That session has already ended"},
+		{"log out of all other sessions", Repo.PostRevokeOtherSessions, "/account/sessions/revoke-others", "Logged out of your other sessions"},
+		{"no other sessions", Repo.PostRevokeOtherSessions, "/account/sessions/revoke-others", "You have no other sessions"},
+	}
+
+	for _, e := range tests {
+		respRecorder, message := postSessionAction(e.handler, e.url, current)
+		if respRecorder.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, http.StatusSeeOther, respRecorder.Code)
+		}
+		if message != e.expectedMessage {
+			t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+		}
+	}
+
+	for token, expected := range map[string]bool{current: true, phone: false, tablet: false, someoneElse: true} {
+		if _, found, _ := session.Store.Find(token); found != expected {
+			t.Errorf("expected session %s found %t, got %t", sessionID(token), expected, found)
+		}
+	}
+}
+
+// outboxActionTests is the test data for the handlers that resend and discard outbox messages
+var outboxActionTests = []struct {
+	tcName             string
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	url                string
+	expectedStatusCode int
+	expectedURL        string
+	expectedMessage    string
+}{
+	{
+		tcName:             "resend dead message",
+		handler:            (*Repository).AdminResendOutboxMessage,
+		url:                "/admin/outbox/2/resend",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/2",
+		expectedMessage:    "Message queued to be sent again",
+	},
+	{
+		tcName:             "resend database failure",
+		handler:            (*Repository).AdminResendOutboxMessage,
+		url:                "/admin/outbox/4/resend",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/4",
+		expectedMessage:    "cannot resend message",
+	},
+	{
+		tcName:             "resend cleared message",
+		handler:            (*Repository).AdminResendOutboxMessage,
+		url:                "/admin/outbox/3/resend",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/3",
+		expectedMessage:    "This message had a private link and was cleared",
+	},
+	{
+		tcName:             "resend missing message",
+		handler:            (*Repository).AdminResendOutboxMessage,
+		url:                "/admin/outbox/1000/resend",
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		tcName:             "discard pending message",
+		handler:            (*Repository).AdminDiscardOutboxMessage,
+		url:                "/admin/outbox/1/discard",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/1",
+		expectedMessage:    "Message discarded",
+	},
+	{
+		tcName:             "discard sent message",
+		handler:            (*Repository).AdminDiscardOutboxMessage,
+		url:                "/admin/outbox/3/discard",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/3",
+		expectedMessage:    "Only messages not sent yet can be discarded",
+	},
+	{
+		tcName:             "discard database failure",
+		handler:            (*Repository).AdminDiscardOutboxMessage,
+		url:                "/admin/outbox/4/discard",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedURL:        "/admin/outbox/4",
+		expectedMessage:    "cannot discard message",
+	},
+	{
+		tcName:             "discard missing message",
+		handler:            (*Repository).AdminDiscardOutboxMessage,
+		url:                "/admin/outbox/1000/discard",
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestRepository_OutboxActions tests resending and discarding outbox messages
+func TestRepository_OutboxActions(t *testing.T) {
+	for _, e := range outboxActionTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		req.RequestURI = e.url
+
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		respRecorder := httptest.NewRecorder()
+		e.handler(Repo, respRecorder, req)
+
+		if respRecorder.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.tcName, e.expectedStatusCode, respRecorder.Code)
+		}
+
+		if e.expectedURL != "" {
+			actualLoc, _ := respRecorder.Result().Location()
+			if actualLoc.String() != e.expectedURL {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.tcName, e.expectedURL, actualLoc.String())
+			}
+		}
+
+		if e.expectedMessage != "" {
+			message := session.PopString(ctx, "flash") + session.PopString(ctx, "error")
+			if !strings.Contains(message, e.expectedMessage) {
+				t.Errorf("failed %s: expected message %s, but got %s", e.tcName, e.expectedMessage, message)
+			}
+		}
 	}
-	return ctx
 }
@@ -16,7 +16,12 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
+	"github.com/tanishqv/bnb-bookings/internal/helpers"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 	"github.com/tanishqv/bnb-bookings/internal/render"
 )
 
@@ -27,10 +32,16 @@ var infoLog *log.Logger
 var errorLog *log.Logger
 
 var functions = template.FuncMap{
-	"humanDate":  render.HumanDate,
-	"formatDate": render.FormatDate,
-	"iterate":    render.Iterate,
-	"add":        render.Add,
+	"humanDate":      render.HumanDate,
+	"formatDate":     render.FormatDate,
+	"iterate":        render.Iterate,
+	"add":            render.Add,
+	"formatAmount":   pricing.FormatAmount,
+	"formatCurrency": currency.Format,
+	"displayAmount":  render.DisplayAmount,
+	"can":            render.Can,
+	"adminHome":      rbac.Home,
+	"roleName":       rbac.RoleName,
 }
 
 func TestMain(m *testing.M) {
@@ -58,11 +69,13 @@ func TestMain(m *testing.M) {
 
 	app.Session = session
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-	defer close(mailChan)
+	app.Payments = payments.NewFakeGateway("secret")
 
-	listenForMail()
+	app.ExchangeRates = currency.NewRates("USD")
+	app.ExchangeRates.Set([]models.ExchangeRate{{Currency: "EUR", Rate: 0.9}})
+
+	app.Property.Name = "Fort Smythe BnB"
+	app.TwoFactorRoles = map[int]bool{models.AccessLevelFrontDesk: true}
 
 	tc, err := CreateTestTemplateCache()
 	if err != nil {
@@ -76,19 +89,11 @@ func TestMain(m *testing.M) {
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	os.Exit(m.Run())
 }
 
-func listenForMail() {
-	go func() {
-		for {
-			<-app.MailChan
-			app.InfoLog.Println("Message read from mail channel")
-		}
-	}()
-}
-
 func getRoutes() http.Handler {
 	// ****************
 	// From routes.go
@@ -120,22 +125,114 @@ func getRoutes() http.Handler {
 	mux.Get("/make-reservation", Repo.Reservation)
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
+	mux.Get("/payment", Repo.Payment)
+	mux.Post("/payment", Repo.PostPayment)
+	mux.Post("/payments/webhook", Repo.PaymentWebhook)
+	mux.Get("/pay/{token}", Repo.PayReservation)
+	mux.Get("/manage/{token}", Repo.ManageReservation)
+	mux.Post("/manage/{token}/cancel", Repo.PostCancelReservation)
+	mux.Get("/manage/{token}/invoice", Repo.GuestInvoice)
+
+	mux.Get("/currency", Repo.SetCurrency)
 
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
+	mux.Get("/user/login/two-factor", Repo.ShowLoginTwoFactor)
+	mux.Post("/user/login/two-factor", Repo.PostLoginTwoFactor)
 	mux.Get("/user/logout", Repo.Logout)
+	mux.Get("/user/register", Repo.ShowRegister)
+	mux.Post("/user/register", Repo.PostRegister)
+	mux.Get("/user/verify", Repo.VerifyEmail)
+	mux.Get("/user/set-password", Repo.ShowSetPassword)
+	mux.Post("/user/set-password", Repo.PostSetPassword)
+	mux.Get("/user/forgot-password", Repo.ShowForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", Repo.ShowResetPassword)
+	mux.Post("/user/reset-password", Repo.PostResetPassword)
+	mux.Get("/account/stays", Repo.MyStays)
+	mux.Get("/account/profile", Repo.ShowProfile)
+	mux.Post("/account/profile", Repo.PostProfile)
+	mux.Get("/account/two-factor", Repo.ShowTwoFactor)
+	mux.Post("/account/two-factor", Repo.PostEnableTwoFactor)
+	mux.Post("/account/two-factor/recovery-codes", Repo.PostRecoveryCodes)
+	mux.Post("/account/two-factor/disable", Repo.PostDisableTwoFactor)
+	mux.Get("/account/sessions", Repo.ShowSessions)
+	mux.Post("/account/sessions/revoke-others", Repo.PostRevokeOtherSessions)
+	mux.Post("/account/sessions/{id}/revoke", Repo.PostRevokeSession)
+
+	mux.Get("/ical/rooms/{id}.ics", Repo.ICalRoomFeed)
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
+	mux.Get("/admin/search", Repo.AdminSearch)
+	mux.Get("/admin/search-json", Repo.AdminSearchJSON)
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
+	mux.Get("/admin/reservations/export", Repo.AdminExportReservations)
+	mux.Get("/admin/import", Repo.AdminImport)
+	mux.Post("/admin/import", Repo.AdminPostImport)
+	mux.Get("/admin/import/result", Repo.AdminImportResult)
+
+	mux.Get("/admin/guests", Repo.AdminGuests)
+	mux.Get("/admin/guests/{id}", Repo.AdminShowGuest)
+	mux.Post("/admin/guests/{id}", Repo.AdminPostGuest)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalendar)
 	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalendar)
 	mux.Get("/admin/process-reservation/{src}/{id}/process", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/delete", Repo.AdminDeleteReservation)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
+	mux.Get("/admin/reservations/{id}/invoice", Repo.AdminInvoice)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
 
+	mux.Get("/admin/ical-sources", Repo.AdminICalSources)
+	mux.Post("/admin/ical-sources", Repo.AdminPostICalSource)
+	mux.Post("/admin/ical-sources/{id}/sync", Repo.AdminSyncICalSource)
+	mux.Post("/admin/ical-sources/{id}/delete", Repo.AdminDeleteICalSource)
+
+	mux.Post("/admin/payments/{id}/capture", Repo.AdminCapturePayment)
+	mux.Post("/admin/payments/{id}/refund", Repo.AdminRefundPayment)
+
+	mux.Get("/admin/deposit-policies", Repo.AdminDepositPolicies)
+	mux.Post("/admin/deposit-policies", Repo.AdminPostDepositPolicy)
+	mux.Get("/admin/balances-due", Repo.AdminBalancesDue)
+
+	mux.Get("/admin/cancellation-policies", Repo.AdminCancellationPolicies)
+	mux.Post("/admin/cancellation-policies", Repo.AdminPostCancellationPolicy)
+	mux.Post("/admin/cancellation-policies/{id}/delete", Repo.AdminDeleteCancellationPolicy)
+	mux.Post("/admin/cancellation-policies/rooms", Repo.AdminPostRoomCancellationPolicy)
+
+	mux.Get("/admin/promotions", Repo.AdminPromotions)
+	mux.Post("/admin/promotions", Repo.AdminPostPromotion)
+	mux.Post("/admin/promotions/{id}/toggle", Repo.AdminTogglePromotion)
+	mux.Post("/admin/promotions/{id}/delete", Repo.AdminDeletePromotion)
+
+	mux.Get("/admin/fees", Repo.AdminFees)
+	mux.Post("/admin/fees", Repo.AdminPostFee)
+	mux.Get("/admin/fees/report", Repo.AdminFeeReport)
+	mux.Post("/admin/fees/{id}/toggle", Repo.AdminToggleFee)
+	mux.Post("/admin/fees/{id}/delete", Repo.AdminDeleteFee)
+
+	mux.Get("/admin/exchange-rates", Repo.AdminExchangeRates)
+	mux.Post("/admin/exchange-rates", Repo.AdminPostExchangeRate)
+	mux.Post("/admin/exchange-rates/import", Repo.AdminImportExchangeRates)
+	mux.Post("/admin/exchange-rates/{id}/delete", Repo.AdminDeleteExchangeRate)
+
+	mux.Post("/admin/cancel-reservation/{src}/{id}/cancel", Repo.AdminCancelReservation)
+
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Post("/admin/users", Repo.AdminInviteUser)
+	mux.Get("/admin/users/{id}", Repo.AdminShowUser)
+	mux.Post("/admin/users/{id}", Repo.AdminPostUser)
+	mux.Post("/admin/users/{id}/deactivate", Repo.AdminDeactivateUser)
+	mux.Post("/admin/users/{id}/reactivate", Repo.AdminReactivateUser)
+	mux.Post("/admin/users/{id}/reset-two-factor", Repo.AdminResetTwoFactor)
+	mux.Post("/admin/users/{id}/unlock", Repo.AdminUnlockAccount)
+	mux.Get("/admin/locked-accounts", Repo.AdminLockedAccounts)
+	mux.Get("/admin/outbox", Repo.AdminOutbox)
+	mux.Get("/admin/outbox/{id}", Repo.AdminShowOutboxMessage)
+	mux.Post("/admin/outbox/{id}/resend", Repo.AdminResendOutboxMessage)
+	mux.Post("/admin/outbox/{id}/discard", Repo.AdminDiscardOutboxMessage)
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -1,11 +1,16 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
 
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 )
 
 var app *config.AppConfig
@@ -29,3 +34,34 @@ func ServerError(w http.ResponseWriter, err error) {
 func IsAuthenticated(r *http.Request) bool {
 	return app.Session.Exists(r.Context(), "user-id")
 }
+
+// IsStaff reports whether the user logged in has a staff account rather than a guest account
+func IsStaff(r *http.Request) bool {
+	return IsAuthenticated(r) && rbac.IsStaff(app.Session.GetInt(r.Context(), "access-level"))
+}
+
+// ClientIP returns the IP address a request came from. Behind a proxy it is the proxy's, as
+// the headers with the client's address can be forged unless the proxy sets them.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RandomToken returns a random hex token suitable for use in URLs
+func RandomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hash of a token emailed to a user, which is stored instead of the token
+// so that the tokens cannot be read from the database
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
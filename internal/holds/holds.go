@@ -0,0 +1,61 @@
+package holds
+
+import (
+	"log"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/repository"
+)
+
+// Duration is how long a reservation with a payment due up front holds its room for the
+// guest to pay
+const Duration = 30 * time.Minute
+
+// Reaper releases the rooms of reservations that were not paid for before their hold ran out
+type Reaper struct {
+	DB       repository.DatabaseRepo
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// New creates a new reaper
+func New(db repository.DatabaseRepo, infoLog, errorLog *log.Logger) *Reaper {
+	return &Reaper{
+		DB:       db,
+		InfoLog:  infoLog,
+		ErrorLog: errorLog,
+	}
+}
+
+// Start expires the holds that ran out every interval in the background until stop is closed.
+// The returned channel is closed once the run in progress, if any, has finished.
+func (rp *Reaper) Start(interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			rp.ExpireDue(time.Now())
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	return done
+}
+
+// ExpireDue cancels the reservations whose hold ran out at now
+func (rp *Reaper) ExpireDue(now time.Time) {
+	n, err := rp.DB.ExpireHolds(now)
+	if err != nil {
+		rp.ErrorLog.Println("cannot expire reservation holds:", err)
+		return
+	}
+
+	if n > 0 {
+		rp.InfoLog.Printf("released the rooms of %d unpaid reservations", n)
+	}
+}
@@ -0,0 +1,44 @@
+package holds
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+)
+
+func TestReaper_ExpireDue(t *testing.T) {
+	var app config.AppConfig
+	var infoBuf, errorBuf bytes.Buffer
+	rp := New(dbrepo.NewTestRepo(&app), log.New(&infoBuf, "", 0), log.New(&errorBuf, "", 0))
+
+	rp.ExpireDue(time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !strings.Contains(infoBuf.String(), "1 unpaid reservations") {
+		t.Errorf("expected the expired holds to be logged, got %q", infoBuf.String())
+	}
+
+	rp.ExpireDue(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !strings.Contains(errorBuf.String(), "expire holds failed") {
+		t.Errorf("expected the failure to be logged, got %q", errorBuf.String())
+	}
+}
+
+func TestReaper_Start(t *testing.T) {
+	var app config.AppConfig
+	var buf bytes.Buffer
+	rp := New(dbrepo.NewTestRepo(&app), log.New(&buf, "", 0), log.New(&buf, "", 0))
+
+	stop := make(chan struct{})
+	done := rp.Start(time.Hour, stop)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the reaper to stop")
+	}
+}
@@ -0,0 +1,267 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405Z"
+	maxLineLength  = 75
+)
+
+// Event is a single all-day VEVENT in a calendar
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	Stamp       time.Time
+}
+
+// Calendar holds a VCALENDAR with its events
+type Calendar struct {
+	ProdID string
+	Name   string
+	Events []Event
+}
+
+// Write writes the calendar to w in iCalendar (RFC 5545) format
+func (c *Calendar) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + c.ProdID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+	}
+	if c.Name != "" {
+		lines = append(lines, "X-WR-CALNAME:"+escapeText(c.Name))
+	}
+
+	for _, e := range c.Events {
+		stamp := e.Stamp
+		if stamp.IsZero() {
+			stamp = time.Now()
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+e.UID,
+			"DTSTAMP:"+stamp.UTC().Format(dateTimeLayout),
+			"DTSTART;VALUE=DATE:"+e.Start.Format(dateLayout),
+			"DTEND;VALUE=DATE:"+e.End.Format(dateLayout),
+			"SUMMARY:"+escapeText(e.Summary),
+		)
+		if e.Description != "" {
+			lines = append(lines, "DESCRIPTION:"+escapeText(e.Description))
+		}
+		lines = append(lines, "TRANSP:OPAQUE", "END:VEVENT")
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, l := range lines {
+		if _, err := bw.WriteString(fold(l)); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Bytes returns the calendar in iCalendar format
+func (c *Calendar) Bytes() []byte {
+	var sb strings.Builder
+	_ = c.Write(&sb)
+	return []byte(sb.String())
+}
+
+// ReservationUID returns the stable UID used for a reservation event
+func ReservationUID(id int, domain string) string {
+	return fmt.Sprintf("reservation-%d@%s", id, domain)
+}
+
+// BlockUID returns the stable UID used for an owner block event
+func BlockUID(id int, domain string) string {
+	return fmt.Sprintf("block-%d@%s", id, domain)
+}
+
+// escapeText escapes a TEXT property value
+func escapeText(s string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return r.Replace(s)
+}
+
+// fold splits a content line into chunks of at most 75 octets, terminated by CRLF
+func fold(line string) string {
+	if len(line) <= maxLineLength {
+		return line + "\r\n"
+	}
+
+	var sb strings.Builder
+	limit := maxLineLength
+	for len(line) > limit {
+		// Do not split in the middle of a multi-byte character
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space, which counts towards the limit
+		limit = maxLineLength - 1
+	}
+	sb.WriteString(line)
+	sb.WriteString("\r\n")
+
+	return sb.String()
+}
+
+// Parse reads an iCalendar stream and returns the VEVENTs it contains
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var current *Event
+
+	for _, line := range lines {
+		name, params, value := splitLine(line)
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			current = &Event{}
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if current == nil {
+				return nil, errors.New("unexpected END:VEVENT")
+			}
+			if current.UID == "" {
+				return nil, errors.New("event without UID")
+			}
+			if current.Start.IsZero() {
+				return nil, fmt.Errorf("event %s has no DTSTART", current.UID)
+			}
+			if current.End.IsZero() {
+				// An all-day event without DTEND lasts one day
+				current.End = current.Start.AddDate(0, 0, 1)
+			}
+			events = append(events, *current)
+			current = nil
+		case current == nil:
+			continue
+		case name == "UID":
+			current.UID = value
+		case name == "SUMMARY":
+			current.Summary = unescapeText(value)
+		case name == "DESCRIPTION":
+			current.Description = unescapeText(value)
+		case name == "DTSTART":
+			current.Start, err = parseDate(value, params)
+			if err != nil {
+				return nil, err
+			}
+		case name == "DTEND":
+			current.End, err = parseDate(value, params)
+			if err != nil {
+				return nil, err
+			}
+		case name == "DTSTAMP":
+			current.Stamp, _ = parseDate(value, "")
+		}
+	}
+
+	if current != nil {
+		return nil, errors.New("unterminated VEVENT")
+	}
+
+	return events, nil
+}
+
+// unfold reads content lines, joining continuation lines
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// splitLine splits a content line into its upper-cased name, parameters and value
+func splitLine(line string) (string, string, string) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), "", ""
+	}
+
+	name, value := line[:colon], line[colon+1:]
+	params := ""
+	if semi := strings.Index(name, ";"); semi >= 0 {
+		name, params = name[:semi], name[semi+1:]
+	}
+
+	return strings.ToUpper(name), strings.ToUpper(params), value
+}
+
+// parseDate parses a DATE or DATE-TIME value, returning the calendar date at midnight UTC
+func parseDate(value, params string) (time.Time, error) {
+	if strings.Contains(params, "VALUE=DATE") && !strings.Contains(params, "VALUE=DATE-TIME") {
+		return time.Parse(dateLayout, value)
+	}
+
+	if len(value) == len(dateLayout) {
+		return time.Parse(dateLayout, value)
+	}
+
+	value = strings.TrimSuffix(value, "Z")
+	t, err := time.Parse("20060102T150405", value)
+	if err != nil {
+		return t, fmt.Errorf("cannot parse date %q: %w", value, err)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// unescapeText reverses escapeText
+func unescapeText(s string) string {
+	r := strings.NewReplacer(
+		`\\`, `\`,
+		`\;`, ";",
+		`\,`, ",",
+		`\n`, "\n",
+		`\N`, "\n",
+	)
+	return r.Replace(s)
+}
@@ -0,0 +1,147 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar_Write(t *testing.T) {
+	layout := "2006-01-02"
+	start, _ := time.Parse(layout, "2050-01-01")
+	end, _ := time.Parse(layout, "2050-01-03")
+
+	cal := Calendar{
+		ProdID: "-//Test//EN",
+		Name:   "General's Quarters",
+		Events: []Event{
+			{
+				UID:     ReservationUID(1, "fsbnb.com"),
+				Summary: "Reserved",
+				Start:   start,
+				End:     end,
+			},
+		},
+	}
+
+	var sb strings.Builder
+	err := cal.Write(&sb)
+	if err != nil {
+		t.Error(err)
+	}
+
+	out := sb.String()
+
+	expected := []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:reservation-1@fsbnb.com\r\n",
+		"DTSTART;VALUE=DATE:20500101\r\n",
+		"DTEND;VALUE=DATE:20500103\r\n",
+		"SUMMARY:Reserved\r\n",
+		"END:VCALENDAR\r\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected to find %q in calendar output but did not", e)
+		}
+	}
+}
+
+func TestEscapeText(t *testing.T) {
+	got := escapeText("a,b;c\\d\ne")
+	if got != `a\,b\;c\\d\ne` {
+		t.Errorf("unexpected escaped text: %s", got)
+	}
+}
+
+func TestFold(t *testing.T) {
+	line := "DESCRIPTION:" + strings.Repeat("x", 200)
+	folded := fold(line)
+
+	for _, l := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(l) > maxLineLength {
+			t.Errorf("folded line is %d octets long, expected at most %d", len(l), maxLineLength)
+		}
+	}
+
+	if strings.ReplaceAll(strings.TrimSuffix(folded, "\r\n"), "\r\n ", "") != line {
+		t.Error("unfolded line does not match original")
+	}
+}
+
+func TestParse(t *testing.T) {
+	feed := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc123@example.com\r\n" +
+		"DTSTART;VALUE=DATE:20500101\r\n" +
+		"DTEND;VALUE=DATE:20500104\r\n" +
+		"SUMMARY:Booked\\, via\r\n" +
+		"  partner\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:def456@example.com\r\n" +
+		"DTSTART:20500110T140000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	events, err := Parse(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if events[0].UID != "abc123@example.com" {
+		t.Errorf("unexpected UID %s", events[0].UID)
+	}
+
+	if events[0].Summary != "Booked, via partner" {
+		t.Errorf("unexpected summary %q", events[0].Summary)
+	}
+
+	if events[0].Start.Format("2006-01-02") != "2050-01-01" || events[0].End.Format("2006-01-02") != "2050-01-04" {
+		t.Errorf("unexpected dates %s - %s", events[0].Start, events[0].End)
+	}
+
+	if events[1].End.Format("2006-01-02") != "2050-01-11" {
+		t.Errorf("expected event without DTEND to last one day, got end %s", events[1].End)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	feeds := []string{
+		"BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20500101\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:x\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:x\r\nDTSTART;VALUE=DATE:2050-01-01\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:x\r\nDTSTART;VALUE=DATE:20500101\r\n",
+	}
+
+	for _, f := range feeds {
+		if _, err := Parse(strings.NewReader(f)); err == nil {
+			t.Errorf("expected error parsing %q", f)
+		}
+	}
+}
+
+func TestParse_RoundTrip(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-02-01")
+	cal := Calendar{
+		ProdID: "-//Test//EN",
+		Events: []Event{
+			{UID: BlockUID(7, "fsbnb.com"), Summary: "Blocked", Start: start, End: start.AddDate(0, 0, 1)},
+		},
+	}
+
+	events, err := Parse(strings.NewReader(string(cal.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].UID != "block-7@fsbnb.com" || !events[0].Start.Equal(start) {
+		t.Errorf("round trip did not preserve event: %+v", events)
+	}
+}
@@ -0,0 +1,184 @@
+package icalsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/ical"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
+)
+
+// maxFeedSize limits how much of a remote feed is read
+const maxFeedSize = 5 << 20
+
+// Syncer imports external calendars as owner blocks
+type Syncer struct {
+	DB       repository.DatabaseRepo
+	Client   *http.Client
+	ErrorLog *log.Logger
+}
+
+// New creates a new syncer
+func New(db repository.DatabaseRepo, errorLog *log.Logger) *Syncer {
+	return &Syncer{
+		DB:       db,
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		ErrorLog: errorLog,
+	}
+}
+
+// Start syncs all external calendars every interval in the background until stop is closed.
+// The returned channel is closed once the sync in progress, if any, has finished.
+func (s *Syncer) Start(interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			s.SyncAll()
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	return done
+}
+
+// SyncAll syncs every registered external calendar
+func (s *Syncer) SyncAll() {
+	sources, err := s.DB.AllICalSources()
+	if err != nil {
+		s.ErrorLog.Println(err)
+		return
+	}
+
+	for _, src := range sources {
+		if err := s.Sync(src); err != nil {
+			s.ErrorLog.Printf("calendar sync for source %d failed: %v", src.ID, err)
+		}
+	}
+}
+
+// Sync imports one external calendar and records the outcome on the source
+func (s *Syncer) Sync(src models.ICalSource) error {
+	err := s.sync(src)
+
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	}
+
+	if statusErr := s.DB.UpdateICalSourceStatus(src.ID, time.Now(), lastError); statusErr != nil {
+		s.ErrorLog.Println(statusErr)
+	}
+
+	return err
+}
+
+func (s *Syncer) sync(src models.ICalSource) error {
+	body, err := s.fetch(src.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	events, err := ical.Parse(io.LimitReader(body, maxFeedSize))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return s.DB.SyncSourceBlocks(src.ID, func(existing []models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, []models.RoomRestriction) {
+		return Plan(src, existing, events, now)
+	})
+}
+
+// fetch opens a feed from an HTTP(S) URL or a local file path
+func (s *Syncer) fetch(location string) (io.ReadCloser, error) {
+	if location == "" {
+		return nil, errors.New("no calendar location set")
+	}
+
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := s.Client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status fetching calendar: %s", resp.Status)
+		}
+
+		return resp.Body, nil
+	}
+
+	return os.Open(strings.TrimPrefix(location, "file://"))
+}
+
+// Plan compares the blocks already imported from a source with the events in its feed,
+// and returns the blocks to insert, update and delete. Blocks that ended before now are kept as
+// history even when the feed drops them, and past events are not imported or moved.
+func Plan(src models.ICalSource, existing []models.RoomRestriction, events []ical.Event, now time.Time) ([]models.RoomRestriction, []models.RoomRestriction, []models.RoomRestriction) {
+	var toInsert, toUpdate, toDelete []models.RoomRestriction
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	current := make(map[string]models.RoomRestriction)
+	for _, r := range existing {
+		current[r.ExternalUID] = r
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if seen[e.UID] || !e.End.After(e.Start) {
+			continue
+		}
+		seen[e.UID] = true
+
+		r, ok := current[e.UID]
+		if (!ok && !e.End.After(today)) || (ok && !r.EndDate.After(today)) {
+			continue
+		}
+		if !ok {
+			toInsert = append(toInsert, models.RoomRestriction{
+				StartDate:     e.Start,
+				EndDate:       e.End,
+				RoomID:        src.RoomID,
+				RestrictionID: 2, // Type: Owner Block
+				SourceID:      src.ID,
+				ExternalUID:   e.UID,
+			})
+			continue
+		}
+
+		if !sameDay(r.StartDate, e.Start) || !sameDay(r.EndDate, e.End) {
+			r.StartDate = e.Start
+			r.EndDate = e.End
+			toUpdate = append(toUpdate, r)
+		}
+	}
+
+	for _, r := range existing {
+		if !seen[r.ExternalUID] && r.EndDate.After(today) {
+			toDelete = append(toDelete, r)
+		}
+	}
+
+	return toInsert, toUpdate, toDelete
+}
+
+// sameDay reports whether two times fall on the same calendar date
+func sameDay(a, b time.Time) bool {
+	return a.Format("2006-01-02") == b.Format("2006-01-02")
+}
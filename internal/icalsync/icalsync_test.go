@@ -0,0 +1,101 @@
+package icalsync
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/ical"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestPlan(t *testing.T) {
+	src := models.ICalSource{ID: 5, RoomID: 2}
+	now := date("2050-01-01")
+
+	existing := []models.RoomRestriction{
+		{ID: 1, ExternalUID: "unchanged", StartDate: date("2050-01-10"), EndDate: date("2050-01-12")},
+		{ID: 2, ExternalUID: "moved", StartDate: date("2050-02-01"), EndDate: date("2050-02-03")},
+		{ID: 3, ExternalUID: "cancelled", StartDate: date("2050-03-01"), EndDate: date("2050-03-03")},
+		{ID: 4, ExternalUID: "ended", StartDate: date("2049-12-20"), EndDate: date("2049-12-22")},
+		{ID: 5, ExternalUID: "ended-dropped", StartDate: date("2049-11-20"), EndDate: date("2049-11-22")},
+		{ID: 6, ExternalUID: "staying", StartDate: date("2049-12-30"), EndDate: date("2050-01-03")},
+	}
+
+	events := []ical.Event{
+		{UID: "unchanged", Start: date("2050-01-10"), End: date("2050-01-12")},
+		{UID: "moved", Start: date("2050-02-05"), End: date("2050-02-07")},
+		{UID: "new", Start: date("2050-04-01"), End: date("2050-04-02")},
+		{UID: "new", Start: date("2050-04-01"), End: date("2050-04-02")},
+		{UID: "past", Start: date("2049-12-01"), End: date("2049-12-02")},
+		{UID: "ended", Start: date("2049-12-21"), End: date("2049-12-22")},
+		{UID: "staying", Start: date("2049-12-30"), End: date("2050-01-03")},
+	}
+
+	toInsert, toUpdate, toDelete := Plan(src, existing, events, now)
+
+	if len(toInsert) != 1 || toInsert[0].ExternalUID != "new" || toInsert[0].SourceID != 5 || toInsert[0].RoomID != 2 {
+		t.Errorf("unexpected blocks to insert: %+v", toInsert)
+	}
+
+	if len(toUpdate) != 1 || toUpdate[0].ID != 2 || !toUpdate[0].StartDate.Equal(date("2050-02-05")) {
+		t.Errorf("unexpected blocks to update: %+v", toUpdate)
+	}
+
+	// Blocks that ended stay as history, whether the feed still has them or not
+	if len(toDelete) != 1 || toDelete[0].ID != 3 {
+		t.Errorf("unexpected blocks to delete: %+v", toDelete)
+	}
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	var app config.AppConfig
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
+	s := New(dbrepo.NewTestRepo(&app), errorLog)
+
+	feed := filepath.Join(t.TempDir(), "feed.ics")
+	err := os.WriteFile(feed, []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nDTSTART;VALUE=DATE:20500101\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Sync(models.ICalSource{ID: 1, RoomID: 1, URL: feed})
+	if err != nil {
+		t.Errorf("expected sync of local file to succeed, got %v", err)
+	}
+
+	err = s.Sync(models.ICalSource{ID: 1, RoomID: 1, URL: filepath.Join(t.TempDir(), "missing.ics")})
+	if err == nil {
+		t.Error("expected sync of missing file to fail")
+	}
+
+	err = s.Sync(models.ICalSource{ID: 1, RoomID: 1})
+	if err == nil {
+		t.Error("expected sync without location to fail")
+	}
+}
+
+func TestSyncer_Start(t *testing.T) {
+	var app config.AppConfig
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
+	s := New(dbrepo.NewTestRepo(&app), errorLog)
+
+	stop := make(chan struct{})
+	done := s.Start(time.Hour, stop)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the sync to stop")
+	}
+}
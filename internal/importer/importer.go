@@ -0,0 +1,351 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/forms"
+	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
+)
+
+// Row statuses
+const (
+	StatusOK       = "ok"
+	StatusImported = "imported"
+	StatusSkipped  = "skipped"
+	StatusError    = "error"
+)
+
+// Columns are the columns read from an import file; headings are matched ignoring case,
+// spaces and underscores, so a file exported from the reservations page can be imported
+var Columns = []string{
+	"first-name", "last-name", "email", "phone", "room", "arrival", "departure",
+	"total", "guests", "processed", "status",
+}
+
+// required are the columns an import file must have
+var required = []string{"first-name", "last-name", "email", "room", "arrival", "departure"}
+
+const dateLayout = "2006-01-02"
+
+// Row is one reservation read from an import file
+type Row struct {
+	Line        int
+	Values      []string
+	Reservation models.Reservation
+	Errors      []string
+	Status      string
+}
+
+// Result is the outcome of an import. Reservations are only imported when every row is
+// valid, and never in a dry run.
+type Result struct {
+	Header   []string
+	Rows     []Row
+	DryRun   bool
+	Imported int
+}
+
+// Failed returns the number of rows with errors
+func (r Result) Failed() int {
+	n := 0
+	for _, row := range r.Rows {
+		if len(row.Errors) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Run reads reservations from a CSV file, validates them and checks that their rooms are
+// free, and imports them with their room restrictions in a single transaction unless
+// this is a dry run or any row has errors. An error is returned when the file itself
+// cannot be read; problems with rows are reported in the result.
+func Run(db repository.DatabaseRepo, in io.Reader, dryRun bool) (Result, error) {
+	result := Result{DryRun: dryRun}
+
+	rooms, err := db.AllRooms()
+	if err != nil {
+		return result, err
+	}
+
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	result.Header, err = r.Read()
+	if err == io.EOF {
+		return result, errors.New("the file is empty")
+	}
+	if err != nil {
+		return result, err
+	}
+
+	index := make(map[string]int)
+	for i, h := range result.Header {
+		index[normalize(h)] = i
+	}
+	var missing []string
+	for _, c := range required {
+		if _, ok := index[c]; !ok {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return result, fmt.Errorf("missing column(s) %s", strings.Join(missing, ", "))
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		line, _ := r.FieldPos(0)
+		if blank(record) {
+			continue
+		}
+
+		values := url.Values{}
+		for _, c := range Columns {
+			if i, ok := index[c]; ok && i < len(record) {
+				values.Set(c, strings.TrimSpace(record[i]))
+			}
+		}
+
+		row := Row{Line: line, Values: record}
+		row.Reservation, row.Errors = parse(values, rooms)
+		result.Rows = append(result.Rows, row)
+	}
+
+	if len(result.Rows) == 0 {
+		return result, errors.New("the file has no reservations")
+	}
+
+	if err = checkAvailability(db, result.Rows); err != nil {
+		return result, err
+	}
+
+	failed := result.Failed()
+	for i := range result.Rows {
+		row := &result.Rows[i]
+		switch {
+		case len(row.Errors) > 0:
+			row.Status = StatusError
+		case dryRun:
+			row.Status = StatusOK
+		case failed > 0:
+			row.Status = StatusSkipped
+		default:
+			row.Status = StatusImported
+		}
+	}
+
+	if dryRun || failed > 0 {
+		return result, nil
+	}
+
+	reservations := make([]models.Reservation, len(result.Rows))
+	for i, row := range result.Rows {
+		reservations[i] = row.Reservation
+	}
+
+	if err = db.ImportReservations(reservations); err != nil {
+		for i := range result.Rows {
+			result.Rows[i].Status = StatusSkipped
+		}
+		return result, err
+	}
+	result.Imported = len(reservations)
+
+	return result, nil
+}
+
+// parse validates the values of a row and returns the reservation they describe
+func parse(values url.Values, rooms []models.Room) (models.Reservation, []string) {
+	var res models.Reservation
+
+	form := forms.New(values)
+	form.Required(required...)
+	form.MinLength("first-name", 3)
+	if form.Has("email") {
+		form.IsEmail("email")
+	}
+
+	res.FirstName = form.Get("first-name")
+	res.LastName = form.Get("last-name")
+	res.Email = form.Get("email")
+	res.Phone = form.Get("phone")
+
+	if form.Has("room") {
+		room, ok := findRoom(rooms, form.Get("room"))
+		if ok {
+			res.RoomID = room.ID
+			res.Room = room
+		} else {
+			form.Errors.Add("room", "No such room")
+		}
+	}
+
+	var err error
+	if form.Has("arrival") {
+		if res.StartDate, err = time.Parse(dateLayout, form.Get("arrival")); err != nil {
+			form.Errors.Add("arrival", "Enter a date such as 2050-01-31")
+		}
+	}
+	if form.Has("departure") {
+		if res.EndDate, err = time.Parse(dateLayout, form.Get("departure")); err != nil {
+			form.Errors.Add("departure", "Enter a date such as 2050-01-31")
+		}
+	}
+	if !res.StartDate.IsZero() && !res.EndDate.IsZero() && !res.EndDate.After(res.StartDate) {
+		form.Errors.Add("departure", "Departure must be after arrival")
+	}
+
+	if form.Has("total") {
+		if res.TotalAmount, err = pricing.ParseAmount(form.Get("total")); err != nil || res.TotalAmount < 0 {
+			form.Errors.Add("total", "Enter an amount such as 200.00")
+		}
+	}
+
+	if form.Has("guests") {
+		if res.Guests, err = strconv.Atoi(form.Get("guests")); err != nil || res.Guests < 0 {
+			form.Errors.Add("guests", "Enter a number of guests")
+		}
+	}
+
+	switch strings.ToLower(form.Get("processed")) {
+	case "", "0", "false", "no", "n":
+	case "1", "true", "yes", "y":
+		res.Processed = 1
+	default:
+		form.Errors.Add("processed", "Enter yes or no")
+	}
+
+	if strings.EqualFold(form.Get("status"), models.StatusCancelled) {
+		form.Errors.Add("status", "Cancelled reservations cannot be imported")
+	}
+
+	return res, formErrors(form)
+}
+
+// checkAvailability reports rows whose room is already taken, in the database or by an
+// earlier row of the file
+func checkAvailability(db repository.DatabaseRepo, rows []Row) error {
+	var accepted []*Row
+	for i := range rows {
+		row := &rows[i]
+		if len(row.Errors) > 0 {
+			continue
+		}
+		res := row.Reservation
+
+		available, err := db.SearchAvailabilityByDatesByRoomID(res.StartDate, res.EndDate, res.RoomID)
+		if err != nil {
+			return err
+		}
+		if !available {
+			row.Errors = append(row.Errors, fmt.Sprintf("room: %s is not available from %s to %s",
+				res.Room.RoomName, res.StartDate.Format(dateLayout), res.EndDate.Format(dateLayout)))
+			continue
+		}
+
+		for _, other := range accepted {
+			o := other.Reservation
+			if o.RoomID == res.RoomID && res.StartDate.Before(o.EndDate) && o.StartDate.Before(res.EndDate) {
+				row.Errors = append(row.Errors, fmt.Sprintf("room: overlaps the reservation on line %d", other.Line))
+				break
+			}
+		}
+		if len(row.Errors) == 0 {
+			accepted = append(accepted, row)
+		}
+	}
+
+	// Guests can manage imported reservations like any other
+	for _, row := range accepted {
+		token, err := helpers.RandomToken()
+		if err != nil {
+			return err
+		}
+		row.Reservation.AccessToken = token
+	}
+
+	return nil
+}
+
+// WriteCSV writes the import file back with the status and errors of each row in front
+func (r Result) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	header := append([]string{"line", "status", "errors"}, r.Header...)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, row := range r.Rows {
+		record := append([]string{strconv.Itoa(row.Line), row.Status, strings.Join(row.Errors, "; ")}, row.Values...)
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// formErrors returns a form's errors as "field: message", sorted by field
+func formErrors(form *forms.Form) []string {
+	var fields []string
+	for field := range form.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var messages []string
+	for _, field := range fields {
+		for _, message := range form.Errors[field] {
+			messages = append(messages, field+": "+message)
+		}
+	}
+	return messages
+}
+
+// findRoom finds a room by ID or by name, ignoring case
+func findRoom(rooms []models.Room, s string) (models.Room, bool) {
+	id, _ := strconv.Atoi(s)
+	for _, room := range rooms {
+		if (id > 0 && room.ID == id) || strings.EqualFold(room.RoomName, s) {
+			return room, true
+		}
+	}
+	return models.Room{}, false
+}
+
+// normalize turns a heading such as "First Name" into a column name such as "first-name"
+func normalize(heading string) string {
+	heading = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(heading, "\ufeff")))
+	return strings.NewReplacer(" ", "-", "_", "-").Replace(heading)
+}
+
+func blank(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
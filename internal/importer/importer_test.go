@@ -0,0 +1,153 @@
+package importer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+)
+
+const validFile = `First Name,Last Name,Email,Phone,Room,Arrival,Departure,Total,Guests,Processed
+John,Smith,john@smith.com,555-1234,Major's Quarters,2030-01-01,2030-01-03,200.00,2,yes
+Jane,Doe,jane@doe.com,,1,2030-01-03,2030-01-05,,,
+
+`
+
+func TestRun_DryRun(t *testing.T) {
+	var app config.AppConfig
+	result, err := Run(dbrepo.NewTestRepo(&app), strings.NewReader(validFile), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(result.Rows))
+	}
+	if result.Failed() != 0 || result.Imported != 0 {
+		t.Errorf("expected no failures and nothing imported, got %d and %d", result.Failed(), result.Imported)
+	}
+
+	john := result.Rows[0]
+	if john.Status != StatusOK || john.Line != 2 {
+		t.Errorf("unexpected row %+v", john)
+	}
+	res := john.Reservation
+	if res.RoomID != 1 || res.TotalAmount != 20000 || res.Guests != 2 || res.Processed != 1 || res.AccessToken == "" {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+	if result.Rows[1].Reservation.RoomID != 1 {
+		t.Error("expected the room to be found by ID")
+	}
+}
+
+func TestRun_Import(t *testing.T) {
+	var app config.AppConfig
+	result, err := Run(dbrepo.NewTestRepo(&app), strings.NewReader(validFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Imported != 2 {
+		t.Errorf("expected 2 reservations imported, got %d", result.Imported)
+	}
+	for _, row := range result.Rows {
+		if row.Status != StatusImported {
+			t.Errorf("expected line %d to be imported, got %s", row.Line, row.Status)
+		}
+	}
+
+	// The database refuses the import
+	failing := strings.Replace(validFile, "Smith", "Fail", 1)
+	result, err = Run(dbrepo.NewTestRepo(&app), strings.NewReader(failing), false)
+	if err == nil || result.Imported != 0 {
+		t.Error("expected the import to fail")
+	}
+}
+
+func TestRun_RowErrors(t *testing.T) {
+	file := `first_name,last_name,email,room,arrival,departure,total,processed,status
+Al,Smith,john@smith.com,Major's Quarters,2030-01-01,2030-01-03,,,
+John,Smith,not-an-email,Nowhere,2030-01-05,2030-01-04,-1,maybe,
+John,Smith,john@smith.com,Major's Quarters,2030-02-01,2030-02-05,,,
+Jane,Doe,jane@doe.com,Major's Quarters,2030-02-04,2030-02-06,,,
+Jane,Doe,jane@doe.com,Major's Quarters,2045-01-01,2045-01-02,,,
+Jane,Doe,jane@doe.com,Major's Quarters,2030-03-01,2030-03-02,,,cancelled
+`
+	var app config.AppConfig
+	result, err := Run(dbrepo.NewTestRepo(&app), strings.NewReader(file), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Imported != 0 {
+		t.Error("expected nothing to be imported when a row has errors")
+	}
+
+	expected := []struct {
+		status string
+		errors []string
+	}{
+		{StatusError, []string{"first-name: This field must be at least 3 chars long"}},
+		{StatusError, []string{
+			"departure: Departure must be after arrival",
+			"email: Invalid email address",
+			"processed: Enter yes or no",
+			"room: No such room",
+			"total: Enter an amount such as 200.00",
+		}},
+		{StatusSkipped, nil},
+		{StatusError, []string{"room: overlaps the reservation on line 4"}},
+		{StatusError, []string{"room: Major's Quarters is not available from 2045-01-01 to 2045-01-02"}},
+		{StatusError, []string{"status: Cancelled reservations cannot be imported"}},
+	}
+
+	for i, e := range expected {
+		row := result.Rows[i]
+		if row.Status != e.status {
+			t.Errorf("line %d: expected status %s, got %s", row.Line, e.status, row.Status)
+		}
+		if strings.Join(row.Errors, "|") != strings.Join(e.errors, "|") {
+			t.Errorf("line %d: expected errors %q, got %q", row.Line, e.errors, row.Errors)
+		}
+	}
+}
+
+func TestRun_FileErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":           "",
+		"missing columns": "first-name,last-name\nJohn,Smith\n",
+		"no rows":         "first-name,last-name,email,room,arrival,departure\n",
+		"bad quoting":     "first-name,last-name,email,room,arrival,departure\n\"John,Smith\n",
+		"query failure":   "first-name,last-name,email,room,arrival,departure\nJohn,Smith,john@smith.com,1,2060-01-01,2060-01-02\n",
+	}
+
+	var app config.AppConfig
+	for name, file := range tests {
+		if _, err := Run(dbrepo.NewTestRepo(&app), strings.NewReader(file), true); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestResult_WriteCSV(t *testing.T) {
+	var app config.AppConfig
+	result, _ := Run(dbrepo.NewTestRepo(&app), strings.NewReader(strings.Replace(validFile, "2030-01-03,200.00", "2030-01-03,lots", 1)), true)
+
+	var buf bytes.Buffer
+	if err := result.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if lines[0] != "line,status,errors,First Name,Last Name,Email,Phone,Room,Arrival,Departure,Total,Guests,Processed" {
+		t.Errorf("unexpected header %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "2,error,total: Enter an amount such as 200.00,John,Smith,") {
+		t.Errorf("unexpected row %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "3,ok,,Jane,Doe,") {
+		t.Errorf("unexpected row %s", lines[2])
+	}
+}
@@ -0,0 +1,209 @@
+package invoice
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/payments"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+)
+
+const (
+	margin     = 50.0
+	lineHeight = 16.0
+	dateLayout = "2006-01-02"
+)
+
+// Property holds the details of the business printed at the top of every invoice
+type Property struct {
+	Name    string
+	Address string
+	Email   string
+	TaxID   string
+}
+
+// Invoice is everything printed on an invoice for a reservation
+type Invoice struct {
+	Number      int
+	IssuedAt    time.Time
+	Property    Property
+	Reservation models.Reservation
+	Lines       []pricing.LineItem
+	Payments    []models.Payment
+}
+
+// FormatNumber formats a sequential invoice number for display
+func FormatNumber(n int) string {
+	return fmt.Sprintf("INV-%06d", n)
+}
+
+// Filename returns the file name the invoice is downloaded or attached as
+func (inv Invoice) Filename() string {
+	return FormatNumber(inv.Number) + ".pdf"
+}
+
+// Render renders the invoice as a PDF
+func Render(inv Invoice) []byte {
+	r := renderer{}
+	r.doc.newPage()
+	r.y = pageHeight - margin
+
+	res := inv.Reservation
+	right := pageWidth - margin
+
+	// Property and invoice details
+	r.doc.text(margin, r.y-8, 18, true, inv.Property.Name)
+	r.doc.textRight(right, r.y-8, 18, true, "INVOICE")
+	r.y -= 30
+
+	details := []string{
+		"Invoice " + FormatNumber(inv.Number),
+		"Date " + inv.IssuedAt.Format(dateLayout),
+		fmt.Sprintf("Reservation #%d", res.ID),
+	}
+	var property []string
+	for _, l := range strings.Split(inv.Property.Address, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			property = append(property, l)
+		}
+	}
+	if inv.Property.Email != "" {
+		property = append(property, inv.Property.Email)
+	}
+	if inv.Property.TaxID != "" {
+		property = append(property, "Tax ID "+inv.Property.TaxID)
+	}
+	for i := 0; i < len(property) || i < len(details); i++ {
+		if i < len(property) {
+			r.doc.text(margin, r.y, 10, false, property[i])
+		}
+		if i < len(details) {
+			r.doc.textRight(right, r.y, 10, false, details[i])
+		}
+		r.y -= 14
+	}
+	r.y -= 20
+
+	// Guest and stay
+	col := margin + 260
+	r.doc.text(margin, r.y, 10, true, "Bill to")
+	r.doc.text(col, r.y, 10, true, "Stay")
+	r.y -= 14
+
+	guest := []string{res.FirstName + " " + res.LastName, res.Email, res.Phone}
+	stay := []string{
+		res.Room.RoomName,
+		"Arrival " + res.StartDate.Format(dateLayout),
+		"Departure " + res.EndDate.Format(dateLayout),
+		fmt.Sprintf("%d night(s)", pricing.Nights(res.StartDate, res.EndDate)),
+	}
+	if res.Guests > 0 {
+		stay = append(stay, fmt.Sprintf("%d guest(s)", res.Guests))
+	}
+	for i := 0; i < len(guest) || i < len(stay); i++ {
+		if i < len(guest) {
+			r.doc.text(margin, r.y, 10, false, guest[i])
+		}
+		if i < len(stay) {
+			r.doc.text(col, r.y, 10, false, stay[i])
+		}
+		r.y -= 14
+	}
+	r.y -= 20
+
+	// Charges
+	r.header("Description", "Amount")
+	for _, l := range inv.Lines {
+		r.row(l.Description, pricing.FormatAmount(l.Amount), false)
+	}
+	r.rule()
+	r.row("Total", pricing.FormatAmount(res.TotalAmount), true)
+
+	taxes := 0
+	for _, l := range inv.Lines {
+		if l.Kind == pricing.LineTax {
+			taxes += l.Amount
+		}
+	}
+	if taxes > 0 {
+		r.row("Includes taxes of", pricing.FormatAmount(taxes), false)
+	}
+	r.y -= 20
+
+	// Payments
+	var received []models.Payment
+	for _, p := range inv.Payments {
+		if p.Status == payments.StatusCaptured || p.Status == payments.StatusRefunded {
+			received = append(received, p)
+		}
+	}
+
+	r.header("Payments", "Amount")
+	for _, p := range received {
+		description := p.CreatedAt.Format(dateLayout) + "  Card payment"
+		if p.CardLast4 != "" {
+			description += " ending " + p.CardLast4
+		}
+		r.row(description, pricing.FormatAmount(p.Amount), false)
+		if p.RefundedAmount > 0 {
+			r.row(p.UpdatedAt.Format(dateLayout)+"  Refund", pricing.FormatAmount(-p.RefundedAmount), false)
+		}
+	}
+	if len(received) == 0 {
+		r.row("No payments received", "", false)
+	}
+	r.rule()
+	r.row("Total paid", pricing.FormatAmount(res.PaidAmount-res.RefundedAmount), true)
+
+	if res.Cancelled() {
+		r.row("Cancelled on "+res.CancelledAt.Format(dateLayout)+", cancellation fee",
+			pricing.FormatAmount(res.CancellationPenalty), false)
+	} else {
+		r.row("Balance due", pricing.FormatAmount(res.OutstandingAmount()), true)
+	}
+
+	r.y -= 30
+	r.ensure(lineHeight)
+	r.doc.text(margin, r.y, 9, false, "Thank you for staying with "+inv.Property.Name+".")
+
+	return r.doc.bytes()
+}
+
+// renderer keeps track of the position on the page while an invoice is laid out
+type renderer struct {
+	doc document
+	y   float64
+}
+
+// ensure starts a new page unless there is room for height more points
+func (r *renderer) ensure(height float64) {
+	if r.y-height < margin {
+		r.doc.newPage()
+		r.y = pageHeight - margin
+	}
+}
+
+// header draws the shaded heading row of a table
+func (r *renderer) header(left, right string) {
+	r.ensure(3 * lineHeight)
+	r.doc.shade(margin, r.y-5, pageWidth-2*margin, lineHeight+2)
+	r.doc.text(margin+5, r.y, 10, true, left)
+	r.doc.textRight(pageWidth-margin-5, r.y, 10, true, right)
+	r.y -= lineHeight + 4
+}
+
+// row draws a table row with a description and a right-aligned amount
+func (r *renderer) row(left, right string, bold bool) {
+	r.ensure(lineHeight)
+	r.doc.text(margin+5, r.y, 10, bold, left)
+	r.doc.textRight(pageWidth-margin-5, r.y, 10, bold, right)
+	r.y -= lineHeight
+}
+
+// rule draws a line under the rows of a table
+func (r *renderer) rule() {
+	r.doc.line(margin, r.y+lineHeight-4, pageWidth-margin, r.y+lineHeight-4)
+	r.y -= 4
+}
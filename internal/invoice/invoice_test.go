@@ -0,0 +1,167 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+)
+
+func testInvoice() Invoice {
+	layout := "2006-01-02"
+	start, _ := time.Parse(layout, "2050-01-01")
+	end, _ := time.Parse(layout, "2050-01-03")
+	issued, _ := time.Parse(layout, "2049-12-01")
+
+	return Invoice{
+		Number:   42,
+		IssuedAt: issued,
+		Property: Property{
+			Name:    "Fort Smythe BnB",
+			Address: "1 Main Street\nSmythe (North)",
+			Email:   "manager@fsbnb.com",
+			TaxID:   "TX-123",
+		},
+		Reservation: models.Reservation{
+			ID:          7,
+			FirstName:   "John",
+			LastName:    "Smith",
+			Email:       "john@smith.com",
+			StartDate:   start,
+			EndDate:     end,
+			Room:        models.Room{RoomName: "General's Quarters"},
+			TotalAmount: 20000,
+			PaidAmount:  5000,
+		},
+		Lines: []pricing.LineItem{
+			{Description: "2 night(s) x 100.00", Amount: 20000},
+		},
+		Payments: []models.Payment{
+			{Amount: 5000, CardLast4: "4242", Status: "captured", CreatedAt: issued},
+			{Amount: 5000, Status: "failed", CreatedAt: issued},
+		},
+	}
+}
+
+func TestRender(t *testing.T) {
+	out := Render(testInvoice())
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) {
+		t.Error("missing PDF header")
+	}
+	if !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Error("missing PDF trailer")
+	}
+
+	expected := []string{
+		"(Invoice INV-000042)",
+		"(Reservation #7)",
+		"(Smythe \\(North\\))",
+		"(Tax ID TX-123)",
+		"(General's Quarters)",
+		"(2 night\\(s\\) x 100.00)",
+		"(2049-12-01  Card payment ending 4242)",
+		"(Balance due)",
+		"(150.00)",
+	}
+	for _, e := range expected {
+		if !bytes.Contains(out, []byte(e)) {
+			t.Errorf("expected PDF to contain %s", e)
+		}
+	}
+
+	if bytes.Count(out, []byte("Card payment")) != 1 {
+		t.Error("expected only the captured payment to be listed")
+	}
+}
+
+func TestRender_CrossReferenceTable(t *testing.T) {
+	out := Render(testInvoice())
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if m == nil {
+		t.Fatal("missing startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(out[xref:], -1)
+	if len(entries) == 0 {
+		t.Fatal("no objects in xref table")
+	}
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		prefix := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !bytes.HasPrefix(out[offset:], []byte(prefix)) {
+			t.Errorf("xref entry %d points at the wrong offset %d", i+1, offset)
+		}
+	}
+}
+
+func TestRender_NewPages(t *testing.T) {
+	inv := testInvoice()
+	for i := 0; i < 60; i++ {
+		inv.Lines = append(inv.Lines, pricing.LineItem{Description: "Extra", Amount: 100})
+	}
+
+	out := Render(inv)
+	if !bytes.Contains(out, []byte("/Count 2 >>")) {
+		t.Error("expected a long invoice to use two pages")
+	}
+}
+
+func TestRender_Cancelled(t *testing.T) {
+	inv := testInvoice()
+	inv.Reservation.CancelledAt = time.Date(2049, 12, 10, 0, 0, 0, 0, time.UTC)
+	inv.Reservation.CancellationPenalty = 5000
+
+	out := string(Render(inv))
+	if !strings.Contains(out, "(Cancelled on 2049-12-10, cancellation fee)") {
+		t.Error("expected the cancellation to be shown")
+	}
+	if strings.Contains(out, "(Balance due)") {
+		t.Error("did not expect a balance due on a cancelled reservation")
+	}
+}
+
+func TestRender_Taxes(t *testing.T) {
+	inv := testInvoice()
+	inv.Reservation.Guests = 2
+	inv.Lines = append(inv.Lines, pricing.LineItem{Kind: pricing.LineTax, Description: "City tax", Amount: 1000})
+
+	out := string(Render(inv))
+	for _, e := range []string{"(2 guest\\(s\\))", "(City tax)", "(Includes taxes of)", "(10.00)"} {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected PDF to contain %s", e)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	if got := FormatNumber(42); got != "INV-000042" {
+		t.Errorf("expected INV-000042, got %s", got)
+	}
+	if got := (Invoice{Number: 1234567}).Filename(); got != "INV-1234567.pdf" {
+		t.Errorf("expected INV-1234567.pdf, got %s", got)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if got := escape(encode(`a(b)\c é €`)); got != `a\(b\)\\c \351 ?` {
+		t.Errorf("unexpected escaped string %s", got)
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	if got := textWidth("10.00", 10, false); got != 25.02 {
+		t.Errorf("expected 25.02, got %v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package lockout
+
+import "time"
+
+// Policy is how failed logins are slowed down. After FreeAttempts failures each further
+// failure blocks logins for twice as long as the one before, starting at BaseDelay and up to
+// MaxDelay. MaxAttempts failures lock logins out for Lockout.
+type Policy struct {
+	FreeAttempts int
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Lockout      time.Duration
+}
+
+// Account is the policy for the failed logins to an account, counted by email address whether
+// or not an account has it, so that the answers do not tell who has one
+var Account = Policy{
+	FreeAttempts: 2,
+	MaxAttempts:  5,
+	BaseDelay:    2 * time.Second,
+	MaxDelay:     time.Minute,
+	Lockout:      15 * time.Minute,
+}
+
+// IP is the policy for the failed logins from a client IP address, more lenient as people
+// share addresses, but enough to stop guessing the passwords of many accounts
+var IP = Policy{
+	FreeAttempts: 10,
+	MaxAttempts:  50,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	Lockout:      time.Hour,
+}
+
+// Reset is how long after the last failure the failures are forgotten
+const Reset = 24 * time.Hour
+
+// Block returns until when logins are blocked after a number of failures at now, and whether
+// the failures lock logins out. The time is zero when logins are not blocked.
+func (p Policy) Block(failures int, now time.Time) (time.Time, bool) {
+	if failures >= p.MaxAttempts {
+		return now.Add(p.Lockout), true
+	}
+	if failures <= p.FreeAttempts {
+		return time.Time{}, false
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return now.Add(delay), false
+}
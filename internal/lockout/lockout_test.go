@@ -0,0 +1,52 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicy_Block(t *testing.T) {
+	p := Policy{FreeAttempts: 2, MaxAttempts: 8, BaseDelay: time.Second, MaxDelay: 5 * time.Second, Lockout: time.Hour}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		delay    time.Duration
+		locked   bool
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{5, 4 * time.Second, false},
+		{6, 5 * time.Second, false},
+		{7, 5 * time.Second, false},
+		{8, time.Hour, true},
+		{20, time.Hour, true},
+	}
+
+	for _, e := range tests {
+		until, locked := p.Block(e.failures, now)
+		if locked != e.locked {
+			t.Errorf("%d failures: expected locked %t, got %t", e.failures, e.locked, locked)
+		}
+		if e.delay == 0 && !until.IsZero() {
+			t.Errorf("%d failures: expected no block, got until %s", e.failures, until)
+		}
+		if e.delay != 0 && until.Sub(now) != e.delay {
+			t.Errorf("%d failures: expected a block of %s, got %s", e.failures, e.delay, until.Sub(now))
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	// The account locks out before the client IP address, which many accounts share
+	for _, p := range []Policy{Account, IP} {
+		if p.FreeAttempts >= p.MaxAttempts || p.BaseDelay > p.MaxDelay || p.MaxDelay > p.Lockout {
+			t.Errorf("inconsistent policy %+v", p)
+		}
+	}
+	if Account.MaxAttempts >= IP.MaxAttempts {
+		t.Error("expected accounts to lock out before client IP addresses")
+	}
+}
@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// File writes each message to a .eml file in a directory, which mail programs open, instead
+// of sending it
+type File struct {
+	cfg Config
+}
+
+// NewFile creates a new mailer writing to the directory of the config
+func NewFile(cfg Config) *File {
+	return &File{cfg: cfg}
+}
+
+// Send writes a message to a new file, named after the time so they sort in order
+func (f *File) Send(msg models.MailData) error {
+	email, err := compose(f.cfg, msg)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(f.cfg.Dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err = rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(f.cfg.Dir, name), []byte(message(email)), 0o644)
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"log"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Log only logs each message, with its content so links in it can be followed, instead of
+// sending it
+type Log struct {
+	infoLog *log.Logger
+}
+
+// NewLog creates a new mailer logging to a logger
+func NewLog(infoLog *log.Logger) *Log {
+	return &Log{infoLog: infoLog}
+}
+
+// Send logs a message
+func (l *Log) Send(msg models.MailData) error {
+	l.infoLog.Printf("mail to %s from %s: %s\n%s", msg.To, msg.From, msg.Subject, msg.Content)
+	for _, a := range msg.Attachments {
+		l.infoLog.Printf("attachment %s (%s, %d bytes)", a.Name, a.MimeType, len(a.Data))
+	}
+	return nil
+}
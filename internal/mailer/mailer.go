@@ -0,0 +1,159 @@
+package mailer
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/toorop/go-dkim"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(models.MailData) error
+}
+
+// Config holds the mail settings
+type Config struct {
+	// Transport is how mail is sent: smtp, file or log
+	Transport string
+
+	// The SMTP server; Encryption is none, starttls or tls
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+
+	// From replaces the sender of every message when set
+	From string
+
+	// DKIMKey is the PEM private key messages are signed with, with DKIMSelector, when set
+	DKIMKey      []byte
+	DKIMSelector string
+
+	// Dir is where the file transport writes messages
+	Dir string
+}
+
+// New returns the mailer for the transport in the config. The file and log transports send
+// nothing, for working offline.
+func New(cfg Config, infoLog *log.Logger) (Mailer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Transport {
+	case "smtp":
+		return NewSMTP(cfg)
+	case "file":
+		if cfg.Dir == "" {
+			return nil, errors.New("the file mail transport needs a directory")
+		}
+		return NewFile(cfg), nil
+	case "log":
+		return NewLog(infoLog), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.Transport)
+	}
+}
+
+// validate checks the sender address and the DKIM key, so a bad setting fails at startup
+// rather than on every message
+func (cfg Config) validate() error {
+	if cfg.From != "" && domain(cfg.From) == "" {
+		return fmt.Errorf("invalid from address %q", cfg.From)
+	}
+	if len(cfg.DKIMKey) == 0 {
+		return nil
+	}
+	if cfg.DKIMSelector == "" {
+		return errors.New("a DKIM key needs a selector")
+	}
+	if cfg.From == "" {
+		return errors.New("a DKIM key needs a from address to sign for")
+	}
+	return checkDKIMKey(cfg.DKIMKey)
+}
+
+// checkDKIMKey parses the key the way messages are signed with it: a PEM RSA key in PKCS1 or PKCS8
+func checkDKIMKey(key []byte) error {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("the DKIM key is not PEM encoded")
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cannot parse the DKIM key: %w", err)
+	}
+	if _, ok := k.(*rsa.PrivateKey); !ok {
+		return errors.New("the DKIM key is not an RSA key")
+	}
+	return nil
+}
+
+// compose builds the email for a message, signed with the DKIM key of the config if it has one
+func compose(cfg Config, msg models.MailData) (*mail.Email, error) {
+	from := msg.From
+	if cfg.From != "" {
+		from = cfg.From
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(from).AddTo(msg.To).SetSubject(msg.Subject)
+	email.SetBody(mail.TextHTML, msg.Content)
+
+	for _, a := range msg.Attachments {
+		email.Attach(&mail.File{
+			Name:     a.Name,
+			MimeType: a.MimeType,
+			Data:     a.Data,
+		})
+	}
+
+	if len(cfg.DKIMKey) > 0 {
+		options := dkim.NewSigOptions()
+		options.PrivateKey = cfg.DKIMKey
+		options.Domain = domain(from)
+		if options.Domain == "" {
+			return nil, fmt.Errorf("cannot sign mail from %q: no domain", from)
+		}
+		options.Selector = cfg.DKIMSelector
+		options.Headers = []string{"from", "to", "subject", "date", "mime-version", "content-type"}
+		email.SetDkim(options)
+	}
+
+	return email, email.GetError()
+}
+
+// message returns the email as it is sent, signed if it was
+func message(email *mail.Email) string {
+	if email.DkimMsg != "" {
+		return email.DkimMsg
+	}
+	return email.GetMessage()
+}
+
+// domain returns the domain of an email address, which may be written as "Name <address>",
+// or "" if it is not a valid address
+func domain(address string) string {
+	a, err := netmail.ParseAddress(address)
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndex(a.Address, "@")
+	if at < 0 {
+		return ""
+	}
+	return a.Address[at+1:]
+}
@@ -0,0 +1,155 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+var testMessage = models.MailData{
+	To:      "john@smith.com",
+	From:    "manager@fsbnb.com",
+	Subject: "Reservation Confirmation",
+	Content: "<strong>Reservation Confirmation</strong>",
+	Attachments: []models.MailAttachment{
+		{Name: "reservation.ics", MimeType: "text/calendar", Data: []byte("BEGIN:VCALENDAR")},
+	},
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		tcName   string
+		cfg      Config
+		expected string
+	}{
+		{"smtp", Config{Transport: "smtp", Host: "localhost", Port: 1025, Encryption: "starttls"}, "*mailer.SMTP"},
+		{"file", Config{Transport: "file", Dir: t.TempDir()}, "*mailer.File"},
+		{"log", Config{Transport: "log"}, "*mailer.Log"},
+		{"unknown encryption", Config{Transport: "smtp", Encryption: "ssl"}, ""},
+		{"file without a directory", Config{Transport: "file"}, ""},
+		{"unknown transport", Config{Transport: "pigeon"}, ""},
+		{"dkim", Config{Transport: "log", From: "bookings@fsbnb.com", DKIMKey: testKey(t), DKIMSelector: "mail"}, "*mailer.Log"},
+		{"invalid from address", Config{Transport: "log", From: "bookings"}, ""},
+		{"bad dkim key", Config{Transport: "log", From: "bookings@fsbnb.com", DKIMKey: []byte("not a key"), DKIMSelector: "mail"}, ""},
+		{"dkim without a selector", Config{Transport: "log", From: "bookings@fsbnb.com", DKIMKey: testKey(t)}, ""},
+		{"dkim without a from address", Config{Transport: "log", DKIMKey: testKey(t), DKIMSelector: "mail"}, ""},
+	}
+
+	for _, e := range tests {
+		m, err := New(e.cfg, log.New(&bytes.Buffer{}, "", 0))
+		if e.expected == "" {
+			if err == nil {
+				t.Errorf("failed %s: expected an error", e.tcName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed %s: %v", e.tcName, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", m); got != e.expected {
+			t.Errorf("failed %s: expected %s, got %s", e.tcName, e.expected, got)
+		}
+	}
+}
+
+func TestFile_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := NewFile(Config{Dir: dir, From: "Fort Smythe BnB <bookings@fsbnb.com>"})
+
+	for i := 0; i < 2; i++ {
+		if err := m.Send(testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"To: <john@smith.com>", `From: "Fort Smythe BnB" <bookings@fsbnb.com>`,
+		"Subject: Reservation Confirmation", `filename="reservation.ics"`} {
+		if !strings.Contains(string(b), e) {
+			t.Errorf("expected the message to contain %s, got %s", e, b)
+		}
+	}
+}
+
+// testKey returns a PEM RSA private key for signing
+func testKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestFile_SendDKIM(t *testing.T) {
+	pemKey := testKey(t)
+
+	dir := t.TempDir()
+	m := NewFile(Config{Dir: dir, DKIMKey: pemKey, DKIMSelector: "mail"})
+	if err := m.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	b, _ := os.ReadFile(files[0])
+	if !strings.HasPrefix(string(b), "DKIM-Signature:") || !strings.Contains(string(b), "d=fsbnb.com") || !strings.Contains(string(b), "s=mail") {
+		t.Errorf("expected a DKIM signature for fsbnb.com, got %s", b)
+	}
+
+	bad := NewFile(Config{Dir: dir, DKIMKey: []byte("not a key"), DKIMSelector: "mail"})
+	if err := bad.Send(testMessage); err == nil {
+		t.Error("expected an error signing with a bad key")
+	}
+}
+
+func TestLog_Send(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewLog(log.New(&buf, "", 0))
+
+	if err := m.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"mail to john@smith.com", "Reservation Confirmation", "<strong>", "attachment reservation.ics"} {
+		if !strings.Contains(buf.String(), e) {
+			t.Errorf("expected the log to contain %s, got %s", e, buf.String())
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	for address, expected := range map[string]string{
+		"manager@fsbnb.com":                    "fsbnb.com",
+		"Fort Smythe BnB <bookings@fsbnb.com>": "fsbnb.com",
+		" Bookings <bookings@mail.fsbnb.com> ": "mail.fsbnb.com",
+		"bookings":                             "",
+		"":                                     "",
+	} {
+		if got := domain(address); got != expected {
+			t.Errorf("%s: expected %s, got %s", address, expected, got)
+		}
+	}
+}
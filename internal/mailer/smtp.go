@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// encryptions are the SMTP encryption settings by name
+var encryptions = map[string]mail.Encryption{
+	"none":     mail.EncryptionNone,
+	"starttls": mail.EncryptionSTARTTLS,
+	"tls":      mail.EncryptionSSLTLS,
+}
+
+// SMTP sends mail through an SMTP server, connecting for each message
+type SMTP struct {
+	cfg    Config
+	server *mail.SMTPServer
+}
+
+// NewSMTP creates a new mailer sending through the SMTP server of the config
+func NewSMTP(cfg Config) (*SMTP, error) {
+	encryption, ok := encryptions[cfg.Encryption]
+	if !ok {
+		return nil, fmt.Errorf("unknown mail encryption %q", cfg.Encryption)
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = cfg.Host
+	server.Port = cfg.Port
+	server.Username = cfg.Username
+	server.Password = cfg.Password
+	server.Encryption = encryption
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	return &SMTP{cfg: cfg, server: server}, nil
+}
+
+// Send sends a message
+func (s *SMTP) Send(msg models.MailData) error {
+	email, err := compose(s.cfg, msg)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return email.Send(client)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 )
 
@@ -18,16 +19,160 @@ type User struct {
 	FirstName   string
 	LastName    string
 	Email       string
+	Phone       string
 	Password    string
 	AccessLevel int
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+
+	// EmailVerifiedAt is zero until a guest follows the link sent when they register
+	EmailVerifiedAt time.Time
+
+	// DeactivatedAt is set when the user is no longer allowed to log in
+	DeactivatedAt time.Time
+
+	// PasswordChangedAt is when the password was last changed; sessions older than that end
+	PasswordChangedAt time.Time
+
+	// TOTPSecret is the secret shared with the user's authenticator app. Two-factor
+	// authentication is on from TOTPEnabledAt, once they have entered a code from the app.
+	TOTPSecret    string
+	TOTPEnabledAt time.Time
+}
+
+// Access levels, the role of a user. Guests cannot use the admin tool; what each staff role
+// can do there is set in the rbac package. Owners have 3, the level the first admin users
+// were created with.
+const (
+	AccessLevelGuest        = 0
+	AccessLevelHousekeeping = 1
+	AccessLevelFrontDesk    = 2
+	AccessLevelOwner        = 3
+	AccessLevelManager      = 4
+)
+
+// IsGuest reports whether the user has a guest account rather than being staff
+func (u User) IsGuest() bool {
+	return u.AccessLevel == AccessLevelGuest
+}
+
+// Active reports whether the user can log in
+func (u User) Active() bool {
+	return u.DeactivatedAt.IsZero()
+}
+
+// TwoFactorEnabled reports whether the user logs in with a code from an authenticator app too
+func (u User) TwoFactorEnabled() bool {
+	return !u.TOTPEnabledAt.IsZero()
+}
+
+// User token purposes
+const (
+	TokenVerifyEmail   = "verify-email"
+	TokenSetPassword   = "set-password"
+	TokenResetPassword = "reset-password"
+)
+
+// UserToken is a single use token emailed to a user, stored as a hash
+type UserToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Scopes of login throttles: the failed logins to an account, by email address, and from a
+// client IP address
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+// LoginThrottle counts the failed logins in a scope. Logins are refused until BlockedUntil, and
+// LockedAt is set when the failures locked logins out rather than slowing them down.
+type LoginThrottle struct {
+	ID            int
+	Scope         string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	BlockedUntil  time.Time
+	LockedAt      time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+
+	// User is the user of a locked account, for the admin tool
+	User User
+}
+
+// Locked reports whether logins are locked out at a time
+func (t LoginThrottle) Locked(now time.Time) bool {
+	return !t.LockedAt.IsZero() && now.Before(t.BlockedUntil)
+}
+
+// UserSession is a session a user is logged in with, for the sessions page. ID identifies it
+// without showing its token.
+type UserSession struct {
+	ID         string
+	Current    bool
+	IP         string
+	UserAgent  string
+	LoggedInAt time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Device describes the browser and operating system of the session from its user agent, such
+// as "Firefox on Windows"
+func (s UserSession) Device() string {
+	if s.UserAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, b := range [][2]string{{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}} {
+		if strings.Contains(s.UserAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+
+	for _, o := range [][2]string{{"Windows", "Windows"}, {"iPhone", "iOS"}, {"iPad", "iOS"},
+		{"Android", "Android"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"}} {
+		if strings.Contains(s.UserAgent, o[0]) {
+			return browser + " on " + o[1]
+		}
+	}
+	return browser
 }
 
 // Room is the room model
 type Room struct {
 	ID        int
 	RoomName  string
+	ICalToken string
+	Price     int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Deposit policy: DepositType is "percent", "fixed" or empty for payment in full
+	DepositType    string
+	DepositValue   int
+	BalanceDueDays int
+
+	CancellationPolicyID int
+}
+
+// CancellationPolicy is a named set of cancellation rules, written as "days:percent" pairs
+type CancellationPolicy struct {
+	ID        int
+	Name      string
+	Rules     string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -56,7 +201,220 @@ type Reservation struct {
 	// Not necessary to put fields exactly as they exist in DB table, other info can also be put
 	Room Room
 
-	Processed int
+	Processed   int
+	TotalAmount int
+
+	// Totals of the payments made against the reservation
+	PaidAmount     int
+	RefundedAmount int
+
+	AccessToken string
+	Schedule    []ScheduledPayment
+
+	CancelledAt         time.Time
+	CancellationRefund  int
+	CancellationPenalty int
+
+	// ConfirmedAt is when the reservation was booked with nothing to pay up front, or its first
+	// payment was taken. Until then the room is only held for the guest, until HoldExpiresAt.
+	ConfirmedAt   time.Time
+	HoldExpiresAt time.Time
+
+	PromotionID    int
+	DiscountAmount int
+
+	Guests  int
+	Charges []ReservationCharge
+
+	// GuestID is the profile of the guest with the reservation's email address
+	GuestID int
+
+	// Emails are queued in the outbox when the reservation is inserted, in the same transaction
+	Emails []MailData
+}
+
+// Reservation statuses. Active reservations are those confirmed and not cancelled, either new
+// or processed. Pending reservations hold a room until their first payment is made.
+const (
+	StatusPending   = "pending"
+	StatusNew       = "new"
+	StatusProcessed = "processed"
+	StatusCancelled = "cancelled"
+	StatusActive    = "active"
+)
+
+// Reservation sort orders
+const (
+	SortArrival   = "arrival"
+	SortDeparture = "departure"
+	SortName      = "name"
+	SortBooked    = "booked"
+	SortTotal     = "total"
+)
+
+// ReservationFilter narrows down a list of reservations; zero values match everything
+type ReservationFilter struct {
+	// Query matches part of the guest's name, email or phone
+	Query     string
+	Status    string
+	Processed *bool
+	RoomID    int
+	GuestID   int
+
+	// UserID matches the reservations of the guest with that account
+	UserID int
+
+	// Stays with at least one night from Start up to and including End
+	Start time.Time
+	End   time.Time
+
+	// Sort is one of the sort orders, by arrival when empty, with ties in order of ID
+	Sort string
+	Desc bool
+
+	// After is the cursor of the last reservation on the previous page, and Limit the
+	// number of reservations on a page, unlimited when zero
+	After string
+	Limit int
+}
+
+// ReservationPage is a page of reservations found by a search
+type ReservationPage struct {
+	Reservations []Reservation
+
+	// Next is the cursor to pass as After for the next page, empty on the last page
+	Next string
+}
+
+// Guest is the profile of someone who has made reservations, one per email address. The
+// name and phone number are those of their latest reservation.
+type Guest struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Email     string
+	Phone     string
+	Notes     string
+	Tags      []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// ReservationCount includes cancelled reservations, and TotalSpent is the total of the
+	// payments made less refunds
+	ReservationCount int
+	TotalSpent       int
+}
+
+// Guest tags
+const (
+	TagVIP       = "vip"
+	TagDoNotBook = "do-not-book"
+)
+
+// GuestTags are the tags a guest can have
+var GuestTags = []string{TagVIP, TagDoNotBook}
+
+// HasTag reports whether the guest has a tag
+func (g Guest) HasTag(tag string) bool {
+	for _, t := range g.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// GuestFilter narrows down the list of guests; zero values match everything
+type GuestFilter struct {
+	// Query matches part of the guest's name, email or phone
+	Query string
+	Tag   string
+
+	// After is the cursor of the last guest on the previous page, and Limit the number of
+	// guests on a page, unlimited when zero
+	After string
+	Limit int
+}
+
+// GuestPage is a page of guests in order of name
+type GuestPage struct {
+	Guests []Guest
+
+	// Next is the cursor to pass as After for the next page, empty on the last page
+	Next string
+}
+
+// SearchResults are the reservations, guests and rooms matching a global admin search,
+// best matches first
+type SearchResults struct {
+	Reservations []Reservation
+	Guests       []Guest
+	Rooms        []Room
+}
+
+// Cancelled reports whether the reservation has been cancelled
+func (r Reservation) Cancelled() bool {
+	return !r.CancelledAt.IsZero()
+}
+
+// Confirmed reports whether the reservation has been confirmed, rather than holding the room
+// until it is paid for
+func (r Reservation) Confirmed() bool {
+	return !r.ConfirmedAt.IsZero()
+}
+
+// Expired reports whether the reservation was cancelled as its hold ran out before it was paid
+func (r Reservation) Expired() bool {
+	return r.Cancelled() && !r.Confirmed()
+}
+
+// OutstandingAmount returns the amount still to be paid for the reservation
+func (r Reservation) OutstandingAmount() int {
+	return r.TotalAmount - r.PaidAmount
+}
+
+// AmountDueBy returns the unpaid amount of the installments due on or before t.
+// A reservation without a schedule is due in full.
+func (r Reservation) AmountDueBy(t time.Time) int {
+	if len(r.Schedule) == 0 {
+		return r.OutstandingAmount()
+	}
+
+	due := 0
+	for _, s := range r.Schedule {
+		if !s.DueDate.After(t) {
+			due += s.Amount
+		}
+	}
+
+	due -= r.PaidAmount
+	if due < 0 {
+		return 0
+	}
+	return due
+}
+
+// NextPaymentAmount returns the amount the guest should pay now: whatever is
+// due by t, or the remaining balance when nothing is due yet
+func (r Reservation) NextPaymentAmount(t time.Time) int {
+	if due := r.AmountDueBy(t); due > 0 {
+		return due
+	}
+	return r.OutstandingAmount()
+}
+
+// ScheduledPayment is an installment of a reservation's payment schedule
+type ScheduledPayment struct {
+	ID             int
+	ReservationID  int
+	Kind           string
+	Amount         int
+	DueDate        time.Time
+	ReminderSentAt time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+
+	Reservation Reservation
 }
 
 // RoomRestriction is the room restriction model
@@ -67,6 +425,8 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
+	SourceID      int
+	ExternalUID   string
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 
@@ -75,10 +435,168 @@ type RoomRestriction struct {
 	Restriction Restriction
 }
 
+// ICalSource is an external calendar whose events are imported as blocks for a room
+type ICalSource struct {
+	ID           int
+	RoomID       int
+	Name         string
+	URL          string
+	LastSyncedAt time.Time
+	LastError    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	Room Room
+
+	// Conflicts are the reservations overlapping blocks imported from the calendar, rooms
+	// sold twice that need moving or cancelling
+	Conflicts []Reservation
+}
+
+// Payment is the payment model
+type Payment struct {
+	ID             int
+	ReservationID  int
+	Gateway        string
+	Reference      string
+	CardLast4      string
+	Amount         int
+	RefundedAmount int
+	Currency       string
+	Status         string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Promotion is a discount code
+type Promotion struct {
+	ID              int
+	Code            string
+	Description     string
+	DiscountType    string
+	DiscountValue   int
+	ValidFrom       time.Time
+	ValidUntil      time.Time
+	MinNights       int
+	MaxUses         int
+	MaxUsesPerEmail int
+	Active          bool
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+
+	// RoomIDs restricts the code to these rooms; empty means any room
+	RoomIDs []int
+
+	// Usage statistics over reservations that have not been cancelled
+	Uses          int
+	DiscountGiven int
+	Revenue       int
+}
+
+// Fee is a tax or fee added to every booking. Amount is in cents, or in hundredths of a
+// percent for percentage fees.
+type Fee struct {
+	ID        int
+	Name      string
+	Kind      string
+	Amount    int
+	IsTax     bool
+	Active    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ReservationCharge is a line of a reservation's price as it was quoted at booking
+type ReservationCharge struct {
+	ID            int
+	ReservationID int
+	Kind          string
+	Name          string
+	Description   string
+	Amount        int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// FeeTotal is the amount of one tax or fee charged on stays starting in a month
+type FeeTotal struct {
+	Month        time.Time
+	Kind         string
+	Name         string
+	Reservations int
+	Amount       int
+}
+
+// Stay is a reservation as counted by the occupancy and revenue reports. RoomRevenue is
+// the room charge after any discount, without taxes and fees.
+type Stay struct {
+	ReservationID int
+	RoomID        int
+	StartDate     time.Time
+	EndDate       time.Time
+	BookedAt      time.Time
+	CancelledAt   time.Time
+	RoomRevenue   int
+}
+
+// ExchangeRate is how many units of a currency one unit of the base currency buys
+type ExchangeRate struct {
+	ID        int
+	Currency  string
+	Rate      float64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Invoice is the sequential number issued for a reservation's invoice
+type Invoice struct {
+	ID            int
+	ReservationID int
+	Number        int
+	IssuedAt      time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
 // MailData holds an email message
 type MailData struct {
-	To      string
-	From    string
-	Subject string
-	Content string
+	To          string
+	From        string
+	Subject     string
+	Content     string
+	Attachments []MailAttachment
+
+	// Sensitive is set on messages with a link that gives access to an account, such as a
+	// password reset. The outbox keeps their content only until they are sent.
+	Sensitive bool
+}
+
+// MailAttachment holds a file attached to an email message
+type MailAttachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
+// Outbox message statuses. Pending messages are sent by the outbox workers; dead messages
+// failed too many times, and discarded ones were given up by an admin.
+const (
+	OutboxPending   = "pending"
+	OutboxSent      = "sent"
+	OutboxDead      = "dead"
+	OutboxDiscarded = "discarded"
+)
+
+// OutboxMessage is an email message queued in the outbox. Attempts counts the tries to send it,
+// the next of which is due at NextAttemptAt, and LastError is why the last one failed.
+type OutboxMessage struct {
+	ID            int
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
@@ -14,4 +14,15 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated int
+
+	// AccessLevel is the access level of the user logged in
+	AccessLevel int
+
+	// Currency is the currency the visitor chose to see prices in
+	Currency     string
+	BaseCurrency string
+	Currencies   []string
+
+	// OnlinePayments is whether guests can pay online, through a payment gateway
+	OnlinePayments bool
 }
@@ -0,0 +1,144 @@
+package outbox
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// MaxAttempts is how many times a message is tried before it is given up as dead
+const MaxAttempts = 8
+
+// Lease is how long a worker has to send a message it took before another worker may take it,
+// in case the first one stopped
+const Lease = 5 * time.Minute
+
+const (
+	firstRetry = time.Minute
+	maxRetry   = 6 * time.Hour
+)
+
+// Backoff returns how long to wait before trying a message again after a number of failed
+// attempts, a minute after the first, twice as long after each one after that, up to six hours
+func Backoff(attempts int) time.Duration {
+	delay := firstRetry
+	for i := 1; i < attempts && delay < maxRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxRetry {
+		delay = maxRetry
+	}
+	return delay
+}
+
+// Queue is where the messages to send wait
+type Queue interface {
+	ClaimOutboxMessage(lease time.Duration) (models.OutboxMessage, error)
+	MarkOutboxSent(id int) error
+	MarkOutboxFailed(id int, lastError string, retryAt time.Time, dead bool) error
+}
+
+// Sender sends an email message
+type Sender func(models.MailData) error
+
+// Outbox sends the messages queued in the outbox with a pool of workers, trying those that fail
+// again later until they are dead
+type Outbox struct {
+	Queue    Queue
+	Send     Sender
+	ErrorLog *log.Logger
+
+	// Workers is how many messages are sent at once
+	Workers int
+	// Poll is how long the workers wait before looking again when no message is due
+	Poll time.Duration
+}
+
+// New creates a new outbox sending with a number of workers
+func New(queue Queue, send Sender, errorLog *log.Logger, workers int) *Outbox {
+	return &Outbox{
+		Queue:    queue,
+		Send:     send,
+		ErrorLog: errorLog,
+		Workers:  workers,
+		Poll:     5 * time.Second,
+	}
+}
+
+// Start sends the messages due in the background until stop is closed. The channel it returns
+// is closed when the workers have finished the messages they were sending; messages still
+// queued are sent after the next start.
+func (o *Outbox) Start(stop <-chan struct{}) <-chan struct{} {
+	var wg sync.WaitGroup
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.work(stop)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// work sends the messages due one after the other, waiting a while when there are none, until
+// stop is closed
+func (o *Outbox) work(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if o.SendNext(time.Now()) {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(o.Poll):
+		}
+	}
+}
+
+// SendNext sends the message that has been due the longest, and reports whether there was one.
+// A message that fails is tried again after a backoff, or is dead after MaxAttempts.
+func (o *Outbox) SendNext(now time.Time) bool {
+	msg, err := o.Queue.ClaimOutboxMessage(Lease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		o.ErrorLog.Println("cannot take a message from the outbox:", err)
+		return false
+	}
+
+	err = o.Send(msg.Mail)
+	if err == nil {
+		if err := o.Queue.MarkOutboxSent(msg.ID); err != nil {
+			o.ErrorLog.Printf("cannot mark outbox message %d as sent: %v", msg.ID, err)
+		}
+		return true
+	}
+
+	dead := msg.Attempts >= MaxAttempts
+	if dead {
+		o.ErrorLog.Printf("giving up on outbox message %d to %s after %d attempts: %v", msg.ID, msg.Mail.To, msg.Attempts, err)
+	}
+	if err := o.Queue.MarkOutboxFailed(msg.ID, err.Error(), now.Add(Backoff(msg.Attempts)), dead); err != nil {
+		o.ErrorLog.Printf("cannot mark outbox message %d as failed: %v", msg.ID, err)
+	}
+	return true
+}
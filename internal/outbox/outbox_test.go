@@ -0,0 +1,153 @@
+package outbox
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// testQueue is an outbox queue in memory
+type testQueue struct {
+	mu       sync.Mutex
+	messages []models.OutboxMessage
+}
+
+func (q *testQueue) ClaimOutboxMessage(lease time.Duration) (models.OutboxMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, m := range q.messages {
+		if m.Status == models.OutboxPending && !m.NextAttemptAt.After(time.Now()) {
+			q.messages[i].Attempts++
+			q.messages[i].NextAttemptAt = time.Now().Add(lease)
+			return q.messages[i], nil
+		}
+	}
+	return models.OutboxMessage{}, sql.ErrNoRows
+}
+
+func (q *testQueue) MarkOutboxSent(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.messages[id-1].Status = models.OutboxSent
+	return nil
+}
+
+func (q *testQueue) MarkOutboxFailed(id int, lastError string, retryAt time.Time, dead bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.messages[id-1].LastError = lastError
+	q.messages[id-1].NextAttemptAt = retryAt
+	if dead {
+		q.messages[id-1].Status = models.OutboxDead
+	}
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{9, 4*time.Hour + 16*time.Minute},
+		{10, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+
+	for _, e := range tests {
+		if got := Backoff(e.attempts); got != e.expected {
+			t.Errorf("%d attempts: expected %s, got %s", e.attempts, e.expected, got)
+		}
+	}
+}
+
+func TestOutbox_SendNext(t *testing.T) {
+	queue := &testQueue{messages: []models.OutboxMessage{
+		{ID: 1, Mail: models.MailData{To: "john@smith.com"}, Status: models.OutboxPending},
+		{ID: 2, Mail: models.MailData{To: "bounce@fsbnb.com"}, Status: models.OutboxPending},
+		{ID: 3, Mail: models.MailData{To: "bounce@fsbnb.com"}, Status: models.OutboxPending, Attempts: MaxAttempts - 1},
+	}}
+	send := func(msg models.MailData) error {
+		if msg.To == "bounce@fsbnb.com" {
+			return errors.New("550 mailbox unavailable")
+		}
+		return nil
+	}
+	o := New(queue, send, log.New(io.Discard, "", 0), 1)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !o.SendNext(now) {
+			t.Fatalf("expected message %d to be sent", i+1)
+		}
+	}
+	if o.SendNext(now) {
+		t.Error("expected no message due")
+	}
+
+	m := queue.messages
+	if m[0].Status != models.OutboxSent {
+		t.Errorf("expected message 1 sent, got %s", m[0].Status)
+	}
+	if m[1].Status != models.OutboxPending || m[1].LastError != "550 mailbox unavailable" || !m[1].NextAttemptAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected message 2 to be tried again in a minute, got %+v", m[1])
+	}
+	if m[2].Status != models.OutboxDead {
+		t.Errorf("expected message 3 dead, got %s", m[2].Status)
+	}
+}
+
+func TestOutbox_Start(t *testing.T) {
+	queue := &testQueue{}
+	for i := 1; i <= 20; i++ {
+		queue.messages = append(queue.messages, models.OutboxMessage{ID: i, Status: models.OutboxPending})
+	}
+
+	var mu sync.Mutex
+	sent := 0
+	send := func(models.MailData) error {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		return nil
+	}
+
+	o := New(queue, send, log.New(io.Discard, "", 0), 4)
+	o.Poll = time.Millisecond
+
+	stop := make(chan struct{})
+	done := o.Start(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := sent
+		mu.Unlock()
+		if n == 20 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the workers to stop")
+	}
+
+	if sent != 20 {
+		t.Errorf("expected 20 messages sent, got %d", sent)
+	}
+}
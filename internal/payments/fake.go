@@ -0,0 +1,192 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeclinedCardNumber is always declined by the fake gateway
+const DeclinedCardNumber = "4000000000000002"
+
+// FakeGateway is an in-memory gateway for development and tests. It accepts any card
+// number that passes the Luhn check, except DeclinedCardNumber.
+type FakeGateway struct {
+	mu           sync.Mutex
+	secret       []byte
+	seq          int
+	transactions map[string]*Transaction
+}
+
+// NewFakeGateway creates a fake gateway signing webhooks with secret
+func NewFakeGateway(secret string) *FakeGateway {
+	return &FakeGateway{
+		secret:       []byte(secret),
+		transactions: make(map[string]*Transaction),
+	}
+}
+
+// Name returns the identifier stored with payment records
+func (g *FakeGateway) Name() string {
+	return "fake"
+}
+
+// Authorize reserves the amount on the card without charging it
+func (g *FakeGateway) Authorize(ctx context.Context, req AuthorizeRequest) (Transaction, error) {
+	if req.Amount <= 0 {
+		return Transaction{}, ErrInvalidAmount
+	}
+
+	number := strings.ReplaceAll(req.Card.Number, " ", "")
+	if !luhnValid(number) || len(req.Card.CVC) < 3 || req.Card.ExpMonth < 1 || req.Card.ExpMonth > 12 {
+		return Transaction{}, ErrInvalidCard
+	}
+
+	now := time.Now()
+	if req.Card.ExpYear < now.Year() || (req.Card.ExpYear == now.Year() && req.Card.ExpMonth < int(now.Month())) {
+		return Transaction{}, ErrInvalidCard
+	}
+
+	if number == DeclinedCardNumber {
+		return Transaction{}, ErrCardDeclined
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.seq++
+	t := &Transaction{
+		Reference: fmt.Sprintf("fake_%d_%d", now.UnixNano(), g.seq),
+		Status:    StatusAuthorized,
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+	}
+	g.transactions[t.Reference] = t
+
+	return *t, nil
+}
+
+// Capture charges a previously authorized amount
+func (g *FakeGateway) Capture(ctx context.Context, reference string, amount int) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[reference]
+	if !ok {
+		return Transaction{}, ErrUnknownTransaction
+	}
+
+	if t.Status != StatusAuthorized {
+		return *t, ErrInvalidTransaction
+	}
+
+	if amount <= 0 || amount > t.Amount {
+		return *t, ErrInvalidAmount
+	}
+
+	t.Amount = amount
+	t.Status = StatusCaptured
+
+	return *t, nil
+}
+
+// Refund returns some or all of a captured amount to the card
+func (g *FakeGateway) Refund(ctx context.Context, reference string, amount int) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[reference]
+	if !ok {
+		return Transaction{}, ErrUnknownTransaction
+	}
+
+	if t.Status != StatusCaptured && t.Status != StatusRefunded {
+		return *t, ErrInvalidTransaction
+	}
+
+	if amount <= 0 || t.Refunded+amount > t.Amount {
+		return *t, ErrInvalidAmount
+	}
+
+	t.Refunded += amount
+	if t.Refunded == t.Amount {
+		t.Status = StatusRefunded
+	}
+
+	return *t, nil
+}
+
+// Void releases an authorization that will not be captured
+func (g *FakeGateway) Void(ctx context.Context, reference string) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[reference]
+	if !ok {
+		return Transaction{}, ErrUnknownTransaction
+	}
+
+	if t.Status != StatusAuthorized {
+		return *t, ErrInvalidTransaction
+	}
+
+	t.Status = StatusVoided
+
+	return *t, nil
+}
+
+// VerifyWebhook checks the signature of a webhook payload and decodes its event
+func (g *FakeGateway) VerifyWebhook(payload []byte, signature string) (Event, error) {
+	var e Event
+
+	expected := g.Sign(payload)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return e, ErrInvalidSignature
+	}
+
+	err := json.Unmarshal(payload, &e)
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a webhook payload
+func (g *FakeGateway) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// luhnValid reports whether a card number passes the Luhn checksum
+func luhnValid(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
@@ -0,0 +1,187 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func validCard() Card {
+	return Card{
+		Name:     "John Smith",
+		Number:   "4242 4242 4242 4242",
+		ExpMonth: 12,
+		ExpYear:  time.Now().Year() + 1,
+		CVC:      "123",
+	}
+}
+
+func TestFakeGateway_AuthorizeCaptureRefund(t *testing.T) {
+	g := NewFakeGateway("secret")
+	ctx := context.Background()
+
+	auth, err := g.Authorize(ctx, AuthorizeRequest{Amount: 10000, Currency: DefaultCurrency, Card: validCard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.Status != StatusAuthorized {
+		t.Errorf("expected status %s, got %s", StatusAuthorized, auth.Status)
+	}
+
+	_, err = g.Refund(ctx, auth.Reference, 100)
+	if !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("expected refund of uncaptured transaction to fail, got %v", err)
+	}
+
+	_, err = g.Capture(ctx, auth.Reference, 20000)
+	if !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected capture above authorized amount to fail, got %v", err)
+	}
+
+	captured, err := g.Capture(ctx, auth.Reference, 10000)
+	if err != nil || captured.Status != StatusCaptured {
+		t.Fatalf("capture failed: %v %+v", err, captured)
+	}
+
+	refunded, err := g.Refund(ctx, auth.Reference, 4000)
+	if err != nil || refunded.Refunded != 4000 || refunded.Status != StatusCaptured {
+		t.Errorf("partial refund failed: %v %+v", err, refunded)
+	}
+
+	_, err = g.Refund(ctx, auth.Reference, 7000)
+	if !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected refund above captured amount to fail, got %v", err)
+	}
+
+	refunded, err = g.Refund(ctx, auth.Reference, 6000)
+	if err != nil || refunded.Status != StatusRefunded {
+		t.Errorf("full refund failed: %v %+v", err, refunded)
+	}
+
+	_, err = g.Capture(ctx, "unknown", 100)
+	if !errors.Is(err, ErrUnknownTransaction) {
+		t.Errorf("expected unknown transaction error, got %v", err)
+	}
+}
+
+func TestFakeGateway_Authorize_Invalid(t *testing.T) {
+	g := NewFakeGateway("secret")
+	ctx := context.Background()
+
+	declined := validCard()
+	declined.Number = DeclinedCardNumber
+
+	badNumber := validCard()
+	badNumber.Number = "4242424242424241"
+
+	expired := validCard()
+	expired.ExpYear = time.Now().Year() - 1
+
+	var tests = []struct {
+		name     string
+		amount   int
+		card     Card
+		expected error
+	}{
+		{"declined", 100, declined, ErrCardDeclined},
+		{"failed luhn check", 100, badNumber, ErrInvalidCard},
+		{"expired", 100, expired, ErrInvalidCard},
+		{"zero amount", 0, validCard(), ErrInvalidAmount},
+	}
+
+	for _, e := range tests {
+		_, err := g.Authorize(ctx, AuthorizeRequest{Amount: e.amount, Card: e.card})
+		if !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, err)
+		}
+	}
+}
+
+func TestFakeGateway_VerifyWebhook(t *testing.T) {
+	g := NewFakeGateway("secret")
+	payload := []byte(`{"type":"payment.refunded","reference":"fake_1","amount":500}`)
+
+	e, err := g.VerifyWebhook(payload, g.Sign(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Type != EventRefunded || e.Reference != "fake_1" || e.Amount != 500 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	_, err = g.VerifyWebhook(payload, "invalid")
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("fake", "secret"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := New("unknown", "secret"); !errors.Is(err, ErrUnsupportedProvider) {
+		t.Errorf("expected unsupported provider error, got %v", err)
+	}
+
+	if _, err := New("fake", ""); !errors.Is(err, ErrMissingSecret) {
+		t.Errorf("expected missing secret error, got %v", err)
+	}
+}
+
+func TestFakeGateway_Void(t *testing.T) {
+	g := NewFakeGateway("secret")
+	ctx := context.Background()
+
+	auth, err := g.Authorize(ctx, AuthorizeRequest{Amount: 10000, Currency: DefaultCurrency, Card: validCard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	voided, err := g.Void(ctx, auth.Reference)
+	if err != nil || voided.Status != StatusVoided {
+		t.Fatalf("void failed: %v %+v", err, voided)
+	}
+
+	_, err = g.Capture(ctx, auth.Reference, 10000)
+	if !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("expected capture of voided transaction to fail, got %v", err)
+	}
+
+	_, err = g.Void(ctx, auth.Reference)
+	if !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("expected second void to fail, got %v", err)
+	}
+
+	_, err = g.Void(ctx, "unknown")
+	if !errors.Is(err, ErrUnknownTransaction) {
+		t.Errorf("expected unknown transaction error, got %v", err)
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		expected bool
+	}{
+		{StatusAuthorized, StatusCaptured, true},
+		{StatusAuthorized, StatusFailed, true},
+		{StatusAuthorized, StatusVoided, true},
+		{StatusCaptured, StatusRefunded, true},
+		{StatusCaptured, StatusCaptured, true},
+		{StatusCaptured, StatusFailed, false},
+		{StatusCaptured, StatusAuthorized, false},
+		{StatusRefunded, StatusCaptured, false},
+		{StatusVoided, StatusCaptured, false},
+		{StatusFailed, StatusCaptured, false},
+	}
+
+	for _, e := range tests {
+		if got := CanTransition(e.from, e.to); got != e.expected {
+			t.Errorf("%s to %s: expected %t, got %t", e.from, e.to, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// DefaultCurrency is the currency amounts are charged in
+const DefaultCurrency = "USD"
+
+// Payment statuses
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusRefunded   = "refunded"
+	StatusFailed     = "failed"
+	StatusVoided     = "voided"
+)
+
+// Webhook event types
+const (
+	EventCaptured = "payment.captured"
+	EventRefunded = "payment.refunded"
+	EventFailed   = "payment.failed"
+)
+
+var (
+	ErrCardDeclined        = errors.New("card declined")
+	ErrInvalidCard         = errors.New("invalid card details")
+	ErrInvalidAmount       = errors.New("invalid amount")
+	ErrUnknownTransaction  = errors.New("unknown transaction")
+	ErrInvalidTransaction  = errors.New("transaction is not in a valid state for this operation")
+	ErrInvalidSignature    = errors.New("invalid webhook signature")
+	ErrUnsupportedProvider = errors.New("unsupported payment gateway")
+	ErrMissingSecret       = errors.New("a webhook signing secret is required")
+)
+
+// CanTransition reports whether a payment may move from one status to another. Payments only
+// move forward, so a late or replayed webhook cannot undo a capture or a refund.
+func CanTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+
+	switch to {
+	case StatusCaptured, StatusVoided, StatusFailed:
+		return from == StatusAuthorized
+	case StatusRefunded:
+		return from == StatusCaptured
+	}
+	return false
+}
+
+// Card holds the card details entered by a guest
+type Card struct {
+	Name     string
+	Number   string
+	ExpMonth int
+	ExpYear  int
+	CVC      string
+}
+
+// Last4 returns the last four digits of the card number
+func (c Card) Last4() string {
+	if len(c.Number) < 4 {
+		return c.Number
+	}
+	return c.Number[len(c.Number)-4:]
+}
+
+// AuthorizeRequest is a request to reserve funds on a card
+type AuthorizeRequest struct {
+	Amount      int
+	Currency    string
+	Card        Card
+	Description string
+}
+
+// Transaction is the result of a gateway operation
+type Transaction struct {
+	Reference string
+	Status    string
+	Amount    int
+	Refunded  int
+	Currency  string
+}
+
+// Event is a notification sent by a gateway to the webhook endpoint
+type Event struct {
+	Type      string `json:"type"`
+	Reference string `json:"reference"`
+	Amount    int    `json:"amount"`
+}
+
+// Gateway is implemented by payment providers. Amounts are in minor units (cents).
+type Gateway interface {
+	// Name returns the identifier stored with payment records
+	Name() string
+	// Authorize reserves the amount on the card without charging it
+	Authorize(ctx context.Context, req AuthorizeRequest) (Transaction, error)
+	// Capture charges a previously authorized amount
+	Capture(ctx context.Context, reference string, amount int) (Transaction, error)
+	// Refund returns some or all of a captured amount to the card
+	Refund(ctx context.Context, reference string, amount int) (Transaction, error)
+	// Void releases an authorization that will not be captured
+	Void(ctx context.Context, reference string) (Transaction, error)
+	// VerifyWebhook checks the signature of a webhook payload and decodes its event
+	VerifyWebhook(payload []byte, signature string) (Event, error)
+}
+
+// New returns the gateway with the given name. The secret is required, as webhooks signed
+// with an empty key could be forged by anyone.
+func New(name, secret string) (Gateway, error) {
+	if secret == "" {
+		return nil, ErrMissingSecret
+	}
+
+	switch name {
+	case "fake":
+		return NewFakeGateway(secret), nil
+	default:
+		return nil, ErrUnsupportedProvider
+	}
+}
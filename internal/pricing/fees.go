@@ -0,0 +1,108 @@
+package pricing
+
+import (
+	"fmt"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// How a fee is charged
+const (
+	FeePerStay       = "per_stay"
+	FeePerNight      = "per_night"
+	FeePerGuestNight = "per_guest_night"
+	FeePercent       = "percent"
+)
+
+// FeeKinds lists the fee kinds in the order they are offered to admins
+var FeeKinds = []string{FeePerStay, FeePerNight, FeePerGuestNight, FeePercent}
+
+// ValidFeeKind reports whether kind is a known fee kind
+func ValidFeeKind(kind string) bool {
+	for _, k := range FeeKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeFee returns how a fee is charged, such as "3.00 per guest per night" or "7.50%"
+func DescribeFee(f models.Fee) string {
+	switch f.Kind {
+	case FeePerStay:
+		return FormatAmount(f.Amount) + " per stay"
+	case FeePerNight:
+		return FormatAmount(f.Amount) + " per night"
+	case FeePerGuestNight:
+		return FormatAmount(f.Amount) + " per guest per night"
+	case FeePercent:
+		return FormatDecimal(f.Amount, 2) + "%"
+	}
+	return ""
+}
+
+// AddFees adds the active taxes and fees to the quote. Fixed fees are added first, then
+// percentages are charged on the total so far, so a percentage tax also applies to the
+// cleaning fee and after any discount.
+func (q *Quote) AddFees(fees []models.Fee, guests int) {
+	if guests < 1 {
+		guests = 1
+	}
+
+	for _, f := range fees {
+		if !f.Active || f.Kind == FeePercent {
+			continue
+		}
+
+		var amount int
+		var description string
+		switch f.Kind {
+		case FeePerStay:
+			amount = f.Amount
+			description = f.Name
+		case FeePerNight:
+			amount = f.Amount * q.Nights
+			description = fmt.Sprintf("%s (%d night(s) x %s)", f.Name, q.Nights, FormatAmount(f.Amount))
+		case FeePerGuestNight:
+			amount = f.Amount * q.Nights * guests
+			description = fmt.Sprintf("%s (%d guest(s) x %d night(s) x %s)", f.Name, guests, q.Nights, FormatAmount(f.Amount))
+		default:
+			continue
+		}
+
+		q.addFee(f, description, amount)
+	}
+
+	base := q.Total
+	for _, f := range fees {
+		if !f.Active || f.Kind != FeePercent {
+			continue
+		}
+
+		// Rates are in hundredths of a percent; round half up to the minor unit
+		amount := (base*f.Amount + 5000) / 10000
+		q.addFee(f, fmt.Sprintf("%s (%s%%)", f.Name, FormatDecimal(f.Amount, 2)), amount)
+	}
+}
+
+func (q *Quote) addFee(f models.Fee, description string, amount int) {
+	if amount <= 0 {
+		return
+	}
+
+	kind := LineFee
+	if f.IsTax {
+		kind = LineTax
+		q.Taxes += amount
+	} else {
+		q.Fees += amount
+	}
+
+	q.add(LineItem{
+		Kind:        kind,
+		Name:        f.Name,
+		Description: description,
+		Amount:      amount,
+	})
+}
@@ -0,0 +1,185 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Kinds of quote lines
+const (
+	LineRoom     = "room"
+	LineDiscount = "discount"
+	LineFee      = "fee"
+	LineTax      = "tax"
+)
+
+// LineItem is a single line of a quote
+type LineItem struct {
+	Kind        string
+	Name        string
+	Description string
+	Amount      int
+}
+
+// Quote is the price of a stay. Amounts are in minor units (cents).
+type Quote struct {
+	Nights      int
+	NightlyRate int
+	Lines       []LineItem
+	Discount    int
+	Fees        int
+	Taxes       int
+	Total       int
+}
+
+// Nights returns the number of nights between arrival and departure
+func Nights(start, end time.Time) int {
+	n := int(end.Sub(start).Hours() / 24)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// NewQuote prices a stay in a room
+func NewQuote(room models.Room, start, end time.Time) Quote {
+	q := Quote{
+		Nights:      Nights(start, end),
+		NightlyRate: room.Price,
+	}
+
+	q.add(LineItem{
+		Kind:        LineRoom,
+		Name:        room.RoomName,
+		Description: fmt.Sprintf("%d night(s) x %s", q.Nights, FormatAmount(room.Price)),
+		Amount:      q.Nights * room.Price,
+	})
+
+	return q
+}
+
+func (q *Quote) add(l LineItem) {
+	q.Lines = append(q.Lines, l)
+	q.Total += l.Amount
+}
+
+// ApplyDiscount adds a discount line to the quote. The discount never exceeds the total.
+func (q *Quote) ApplyDiscount(description string, amount int) {
+	if amount > q.Total {
+		amount = q.Total
+	}
+	if amount <= 0 {
+		return
+	}
+
+	q.add(LineItem{
+		Kind:        LineDiscount,
+		Name:        description,
+		Description: description,
+		Amount:      -amount,
+	})
+	q.Discount += amount
+}
+
+// decimals is the number of minor unit digits of the base currency, which amounts are kept in
+var decimals = 2
+
+// SetDecimals sets the number of minor unit digits of the base currency: two for most
+// currencies, none for the likes of the yen. It is called once on start.
+func SetDecimals(n int) {
+	decimals = n
+}
+
+// Decimals returns the number of minor unit digits amounts are kept in
+func Decimals() int {
+	return decimals
+}
+
+// FormatAmount formats an amount in minor units of the base currency
+func FormatAmount(amount int) string {
+	return FormatDecimal(amount, decimals)
+}
+
+// FormatDecimal formats a number kept with the given number of implied decimals, such as
+// 1250 with two decimals as "12.50"
+func FormatDecimal(n, places int) string {
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	if places == 0 {
+		return sign + strconv.Itoa(n)
+	}
+
+	scale := pow10(places)
+	return fmt.Sprintf("%s%d.%0*d", sign, n/scale, places, n%scale)
+}
+
+// ParseAmount parses a decimal amount such as "12.5" into minor units of the base currency
+func ParseAmount(s string) (int, error) {
+	return ParseDecimal(s, decimals)
+}
+
+// ParseDecimal parses a decimal number such as "12.5" into a number with the given number of
+// implied decimals. Only digits and a decimal point are accepted, so signs and exponents are
+// rejected.
+func ParseDecimal(s string, places int) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("amount is empty")
+	}
+
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if len(frac) > places || (hasPoint && places == 0) {
+		return 0, fmt.Errorf("amount %q has more than %d decimals", s, places)
+	}
+	if !digits(whole) || (frac != "" && !digits(frac)) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < places {
+		frac += "0"
+	}
+
+	units, err := strconv.Atoi(whole)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	minor := 0
+	if places > 0 {
+		minor, err = strconv.Atoi(frac)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+
+	return units*pow10(places) + minor, nil
+}
+
+// pow10 returns 10 to the power of n
+func pow10(n int) int {
+	p := 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// digits reports whether s is made of one or more ASCII digits
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
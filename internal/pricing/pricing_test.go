@@ -0,0 +1,197 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func TestNewQuote(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	end, _ := time.Parse("2006-01-02", "2050-01-04")
+
+	q := NewQuote(models.Room{Price: 12550}, start, end)
+
+	if q.Nights != 3 {
+		t.Errorf("expected 3 nights, got %d", q.Nights)
+	}
+
+	if q.Total != 37650 {
+		t.Errorf("expected total 37650, got %d", q.Total)
+	}
+
+	if len(q.Lines) != 1 {
+		t.Errorf("expected 1 line item, got %d", len(q.Lines))
+	}
+}
+
+func TestNights(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-05")
+	end, _ := time.Parse("2006-01-02", "2050-01-01")
+
+	if n := Nights(start, end); n != 0 {
+		t.Errorf("expected 0 nights for reversed dates, got %d", n)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	var tests = []struct {
+		amount   int
+		expected string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{12345, "123.45"},
+		{-250, "-2.50"},
+	}
+
+	for _, e := range tests {
+		if got := FormatAmount(e.amount); got != e.expected {
+			t.Errorf("FormatAmount(%d): expected %s, got %s", e.amount, e.expected, got)
+		}
+	}
+}
+
+func TestAmounts_ZeroDecimals(t *testing.T) {
+	SetDecimals(0)
+	defer SetDecimals(2)
+
+	if got := FormatAmount(1250); got != "1250" {
+		t.Errorf("FormatAmount: expected 1250, got %s", got)
+	}
+	if got, err := ParseAmount("1250"); err != nil || got != 1250 {
+		t.Errorf("ParseAmount: expected 1250, got %d (%v)", got, err)
+	}
+	if _, err := ParseAmount("12.5"); err == nil {
+		t.Error("ParseAmount: expected error for decimals in a currency without minor units")
+	}
+
+	// Percentages keep two decimals whatever the currency
+	fee := models.Fee{Kind: FeePercent, Amount: 750}
+	if got := DescribeFee(fee); got != "7.50%" {
+		t.Errorf("DescribeFee: expected 7.50%%, got %s", got)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected int
+		valid    bool
+	}{
+		{"12", 1200, true},
+		{"12.5", 1250, true},
+		{" 0.05 ", 5, true},
+		{"12.345", 0, false},
+		{"-1", 0, false},
+		{"-0.50", 0, false},
+		{"+1", 0, false},
+		{"1.+5", 0, false},
+		{"1.-5", 0, false},
+		{".5", 0, false},
+		{"abc", 0, false},
+		{"", 0, false},
+	}
+
+	for _, e := range tests {
+		got, err := ParseAmount(e.input)
+		if e.valid && (err != nil || got != e.expected) {
+			t.Errorf("ParseAmount(%q): expected %d, got %d (%v)", e.input, e.expected, got, err)
+		}
+		if !e.valid && err == nil {
+			t.Errorf("ParseAmount(%q): expected error", e.input)
+		}
+	}
+}
+
+func TestQuote_ApplyDiscount(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	end, _ := time.Parse("2006-01-02", "2050-01-03")
+
+	q := NewQuote(models.Room{Price: 10000}, start, end)
+	q.ApplyDiscount("Promo code WINTER10", 2000)
+
+	if q.Total != 18000 || q.Discount != 2000 || len(q.Lines) != 2 {
+		t.Errorf("unexpected quote after discount: %+v", q)
+	}
+
+	q.ApplyDiscount("Too much", 50000)
+	if q.Total != 0 || q.Discount != 20000 {
+		t.Errorf("expected discount to be capped at the total, got %+v", q)
+	}
+}
+
+func TestQuote_AddFees(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	end, _ := time.Parse("2006-01-02", "2050-01-03")
+
+	fees := []models.Fee{
+		{Name: "VAT", Kind: FeePercent, Amount: 1000, IsTax: true, Active: true},
+		{Name: "Cleaning fee", Kind: FeePerStay, Amount: 5000, Active: true},
+		{Name: "City tax", Kind: FeePerGuestNight, Amount: 250, IsTax: true, Active: true},
+		{Name: "Linen", Kind: FeePerNight, Amount: 500, Active: true},
+		{Name: "Resort fee", Kind: FeePerStay, Amount: 9900, Active: false},
+	}
+
+	q := NewQuote(models.Room{Price: 10000}, start, end)
+	q.ApplyDiscount("Promo", 2000)
+	q.AddFees(fees, 3)
+
+	// 20000 - 2000 + 5000 cleaning + 1500 city tax + 1000 linen = 25500, plus 10% VAT of 2550
+	if q.Total != 28050 {
+		t.Errorf("expected total 28050, got %d", q.Total)
+	}
+
+	if q.Fees != 6000 {
+		t.Errorf("expected fees 6000, got %d", q.Fees)
+	}
+
+	if q.Taxes != 4050 {
+		t.Errorf("expected taxes 4050, got %d", q.Taxes)
+	}
+
+	if len(q.Lines) != 6 {
+		t.Fatalf("expected 6 line items, got %d", len(q.Lines))
+	}
+
+	last := q.Lines[len(q.Lines)-1]
+	if last.Kind != LineTax || last.Name != "VAT" || last.Description != "VAT (10.00%)" {
+		t.Errorf("expected VAT to be charged last, got %+v", last)
+	}
+
+	if q.Lines[3].Description != "City tax (3 guest(s) x 2 night(s) x 2.50)" {
+		t.Errorf("unexpected city tax description %q", q.Lines[3].Description)
+	}
+}
+
+func TestQuote_AddFees_Rounding(t *testing.T) {
+	start, _ := time.Parse("2006-01-02", "2050-01-01")
+	end, _ := time.Parse("2006-01-02", "2050-01-02")
+
+	q := NewQuote(models.Room{Price: 1005}, start, end)
+	q.AddFees([]models.Fee{{Name: "Tax", Kind: FeePercent, Amount: 750, Active: true}}, 0)
+
+	// 7.5% of 10.05 is 0.75375
+	if q.Total != 1080 {
+		t.Errorf("expected total 1080, got %d", q.Total)
+	}
+}
+
+func TestDescribeFee(t *testing.T) {
+	var tests = []struct {
+		fee      models.Fee
+		expected string
+	}{
+		{models.Fee{Kind: FeePerStay, Amount: 5000}, "50.00 per stay"},
+		{models.Fee{Kind: FeePerNight, Amount: 500}, "5.00 per night"},
+		{models.Fee{Kind: FeePerGuestNight, Amount: 250}, "2.50 per guest per night"},
+		{models.Fee{Kind: FeePercent, Amount: 750}, "7.50%"},
+	}
+
+	for _, e := range tests {
+		if got := DescribeFee(e.fee); got != e.expected {
+			t.Errorf("DescribeFee(%s): expected %s, got %s", e.fee.Kind, e.expected, got)
+		}
+	}
+}
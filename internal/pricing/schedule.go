@@ -0,0 +1,83 @@
+package pricing
+
+import (
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Deposit policy types
+const (
+	DepositPercent = "percent"
+	DepositFixed   = "fixed"
+)
+
+// Installment kinds of a payment schedule
+const (
+	InstallmentFull    = "full"
+	InstallmentDeposit = "deposit"
+	InstallmentBalance = "balance"
+)
+
+// DepositAmount returns the deposit the room's policy asks for on a stay costing total
+func DepositAmount(room models.Room, total int) int {
+	var deposit int
+
+	switch room.DepositType {
+	case DepositPercent:
+		deposit = total * room.DepositValue / 100
+	case DepositFixed:
+		deposit = room.DepositValue
+	default:
+		return total
+	}
+
+	if deposit > total {
+		return total
+	}
+	if deposit < 0 {
+		return 0
+	}
+	return deposit
+}
+
+// BalanceDueDate returns the date the balance of a stay starting on start is due
+func BalanceDueDate(room models.Room, start time.Time) time.Time {
+	return start.AddDate(0, 0, -room.BalanceDueDays)
+}
+
+// NewSchedule builds the payment schedule for a stay booked on today. A deposit is
+// due straight away and the balance on the balance due date, unless the room takes
+// no deposit or the stay is booked inside the balance window, in which case the
+// full amount is due today.
+func NewSchedule(room models.Room, total int, start, today time.Time) []models.ScheduledPayment {
+	today = truncateDay(today)
+	if total <= 0 {
+		return nil
+	}
+
+	deposit := DepositAmount(room, total)
+	balanceDue := truncateDay(BalanceDueDate(room, start))
+
+	if deposit >= total || !balanceDue.After(today) {
+		return []models.ScheduledPayment{
+			{Kind: InstallmentFull, Amount: total, DueDate: today},
+		}
+	}
+
+	schedule := []models.ScheduledPayment{
+		{Kind: InstallmentBalance, Amount: total - deposit, DueDate: balanceDue},
+	}
+	if deposit > 0 {
+		schedule = append([]models.ScheduledPayment{
+			{Kind: InstallmentDeposit, Amount: deposit, DueDate: today},
+		}, schedule...)
+	}
+
+	return schedule
+}
+
+// truncateDay returns midnight UTC of t's calendar date
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
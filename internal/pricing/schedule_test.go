@@ -0,0 +1,104 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func TestNewSchedule(t *testing.T) {
+	today := time.Date(2050, 1, 1, 15, 30, 0, 0, time.UTC)
+	start := time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		room     models.Room
+		start    time.Time
+		expected []models.ScheduledPayment
+	}{
+		{
+			name:  "no deposit policy",
+			room:  models.Room{},
+			start: start,
+			expected: []models.ScheduledPayment{
+				{Kind: InstallmentFull, Amount: 50000, DueDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:  "percentage deposit",
+			room:  models.Room{DepositType: DepositPercent, DepositValue: 20, BalanceDueDays: 14},
+			start: start,
+			expected: []models.ScheduledPayment{
+				{Kind: InstallmentDeposit, Amount: 10000, DueDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)},
+				{Kind: InstallmentBalance, Amount: 40000, DueDate: time.Date(2050, 2, 15, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:  "fixed deposit",
+			room:  models.Room{DepositType: DepositFixed, DepositValue: 7500, BalanceDueDays: 30},
+			start: start,
+			expected: []models.ScheduledPayment{
+				{Kind: InstallmentDeposit, Amount: 7500, DueDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)},
+				{Kind: InstallmentBalance, Amount: 42500, DueDate: time.Date(2050, 1, 30, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:  "booked inside the balance window",
+			room:  models.Room{DepositType: DepositPercent, DepositValue: 20, BalanceDueDays: 14},
+			start: time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+			expected: []models.ScheduledPayment{
+				{Kind: InstallmentFull, Amount: 50000, DueDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:  "fixed deposit larger than total",
+			room:  models.Room{DepositType: DepositFixed, DepositValue: 90000, BalanceDueDays: 14},
+			start: start,
+			expected: []models.ScheduledPayment{
+				{Kind: InstallmentFull, Amount: 50000, DueDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+	}
+
+	for _, e := range tests {
+		got := NewSchedule(e.room, 50000, e.start, today)
+		if len(got) != len(e.expected) {
+			t.Errorf("%s: expected %d installments, got %d", e.name, len(e.expected), len(got))
+			continue
+		}
+
+		for i := range got {
+			if got[i].Kind != e.expected[i].Kind || got[i].Amount != e.expected[i].Amount || !got[i].DueDate.Equal(e.expected[i].DueDate) {
+				t.Errorf("%s: installment %d: expected %+v, got %+v", e.name, i, e.expected[i], got[i])
+			}
+		}
+	}
+}
+
+func TestReservation_AmountDueBy(t *testing.T) {
+	today := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	room := models.Room{DepositType: DepositPercent, DepositValue: 20, BalanceDueDays: 14}
+
+	res := models.Reservation{
+		TotalAmount: 50000,
+		Schedule:    NewSchedule(room, 50000, time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC), today),
+	}
+
+	if due := res.AmountDueBy(today); due != 10000 {
+		t.Errorf("expected deposit of 10000 due today, got %d", due)
+	}
+
+	res.PaidAmount = 10000
+	if due := res.AmountDueBy(today); due != 0 {
+		t.Errorf("expected nothing due after paying deposit, got %d", due)
+	}
+
+	if next := res.NextPaymentAmount(today); next != 40000 {
+		t.Errorf("expected next payment to be the balance of 40000, got %d", next)
+	}
+
+	if due := res.AmountDueBy(time.Date(2050, 2, 15, 0, 0, 0, 0, time.UTC)); due != 40000 {
+		t.Errorf("expected balance of 40000 due on balance date, got %d", due)
+	}
+}
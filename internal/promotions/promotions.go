@@ -0,0 +1,93 @@
+package promotions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Discount types
+const (
+	TypePercent = "percent"
+	TypeFixed   = "fixed"
+)
+
+var (
+	ErrInactive   = errors.New("this promo code is no longer active")
+	ErrNotStarted = errors.New("this promo code is not valid yet")
+	ErrExpired    = errors.New("this promo code has expired")
+	ErrRoom       = errors.New("this promo code cannot be used for this room")
+	ErrUsedUp     = errors.New("this promo code has been fully redeemed")
+	ErrEmailLimit = errors.New("this promo code has already been used with this email address")
+)
+
+// Normalize returns a code the way it is stored: trimmed and upper case
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check returns an error when the promotion cannot be applied to a stay of nights nights
+// in roomID booked on today. uses is how many reservations have used the code so far
+// and emailUses how many of those were made with the guest's email address.
+func Check(p models.Promotion, roomID, nights int, today time.Time, uses, emailUses int) error {
+	if !p.Active {
+		return ErrInactive
+	}
+
+	day := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	if !p.ValidFrom.IsZero() && day.Before(p.ValidFrom) {
+		return ErrNotStarted
+	}
+	if !p.ValidUntil.IsZero() && day.After(p.ValidUntil) {
+		return ErrExpired
+	}
+
+	if len(p.RoomIDs) > 0 {
+		found := false
+		for _, id := range p.RoomIDs {
+			if id == roomID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrRoom
+		}
+	}
+
+	if p.MinNights > 0 && nights < p.MinNights {
+		return fmt.Errorf("this promo code requires a stay of at least %d nights", p.MinNights)
+	}
+
+	if p.MaxUses > 0 && uses >= p.MaxUses {
+		return ErrUsedUp
+	}
+	if p.MaxUsesPerEmail > 0 && emailUses >= p.MaxUsesPerEmail {
+		return ErrEmailLimit
+	}
+
+	return nil
+}
+
+// Discount returns the discount the promotion gives on a stay costing total
+func Discount(p models.Promotion, total int) int {
+	var discount int
+
+	switch p.DiscountType {
+	case TypePercent:
+		discount = total * p.DiscountValue / 100
+	case TypeFixed:
+		discount = p.DiscountValue
+	}
+
+	if discount > total {
+		return total
+	}
+	if discount < 0 {
+		return 0
+	}
+	return discount
+}
@@ -0,0 +1,80 @@
+package promotions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func TestCheck(t *testing.T) {
+	today := time.Date(2050, 1, 15, 14, 0, 0, 0, time.UTC)
+
+	base := models.Promotion{
+		Code:            "WINTER10",
+		Active:          true,
+		ValidFrom:       time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		ValidUntil:      time.Date(2050, 1, 15, 0, 0, 0, 0, time.UTC),
+		RoomIDs:         []int{1},
+		MinNights:       2,
+		MaxUses:         10,
+		MaxUsesPerEmail: 1,
+	}
+
+	var tests = []struct {
+		name      string
+		modify    func(p *models.Promotion)
+		roomID    int
+		nights    int
+		uses      int
+		emailUses int
+		expected  error
+	}{
+		{"valid", func(p *models.Promotion) {}, 1, 2, 0, 0, nil},
+		{"inactive", func(p *models.Promotion) { p.Active = false }, 1, 2, 0, 0, ErrInactive},
+		{"not started", func(p *models.Promotion) { p.ValidFrom = time.Date(2050, 2, 1, 0, 0, 0, 0, time.UTC) }, 1, 2, 0, 0, ErrNotStarted},
+		{"expired", func(p *models.Promotion) { p.ValidUntil = time.Date(2050, 1, 14, 0, 0, 0, 0, time.UTC) }, 1, 2, 0, 0, ErrExpired},
+		{"wrong room", func(p *models.Promotion) {}, 2, 2, 0, 0, ErrRoom},
+		{"any room", func(p *models.Promotion) { p.RoomIDs = nil }, 2, 2, 0, 0, nil},
+		{"used up", func(p *models.Promotion) {}, 1, 2, 10, 0, ErrUsedUp},
+		{"email limit", func(p *models.Promotion) {}, 1, 2, 3, 1, ErrEmailLimit},
+		{"no limits", func(p *models.Promotion) { p.MaxUses, p.MaxUsesPerEmail = 0, 0 }, 1, 2, 100, 100, nil},
+	}
+
+	for _, e := range tests {
+		p := base
+		e.modify(&p)
+
+		if err := Check(p, e.roomID, e.nights, today, e.uses, e.emailUses); err != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, err)
+		}
+	}
+
+	if err := Check(base, 1, 1, today, 0, 0); err == nil {
+		t.Error("expected error for stay shorter than minimum nights")
+	}
+}
+
+func TestDiscount(t *testing.T) {
+	var tests = []struct {
+		promotion models.Promotion
+		expected  int
+	}{
+		{models.Promotion{DiscountType: TypePercent, DiscountValue: 10}, 3000},
+		{models.Promotion{DiscountType: TypeFixed, DiscountValue: 2500}, 2500},
+		{models.Promotion{DiscountType: TypeFixed, DiscountValue: 50000}, 30000},
+		{models.Promotion{DiscountType: "unknown", DiscountValue: 10}, 0},
+	}
+
+	for _, e := range tests {
+		if got := Discount(e.promotion, 30000); got != e.expected {
+			t.Errorf("%+v: expected discount %d, got %d", e.promotion, e.expected, got)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if got := Normalize("  winter10 "); got != "WINTER10" {
+		t.Errorf("unexpected code %q", got)
+	}
+}
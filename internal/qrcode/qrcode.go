@@ -0,0 +1,40 @@
+package qrcode
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+
+	qr "github.com/skip2/go-qrcode"
+)
+
+// SVG draws text as an inline SVG QR code at error correction level M, size pixels wide
+func SVG(text, title string, size int) (template.HTML, error) {
+	c, err := qr.New(text, qr.Medium)
+	if err != nil {
+		return "", err
+	}
+
+	// The bitmap includes the light border decoders need around the code
+	bitmap := c.Bitmap()
+	side := len(bitmap)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="qrcode" viewBox="0 0 %d %d" width="%d" height="%d" role="img" aria-label="%s" shape-rendering="crispEdges" xmlns="http://www.w3.org/2000/svg">`,
+		side, side, size, size, html.EscapeString(title))
+	fmt.Fprintf(&b, `<title>%s</title>`, html.EscapeString(title))
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, side, side)
+
+	b.WriteString(`<path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+
+	return template.HTML(b.String()), nil
+}
@@ -0,0 +1,29 @@
+package qrcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSVG(t *testing.T) {
+	svg, err := SVG("hello", "Scan <me>", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{`viewBox="0 0 29 29"`, `width="200"`, `<title>Scan &lt;me&gt;</title>`, `M4 4h1v1h-1z`} {
+		if !strings.Contains(string(svg), e) {
+			t.Errorf("expected %s in %s", e, svg)
+		}
+	}
+
+	// The quiet zone around the code is light
+	if strings.Contains(string(svg), "M0 0h1v1h-1z") || strings.Contains(string(svg), "M3 4h1v1h-1z") {
+		t.Error("expected a light border around the code")
+	}
+}
+
+func TestSVG_TooLong(t *testing.T) {
+	if _, err := SVG(strings.Repeat("a", 3000), "Scan me", 200); err == nil {
+		t.Error("expected an error for text too long for a QR code")
+	}
+}
@@ -0,0 +1,113 @@
+package rbac
+
+import (
+	"strings"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Permission is something a staff user may be allowed to do in the admin tool
+type Permission string
+
+// Permissions
+const (
+	ViewReports        Permission = "view-reports"
+	ViewReservations   Permission = "view-reservations"
+	EditReservations   Permission = "edit-reservations"
+	DeleteReservations Permission = "delete-reservations"
+	ExportReservations Permission = "export-reservations"
+	ImportReservations Permission = "import-reservations"
+	EditGuests         Permission = "edit-guests"
+	ViewCalendar       Permission = "view-calendar"
+	BlockRooms         Permission = "block-rooms"
+	ManagePayments     Permission = "manage-payments"
+	ManageSettings     Permission = "manage-settings"
+	ManageUsers        Permission = "manage-users"
+	ManageMail         Permission = "manage-mail"
+)
+
+// Role is an access level with a name
+type Role struct {
+	AccessLevel int
+	Name        string
+}
+
+// Roles are the roles a user can have, staff roles first, most powerful first
+var Roles = []Role{
+	{models.AccessLevelOwner, "Owner"},
+	{models.AccessLevelManager, "Manager"},
+	{models.AccessLevelFrontDesk, "Front desk"},
+	{models.AccessLevelHousekeeping, "Housekeeping"},
+	{models.AccessLevelGuest, "Guest"},
+}
+
+// matrix lists the permissions of each staff role; guests have none. Owners can do
+// everything, managers everything but manage users and the mail outbox, whose messages carry
+// password links, front desk staff look after reservations and guests but cannot cancel them,
+// since that refunds payments, and housekeeping see the calendar and block rooms.
+var matrix = map[int][]Permission{
+	models.AccessLevelOwner: {
+		ViewReports, ViewReservations, EditReservations, DeleteReservations, ExportReservations,
+		ImportReservations, EditGuests, ViewCalendar, BlockRooms, ManagePayments, ManageSettings,
+		ManageUsers, ManageMail,
+	},
+	models.AccessLevelManager: {
+		ViewReports, ViewReservations, EditReservations, DeleteReservations, ExportReservations,
+		ImportReservations, EditGuests, ViewCalendar, BlockRooms, ManagePayments, ManageSettings,
+	},
+	models.AccessLevelFrontDesk: {
+		ViewReservations, EditReservations, EditGuests, ViewCalendar, BlockRooms,
+	},
+	models.AccessLevelHousekeeping: {
+		ViewCalendar, BlockRooms,
+	},
+}
+
+// Can reports whether a user with an access level has a permission
+func Can(accessLevel int, permission Permission) bool {
+	for _, p := range matrix[accessLevel] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether an access level is one of the staff roles, who can use the admin tool
+func IsStaff(accessLevel int) bool {
+	_, ok := matrix[accessLevel]
+	return ok
+}
+
+// RoleName returns the name of the role with an access level
+func RoleName(accessLevel int) string {
+	for _, role := range Roles {
+		if role.AccessLevel == accessLevel {
+			return role.Name
+		}
+	}
+	return "Unknown"
+}
+
+// ParseRole returns the access level of a role by name, ignoring case and with dashes for
+// spaces, as in "front-desk"
+func ParseRole(name string) (int, bool) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "-", " ")
+	for _, role := range Roles {
+		if strings.EqualFold(role.Name, name) {
+			return role.AccessLevel, true
+		}
+	}
+	return 0, false
+}
+
+// Home returns the first admin page a staff user can see
+func Home(accessLevel int) string {
+	if Can(accessLevel, ViewReports) {
+		return "/admin/dashboard"
+	}
+	if Can(accessLevel, ViewReservations) {
+		return "/admin/reservations-new"
+	}
+	return "/admin/reservations-calendar"
+}
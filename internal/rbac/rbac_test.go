@@ -0,0 +1,93 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		accessLevel int
+		permission  Permission
+		expected    bool
+	}{
+		{models.AccessLevelOwner, DeleteReservations, true},
+		{models.AccessLevelOwner, ManageSettings, true},
+		{models.AccessLevelOwner, ManageUsers, true},
+		{models.AccessLevelManager, ManagePayments, true},
+		{models.AccessLevelManager, ManageUsers, false},
+		{models.AccessLevelOwner, ManageMail, true},
+		{models.AccessLevelManager, ManageMail, false},
+		{models.AccessLevelFrontDesk, EditReservations, true},
+		{models.AccessLevelFrontDesk, DeleteReservations, false},
+		{models.AccessLevelFrontDesk, ViewReports, false},
+		{models.AccessLevelHousekeeping, BlockRooms, true},
+		{models.AccessLevelHousekeeping, ViewReservations, false},
+		{models.AccessLevelGuest, ViewCalendar, false},
+		{99, ViewCalendar, false},
+	}
+
+	for _, e := range tests {
+		if got := Can(e.accessLevel, e.permission); got != e.expected {
+			t.Errorf("%s can %s: expected %t, got %t", RoleName(e.accessLevel), e.permission, e.expected, got)
+		}
+	}
+}
+
+func TestIsStaff(t *testing.T) {
+	for _, role := range Roles {
+		if IsStaff(role.AccessLevel) == (role.AccessLevel == models.AccessLevelGuest) {
+			t.Errorf("unexpected IsStaff for %s", role.Name)
+		}
+	}
+	if IsStaff(99) {
+		t.Error("expected an unknown access level not to be staff")
+	}
+}
+
+func TestHome(t *testing.T) {
+	// Every staff role can see its first admin page
+	for _, role := range Roles {
+		if !IsStaff(role.AccessLevel) {
+			continue
+		}
+		home := Home(role.AccessLevel)
+		permission := ViewCalendar
+		switch home {
+		case "/admin/dashboard":
+			permission = ViewReports
+		case "/admin/reservations-new":
+			permission = ViewReservations
+		}
+		if !Can(role.AccessLevel, permission) {
+			t.Errorf("%s cannot see their home page %s", role.Name, home)
+		}
+	}
+
+	if RoleName(models.AccessLevelFrontDesk) != "Front desk" || RoleName(99) != "Unknown" {
+		t.Error("unexpected role names")
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		ok       bool
+	}{
+		{"owner", models.AccessLevelOwner, true},
+		{"Manager", models.AccessLevelManager, true},
+		{"front-desk", models.AccessLevelFrontDesk, true},
+		{" Front desk ", models.AccessLevelFrontDesk, true},
+		{"guest", models.AccessLevelGuest, true},
+		{"cleaner", 0, false},
+	}
+
+	for _, e := range tests {
+		level, ok := ParseRole(e.name)
+		if level != e.expected || ok != e.ok {
+			t.Errorf("%q: expected %d %t, got %d %t", e.name, e.expected, e.ok, level, ok)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package reminders
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
+)
+
+// Reminder emails guests whose balance is coming due
+type Reminder struct {
+	DB       repository.DatabaseRepo
+	ErrorLog *log.Logger
+
+	// BaseURL is prepended to the payment link in the email
+	BaseURL string
+	// LeadDays is how many days before the due date the reminder is sent
+	LeadDays int
+}
+
+// New creates a new balance reminder
+func New(db repository.DatabaseRepo, errorLog *log.Logger, baseURL string, leadDays int) *Reminder {
+	return &Reminder{
+		DB:       db,
+		ErrorLog: errorLog,
+		BaseURL:  baseURL,
+		LeadDays: leadDays,
+	}
+}
+
+// Start sends due reminders every interval in the background until stop is closed. The
+// returned channel is closed once the run in progress, if any, has finished.
+func (rm *Reminder) Start(interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			rm.SendDue(time.Now())
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	return done
+}
+
+// SendDue sends a reminder for every balance coming due that has not been reminded yet
+func (rm *Reminder) SendDue(now time.Time) {
+	balances, err := rm.DB.BalancesDue()
+	if err != nil {
+		rm.ErrorLog.Println(err)
+		return
+	}
+
+	for _, sp := range Due(balances, now, rm.LeadDays) {
+		if err := rm.DB.QueueMail(rm.message(sp)); err != nil {
+			rm.ErrorLog.Printf("cannot queue reminder %d: %v", sp.ID, err)
+			continue
+		}
+
+		if err := rm.DB.MarkReminderSent(sp.ID, now); err != nil {
+			rm.ErrorLog.Printf("cannot mark reminder %d as sent: %v", sp.ID, err)
+		}
+	}
+}
+
+// Due returns the balances that need a reminder at now: not reminded yet, due within
+// leadDays, and for stays that have not started
+func Due(balances []models.ScheduledPayment, now time.Time, leadDays int) []models.ScheduledPayment {
+	var due []models.ScheduledPayment
+
+	cutoff := now.AddDate(0, 0, leadDays)
+	for _, sp := range balances {
+		if !sp.ReminderSentAt.IsZero() || sp.DueDate.After(cutoff) || sp.Reservation.StartDate.Before(now) {
+			continue
+		}
+		due = append(due, sp)
+	}
+
+	return due
+}
+
+// message builds the reminder email for a balance
+func (rm *Reminder) message(sp models.ScheduledPayment) models.MailData {
+	res := sp.Reservation
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Balance Reminder</strong>
+		<hr>
+		Dear %s, <br>
+		This is a reminder that the balance for your reservation at Fort Smythe BnB is due on %s. <br>
+		<div style="text-align:center !important;">
+			<strong>Room</strong>: %s <br>
+			<strong>Duration</strong>: %s to %s <br>
+			<strong>Balance due</strong>: %s <br>
+		</div>
+		You can pay the balance online at <a href="%s">%s</a>.
+	`,
+		res.FirstName+" "+res.LastName,
+		sp.DueDate.Format("2006-01-02"),
+		res.Room.RoomName,
+		res.StartDate.Format("2006-01-02"),
+		res.EndDate.Format("2006-01-02"),
+		pricing.FormatAmount(res.OutstandingAmount()),
+		rm.payURL(res), rm.payURL(res))
+
+	return models.MailData{
+		To:      res.Email,
+		From:    "manager@fsbnb.com",
+		Subject: "Balance Reminder",
+		Content: htmlMessage,
+	}
+}
+
+// payURL returns the link the guest follows to pay their balance
+func (rm *Reminder) payURL(res models.Reservation) string {
+	return fmt.Sprintf("%s/pay/%s", rm.BaseURL, res.AccessToken)
+}
@@ -0,0 +1,73 @@
+package reminders
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/repository/dbrepo"
+)
+
+func TestDue(t *testing.T) {
+	now := time.Date(2050, 1, 1, 9, 0, 0, 0, time.UTC)
+	start := time.Date(2050, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	balances := []models.ScheduledPayment{
+		{ID: 1, DueDate: time.Date(2050, 1, 5, 0, 0, 0, 0, time.UTC), Reservation: models.Reservation{StartDate: start}},
+		{ID: 2, DueDate: time.Date(2050, 1, 20, 0, 0, 0, 0, time.UTC), Reservation: models.Reservation{StartDate: start}},
+		{ID: 3, DueDate: time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC), ReminderSentAt: now.AddDate(0, 0, -1), Reservation: models.Reservation{StartDate: start}},
+		{ID: 4, DueDate: time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC), Reservation: models.Reservation{StartDate: now.AddDate(0, 0, -2)}},
+		{ID: 5, DueDate: time.Date(2049, 12, 20, 0, 0, 0, 0, time.UTC), Reservation: models.Reservation{StartDate: start}},
+	}
+
+	due := Due(balances, now, 7)
+
+	if len(due) != 2 || due[0].ID != 1 || due[1].ID != 5 {
+		t.Errorf("expected balances 1 and 5 to be due for a reminder, got %+v", due)
+	}
+}
+
+func TestReminder_message(t *testing.T) {
+	rm := &Reminder{BaseURL: "https://fsbnb.com"}
+
+	msg := rm.message(models.ScheduledPayment{
+		DueDate: time.Date(2050, 1, 5, 0, 0, 0, 0, time.UTC),
+		Reservation: models.Reservation{
+			FirstName:   "John",
+			LastName:    "Smith",
+			Email:       "john@smith.com",
+			TotalAmount: 50000,
+			PaidAmount:  10000,
+			AccessToken: "abc123",
+		},
+	})
+
+	if msg.To != "john@smith.com" {
+		t.Errorf("unexpected recipient %s", msg.To)
+	}
+
+	for _, s := range []string{"https://fsbnb.com/pay/abc123", "400.00", "2050-01-05"} {
+		if !strings.Contains(msg.Content, s) {
+			t.Errorf("expected reminder to contain %q", s)
+		}
+	}
+}
+
+func TestReminder_Start(t *testing.T) {
+	var app config.AppConfig
+	rm := New(dbrepo.NewTestRepo(&app), log.New(io.Discard, "", 0), "http://localhost:8080", 7)
+
+	stop := make(chan struct{})
+	done := rm.Start(time.Hour, stop)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the reminders to stop")
+	}
+}
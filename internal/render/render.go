@@ -12,14 +12,23 @@ import (
 
 	"github.com/justinas/nosurf"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/pricing"
+	"github.com/tanishqv/bnb-bookings/internal/rbac"
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
-	"add":        Add,
+	"humanDate":      HumanDate,
+	"formatDate":     FormatDate,
+	"iterate":        Iterate,
+	"add":            Add,
+	"formatAmount":   pricing.FormatAmount,
+	"formatCurrency": currency.Format,
+	"displayAmount":  DisplayAmount,
+	"can":            Can,
+	"adminHome":      rbac.Home,
+	"roleName":       rbac.RoleName,
 }
 
 var app *config.AppConfig
@@ -45,6 +54,12 @@ func NewRenderer(a *config.AppConfig) {
 	app = a
 }
 
+// Can reports whether a user with an access level has a permission, so templates can hide
+// what the user is not allowed to do
+func Can(accessLevel int, permission string) bool {
+	return rbac.Can(accessLevel, rbac.Permission(permission))
+}
+
 // HumanDate returns time in YYYY-MM-DD format
 func HumanDate(t time.Time) string {
 	return t.Format("2006-01-02")
@@ -55,6 +70,14 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// DisplayAmount converts an amount in the base currency to the display currency and formats it
+func DisplayAmount(amount int, code string) string {
+	if app == nil || app.ExchangeRates == nil {
+		return pricing.FormatAmount(amount)
+	}
+	return app.ExchangeRates.Display(amount, code)
+}
+
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Error = app.Session.PopString(r.Context(), "error")
@@ -63,6 +86,20 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 
 	if app.Session.Exists(r.Context(), "user-id") {
 		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access-level")
+	}
+
+	td.OnlinePayments = app.Payments != nil
+
+	if app.ExchangeRates != nil {
+		td.BaseCurrency = app.ExchangeRates.Base()
+		td.Currency = td.BaseCurrency
+		if code := app.Session.GetString(r.Context(), "currency"); code != "" {
+			if _, ok := app.ExchangeRates.Rate(code); ok {
+				td.Currency = code
+			}
+		}
+		td.Currencies = app.ExchangeRates.Codes()
 	}
 
 	return td
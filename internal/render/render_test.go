@@ -24,6 +24,50 @@ func TestAddDefaultData(t *testing.T) {
 	}
 }
 
+func TestAddDefaultData_Currency(t *testing.T) {
+	var tests = []struct {
+		chosen   string
+		expected string
+	}{
+		{"", "USD"},
+		{"EUR", "EUR"},
+		{"CHF", "USD"},
+	}
+
+	for _, e := range tests {
+		var td models.TemplateData
+
+		r, err := getSession()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if e.chosen != "" {
+			session.Put(r.Context(), "currency", e.chosen)
+		}
+
+		result := AddDefaultData(&td, r)
+
+		if result.Currency != e.expected {
+			t.Errorf("chosen %q: expected display currency %s, got %s", e.chosen, e.expected, result.Currency)
+		}
+
+		if result.BaseCurrency != "USD" || len(result.Currencies) != 2 {
+			t.Errorf("unexpected currencies %s %v", result.BaseCurrency, result.Currencies)
+		}
+	}
+}
+
+func TestDisplayAmount(t *testing.T) {
+	if got := DisplayAmount(10000, "EUR"); got != "€90.00" {
+		t.Errorf("expected €90.00, got %s", got)
+	}
+
+	if got := DisplayAmount(10000, "USD"); got != "$100.00" {
+		t.Errorf("expected $100.00, got %s", got)
+	}
+}
+
 func TestRenderTemplate(t *testing.T) {
 	pathToTemplates = "./../../templates"
 	tc, err := CreateTemplateCache()
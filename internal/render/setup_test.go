@@ -10,6 +10,7 @@ import (
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/tanishqv/bnb-bookings/internal/config"
+	"github.com/tanishqv/bnb-bookings/internal/currency"
 	"github.com/tanishqv/bnb-bookings/internal/models"
 )
 
@@ -39,6 +40,9 @@ func TestMain(m *testing.M) {
 
 	testApp.Session = session
 
+	testApp.ExchangeRates = currency.NewRates("USD")
+	testApp.ExchangeRates.Set([]models.ExchangeRate{{Currency: "EUR", Rate: 0.9}})
+
 	app = &testApp
 
 	os.Exit(m.Run())
@@ -0,0 +1,86 @@
+package reports
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+)
+
+// Chart layout, in SVG user units; the chart scales to the width of its container
+const (
+	chartWidth  = 640.0
+	chartHeight = 240.0
+	chartTop    = 24.0
+	chartBottom = 40.0
+	chartLeft   = 8.0
+	chartRight  = 8.0
+)
+
+// Bar is one bar of a bar chart
+type Bar struct {
+	Label string
+	Value float64
+}
+
+// BarChart draws the bars as an inline SVG chart. Each bar is labelled underneath and has
+// its value, formatted by format, written above it.
+func BarChart(title string, bars []Bar, format func(float64) string) template.HTML {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %.0f %.0f" width="100%%" role="img" aria-label="%s" xmlns="http://www.w3.org/2000/svg">`,
+		chartWidth, chartHeight, html.EscapeString(title))
+	fmt.Fprintf(&b, `<title>%s</title>`, html.EscapeString(title))
+
+	baseline := chartHeight - chartBottom
+	fmt.Fprintf(&b, `<line x1="%.0f" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#adb5bd" stroke-width="1"/>`,
+		chartLeft, baseline, chartWidth-chartRight, baseline)
+
+	if len(bars) == 0 {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="12" fill="#6c757d">No data</text>`,
+			chartWidth/2, baseline/2)
+		b.WriteString(`</svg>`)
+		return template.HTML(b.String())
+	}
+
+	top := 0.0
+	for _, bar := range bars {
+		if bar.Value > top {
+			top = bar.Value
+		}
+	}
+
+	slot := (chartWidth - chartLeft - chartRight) / float64(len(bars))
+	width := slot * 0.7
+	plot := baseline - chartTop
+
+	// Long labels are only readable when there is room for them
+	labelSize := 11.0
+	if slot < 40 {
+		labelSize = 9
+	}
+
+	for i, bar := range bars {
+		height := 0.0
+		if top > 0 && bar.Value > 0 {
+			height = plot * bar.Value / top
+		}
+
+		x := chartLeft + float64(i)*slot + (slot-width)/2
+		centre := x + width/2
+		value := html.EscapeString(format(bar.Value))
+		label := html.EscapeString(bar.Label)
+
+		fmt.Fprintf(&b, `<g><title>%s: %s</title>`, label, value)
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#0d6efd"/>`,
+			x, baseline-height, width, height)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="%.0f" fill="#212529">%s</text>`,
+			centre, baseline-height-4, labelSize, value)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="%.0f" fill="#6c757d">%s</text>`,
+			centre, baseline+16, labelSize, label)
+		b.WriteString(`</g>`)
+	}
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
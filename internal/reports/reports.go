@@ -0,0 +1,203 @@
+package reports
+
+import (
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+// Metrics are the occupancy and revenue figures for one room, one month or the whole range.
+// Nights sold and revenue count the nights inside the range; bookings, cancellations and
+// lead time count the reservations arriving inside it.
+type Metrics struct {
+	Label string
+
+	// AvailableNights is the number of room nights that could be sold: every night of
+	// every room, less the nights blocked by the owner or by an imported calendar
+	AvailableNights int
+	NightsSold      int
+	Revenue         int
+
+	Bookings      int
+	Cancellations int
+	LeadDays      int
+}
+
+// Occupancy returns the percentage of available nights that were sold
+func (m Metrics) Occupancy() float64 {
+	if m.AvailableNights == 0 {
+		return 0
+	}
+	return 100 * float64(m.NightsSold) / float64(m.AvailableNights)
+}
+
+// ADR returns the average daily rate: room revenue per night sold
+func (m Metrics) ADR() int {
+	if m.NightsSold == 0 {
+		return 0
+	}
+	return m.Revenue / m.NightsSold
+}
+
+// RevPAR returns the room revenue per available room night
+func (m Metrics) RevPAR() int {
+	if m.AvailableNights == 0 {
+		return 0
+	}
+	return m.Revenue / m.AvailableNights
+}
+
+// LeadTime returns the average number of days between booking and arrival
+func (m Metrics) LeadTime() float64 {
+	if m.Bookings == 0 {
+		return 0
+	}
+	return float64(m.LeadDays) / float64(m.Bookings)
+}
+
+// CancellationRate returns the percentage of bookings that were cancelled
+func (m Metrics) CancellationRate() float64 {
+	if m.Bookings == 0 {
+		return 0
+	}
+	return 100 * float64(m.Cancellations) / float64(m.Bookings)
+}
+
+// Report holds the metrics for the nights from From up to, but not including, To
+type Report struct {
+	From   time.Time
+	To     time.Time
+	Total  Metrics
+	Rooms  []Metrics
+	Months []Metrics
+}
+
+// Build computes the report for the nights from from up to to. Cancelled stays do not
+// count as nights sold, and stays in rooms that are not listed are ignored.
+func Build(from, to time.Time, rooms []models.Room, stays []models.Stay, blocks []models.RoomRestriction) Report {
+	from, to = day(from), day(to)
+	days := nightsBetween(from, to)
+	if days < 0 {
+		days = 0
+	}
+
+	report := Report{From: from, To: to, Total: Metrics{Label: "All rooms"}}
+
+	roomIndex := make(map[int]int)
+	for i, room := range rooms {
+		roomIndex[room.ID] = i
+		report.Rooms = append(report.Rooms, Metrics{Label: room.RoomName})
+	}
+
+	// The month each night of the range falls in
+	monthOf := make([]int, days)
+	for i := range monthOf {
+		d := from.AddDate(0, 0, i)
+		if i == 0 || d.Day() == 1 {
+			report.Months = append(report.Months, Metrics{Label: d.Format("Jan 2006")})
+		}
+		monthOf[i] = len(report.Months) - 1
+	}
+
+	// Nights that are sold or blocked, by room
+	sold := make([][]bool, len(rooms))
+	blocked := make([][]bool, len(rooms))
+	for i := range rooms {
+		sold[i] = make([]bool, days)
+		blocked[i] = make([]bool, days)
+	}
+
+	for _, b := range blocks {
+		r, ok := roomIndex[b.RoomID]
+		if !ok || b.ReservationID != 0 {
+			continue
+		}
+		for n := max(0, nightsBetween(from, b.StartDate)); n < min(days, nightsBetween(from, b.EndDate)); n++ {
+			blocked[r][n] = true
+		}
+	}
+
+	for _, s := range stays {
+		r, ok := roomIndex[s.RoomID]
+		if !ok {
+			continue
+		}
+
+		if arrival := nightsBetween(from, s.StartDate); arrival >= 0 && arrival < days {
+			lead := max(0, nightsBetween(day(s.BookedAt), s.StartDate))
+			for _, m := range []*Metrics{&report.Total, &report.Rooms[r], &report.Months[monthOf[arrival]]} {
+				m.Bookings++
+				m.LeadDays += lead
+				if !s.CancelledAt.IsZero() {
+					m.Cancellations++
+				}
+			}
+		}
+
+		if !s.CancelledAt.IsZero() {
+			continue
+		}
+
+		// Spread the revenue evenly over the nights of the stay, the first nights taking
+		// any remainder, so the nights inside the range add up exactly
+		nights := nightsBetween(s.StartDate, s.EndDate)
+		if nights <= 0 {
+			continue
+		}
+		offset := nightsBetween(from, s.StartDate)
+		for n := 0; n < nights; n++ {
+			i := offset + n
+			if i < 0 || i >= days {
+				continue
+			}
+
+			revenue := s.RoomRevenue / nights
+			if n < s.RoomRevenue%nights {
+				revenue++
+			}
+
+			sold[r][i] = true
+			for _, m := range []*Metrics{&report.Total, &report.Rooms[r], &report.Months[monthOf[i]]} {
+				m.NightsSold++
+				m.Revenue += revenue
+			}
+		}
+	}
+
+	for r := range rooms {
+		for i := 0; i < days; i++ {
+			if blocked[r][i] && !sold[r][i] {
+				continue
+			}
+			report.Total.AvailableNights++
+			report.Rooms[r].AvailableNights++
+			report.Months[monthOf[i]].AvailableNights++
+		}
+	}
+
+	return report
+}
+
+// day returns midnight UTC of t's date
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// nightsBetween returns the number of nights from start to end, negative if end is earlier
+func nightsBetween(start, end time.Time) int {
+	return int(day(end).Sub(day(start)).Hours() / 24)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+package reports
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanishqv/bnb-bookings/internal/models"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func testReport() Report {
+	rooms := []models.Room{
+		{ID: 1, RoomName: "General's Quarters"},
+		{ID: 2, RoomName: "Major's Suite"},
+	}
+
+	stays := []models.Stay{
+		// Three nights in January, one in February
+		{RoomID: 1, StartDate: date("2050-01-29"), EndDate: date("2050-02-02"), BookedAt: date("2050-01-19"), RoomRevenue: 40001},
+		// Arrives before the range: only the nights inside it count, not the booking
+		{RoomID: 2, StartDate: date("2049-12-30"), EndDate: date("2050-01-03"), BookedAt: date("2049-12-01"), RoomRevenue: 20000},
+		// Cancelled: a booking, but no nights sold
+		{RoomID: 2, StartDate: date("2050-01-10"), EndDate: date("2050-01-12"), BookedAt: date("2050-01-05"),
+			CancelledAt: date("2050-01-06"), RoomRevenue: 10000},
+		// Unknown room
+		{RoomID: 3, StartDate: date("2050-01-10"), EndDate: date("2050-01-12"), BookedAt: date("2050-01-05"), RoomRevenue: 10000},
+	}
+
+	blocks := []models.RoomRestriction{
+		// Owner block of two nights
+		{RoomID: 1, RestrictionID: 2, StartDate: date("2050-01-05"), EndDate: date("2050-01-07")},
+		// The restriction of a reservation is not a block
+		{RoomID: 2, RestrictionID: 1, ReservationID: 5, StartDate: date("2050-01-20"), EndDate: date("2050-01-22")},
+	}
+
+	return Build(date("2050-01-01"), date("2050-03-01"), rooms, stays, blocks)
+}
+
+func TestBuild(t *testing.T) {
+	r := testReport()
+
+	if len(r.Months) != 2 || r.Months[0].Label != "Jan 2050" || r.Months[1].Label != "Feb 2050" {
+		t.Fatalf("unexpected months %+v", r.Months)
+	}
+	if len(r.Rooms) != 2 {
+		t.Fatalf("expected 2 rooms, got %d", len(r.Rooms))
+	}
+
+	// 59 nights in the range for two rooms, less the two blocked nights
+	total := r.Total
+	if total.AvailableNights != 116 {
+		t.Errorf("expected 116 available nights, got %d", total.AvailableNights)
+	}
+	if total.NightsSold != 6 {
+		t.Errorf("expected 6 nights sold, got %d", total.NightsSold)
+	}
+	if total.Revenue != 40001+10000 {
+		t.Errorf("expected revenue 50001, got %d", total.Revenue)
+	}
+	if total.Bookings != 2 || total.Cancellations != 1 {
+		t.Errorf("expected 2 bookings and 1 cancellation, got %d and %d", total.Bookings, total.Cancellations)
+	}
+	if total.LeadDays != 15 {
+		t.Errorf("expected 15 lead days, got %d", total.LeadDays)
+	}
+
+	january, february := r.Months[0], r.Months[1]
+	if january.NightsSold != 5 || february.NightsSold != 1 {
+		t.Errorf("expected 5 and 1 nights sold, got %d and %d", january.NightsSold, february.NightsSold)
+	}
+	if february.Revenue != 10000 {
+		t.Errorf("expected the last night to earn 10000, got %d", february.Revenue)
+	}
+	if january.AvailableNights != 60 || february.AvailableNights != 56 {
+		t.Errorf("expected 60 and 56 available nights, got %d and %d", january.AvailableNights, february.AvailableNights)
+	}
+
+	generals := r.Rooms[0]
+	if generals.AvailableNights != 57 || generals.NightsSold != 4 || generals.Revenue != 40001 {
+		t.Errorf("unexpected room metrics %+v", generals)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := Metrics{AvailableNights: 40, NightsSold: 10, Revenue: 100000, Bookings: 4, Cancellations: 1, LeadDays: 30}
+
+	if got := m.Occupancy(); got != 25 {
+		t.Errorf("expected occupancy 25, got %v", got)
+	}
+	if got := m.ADR(); got != 10000 {
+		t.Errorf("expected ADR 10000, got %d", got)
+	}
+	if got := m.RevPAR(); got != 2500 {
+		t.Errorf("expected RevPAR 2500, got %d", got)
+	}
+	if got := m.LeadTime(); got != 7.5 {
+		t.Errorf("expected lead time 7.5, got %v", got)
+	}
+	if got := m.CancellationRate(); got != 25 {
+		t.Errorf("expected cancellation rate 25, got %v", got)
+	}
+
+	var empty Metrics
+	if empty.Occupancy() != 0 || empty.ADR() != 0 || empty.RevPAR() != 0 || empty.LeadTime() != 0 || empty.CancellationRate() != 0 {
+		t.Error("expected zero metrics without data")
+	}
+}
+
+func TestBuild_EmptyRange(t *testing.T) {
+	r := Build(date("2050-02-01"), date("2050-01-01"), []models.Room{{ID: 1}}, nil, nil)
+	if r.Total.AvailableNights != 0 || len(r.Months) != 0 {
+		t.Errorf("expected an empty report, got %+v", r)
+	}
+}
+
+func TestBarChart(t *testing.T) {
+	format := func(v float64) string { return fmt.Sprintf("%.0f%%", v) }
+	out := string(BarChart("Occupancy <by month>", []Bar{{"Jan", 50}, {"Feb", 100}, {"Mar", 0}}, format))
+
+	if !strings.HasPrefix(out, "<svg") || !strings.HasSuffix(out, "</svg>") {
+		t.Error("expected an svg element")
+	}
+	if strings.Count(out, "<rect") != 3 {
+		t.Errorf("expected 3 bars, got %d", strings.Count(out, "<rect"))
+	}
+	for _, e := range []string{"Occupancy &lt;by month&gt;", ">Feb<", ">100%<", `height="176.0"`, `height="88.0"`} {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected chart to contain %s", e)
+		}
+	}
+
+	empty := string(BarChart("Nothing", nil, format))
+	if !strings.Contains(empty, "No data") {
+		t.Error("expected an empty chart to say so")
+	}
+}
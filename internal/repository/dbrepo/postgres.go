@@ -2,28 +2,86 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (pgr *postgresDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns all users, staff first, by name
+func (pgr *postgresDBRepo) AllUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT `+userColumns+`
+		FROM users
+		ORDER BY access_level = $1, last_name, first_name, id`, models.AccessLevelGuest)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// nullableID stores an optional foreign key, where 0 means none, as NULL
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id > 0}
+}
+
+// nullableDate stores an optional date, where the zero time means none, as NULL
+func nullableDate(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
 }
 
-// InsertReservation inserts a reservation into the database
+// InsertReservation inserts a reservation and the charges it was quoted into the database
 func (pgr *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if res.PromotionID > 0 {
+		if err = claimPromotion(ctx, tx, res.PromotionID, res.Email); err != nil {
+			return 0, err
+		}
+	}
+
+	guestID, err := upsertGuest(ctx, tx, res)
+	if err != nil {
+		return 0, err
+	}
+
 	var newID int
 	stmt := `INSERT INTO reservations (first_name, last_name, email, phone, start_date,
-		end_date, room_id, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+		end_date, room_id, total_amount, access_token, promotion_id, discount_amount, guests,
+		guest_id, confirmed_at, hold_expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id`
 
-	err := pgr.DB.QueryRowContext(ctx, stmt,
+	err = tx.QueryRowContext(ctx, stmt,
 		res.FirstName,
 		res.LastName,
 		res.Email,
@@ -31,6 +89,14 @@ func (pgr *postgresDBRepo) InsertReservation(res models.Reservation) (int, error
 		res.StartDate,
 		res.EndDate,
 		res.RoomID,
+		res.TotalAmount,
+		res.AccessToken,
+		nullableID(res.PromotionID),
+		res.DiscountAmount,
+		res.Guests,
+		nullableID(guestID),
+		nullableDate(res.ConfirmedAt),
+		nullableDate(res.HoldExpiresAt),
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -39,6 +105,53 @@ func (pgr *postgresDBRepo) InsertReservation(res models.Reservation) (int, error
 		return 0, err
 	}
 
+	stmt = `INSERT INTO reservation_charges (reservation_id, kind, name, description, amount, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	for _, c := range res.Charges {
+		_, err = tx.ExecContext(ctx, stmt, newID, c.Kind, c.Name, c.Description, c.Amount, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The room is taken and the payment schedule saved with the reservation, so that it is
+	// never left without them
+	_, err = tx.ExecContext(ctx, `INSERT INTO room_restrictions (start_date, end_date, room_id,
+		reservation_id, restriction_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		newID,
+		1, // Type: Reservation
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `INSERT INTO payment_schedules (reservation_id, kind, amount, due_date, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	for _, sp := range res.Schedule {
+		_, err = tx.ExecContext(ctx, stmt, newID, sp.Kind, sp.Amount, sp.DueDate, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, msg := range res.Emails {
+		if err = insertOutboxMessage(ctx, tx, msg); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
 	return newID, nil
 }
 
@@ -144,7 +257,8 @@ func (pgr *postgresDBRepo) AllRooms() ([]models.Room, error) {
 
 	var rooms []models.Room
 
-	query := `SELECT id, room_name, created_at, updated_at
+	query := `SELECT id, room_name, ical_token, price, deposit_type, deposit_value,
+			  balance_due_days, COALESCE(cancellation_policy_id, 0), created_at, updated_at
 			  FROM rooms
 			  ORDER BY room_name`
 
@@ -160,6 +274,12 @@ func (pgr *postgresDBRepo) AllRooms() ([]models.Room, error) {
 		err := rows.Scan(
 			&rm.ID,
 			&rm.RoomName,
+			&rm.ICalToken,
+			&rm.Price,
+			&rm.DepositType,
+			&rm.DepositValue,
+			&rm.BalanceDueDays,
+			&rm.CancellationPolicyID,
 			&rm.CreatedAt,
 			&rm.UpdatedAt,
 		)
@@ -183,7 +303,8 @@ func (pgr *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 
 	var room models.Room
 
-	query := `SELECT id, room_name, created_at, updated_at
+	query := `SELECT id, room_name, ical_token, price, deposit_type, deposit_value,
+			  balance_due_days, COALESCE(cancellation_policy_id, 0), created_at, updated_at
 			  FROM rooms
 			  WHERE id = $1`
 
@@ -191,6 +312,12 @@ func (pgr *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.ICalToken,
+		&room.Price,
+		&room.DepositType,
+		&room.DepositValue,
+		&room.BalanceDueDays,
+		&room.CancellationPolicyID,
 		&room.CreatedAt,
 		&room.UpdatedAt,
 	)
@@ -206,31 +333,81 @@ func (pgr *postgresDBRepo) GetUserByID(id int) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var user models.User
+	return pgr.getUser(ctx, "id = $1", id)
+}
 
-	query := `SELECT id, first_name, last_name, email, password, access_level, created_at, updated_at
-			  FROM users
-			  WHERE id = $1`
+// GetUserByEmail returns a user by email address, ignoring case
+func (pgr *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	row := pgr.DB.QueryRowContext(ctx, query, id)
+	return pgr.getUser(ctx, "lower(email) = lower($1)", email)
+}
+
+func (pgr *postgresDBRepo) getUser(ctx context.Context, where string, arg interface{}) (models.User, error) {
+	row := pgr.DB.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+where, arg)
+	return scanUser(row)
+}
+
+// userColumns are the columns of users read into a user
+const userColumns = `id, first_name, last_name, email, phone, password, access_level,
+					email_verified_at, deactivated_at, password_changed_at, totp_secret, totp_enabled_at,
+					created_at, updated_at`
+
+// scanUser scans a row of userColumns
+func scanUser(row scanner) (models.User, error) {
+	var user models.User
+	var verifiedAt, deactivatedAt, passwordChangedAt, totpEnabledAt sql.NullTime
+	var totpSecret sql.NullString
 	err := row.Scan(
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.Phone,
 		&user.Password,
 		&user.AccessLevel,
+		&verifiedAt,
+		&deactivatedAt,
+		&passwordChangedAt,
+		&totpSecret,
+		&totpEnabledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
-	if err != nil {
-		return user, err
-	}
+	user.EmailVerifiedAt = verifiedAt.Time
+	user.DeactivatedAt = deactivatedAt.Time
+	user.PasswordChangedAt = passwordChangedAt.Time
+	user.TOTPSecret = totpSecret.String
+	user.TOTPEnabledAt = totpEnabledAt.Time
+	return user, err
+}
+
+// InsertUser inserts a user, whose password must already be hashed
+func (pgr *postgresDBRepo) InsertUser(u models.User) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := pgr.DB.QueryRowContext(ctx, `INSERT INTO users (first_name, last_name, email, phone, password,
+		access_level, email_verified_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.Phone,
+		u.Password,
+		u.AccessLevel,
+		nullableDate(u.EmailVerifiedAt),
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
 
-	return user, nil
+	return id, err
 }
 
-// UpdateUser updates a user in the database
+// UpdateUser updates the name, email address, phone number and access level of a user. An
+// email address that has not been confirmed is stored with a zero EmailVerifiedAt.
 func (pgr *postgresDBRepo) UpdateUser(u models.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -240,15 +417,21 @@ func (pgr *postgresDBRepo) UpdateUser(u models.User) error {
 			  first_name = $1,
 			  last_name = $2,
 			  email = $3,
-			  access_level = $4,
-			  updated_at = $5`
+			  phone = $4,
+			  access_level = $5,
+			  email_verified_at = $6,
+			  updated_at = $7
+			  WHERE id = $8`
 
 	_, err := pgr.DB.ExecContext(ctx, query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
+		u.Phone,
 		u.AccessLevel,
+		nullableDate(u.EmailVerifiedAt),
 		time.Now(),
+		u.ID,
 	)
 	if err != nil {
 		return err
@@ -257,6 +440,41 @@ func (pgr *postgresDBRepo) UpdateUser(u models.User) error {
 	return nil
 }
 
+// UpdateUserPassword sets the password of a user, which must already be hashed
+func (pgr *postgresDBRepo) UpdateUserPassword(userID int, passwordHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE users SET password = $1, password_changed_at = $2, updated_at = $2
+		WHERE id = $3`, passwordHash, time.Now(), userID)
+	return err
+}
+
+// DeactivateUser stops a user logging in
+func (pgr *postgresDBRepo) DeactivateUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE users SET deactivated_at = COALESCE(deactivated_at, $1), updated_at = $1
+		WHERE id = $2`, time.Now(), userID)
+	return err
+}
+
+// ReactivateUser lets a deactivated user log in again
+func (pgr *postgresDBRepo) ReactivateUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE users SET deactivated_at = NULL, updated_at = $1 WHERE id = $2`,
+		time.Now(), userID)
+	return err
+}
+
+// dummyPasswordHash is compared with the password given for an account that does not exist, or
+// has no password yet, so that logging in takes as long as for one that does. It is hashed at
+// the same cost as passwords.
+const dummyPasswordHash = "$2a$12$5CtIeYfpvnez6LXTnY6l1Oa6UEFNlNfvXbixAzT56Wo.Sp3joJA/K"
+
 // Authenticate authenticates a user
 func (pgr *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -267,12 +485,16 @@ func (pgr *postgresDBRepo) Authenticate(email, testPassword string) (int, string
 
 	query := `SELECT id, password
 			  FROM users
-			  WHERE email = $1`
+			  WHERE lower(email) = lower($1) AND deactivated_at IS NULL`
 
 	row := pgr.DB.QueryRowContext(ctx, query, email)
 	err := row.Scan(&id, &hashedPassword)
+	if err == nil && hashedPassword == "" {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
-		return id, "", err
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(testPassword))
+		return 0, "", err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
@@ -285,128 +507,43 @@ func (pgr *postgresDBRepo) Authenticate(email, testPassword string) (int, string
 	return id, hashedPassword, nil
 }
 
-// AllReservations returns a slice of all the reservations
-func (pgr *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []models.Reservation
-
-	query := `SELECT r.id, r.first_name, r.last_name, r.email, r.phone, 
-					 r.start_date, r.end_date, r.room_id, r.created_at, 
-					 r.updated_at, r.processed, 
-					 rooms.id, rooms.room_name
-			  FROM reservations r
-			  LEFT JOIN rooms
-			  ON r.room_id = rooms.id
-			  ORDER BY r.start_date ASC`
-
-	rows, err := pgr.DB.QueryContext(ctx, query)
-	if err != nil {
-		return reservations, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i models.Reservation
-		err = rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-
-		reservations = append(reservations, i)
-	}
-
-	if err = rows.Err(); err != nil {
-		return reservations, err
-	}
-
-	return reservations, nil
+// GetReservationByID returns one reservation by ID
+func (pgr *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+	return pgr.getReservation("r.id = $1", id)
 }
 
-// AllNewReservations returns a slice of all the reservations
-func (pgr *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []models.Reservation
-
-	query := `SELECT r.id, r.first_name, r.last_name, r.email, r.phone, 
-					 r.start_date, r.end_date, r.room_id, r.created_at, 
-					 r.updated_at, rooms.id, rooms.room_name
-			  FROM reservations r
-			  LEFT JOIN rooms
-			  ON r.room_id = rooms.id
-			  WHERE processed = 0
-			  ORDER BY r.start_date ASC`
-
-	rows, err := pgr.DB.QueryContext(ctx, query)
-	if err != nil {
-		return reservations, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i models.Reservation
-		err = rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-
-		reservations = append(reservations, i)
-	}
-
-	if err = rows.Err(); err != nil {
-		return reservations, err
+// GetReservationByAccessToken returns one reservation by the token given to the guest
+func (pgr *postgresDBRepo) GetReservationByAccessToken(token string) (models.Reservation, error) {
+	if token == "" {
+		return models.Reservation{}, sql.ErrNoRows
 	}
-
-	return reservations, nil
+	return pgr.getReservation("r.access_token = $1", token)
 }
 
-// GetReservationByID returns one reservation by ID
-func (pgr *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+func (pgr *postgresDBRepo) getReservation(where string, arg interface{}) (models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var res models.Reservation
+	var cancelledAt, confirmedAt, holdExpiresAt sql.NullTime
 
 	query := `SELECT r.id, r.first_name, r.last_name, r.email, r.phone,
 			 r.start_date, r.end_date, r.room_id,
-			 r.created_at, r.updated_at, r.processed,
-			 rooms.id, rooms.room_name
+			 r.created_at, r.updated_at, r.processed, r.total_amount, r.access_token,
+			 r.cancelled_at, r.cancellation_refund, r.cancellation_penalty,
+			 r.confirmed_at, r.hold_expires_at,
+			 COALESCE(r.promotion_id, 0), r.discount_amount, r.guests, COALESCE(r.guest_id, 0),
+			 COALESCE((SELECT SUM(p.amount) FROM payments p
+			  WHERE p.reservation_id = r.id AND p.status IN ('captured', 'refunded')), 0),
+			 COALESCE((SELECT SUM(p.refunded_amount) FROM payments p
+			  WHERE p.reservation_id = r.id), 0),
+			 rooms.id, rooms.room_name, rooms.price, COALESCE(rooms.cancellation_policy_id, 0)
 			 FROM reservations r
 			 LEFT JOIN rooms
 			 ON r.room_id = rooms.id
-			 WHERE r.id = $1`
+			 WHERE ` + where
 
-	row := pgr.DB.QueryRowContext(ctx, query, id)
+	row := pgr.DB.QueryRowContext(ctx, query, arg)
 	err := row.Scan(
 		&res.ID,
 		&res.FirstName,
@@ -419,14 +556,53 @@ func (pgr *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error
 		&res.CreatedAt,
 		&res.UpdatedAt,
 		&res.Processed,
+		&res.TotalAmount,
+		&res.AccessToken,
+		&cancelledAt,
+		&res.CancellationRefund,
+		&res.CancellationPenalty,
+		&confirmedAt,
+		&holdExpiresAt,
+		&res.PromotionID,
+		&res.DiscountAmount,
+		&res.Guests,
+		&res.GuestID,
+		&res.PaidAmount,
+		&res.RefundedAmount,
 		&res.Room.ID,
 		&res.Room.RoomName,
+		&res.Room.Price,
+		&res.Room.CancellationPolicyID,
 	)
 	if err != nil {
 		return res, err
 	}
 
-	return res, nil
+	res.CancelledAt = cancelledAt.Time
+	res.ConfirmedAt = confirmedAt.Time
+	res.HoldExpiresAt = holdExpiresAt.Time
+
+	query = `SELECT id, reservation_id, kind, name, description, amount, created_at, updated_at
+			 FROM reservation_charges
+			 WHERE reservation_id = $1
+			 ORDER BY id`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, res.ID)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationCharge
+		err = rows.Scan(&c.ID, &c.ReservationID, &c.Kind, &c.Name, &c.Description, &c.Amount, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return res, err
+		}
+		res.Charges = append(res.Charges, c)
+	}
+
+	return res, rows.Err()
 }
 
 // UpdateReservation updates a reservation in the database
@@ -434,20 +610,34 @@ func (pgr *postgresDBRepo) UpdateReservation(r models.Reservation) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A changed email address moves the reservation to that guest's profile
+	guestID, err := upsertGuest(ctx, tx, r)
+	if err != nil {
+		return err
+	}
+
 	query := `UPDATE reservations
 			  SET
 			  first_name = $1,
 			  last_name = $2,
 			  email = $3,
 			  phone = $4,
-			  updated_at = $5
-			  WHERE id = $6`
+			  guest_id = $5,
+			  updated_at = $6
+			  WHERE id = $7`
 
-	_, err := pgr.DB.ExecContext(ctx, query,
+	_, err = tx.ExecContext(ctx, query,
 		r.FirstName,
 		r.LastName,
 		r.Email,
 		r.Phone,
+		nullableID(guestID),
 		time.Now(),
 		r.ID,
 	)
@@ -455,23 +645,44 @@ func (pgr *postgresDBRepo) UpdateReservation(r models.Reservation) error {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-// DeleteReservation deletes a reservation in the database
+// DeleteReservation deletes a cancelled reservation in the database. It returns
+// sql.ErrNoRows if there is no such reservation or it is not cancelled, and
+// repository.ErrReservationHasPayments if it has payments or an invoice.
 func (pgr *postgresDBRepo) DeleteReservation(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `DELETE FROM reservations
-			  WHERE id = $1`
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := pgr.DB.ExecContext(ctx, query, id)
+	// Locking the reservation keeps payments and invoices from being added to it until it is gone
+	var hasPayments bool
+	query := `SELECT EXISTS (SELECT 1 FROM payments WHERE reservation_id = r.id)
+				OR EXISTS (SELECT 1 FROM invoices WHERE reservation_id = r.id)
+			  FROM reservations r
+			  WHERE r.id = $1 AND r.cancelled_at IS NOT NULL
+			  FOR UPDATE OF r`
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(&hasPayments)
 	if err != nil {
 		return err
 	}
+	if hasPayments {
+		return repository.ErrReservationHasPayments
+	}
 
-	return nil
+	_, err = tx.ExecContext(ctx, `DELETE FROM reservations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // UpdateProcessedForReservation updates processed for a reservation by ID
@@ -567,3 +778,2663 @@ func (pgr *postgresDBRepo) DeleteBlockByID(id int) error {
 
 	return nil
 }
+
+// AllICalSources returns a slice of all external calendars
+func (pgr *postgresDBRepo) AllICalSources() ([]models.ICalSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sources []models.ICalSource
+
+	query := `SELECT s.id, s.room_id, s.name, s.url, s.last_synced_at, s.last_error,
+			  s.created_at, s.updated_at, rooms.id, rooms.room_name
+			  FROM ical_sources s
+			  LEFT JOIN rooms
+			  ON s.room_id = rooms.id
+			  ORDER BY rooms.room_name, s.name`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return sources, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.ICalSource
+		var syncedAt sql.NullTime
+
+		err = rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.URL,
+			&syncedAt,
+			&s.LastError,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+			&s.Room.ID,
+			&s.Room.RoomName,
+		)
+		if err != nil {
+			return sources, err
+		}
+		s.LastSyncedAt = syncedAt.Time
+
+		sources = append(sources, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return sources, err
+	}
+
+	conflicts, err := pgr.sourceConflicts(ctx)
+	if err != nil {
+		return sources, err
+	}
+	for i := range sources {
+		sources[i].Conflicts = conflicts[sources[i].ID]
+	}
+
+	return sources, nil
+}
+
+// GetICalSourceByID returns one external calendar by ID
+func (pgr *postgresDBRepo) GetICalSourceByID(id int) (models.ICalSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s models.ICalSource
+	var syncedAt sql.NullTime
+
+	query := `SELECT s.id, s.room_id, s.name, s.url, s.last_synced_at, s.last_error,
+			  s.created_at, s.updated_at, rooms.id, rooms.room_name
+			  FROM ical_sources s
+			  LEFT JOIN rooms
+			  ON s.room_id = rooms.id
+			  WHERE s.id = $1`
+
+	row := pgr.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&s.ID,
+		&s.RoomID,
+		&s.Name,
+		&s.URL,
+		&syncedAt,
+		&s.LastError,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+		&s.Room.ID,
+		&s.Room.RoomName,
+	)
+	if err != nil {
+		return s, err
+	}
+	s.LastSyncedAt = syncedAt.Time
+
+	return s, nil
+}
+
+// InsertICalSource inserts an external calendar into the database
+func (pgr *postgresDBRepo) InsertICalSource(s models.ICalSource) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO ical_sources (room_id, name, url, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5) RETURNING id`
+
+	err := pgr.DB.QueryRowContext(ctx, stmt,
+		s.RoomID,
+		s.Name,
+		s.URL,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteICalSource deletes an external calendar and the blocks imported from it
+func (pgr *postgresDBRepo) DeleteICalSource(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM ical_sources
+			  WHERE id = $1`
+
+	_, err := pgr.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateICalSourceStatus records the outcome of the last sync of an external calendar
+func (pgr *postgresDBRepo) UpdateICalSourceStatus(id int, syncedAt time.Time, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE ical_sources
+			  SET last_synced_at = $1, last_error = $2, updated_at = $3
+			  WHERE id = $4`
+
+	_, err := pgr.DB.ExecContext(ctx, query, syncedAt, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SyncSourceBlocks replaces the blocks imported from an external calendar in one transaction.
+// The source is locked so that syncs of it run one at a time, and plan is given the blocks
+// imported so far to return those to insert, update and delete.
+func (pgr *postgresDBRepo) SyncSourceBlocks(sourceID int, plan func([]models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, []models.RoomRestriction)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT id FROM ical_sources WHERE id = $1 FOR UPDATE`, sourceID)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT id, room_id, restriction_id, start_date, end_date, source_id, external_uid
+			  FROM room_restrictions
+			  WHERE source_id = $1`
+
+	rows, err := tx.QueryContext(ctx, query, sourceID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var existing []models.RoomRestriction
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(
+			&r.ID,
+			&r.RoomID,
+			&r.RestrictionID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.SourceID,
+			&r.ExternalUID,
+		)
+		if err != nil {
+			return err
+		}
+
+		existing = append(existing, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	toInsert, toUpdate, toDelete := plan(existing)
+
+	query = `INSERT INTO room_restrictions
+			 (start_date, end_date, room_id, restriction_id, source_id, external_uid, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	for _, r := range toInsert {
+		_, err = tx.ExecContext(ctx, query,
+			r.StartDate,
+			r.EndDate,
+			r.RoomID,
+			2,
+			sourceID,
+			r.ExternalUID,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `UPDATE room_restrictions
+			 SET start_date = $1, end_date = $2, updated_at = $3
+			 WHERE id = $4 AND source_id = $5`
+
+	for _, r := range toUpdate {
+		_, err = tx.ExecContext(ctx, query, r.StartDate, r.EndDate, time.Now(), r.ID, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range toDelete {
+		_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE id = $1 AND source_id = $2`, r.ID, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sourceConflicts returns the reservations overlapping blocks imported from each external
+// calendar that have not ended, by source ID
+func (pgr *postgresDBRepo) sourceConflicts(ctx context.Context) (map[int][]models.Reservation, error) {
+	conflicts := make(map[int][]models.Reservation)
+
+	query := `SELECT DISTINCT b.source_id, r.id, r.first_name, r.last_name, r.start_date, r.end_date
+			  FROM room_restrictions b
+			  JOIN room_restrictions rr
+			  ON rr.room_id = b.room_id AND rr.reservation_id IS NOT NULL
+			  AND rr.start_date < b.end_date AND b.start_date < rr.end_date
+			  JOIN reservations r
+			  ON r.id = rr.reservation_id
+			  WHERE b.source_id IS NOT NULL AND b.end_date > CURRENT_DATE
+			  ORDER BY r.start_date, r.id`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return conflicts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sourceID int
+		var res models.Reservation
+		err = rows.Scan(&sourceID, &res.ID, &res.FirstName, &res.LastName, &res.StartDate, &res.EndDate)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts[sourceID] = append(conflicts[sourceID], res)
+	}
+
+	return conflicts, rows.Err()
+}
+
+// paymentLockClass is the first key of the advisory locks held while paying for a reservation,
+// the second being the reservation ID
+const paymentLockClass = 1
+
+// LockReservationPayments runs fn while holding a lock on paying for a reservation, so that a
+// second submit of the payment form waits for the first and then sees its payment. The lock
+// is an advisory one rather than the reservation row, which fn updates on other connections.
+func (pgr *postgresDBRepo) LockReservationPayments(reservationID int, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, paymentLockClass, reservationID)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertPayment inserts a payment into the database
+func (pgr *postgresDBRepo) InsertPayment(p models.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO payments (reservation_id, gateway, reference, card_last4, amount,
+			 refunded_amount, currency, status, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	err := pgr.DB.QueryRowContext(ctx, stmt,
+		p.ReservationID,
+		p.Gateway,
+		p.Reference,
+		p.CardLast4,
+		p.Amount,
+		p.RefundedAmount,
+		p.Currency,
+		p.Status,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetPaymentsByReservationID returns the payments made against a reservation
+func (pgr *postgresDBRepo) GetPaymentsByReservationID(reservationID int) ([]models.Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var payments []models.Payment
+
+	query := `SELECT id, reservation_id, gateway, reference, card_last4, amount,
+			  refunded_amount, currency, status, created_at, updated_at
+			  FROM payments
+			  WHERE reservation_id = $1
+			  ORDER BY created_at`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return payments, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Payment
+		err = rows.Scan(
+			&p.ID,
+			&p.ReservationID,
+			&p.Gateway,
+			&p.Reference,
+			&p.CardLast4,
+			&p.Amount,
+			&p.RefundedAmount,
+			&p.Currency,
+			&p.Status,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return payments, err
+		}
+
+		payments = append(payments, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return payments, err
+	}
+
+	return payments, nil
+}
+
+// GetPaymentByID returns one payment by ID
+func (pgr *postgresDBRepo) GetPaymentByID(id int) (models.Payment, error) {
+	return pgr.getPayment("id = $1", id)
+}
+
+// GetPaymentByReference returns one payment by its gateway reference
+func (pgr *postgresDBRepo) GetPaymentByReference(reference string) (models.Payment, error) {
+	return pgr.getPayment("reference = $1", reference)
+}
+
+func (pgr *postgresDBRepo) getPayment(where string, arg interface{}) (models.Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var p models.Payment
+
+	query := `SELECT id, reservation_id, gateway, reference, card_last4, amount,
+			  refunded_amount, currency, status, created_at, updated_at
+			  FROM payments
+			  WHERE ` + where
+
+	row := pgr.DB.QueryRowContext(ctx, query, arg)
+	err := row.Scan(
+		&p.ID,
+		&p.ReservationID,
+		&p.Gateway,
+		&p.Reference,
+		&p.CardLast4,
+		&p.Amount,
+		&p.RefundedAmount,
+		&p.Currency,
+		&p.Status,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// UpdatePayment updates the amounts and status of a payment
+func (pgr *postgresDBRepo) UpdatePayment(p models.Payment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE payments
+			  SET amount = $1, refunded_amount = $2, status = $3, updated_at = $4
+			  WHERE id = $5`
+
+	_, err := pgr.DB.ExecContext(ctx, query, p.Amount, p.RefundedAmount, p.Status, time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateRoomDepositPolicy updates the deposit policy of a room
+func (pgr *postgresDBRepo) UpdateRoomDepositPolicy(room models.Room) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE rooms
+			  SET deposit_type = $1, deposit_value = $2, balance_due_days = $3, updated_at = $4
+			  WHERE id = $5`
+
+	_, err := pgr.DB.ExecContext(ctx, query,
+		room.DepositType,
+		room.DepositValue,
+		room.BalanceDueDays,
+		time.Now(),
+		room.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetScheduleByReservationID returns the payment schedule of a reservation
+func (pgr *postgresDBRepo) GetScheduleByReservationID(reservationID int) ([]models.ScheduledPayment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var schedule []models.ScheduledPayment
+
+	query := `SELECT id, reservation_id, kind, amount, due_date, reminder_sent_at, created_at, updated_at
+			  FROM payment_schedules
+			  WHERE reservation_id = $1
+			  ORDER BY due_date, id`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return schedule, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sp models.ScheduledPayment
+		var reminderSentAt sql.NullTime
+
+		err = rows.Scan(
+			&sp.ID,
+			&sp.ReservationID,
+			&sp.Kind,
+			&sp.Amount,
+			&sp.DueDate,
+			&reminderSentAt,
+			&sp.CreatedAt,
+			&sp.UpdatedAt,
+		)
+		if err != nil {
+			return schedule, err
+		}
+
+		sp.ReminderSentAt = reminderSentAt.Time
+		schedule = append(schedule, sp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return schedule, err
+	}
+
+	return schedule, nil
+}
+
+// BalancesDue returns the balance installments of reservations that are not yet paid in full.
+// Reservations whose deposit was never paid are left out, since there is no stay to remind of.
+func (pgr *postgresDBRepo) BalancesDue() ([]models.ScheduledPayment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var balances []models.ScheduledPayment
+
+	query := `SELECT ps.id, ps.reservation_id, ps.kind, ps.amount, ps.due_date, ps.reminder_sent_at,
+			  ps.created_at, ps.updated_at,
+			  r.first_name, r.last_name, r.email, r.start_date, r.end_date, r.room_id,
+			  r.total_amount, r.access_token, paid.amount,
+			  rooms.id, rooms.room_name
+			  FROM payment_schedules ps
+			  JOIN reservations r ON ps.reservation_id = r.id
+			  LEFT JOIN rooms ON r.room_id = rooms.id
+			  CROSS JOIN LATERAL (
+				SELECT COALESCE(SUM(p.amount), 0) AS amount FROM payments p
+				WHERE p.reservation_id = r.id AND p.status IN ('captured', 'refunded')
+			  ) paid
+			  WHERE ps.kind = 'balance' AND r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL
+			  AND r.total_amount > paid.amount
+			  AND paid.amount >= (SELECT COALESCE(SUM(d.amount), 0) FROM payment_schedules d
+								  WHERE d.reservation_id = r.id AND d.kind = 'deposit')
+			  ORDER BY ps.due_date, r.id`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return balances, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sp models.ScheduledPayment
+		var reminderSentAt sql.NullTime
+
+		err = rows.Scan(
+			&sp.ID,
+			&sp.ReservationID,
+			&sp.Kind,
+			&sp.Amount,
+			&sp.DueDate,
+			&reminderSentAt,
+			&sp.CreatedAt,
+			&sp.UpdatedAt,
+			&sp.Reservation.FirstName,
+			&sp.Reservation.LastName,
+			&sp.Reservation.Email,
+			&sp.Reservation.StartDate,
+			&sp.Reservation.EndDate,
+			&sp.Reservation.RoomID,
+			&sp.Reservation.TotalAmount,
+			&sp.Reservation.AccessToken,
+			&sp.Reservation.PaidAmount,
+			&sp.Reservation.Room.ID,
+			&sp.Reservation.Room.RoomName,
+		)
+		if err != nil {
+			return balances, err
+		}
+
+		sp.ReminderSentAt = reminderSentAt.Time
+		sp.Reservation.ID = sp.ReservationID
+		balances = append(balances, sp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return balances, err
+	}
+
+	return balances, nil
+}
+
+// MarkReminderSent records when the balance reminder for an installment was sent
+func (pgr *postgresDBRepo) MarkReminderSent(id int, sentAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE payment_schedules SET reminder_sent_at = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := pgr.DB.ExecContext(ctx, query, sentAt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllCancellationPolicies returns all cancellation policies
+func (pgr *postgresDBRepo) AllCancellationPolicies() ([]models.CancellationPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var policies []models.CancellationPolicy
+
+	query := `SELECT id, name, rules, created_at, updated_at
+			  FROM cancellation_policies
+			  ORDER BY name`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return policies, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cp models.CancellationPolicy
+		err = rows.Scan(
+			&cp.ID,
+			&cp.Name,
+			&cp.Rules,
+			&cp.CreatedAt,
+			&cp.UpdatedAt,
+		)
+		if err != nil {
+			return policies, err
+		}
+
+		policies = append(policies, cp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return policies, err
+	}
+
+	return policies, nil
+}
+
+// GetCancellationPolicyByID returns one cancellation policy by ID
+func (pgr *postgresDBRepo) GetCancellationPolicyByID(id int) (models.CancellationPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cp models.CancellationPolicy
+
+	query := `SELECT id, name, rules, created_at, updated_at
+			  FROM cancellation_policies
+			  WHERE id = $1`
+
+	row := pgr.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&cp.ID,
+		&cp.Name,
+		&cp.Rules,
+		&cp.CreatedAt,
+		&cp.UpdatedAt,
+	)
+	if err != nil {
+		return cp, err
+	}
+
+	return cp, nil
+}
+
+// InsertCancellationPolicy inserts a cancellation policy into the database
+func (pgr *postgresDBRepo) InsertCancellationPolicy(cp models.CancellationPolicy) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO cancellation_policies (name, rules, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4) RETURNING id`
+
+	err := pgr.DB.QueryRowContext(ctx, stmt, cp.Name, cp.Rules, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteCancellationPolicy deletes a cancellation policy; rooms using it fall back to no policy
+func (pgr *postgresDBRepo) DeleteCancellationPolicy(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM cancellation_policies WHERE id = $1`
+
+	_, err := pgr.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateRoomCancellationPolicy attaches a cancellation policy to a room; 0 removes it
+func (pgr *postgresDBRepo) UpdateRoomCancellationPolicy(roomID, policyID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE rooms SET cancellation_policy_id = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := pgr.DB.ExecContext(ctx, query, nullableID(policyID), time.Now(), roomID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CancelReservation records the cancellation of a reservation and releases its room. It
+// returns sql.ErrNoRows if the reservation was already cancelled.
+func (pgr *postgresDBRepo) CancelReservation(res models.Reservation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE reservations
+			  SET cancelled_at = $1, cancellation_refund = $2, cancellation_penalty = $3, updated_at = $4
+			  WHERE id = $5 AND cancelled_at IS NULL`
+
+	result, err := tx.ExecContext(ctx, query,
+		res.CancelledAt,
+		res.CancellationRefund,
+		res.CancellationPenalty,
+		time.Now(),
+		res.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, res.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConfirmReservation confirms a reservation holding its room until it is paid for, and reports
+// whether it was confirmed now rather than before. It returns sql.ErrNoRows if the reservation
+// was cancelled, as when its hold expired.
+func (pgr *postgresDBRepo) ConfirmReservation(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var confirmedAt, cancelledAt sql.NullTime
+	query := `SELECT confirmed_at, cancelled_at FROM reservations WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&confirmedAt, &cancelledAt)
+	if err != nil {
+		return false, err
+	}
+	if cancelledAt.Valid {
+		return false, sql.ErrNoRows
+	}
+	if confirmedAt.Valid {
+		return false, nil
+	}
+
+	query = `UPDATE reservations
+			 SET confirmed_at = $1, hold_expires_at = NULL, updated_at = $1
+			 WHERE id = $2`
+
+	_, err = tx.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ExpireHolds cancels the reservations whose hold ran out at now before they were paid for,
+// releasing their rooms, and returns how many there were. Reservations with a payment
+// authorized or captured are kept for staff to sort out.
+func (pgr *postgresDBRepo) ExpireHolds(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := `WITH expired AS (
+				UPDATE reservations r
+				SET cancelled_at = $1, updated_at = $1
+				WHERE r.confirmed_at IS NULL AND r.cancelled_at IS NULL AND r.hold_expires_at <= $1
+				AND NOT EXISTS (SELECT 1 FROM payments p
+				 WHERE p.reservation_id = r.id AND p.status IN ('authorized', 'captured'))
+				RETURNING r.id
+			  ), released AS (
+				DELETE FROM room_restrictions
+				WHERE reservation_id IN (SELECT id FROM expired)
+			  )
+			  SELECT COUNT(*) FROM expired`
+
+	var n int
+	err := pgr.DB.QueryRowContext(ctx, query, now).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// AllPromotions returns all promotions with their usage statistics
+func (pgr *postgresDBRepo) AllPromotions() ([]models.Promotion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var promotions []models.Promotion
+
+	query := `SELECT p.id, p.code, p.description, p.discount_type, p.discount_value,
+			  p.valid_from, p.valid_until, p.min_nights, p.max_uses, p.max_uses_per_email,
+			  p.active, p.created_at, p.updated_at,
+			  COUNT(r.id), COALESCE(SUM(r.discount_amount), 0), COALESCE(SUM(r.total_amount), 0)
+			  FROM promotions p
+			  LEFT JOIN reservations r ON r.promotion_id = p.id
+			  AND r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL
+			  GROUP BY p.id
+			  ORDER BY p.created_at DESC`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return promotions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Promotion
+		var validFrom, validUntil sql.NullTime
+
+		err = rows.Scan(
+			&p.ID,
+			&p.Code,
+			&p.Description,
+			&p.DiscountType,
+			&p.DiscountValue,
+			&validFrom,
+			&validUntil,
+			&p.MinNights,
+			&p.MaxUses,
+			&p.MaxUsesPerEmail,
+			&p.Active,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Uses,
+			&p.DiscountGiven,
+			&p.Revenue,
+		)
+		if err != nil {
+			return promotions, err
+		}
+
+		p.ValidFrom = validFrom.Time
+		p.ValidUntil = validUntil.Time
+		promotions = append(promotions, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return promotions, err
+	}
+
+	roomIDs, err := pgr.promotionRoomIDs(ctx)
+	if err != nil {
+		return promotions, err
+	}
+
+	for i := range promotions {
+		promotions[i].RoomIDs = roomIDs[promotions[i].ID]
+	}
+
+	return promotions, nil
+}
+
+// promotionRoomIDs returns the rooms each promotion is restricted to, by promotion ID
+func (pgr *postgresDBRepo) promotionRoomIDs(ctx context.Context) (map[int][]int, error) {
+	roomIDs := make(map[int][]int)
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT promotion_id, room_id FROM promotion_rooms ORDER BY room_id`)
+	if err != nil {
+		return roomIDs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var promotionID, roomID int
+		if err = rows.Scan(&promotionID, &roomID); err != nil {
+			return roomIDs, err
+		}
+		roomIDs[promotionID] = append(roomIDs[promotionID], roomID)
+	}
+
+	return roomIDs, rows.Err()
+}
+
+// GetPromotionByCode returns one promotion by its code
+func (pgr *postgresDBRepo) GetPromotionByCode(code string) (models.Promotion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var p models.Promotion
+	var validFrom, validUntil sql.NullTime
+
+	query := `SELECT id, code, description, discount_type, discount_value,
+			  valid_from, valid_until, min_nights, max_uses, max_uses_per_email,
+			  active, created_at, updated_at
+			  FROM promotions
+			  WHERE code = $1`
+
+	row := pgr.DB.QueryRowContext(ctx, query, code)
+	err := row.Scan(
+		&p.ID,
+		&p.Code,
+		&p.Description,
+		&p.DiscountType,
+		&p.DiscountValue,
+		&validFrom,
+		&validUntil,
+		&p.MinNights,
+		&p.MaxUses,
+		&p.MaxUsesPerEmail,
+		&p.Active,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return p, err
+	}
+
+	p.ValidFrom = validFrom.Time
+	p.ValidUntil = validUntil.Time
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT room_id FROM promotion_rooms WHERE promotion_id = $1 ORDER BY room_id`, p.ID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID int
+		if err = rows.Scan(&roomID); err != nil {
+			return p, err
+		}
+		p.RoomIDs = append(p.RoomIDs, roomID)
+	}
+
+	return p, rows.Err()
+}
+
+// PromotionUsage returns how many reservations used a promotion, overall and with the given
+// email: those confirmed, and those still held for payment
+func (pgr *postgresDBRepo) PromotionUsage(promotionID int, email string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return promotionUsage(ctx, pgr.DB, promotionID, email)
+}
+
+// promotionUsage counts the uses of a promotion, overall and with the given email. A hold
+// counts until it expires, so that guests paying at the same time cannot go over the limits.
+func promotionUsage(ctx context.Context, q queryRower, promotionID int, email string) (int, int, error) {
+	var uses, emailUses int
+
+	query := `SELECT COUNT(*), COUNT(*) FILTER (WHERE lower(email) = lower($2))
+			  FROM reservations
+			  WHERE promotion_id = $1 AND cancelled_at IS NULL
+			  AND (confirmed_at IS NOT NULL OR hold_expires_at > $3)`
+
+	err := q.QueryRowContext(ctx, query, promotionID, email, time.Now()).Scan(&uses, &emailUses)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uses, emailUses, nil
+}
+
+// claimPromotion locks a promotion until the end of tx and returns ErrPromotionUsedUp if
+// another reservation with the given email would go over its limits
+func claimPromotion(ctx context.Context, tx *sql.Tx, promotionID int, email string) error {
+	var maxUses, maxUsesPerEmail int
+
+	err := tx.QueryRowContext(ctx, `SELECT max_uses, max_uses_per_email FROM promotions WHERE id = $1 FOR UPDATE`,
+		promotionID).Scan(&maxUses, &maxUsesPerEmail)
+	if err != nil {
+		return err
+	}
+
+	uses, emailUses, err := promotionUsage(ctx, tx, promotionID, email)
+	if err != nil {
+		return err
+	}
+
+	if (maxUses > 0 && uses >= maxUses) || (maxUsesPerEmail > 0 && emailUses >= maxUsesPerEmail) {
+		return repository.ErrPromotionUsedUp
+	}
+
+	return nil
+}
+
+// InsertPromotion inserts a promotion and the rooms it applies to
+func (pgr *postgresDBRepo) InsertPromotion(p models.Promotion) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `INSERT INTO promotions (code, description, discount_type, discount_value, valid_from,
+			 valid_until, min_nights, max_uses, max_uses_per_email, active, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		p.Code,
+		p.Description,
+		p.DiscountType,
+		p.DiscountValue,
+		nullableDate(p.ValidFrom),
+		nullableDate(p.ValidUntil),
+		p.MinNights,
+		p.MaxUses,
+		p.MaxUsesPerEmail,
+		p.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, roomID := range p.RoomIDs {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO promotion_rooms (promotion_id, room_id, created_at, updated_at) VALUES ($1, $2, $3, $4)`,
+			newID, roomID, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdatePromotionActive activates or deactivates a promotion
+func (pgr *postgresDBRepo) UpdatePromotionActive(id int, active bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE promotions SET active = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := pgr.DB.ExecContext(ctx, query, active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeletePromotion deletes a promotion; reservations that used it keep their discount
+func (pgr *postgresDBRepo) DeletePromotion(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM promotions WHERE id = $1`
+
+	_, err := pgr.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetInvoiceByReservationID returns the invoice issued for a reservation, or sql.ErrNoRows
+// if none has been issued yet
+func (pgr *postgresDBRepo) GetInvoiceByReservationID(reservationID int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var inv models.Invoice
+
+	query := `SELECT id, reservation_id, number, issued_at, created_at, updated_at
+			  FROM invoices
+			  WHERE reservation_id = $1`
+
+	err := pgr.DB.QueryRowContext(ctx, query, reservationID).Scan(
+		&inv.ID,
+		&inv.ReservationID,
+		&inv.Number,
+		&inv.IssuedAt,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+
+	return inv, err
+}
+
+// IssueInvoice issues the invoice of a reservation with the next invoice number, or returns
+// the one already issued
+func (pgr *postgresDBRepo) IssueInvoice(reservationID int) (models.Invoice, error) {
+	inv, err := pgr.GetInvoiceByReservationID(reservationID)
+	if err != sql.ErrNoRows {
+		return inv, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return inv, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	inv = models.Invoice{
+		ReservationID: reservationID,
+		IssuedAt:      now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	// Numbers must have no gaps, so they come from a single counter row that is locked until
+	// the invoice is saved, and given back if it is not
+	err = tx.QueryRowContext(ctx, `UPDATE invoice_counter SET last_number = last_number + 1, updated_at = $1
+								   WHERE id = 1 RETURNING last_number`, now).Scan(&inv.Number)
+	if err != nil {
+		return inv, err
+	}
+
+	stmt := `INSERT INTO invoices (reservation_id, number, issued_at, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (reservation_id) DO NOTHING
+			 RETURNING id`
+
+	err = tx.QueryRowContext(ctx, stmt, reservationID, inv.Number, inv.IssuedAt, inv.CreatedAt, inv.UpdatedAt).Scan(&inv.ID)
+	if err == sql.ErrNoRows {
+		// Issued meanwhile by another request
+		tx.Rollback()
+		return pgr.GetInvoiceByReservationID(reservationID)
+	}
+	if err != nil {
+		return inv, err
+	}
+
+	return inv, tx.Commit()
+}
+
+// AllFees returns all taxes and fees in the order they were added
+func (pgr *postgresDBRepo) AllFees() ([]models.Fee, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var fees []models.Fee
+
+	query := `SELECT id, name, kind, amount, is_tax, active, created_at, updated_at
+			  FROM fees
+			  ORDER BY id`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return fees, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f models.Fee
+		err = rows.Scan(&f.ID, &f.Name, &f.Kind, &f.Amount, &f.IsTax, &f.Active, &f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return fees, err
+		}
+		fees = append(fees, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return fees, err
+	}
+
+	return fees, nil
+}
+
+// InsertFee inserts a tax or fee
+func (pgr *postgresDBRepo) InsertFee(f models.Fee) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO fees (name, kind, amount, is_tax, active, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	err := pgr.DB.QueryRowContext(ctx, stmt,
+		f.Name,
+		f.Kind,
+		f.Amount,
+		f.IsTax,
+		f.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateFeeActive starts or stops charging a tax or fee on new bookings
+func (pgr *postgresDBRepo) UpdateFeeActive(id int, active bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE fees SET active = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := pgr.DB.ExecContext(ctx, query, active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteFee deletes a tax or fee; reservations keep the charges they were quoted
+func (pgr *postgresDBRepo) DeleteFee(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM fees WHERE id = $1`
+
+	_, err := pgr.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FeeTotalsByMonth returns the taxes and fees charged on live reservations starting in each month of a year
+func (pgr *postgresDBRepo) FeeTotalsByMonth(year int) ([]models.FeeTotal, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var totals []models.FeeTotal
+
+	query := `SELECT date_trunc('month', r.start_date), c.kind, c.name,
+			  COUNT(DISTINCT r.id), SUM(c.amount)
+			  FROM reservation_charges c
+			  JOIN reservations r ON r.id = c.reservation_id
+			  WHERE c.kind IN ('fee', 'tax')
+			  AND r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL
+			  AND r.start_date >= $1 AND r.start_date < $2
+			  GROUP BY 1, c.kind, c.name
+			  ORDER BY 1, c.kind DESC, c.name`
+
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	rows, err := pgr.DB.QueryContext(ctx, query, from, from.AddDate(1, 0, 0))
+	if err != nil {
+		return totals, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.FeeTotal
+		err = rows.Scan(&t.Month, &t.Kind, &t.Name, &t.Reservations, &t.Amount)
+		if err != nil {
+			return totals, err
+		}
+		totals = append(totals, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return totals, err
+	}
+
+	return totals, nil
+}
+
+// AllExchangeRates returns the exchange rates from the base currency, by currency code
+func (pgr *postgresDBRepo) AllExchangeRates() ([]models.ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rates []models.ExchangeRate
+
+	query := `SELECT id, currency, rate, created_at, updated_at
+			  FROM exchange_rates
+			  ORDER BY currency`
+
+	rows, err := pgr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rates, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var er models.ExchangeRate
+		err = rows.Scan(&er.ID, &er.Currency, &er.Rate, &er.CreatedAt, &er.UpdatedAt)
+		if err != nil {
+			return rates, err
+		}
+		rates = append(rates, er)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rates, err
+	}
+
+	return rates, nil
+}
+
+// SaveExchangeRates adds or updates exchange rates, all or none
+func (pgr *postgresDBRepo) SaveExchangeRates(rates []models.ExchangeRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO exchange_rates (currency, rate, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = EXCLUDED.updated_at`
+
+	for _, er := range rates {
+		_, err = tx.ExecContext(ctx, stmt, er.Currency, er.Rate, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteExchangeRate deletes an exchange rate
+func (pgr *postgresDBRepo) DeleteExchangeRate(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM exchange_rates WHERE id = $1`
+
+	_, err := pgr.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StaysByDate returns the confirmed reservations, cancelled or not, with nights between start and end,
+// with the room charge after any discount that the reports count as revenue
+func (pgr *postgresDBRepo) StaysByDate(start, end time.Time) ([]models.Stay, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stays []models.Stay
+
+	// Reservations made before charges were itemised only have a total
+	query := `SELECT r.id, r.room_id, r.start_date, r.end_date, r.created_at, r.cancelled_at,
+			  COALESCE((SELECT SUM(c.amount) FROM reservation_charges c
+			   WHERE c.reservation_id = r.id AND c.kind IN ('room', 'discount')), r.total_amount)
+			  FROM reservations r
+			  WHERE r.start_date < $2 AND r.end_date > $1
+			  AND r.confirmed_at IS NOT NULL
+			  ORDER BY r.start_date`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return stays, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.Stay
+		var cancelledAt sql.NullTime
+		err = rows.Scan(
+			&s.ReservationID,
+			&s.RoomID,
+			&s.StartDate,
+			&s.EndDate,
+			&s.BookedAt,
+			&cancelledAt,
+			&s.RoomRevenue,
+		)
+		if err != nil {
+			return stays, err
+		}
+
+		s.CancelledAt = cancelledAt.Time
+		stays = append(stays, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return stays, err
+	}
+
+	return stays, nil
+}
+
+// BlocksByDate returns the room restrictions other than reservations with nights between start and end
+func (pgr *postgresDBRepo) BlocksByDate(start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocks []models.RoomRestriction
+
+	query := `SELECT id, restriction_id, room_id, start_date, end_date
+			  FROM room_restrictions
+			  WHERE reservation_id IS NULL
+			  AND start_date < $2 AND end_date > $1`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return blocks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(
+			&r.ID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+		)
+		if err != nil {
+			return blocks, err
+		}
+
+		blocks = append(blocks, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return blocks, err
+	}
+
+	return blocks, nil
+}
+
+// reservationColumns are the columns read by scanReservation, for a query selecting from
+// reservations r left joined to rooms
+const reservationColumns = `r.id, r.first_name, r.last_name, r.email, r.phone,
+					 r.start_date, r.end_date, r.room_id, r.created_at,
+					 r.updated_at, r.processed, r.total_amount, r.cancelled_at, r.confirmed_at,
+					 r.discount_amount, r.guests, COALESCE(r.guest_id, 0), r.access_token,
+					 COALESCE((SELECT SUM(p.amount) FROM payments p
+					  WHERE p.reservation_id = r.id AND p.status IN ('captured', 'refunded')), 0),
+					 COALESCE((SELECT SUM(p.refunded_amount) FROM payments p
+					  WHERE p.reservation_id = r.id), 0),
+					 COALESCE(rooms.id, 0), COALESCE(rooms.room_name, '')`
+
+// scanReservation scans a row of reservationColumns
+func scanReservation(rows *sql.Rows) (models.Reservation, error) {
+	var i models.Reservation
+	var cancelledAt, confirmedAt sql.NullTime
+	err := rows.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.Email,
+		&i.Phone,
+		&i.StartDate,
+		&i.EndDate,
+		&i.RoomID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Processed,
+		&i.TotalAmount,
+		&cancelledAt,
+		&confirmedAt,
+		&i.DiscountAmount,
+		&i.Guests,
+		&i.GuestID,
+		&i.AccessToken,
+		&i.PaidAmount,
+		&i.RefundedAmount,
+		&i.Room.ID,
+		&i.Room.RoomName,
+	)
+	i.CancelledAt = cancelledAt.Time
+	i.ConfirmedAt = confirmedAt.Time
+	return i, err
+}
+
+// reservationSort is a column reservations can be sorted by
+type reservationSort struct {
+	column string
+	// cast is the SQL type of the column, for comparing it with a cursor
+	cast string
+	// value returns a reservation's value of the column, as stored in a cursor
+	value func(models.Reservation) string
+}
+
+var reservationSorts = map[string]reservationSort{
+	models.SortArrival: {"r.start_date", "date", func(r models.Reservation) string {
+		return r.StartDate.Format("2006-01-02")
+	}},
+	models.SortDeparture: {"r.end_date", "date", func(r models.Reservation) string {
+		return r.EndDate.Format("2006-01-02")
+	}},
+	models.SortName: {"LOWER(r.last_name || ' ' || r.first_name)", "text", func(r models.Reservation) string {
+		return strings.ToLower(r.LastName + " " + r.FirstName)
+	}},
+	models.SortBooked: {"r.created_at", "timestamp", func(r models.Reservation) string {
+		return r.CreatedAt.Format("2006-01-02 15:04:05.999999")
+	}},
+	models.SortTotal: {"r.total_amount", "integer", func(r models.Reservation) string {
+		return strconv.Itoa(r.TotalAmount)
+	}},
+}
+
+// encodeCursor returns the cursor of the page after a reservation
+func encodeCursor(sort reservationSort, r models.Reservation) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(r.ID) + ":" + sort.value(r)))
+}
+
+// decodeCursor returns the ID and sort value stored in a cursor
+func decodeCursor(cursor string) (int, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", repository.ErrInvalidCursor
+	}
+
+	id, value, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return 0, "", repository.ErrInvalidCursor
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, "", repository.ErrInvalidCursor
+	}
+
+	return n, value, nil
+}
+
+// containsPattern returns a LIKE pattern matching text containing s
+func containsPattern(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+// reservationFilterSQL returns the WHERE conditions and arguments matching a reservation filter,
+// for a query selecting from reservations r
+func reservationFilterSQL(f models.ReservationFilter) (string, []interface{}) {
+	conditions := []string{"TRUE"}
+	var args []interface{}
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q := strings.TrimSpace(f.Query); q != "" {
+		pattern := arg(containsPattern(q))
+		conditions = append(conditions, fmt.Sprintf(`(r.first_name || ' ' || r.last_name ILIKE %[1]s
+			OR r.email ILIKE %[1]s OR r.phone ILIKE %[1]s)`, pattern))
+	}
+
+	switch f.Status {
+	case models.StatusPending:
+		conditions = append(conditions, "r.cancelled_at IS NULL AND r.confirmed_at IS NULL")
+	case models.StatusNew:
+		conditions = append(conditions, "r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL AND r.processed = 0")
+	case models.StatusProcessed:
+		conditions = append(conditions, "r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL AND r.processed = 1")
+	case models.StatusCancelled:
+		conditions = append(conditions, "r.cancelled_at IS NOT NULL")
+	case models.StatusActive:
+		conditions = append(conditions, "r.cancelled_at IS NULL AND r.confirmed_at IS NOT NULL")
+	}
+
+	if f.Processed != nil {
+		processed := 0
+		if *f.Processed {
+			processed = 1
+		}
+		conditions = append(conditions, "r.processed = "+arg(processed))
+	}
+
+	if f.RoomID > 0 {
+		conditions = append(conditions, "r.room_id = "+arg(f.RoomID))
+	}
+	if f.GuestID > 0 {
+		conditions = append(conditions, "r.guest_id = "+arg(f.GuestID))
+	}
+	if f.UserID > 0 {
+		conditions = append(conditions, "r.guest_id IN (SELECT id FROM guests WHERE user_id = "+arg(f.UserID)+")")
+	}
+	if !f.Start.IsZero() {
+		conditions = append(conditions, "r.end_date > "+arg(f.Start))
+	}
+	if !f.End.IsZero() {
+		conditions = append(conditions, "r.start_date <= "+arg(f.End))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// EachReservation calls fn with each reservation matching the filter, in order of arrival,
+// reading them from the database one at a time. It stops at the first error fn returns.
+func (pgr *postgresDBRepo) EachReservation(filter models.ReservationFilter, fn func(models.Reservation) error) error {
+	// Exports can be large, so allow much longer than the usual queries
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	where, args := reservationFilterSQL(filter)
+
+	query := `SELECT ` + reservationColumns + `
+			  FROM reservations r
+			  LEFT JOIN rooms
+			  ON r.room_id = rooms.id
+			  WHERE ` + where + `
+			  ORDER BY r.start_date ASC, r.id ASC`
+
+	rows, err := pgr.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(res); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// SearchReservations returns a page of the reservations matching the filter. Pages are
+// found from the sort value and ID of the last reservation of the previous page, so a
+// page costs the same however deep it is and rows are not skipped or repeated when
+// reservations are added in between.
+func (pgr *postgresDBRepo) SearchReservations(filter models.ReservationFilter) (models.ReservationPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var page models.ReservationPage
+
+	sort, ok := reservationSorts[filter.Sort]
+	if !ok {
+		if filter.Sort != "" {
+			return page, fmt.Errorf("unknown sort order %q", filter.Sort)
+		}
+		sort = reservationSorts[models.SortArrival]
+	}
+
+	where, args := reservationFilterSQL(filter)
+
+	direction, compare := "ASC", ">"
+	if filter.Desc {
+		direction, compare = "DESC", "<"
+	}
+
+	if filter.After != "" {
+		id, value, err := decodeCursor(filter.After)
+		if err != nil {
+			return page, err
+		}
+		args = append(args, value, id)
+		where += fmt.Sprintf(" AND (%s, r.id) %s ($%d::%s, $%d)", sort.column, compare, len(args)-1, sort.cast, len(args))
+	}
+
+	query := `SELECT ` + reservationColumns + `
+			  FROM reservations r
+			  LEFT JOIN rooms
+			  ON r.room_id = rooms.id
+			  WHERE ` + where + `
+			  ORDER BY ` + sort.column + ` ` + direction + `, r.id ` + direction
+
+	// One more than a page, to know whether there is a next page
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := pgr.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Reservations = append(page.Reservations, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+
+	if filter.Limit > 0 && len(page.Reservations) > filter.Limit {
+		page.Reservations = page.Reservations[:filter.Limit]
+		page.Next = encodeCursor(sort, page.Reservations[filter.Limit-1])
+	}
+
+	return page, nil
+}
+
+// ImportReservations inserts reservations with their room restrictions, all or none. The room
+// restrictions are locked while the rooms are checked, so a booking made during the import
+// cannot take the same nights.
+func (pgr *postgresDBRepo) ImportReservations(reservations []models.Reservation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `LOCK TABLE room_restrictions IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range reservations {
+		var taken int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(id) FROM room_restrictions
+			WHERE room_id = $1 AND $2 < end_date AND $3 > start_date`,
+			res.RoomID, res.StartDate, res.EndDate).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fmt.Errorf("room %d is not available from %s to %s", res.RoomID,
+				res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"))
+		}
+
+		guestID, err := upsertGuest(ctx, tx, res)
+		if err != nil {
+			return err
+		}
+
+		var newID int
+		err = tx.QueryRowContext(ctx, `INSERT INTO reservations (first_name, last_name, email, phone,
+			start_date, end_date, room_id, total_amount, access_token, guests, processed,
+			guest_id, confirmed_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
+			res.FirstName,
+			res.LastName,
+			res.Email,
+			res.Phone,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			res.TotalAmount,
+			res.AccessToken,
+			res.Guests,
+			res.Processed,
+			nullableID(guestID),
+			time.Now(),
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO room_restrictions (start_date, end_date, room_id,
+			reservation_id, restriction_id, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			newID,
+			1,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// searchSQL returns the condition and rank matching the reservations or guests with alias t to a
+// global search. Names and emails match by full-text prefix or trigram similarity, so typos are
+// forgiven, and phone numbers match by their digits whatever the formatting.
+func searchSQL(t, query string) (string, string, []interface{}) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	q := arg(query)
+	name := "(" + t + ".first_name || ' ' || " + t + ".last_name)"
+	conditions := []string{
+		name + " % " + q,
+		t + ".last_name % " + q,
+		t + ".email ILIKE " + arg(containsPattern(query)),
+	}
+
+	var terms []string
+	for _, word := range strings.FieldsFunc(query, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) }) {
+		terms = append(terms, word+":*")
+	}
+	if len(terms) > 0 {
+		conditions = append(conditions, "to_tsvector('simple', "+t+".first_name || ' ' || "+t+".last_name || ' ' || "+t+".email)"+
+			" @@ to_tsquery('simple', "+arg(strings.Join(terms, " & "))+")")
+	}
+
+	if digits := onlyDigits(query); len(digits) >= 3 {
+		conditions = append(conditions, "regexp_replace("+t+".phone, '[^0-9]', '', 'g') LIKE "+arg("%"+digits+"%"))
+	}
+
+	rank := fmt.Sprintf("greatest(similarity(%s, %s), similarity(%s.last_name, %s), similarity(%s.email, %s))", name, q, t, q, t, q)
+
+	return "(" + strings.Join(conditions, " OR ") + ")", rank, args
+}
+
+// onlyDigits returns the digits in s
+func onlyDigits(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return c
+		}
+		return -1
+	}, s)
+}
+
+// Search finds up to limit reservations, guests and rooms each matching a query, best matches
+// first
+func (pgr *postgresDBRepo) Search(query string, limit int) (models.SearchResults, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var results models.SearchResults
+
+	where, rank, args := searchSQL("r", query)
+	args = append(args, limit)
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT `+reservationColumns+`
+			  FROM reservations r
+			  LEFT JOIN rooms
+			  ON r.room_id = rooms.id
+			  WHERE `+where+`
+			  ORDER BY `+rank+` DESC, r.start_date DESC
+			  LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return results, err
+		}
+		results.Reservations = append(results.Reservations, res)
+	}
+	if err = rows.Err(); err != nil {
+		return results, err
+	}
+
+	where, rank, args = searchSQL("g", query)
+	args = append(args, limit)
+
+	rows, err = pgr.DB.QueryContext(ctx, `SELECT `+guestColumns+`
+			  FROM guests g
+			  WHERE `+where+`
+			  ORDER BY `+rank+` DESC, g.last_name, g.first_name
+			  LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := scanGuest(rows)
+		if err != nil {
+			return results, err
+		}
+		results.Guests = append(results.Guests, g)
+	}
+	if err = rows.Err(); err != nil {
+		return results, err
+	}
+
+	rows, err = pgr.DB.QueryContext(ctx, `SELECT id, room_name, price
+			  FROM rooms
+			  WHERE room_name ILIKE $2 OR room_name % $1
+			  ORDER BY similarity(room_name, $1) DESC, room_name
+			  LIMIT $3`,
+		query, containsPattern(query), limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rm models.Room
+		if err = rows.Scan(&rm.ID, &rm.RoomName, &rm.Price); err != nil {
+			return results, err
+		}
+		results.Rooms = append(results.Rooms, rm)
+	}
+
+	return results, rows.Err()
+}
+
+// queryRower runs a query returning one row, in a transaction or not
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// upsertGuest creates or updates the profile of the guest with a reservation's email address,
+// with the name and phone number of the reservation, and returns its ID. Reservations without
+// an email address have no guest.
+func upsertGuest(ctx context.Context, db queryRower, res models.Reservation) (int, error) {
+	if strings.TrimSpace(res.Email) == "" {
+		return 0, nil
+	}
+
+	// Guests with a verified account with the same email address claim the profile
+	var id int
+	err := db.QueryRowContext(ctx, `INSERT INTO guests (first_name, last_name, email, phone, user_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4,
+		(SELECT id FROM users WHERE lower(email) = lower($3) AND access_level = 0 AND email_verified_at IS NOT NULL),
+		$5, $6)
+		ON CONFLICT ((lower(email))) DO UPDATE
+		SET first_name = EXCLUDED.first_name,
+		last_name = EXCLUDED.last_name,
+		phone = COALESCE(NULLIF(EXCLUDED.phone, ''), guests.phone),
+		user_id = COALESCE(guests.user_id, EXCLUDED.user_id),
+		updated_at = EXCLUDED.updated_at
+		RETURNING id`,
+		res.FirstName,
+		res.LastName,
+		strings.TrimSpace(res.Email),
+		res.Phone,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// guestColumns are the columns of guests g read into a guest, with their reservation count and
+// total spent
+const guestColumns = `g.id, g.first_name, g.last_name, g.email, g.phone, g.notes, g.tags,
+					 g.created_at, g.updated_at,
+					 (SELECT COUNT(r.id) FROM reservations r WHERE r.guest_id = g.id),
+					 COALESCE((SELECT SUM(p.amount) FROM payments p
+					  JOIN reservations r ON p.reservation_id = r.id
+					  WHERE r.guest_id = g.id AND p.status IN ('captured', 'refunded')), 0)
+					 - COALESCE((SELECT SUM(p.refunded_amount) FROM payments p
+					  JOIN reservations r ON p.reservation_id = r.id
+					  WHERE r.guest_id = g.id), 0)`
+
+// scanner is a row or rows to scan
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanGuest scans a row of guestColumns
+func scanGuest(row scanner) (models.Guest, error) {
+	var g models.Guest
+	var tags string
+	err := row.Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.Notes,
+		&tags,
+		&g.CreatedAt,
+		&g.UpdatedAt,
+		&g.ReservationCount,
+		&g.TotalSpent,
+	)
+	g.Tags = splitTags(tags)
+	return g, err
+}
+
+// splitTags splits the comma separated tags stored for a guest
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// SearchGuests returns a page of the guests matching a filter, in order of name. The cursor is
+// the ID of the last guest on the previous page.
+func (pgr *postgresDBRepo) SearchGuests(filter models.GuestFilter) (models.GuestPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var page models.GuestPage
+
+	conditions := []string{"TRUE"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q := strings.TrimSpace(filter.Query); q != "" {
+		pattern := arg(containsPattern(q))
+		conditions = append(conditions, fmt.Sprintf(`(g.first_name || ' ' || g.last_name ILIKE %[1]s
+			OR g.email ILIKE %[1]s OR g.phone ILIKE %[1]s)`, pattern))
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, "',' || g.tags || ',' LIKE "+arg(containsPattern(","+filter.Tag+",")))
+	}
+	if filter.After != "" {
+		id, err := strconv.Atoi(filter.After)
+		if err != nil {
+			return page, repository.ErrInvalidCursor
+		}
+		conditions = append(conditions, `(g.last_name, g.first_name, g.id) >
+			(SELECT last_name, first_name, id FROM guests WHERE id = `+arg(id)+`)`)
+	}
+
+	query := `SELECT ` + guestColumns + `
+			  FROM guests g
+			  WHERE ` + strings.Join(conditions, " AND ") + `
+			  ORDER BY g.last_name, g.first_name, g.id`
+
+	// One more than a page, to know whether there is a next page
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit+1)
+	}
+
+	rows, err := pgr.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := scanGuest(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Guests = append(page.Guests, g)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+
+	if filter.Limit > 0 && len(page.Guests) > filter.Limit {
+		page.Guests = page.Guests[:filter.Limit]
+		page.Next = strconv.Itoa(page.Guests[filter.Limit-1].ID)
+	}
+
+	return page, nil
+}
+
+// GetGuestByID returns one guest by ID
+func (pgr *postgresDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := pgr.DB.QueryRowContext(ctx, `SELECT `+guestColumns+` FROM guests g WHERE g.id = $1`, id)
+	return scanGuest(row)
+}
+
+// UpdateGuest updates the notes and tags of a guest
+func (pgr *postgresDBRepo) UpdateGuest(g models.Guest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE guests SET notes = $1, tags = $2, updated_at = $3 WHERE id = $4`,
+		g.Notes,
+		strings.Join(g.Tags, ","),
+		time.Now(),
+		g.ID,
+	)
+	return err
+}
+
+// VerifyUserEmail records that a user has confirmed their email address, and lets a guest claim
+// the reservations made earlier with it
+func (pgr *postgresDBRepo) VerifyUserEmail(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	var accessLevel int
+	err = tx.QueryRowContext(ctx, `UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1), updated_at = $1
+		WHERE id = $2 RETURNING email, access_level`, time.Now(), userID).Scan(&email, &accessLevel)
+	if err != nil {
+		return err
+	}
+
+	if accessLevel == models.AccessLevelGuest {
+		_, err = tx.ExecContext(ctx, `UPDATE guests SET user_id = $1, updated_at = $2
+			WHERE lower(email) = lower($3) AND user_id IS NULL`, userID, time.Now(), email)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// InsertUserToken stores a token emailed to a user
+func (pgr *postgresDBRepo) InsertUserToken(t models.UserToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		t.UserID,
+		t.Purpose,
+		t.TokenHash,
+		t.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// GetUserToken returns an unused, unexpired token without using it. It returns sql.ErrNoRows for
+// any other token.
+func (pgr *postgresDBRepo) GetUserToken(purpose, tokenHash string) (models.UserToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t models.UserToken
+	err := pgr.DB.QueryRowContext(ctx, `SELECT id, user_id, purpose, token_hash, expires_at, created_at, updated_at
+		FROM user_tokens
+		WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL AND expires_at > $3`,
+		purpose, tokenHash, time.Now(),
+	).Scan(&t.ID, &t.UserID, &t.Purpose, &t.TokenHash, &t.ExpiresAt, &t.CreatedAt, &t.UpdatedAt)
+
+	return t, err
+}
+
+// SetPasswordWithToken uses a token emailed to a user to set their password, which must already
+// be hashed, and returns the ID of the user. Their other tokens for the same purpose stop working,
+// and following the link confirms the email address too. It returns sql.ErrNoRows when the token
+// is used, expired or unknown.
+func (pgr *postgresDBRepo) SetPasswordWithToken(purpose, tokenHash, passwordHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `UPDATE user_tokens SET used_at = $1, updated_at = $1
+		WHERE purpose = $2 AND token_hash = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id`,
+		time.Now(), purpose, tokenHash,
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_tokens SET used_at = $1, updated_at = $1
+		WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`, time.Now(), userID, purpose)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET password = $1, password_changed_at = $2,
+		email_verified_at = COALESCE(email_verified_at, $2), updated_at = $2
+		WHERE id = $3`, passwordHash, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user with the secret of their
+// authenticator app and the time step of the code they confirmed it with, and stores their
+// recovery codes, which must already be hashed
+func (pgr *postgresDBRepo) EnableTwoFactor(userID int, secret string, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET totp_secret = $1, totp_enabled_at = $2, totp_last_step = $3,
+		updated_at = $2 WHERE id = $4`, secret, time.Now(), step, userID)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes their recovery
+// codes, so they set it up again from scratch
+func (pgr *postgresDBRepo) DisableTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0,
+		updated_at = $1 WHERE id = $2`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a user logged in with the code of a time step, so the code cannot be
+// used again. It returns sql.ErrNoRows when they used a code of that step or a later one already.
+func (pgr *postgresDBRepo) UseTOTPStep(userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	return pgr.DB.QueryRowContext(ctx, `UPDATE users SET totp_last_step = $1
+		WHERE id = $2 AND totp_enabled_at IS NOT NULL AND totp_last_step < $1 RETURNING id`,
+		step, userID,
+	).Scan(&id)
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user, which must already be hashed
+func (pgr *postgresDBRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := pgr.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes the recovery codes of a user and inserts new ones in a transaction
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range codeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash, created_at, updated_at)
+			VALUES ($1, $2, $3, $3)`, userID, hash, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used, so it works only once. It
+// returns sql.ErrNoRows for any other code.
+func (pgr *postgresDBRepo) UseRecoveryCode(userID int, codeHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	return pgr.DB.QueryRowContext(ctx, `UPDATE recovery_codes SET used_at = $1, updated_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL RETURNING id`,
+		time.Now(), userID, codeHash,
+	).Scan(&id)
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (pgr *postgresDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := pgr.DB.QueryRowContext(ctx, `SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// throttleColumns are the columns of login_throttles read into a login throttle
+const throttleColumns = `id, scope, subject, failures, last_failure_at, blocked_until, locked_at, created_at, updated_at`
+
+// scanThrottle scans a row of throttleColumns, followed by any extra destinations
+func scanThrottle(row scanner, extra ...interface{}) (models.LoginThrottle, error) {
+	var t models.LoginThrottle
+	var blockedUntil, lockedAt sql.NullTime
+	err := row.Scan(append([]interface{}{
+		&t.ID,
+		&t.Scope,
+		&t.Subject,
+		&t.Failures,
+		&t.LastFailureAt,
+		&blockedUntil,
+		&lockedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	}, extra...)...)
+	t.BlockedUntil = blockedUntil.Time
+	t.LockedAt = lockedAt.Time
+	return t, err
+}
+
+// GetLoginThrottle returns the failed logins in a scope. It returns a zero throttle when there
+// were none.
+func (pgr *postgresDBRepo) GetLoginThrottle(scope, subject string) (models.LoginThrottle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := pgr.DB.QueryRowContext(ctx, `SELECT `+throttleColumns+` FROM login_throttles
+		WHERE scope = $1 AND subject = $2`, scope, subject)
+	t, err := scanThrottle(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.LoginThrottle{Scope: scope, Subject: subject}, nil
+	}
+	return t, err
+}
+
+// RecordLoginFailure counts a failed login in a scope and returns the failures so far. Failures
+// are counted from one again when the last one was before since.
+func (pgr *postgresDBRepo) RecordLoginFailure(scope, subject string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := pgr.DB.QueryRowContext(ctx, `INSERT INTO login_throttles (scope, subject, failures, last_failure_at,
+			created_at, updated_at)
+		VALUES ($1, $2, 1, $3, $3, $3)
+		ON CONFLICT (scope, subject) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < $4 THEN 1 ELSE login_throttles.failures + 1 END,
+			locked_at = CASE WHEN login_throttles.last_failure_at < $4 THEN NULL ELSE login_throttles.locked_at END,
+			last_failure_at = $3,
+			updated_at = $3
+		RETURNING failures`,
+		scope, subject, time.Now(), since,
+	).Scan(&failures)
+	return failures, err
+}
+
+// BlockLogins refuses logins in a scope until a time. Locked marks the block as a lockout.
+func (pgr *postgresDBRepo) BlockLogins(scope, subject string, until time.Time, locked bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE login_throttles SET blocked_until = $1,
+		locked_at = CASE WHEN $2 THEN COALESCE(locked_at, $3) ELSE locked_at END, updated_at = $3
+		WHERE scope = $4 AND subject = $5`, until, locked, time.Now(), scope, subject)
+	return err
+}
+
+// ClearLoginFailures forgets the failed logins in a scope, after a successful login or to unlock
+// an account
+func (pgr *postgresDBRepo) ClearLoginFailures(scope, subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `DELETE FROM login_throttles WHERE scope = $1 AND subject = $2`, scope, subject)
+	return err
+}
+
+// LockedAccounts returns the accounts locked out now with their users, the first to unlock first
+func (pgr *postgresDBRepo) LockedAccounts() ([]models.LoginThrottle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT t.id, t.scope, t.subject, t.failures, t.last_failure_at,
+			t.blocked_until, t.locked_at, t.created_at, t.updated_at,
+			u.id, u.first_name, u.last_name, u.email, u.access_level
+		FROM login_throttles t
+		JOIN users u ON lower(u.email) = t.subject
+		WHERE t.scope = $1 AND t.locked_at IS NOT NULL AND t.blocked_until > $2
+		ORDER BY t.blocked_until`, models.ThrottleAccount, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var throttles []models.LoginThrottle
+	for rows.Next() {
+		var user models.User
+		t, err := scanThrottle(rows, &user.ID, &user.FirstName, &user.LastName, &user.Email, &user.AccessLevel)
+		if err != nil {
+			return nil, err
+		}
+		t.User = user
+		throttles = append(throttles, t)
+	}
+
+	return throttles, rows.Err()
+}
+
+// UseUserToken marks an unused, unexpired token as used and returns it, so a token works only
+// once. It returns sql.ErrNoRows for any other token.
+func (pgr *postgresDBRepo) UseUserToken(purpose, tokenHash string) (models.UserToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t models.UserToken
+	var usedAt sql.NullTime
+	err := pgr.DB.QueryRowContext(ctx, `UPDATE user_tokens SET used_at = $1, updated_at = $1
+		WHERE purpose = $2 AND token_hash = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING id, user_id, purpose, token_hash, expires_at, used_at, created_at, updated_at`,
+		time.Now(), purpose, tokenHash,
+	).Scan(&t.ID, &t.UserID, &t.Purpose, &t.TokenHash, &t.ExpiresAt, &usedAt, &t.CreatedAt, &t.UpdatedAt)
+	t.UsedAt = usedAt.Time
+
+	return t, err
+}
+
+// execer runs a statement, in a transaction or not
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertOutboxMessage queues an email message in the outbox, to be sent straight away
+func insertOutboxMessage(ctx context.Context, db execer, msg models.MailData) error {
+	attachments, err := json.Marshal(msg.Attachments)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `INSERT INTO outbox (to_address, from_address, subject, content, attachments,
+			sensitive, status, attempts, next_attempt_at, last_error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, '', $8, $8)`,
+		msg.To, msg.From, msg.Subject, msg.Content, string(attachments), msg.Sensitive, models.OutboxPending, time.Now())
+	return err
+}
+
+// outboxColumns are the columns of outbox read into an outbox message
+const outboxColumns = `id, to_address, from_address, subject, content, attachments, sensitive, status,
+	attempts, next_attempt_at, last_error, sent_at, created_at, updated_at`
+
+// clearSensitiveContent is the SET clause that clears the content of a sensitive message once it
+// is no longer pending, so the links it carries are not kept, nor backed up
+const clearSensitiveContent = `content = CASE WHEN sensitive THEN '' ELSE content END`
+
+// scanOutboxMessage scans a row of outboxColumns
+func scanOutboxMessage(row scanner) (models.OutboxMessage, error) {
+	var m models.OutboxMessage
+	var attachments string
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&m.ID,
+		&m.Mail.To,
+		&m.Mail.From,
+		&m.Mail.Subject,
+		&m.Mail.Content,
+		&attachments,
+		&m.Mail.Sensitive,
+		&m.Status,
+		&m.Attempts,
+		&m.NextAttemptAt,
+		&m.LastError,
+		&sentAt,
+		&m.CreatedAt,
+		&m.UpdatedAt,
+	)
+	if err != nil {
+		return m, err
+	}
+	m.SentAt = sentAt.Time
+
+	err = json.Unmarshal([]byte(attachments), &m.Mail.Attachments)
+	return m, err
+}
+
+// QueueMail queues an email message in the outbox, from where the outbox workers send it
+func (pgr *postgresDBRepo) QueueMail(msg models.MailData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertOutboxMessage(ctx, pgr.DB, msg)
+}
+
+// ClaimOutboxMessage takes the pending message that has been due the longest for a worker to
+// send, counting the attempt and putting off the next one by lease, so no other worker takes it
+// meanwhile. It returns sql.ErrNoRows when no message is due.
+func (pgr *postgresDBRepo) ClaimOutboxMessage(lease time.Duration) (models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	row := pgr.DB.QueryRowContext(ctx, `UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $1,
+			updated_at = $2
+		WHERE id = (
+			SELECT id FROM outbox
+			WHERE status = $3 AND next_attempt_at <= $2
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+outboxColumns, now.Add(lease), now, models.OutboxPending)
+	return scanOutboxMessage(row)
+}
+
+// MarkOutboxSent records that an outbox message was sent
+func (pgr *postgresDBRepo) MarkOutboxSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE outbox SET status = $1, sent_at = $2, last_error = '', updated_at = $2,
+		`+clearSensitiveContent+` WHERE id = $3`, models.OutboxSent, time.Now(), id)
+	return err
+}
+
+// MarkOutboxFailed records why sending an outbox message failed, and either tries it again at
+// retryAt or, when dead, gives up on it
+func (pgr *postgresDBRepo) MarkOutboxFailed(id int, lastError string, retryAt time.Time, dead bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	status := models.OutboxPending
+	clear := ""
+	if dead {
+		status = models.OutboxDead
+		clear = ", " + clearSensitiveContent
+	}
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE outbox SET status = $1, last_error = $2, next_attempt_at = $3,
+		updated_at = $4`+clear+` WHERE id = $5`, status, lastError, retryAt, time.Now(), id)
+	return err
+}
+
+// AllOutboxMessages returns the latest outbox messages with a status, or with any status when it
+// is empty, newest first
+func (pgr *postgresDBRepo) AllOutboxMessages(status string) ([]models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := pgr.DB.QueryContext(ctx, `SELECT `+outboxColumns+` FROM outbox
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT 200`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		m, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// GetOutboxMessage returns an outbox message by id
+func (pgr *postgresDBRepo) GetOutboxMessage(id int) (models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := pgr.DB.QueryRowContext(ctx, `SELECT `+outboxColumns+` FROM outbox WHERE id = $1`, id)
+	return scanOutboxMessage(row)
+}
+
+// ResendOutboxMessage queues an outbox message to be sent again straight away, with a fresh
+// count of attempts. It returns sql.ErrNoRows for a sensitive message whose content was cleared.
+func (pgr *postgresDBRepo) ResendOutboxMessage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := pgr.DB.ExecContext(ctx, `UPDATE outbox SET status = $1, attempts = 0, next_attempt_at = $2,
+		last_error = '', updated_at = $2 WHERE id = $3 AND NOT (sensitive AND status <> $1)`,
+		models.OutboxPending, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DiscardOutboxMessage gives up on sending an outbox message
+func (pgr *postgresDBRepo) DiscardOutboxMessage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := pgr.DB.ExecContext(ctx, `UPDATE outbox SET status = $1, updated_at = $2, `+clearSensitiveContent+`
+		WHERE id = $3`, models.OutboxDiscarded, time.Now(), id)
+	return err
+}
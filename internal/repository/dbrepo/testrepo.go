@@ -1,15 +1,22 @@
 package dbrepo
 
 import (
+	"database/sql"
 	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/tanishqv/bnb-bookings/internal/helpers"
+	"github.com/tanishqv/bnb-bookings/internal/lockout"
 	"github.com/tanishqv/bnb-bookings/internal/models"
+	"github.com/tanishqv/bnb-bookings/internal/repository"
 )
 
-func (tr *testDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns all users
+func (tr *testDBRepo) AllUsers() ([]models.User, error) {
+	return testUsers(), nil
 }
 
 // InsertReservation inserts a reservation into the database
@@ -17,6 +24,13 @@ func (tr *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 	if res.RoomID == 2 {
 		return 0, errors.New("insert reservation failed")
 	}
+	if res.RoomID == 1000 {
+		return 0, errors.New("insert restriction failed")
+	}
+	// Promotion 3 was used up by another guest meanwhile
+	if res.PromotionID == 3 {
+		return 0, repository.ErrPromotionUsedUp
+	}
 	return 1, nil
 }
 
@@ -110,51 +124,345 @@ func (tr *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 		return room, errors.New("error while getting room")
 	}
 
+	room.ID = id
+	room.ICalToken = "test-token"
+	room.Price = 10000
+	room.CancellationPolicyID = 1
+
 	return room, nil
 }
 
+// UpdateRoomCancellationPolicy attaches a cancellation policy to a room; 0 removes it
+func (tr *testDBRepo) UpdateRoomCancellationPolicy(roomID, policyID int) error {
+	if roomID == 1000 {
+		return errors.New("update cancellation policy failed")
+	}
+	return nil
+}
+
+// UpdateRoomDepositPolicy updates the deposit policy of a room
+func (tr *testDBRepo) UpdateRoomDepositPolicy(room models.Room) error {
+	if room.ID == 1000 {
+		return errors.New("update deposit policy failed")
+	}
+	return nil
+}
+
 // GetUserByID returns a user by ID
-func (tr *testDBRepo) GetUserByID(int) (models.User, error) {
-	var u models.User
+func (tr *testDBRepo) GetUserByID(id int) (models.User, error) {
+	for _, u := range testUsers() {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// testUsers are an owner, a guest, a guest who has not verified their email address, a user in
+// each of the other staff roles and a deactivated user. The manager has two-factor
+// authentication on.
+func testUsers() []models.User {
+	verified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []models.User{
+		{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@fsbnb.com", AccessLevel: models.AccessLevelOwner, EmailVerifiedAt: verified},
+		{ID: 2, FirstName: "John", LastName: "Smith", Email: "john@smith.com", Phone: "555-1234", EmailVerifiedAt: verified},
+		{ID: 3, FirstName: "New", LastName: "Guest", Email: "new@guest.com"},
+		{ID: 4, FirstName: "Mary", LastName: "Manager", Email: "manager@fsbnb.com", AccessLevel: models.AccessLevelManager, EmailVerifiedAt: verified,
+			TOTPSecret: "JBSWY3DPEHPK3PXP", TOTPEnabledAt: verified},
+		{ID: 5, FirstName: "Fred", LastName: "Desk", Email: "desk@fsbnb.com", AccessLevel: models.AccessLevelFrontDesk, EmailVerifiedAt: verified},
+		{ID: 6, FirstName: "Helen", LastName: "Keeping", Email: "housekeeping@fsbnb.com", AccessLevel: models.AccessLevelHousekeeping, EmailVerifiedAt: verified},
+		{ID: 7, FirstName: "Gone", LastName: "Away", Email: "gone@fsbnb.com", AccessLevel: models.AccessLevelFrontDesk, EmailVerifiedAt: verified, DeactivatedAt: verified},
+	}
+}
 
-	return u, nil
+// GetUserByEmail returns a user by email address, ignoring case
+func (tr *testDBRepo) GetUserByEmail(email string) (models.User, error) {
+	if email == "fail@fsbnb.com" {
+		return models.User{}, errors.New("cannot get user")
+	}
+	for _, u := range testUsers() {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// InsertUser inserts a user
+func (tr *testDBRepo) InsertUser(u models.User) (int, error) {
+	if u.LastName == "Fail" {
+		return 0, errors.New("cannot insert user")
+	}
+	return 4, nil
 }
 
 // UpdateUser updates a user in the database
-func (tr *testDBRepo) UpdateUser(models.User) error {
+func (tr *testDBRepo) UpdateUser(u models.User) error {
+	if u.LastName == "Fail" {
+		return errors.New("cannot update user")
+	}
+	return nil
+}
+
+// UpdateUserPassword sets the password of a user
+func (tr *testDBRepo) UpdateUserPassword(userID int, passwordHash string) error {
+	if userID == 1000 {
+		return errors.New("cannot update password")
+	}
+	return nil
+}
+
+// DeactivateUser stops a user logging in
+func (tr *testDBRepo) DeactivateUser(userID int) error {
+	if userID == 1000 {
+		return errors.New("cannot deactivate user")
+	}
+	return nil
+}
+
+// ReactivateUser lets a deactivated user log in again
+func (tr *testDBRepo) ReactivateUser(userID int) error {
+	if userID == 1000 {
+		return errors.New("cannot reactivate user")
+	}
 	return nil
 }
 
-// Authenticate authenticates a user
+// Authenticate authenticates a user with any password but "wrong-password"
 func (tr *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	if email == "admin@fsbnb.com" {
-		return 1, "", nil
+	if testPassword == "wrong-password" {
+		return 0, "", errors.New("incorrect password")
+	}
+	for _, u := range testUsers() {
+		if u.Email == email && u.Active() {
+			return u.ID, "", nil
+		}
 	}
 
 	return 0, "", errors.New("invalid credentials")
 }
 
-// AllReservations returns a slice of all the reservations
-func (tr *testDBRepo) AllReservations() ([]models.Reservation, error) {
-	var reservations []models.Reservation
+// VerifyUserEmail records that a user has confirmed their email address
+func (tr *testDBRepo) VerifyUserEmail(userID int) error {
+	if userID == 1000 {
+		return errors.New("cannot verify email")
+	}
+	return nil
+}
+
+// InsertUserToken stores a token emailed to a user
+func (tr *testDBRepo) InsertUserToken(t models.UserToken) error {
+	return nil
+}
+
+// GetUserToken returns a token without using it
+func (tr *testDBRepo) GetUserToken(purpose, tokenHash string) (models.UserToken, error) {
+	t, err := testUserToken(purpose, tokenHash)
+	t.UsedAt = time.Time{}
+	return t, err
+}
+
+// UseUserToken marks a token as used and returns it
+func (tr *testDBRepo) UseUserToken(purpose, tokenHash string) (models.UserToken, error) {
+	return testUserToken(purpose, tokenHash)
+}
+
+// SetPasswordWithToken uses a token to set the password of a user
+func (tr *testDBRepo) SetPasswordWithToken(purpose, tokenHash, passwordHash string) (int, error) {
+	t, err := testUserToken(purpose, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	if t.UserID == 1000 {
+		return 0, errors.New("cannot set password")
+	}
+	return t.UserID, nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user
+func (tr *testDBRepo) EnableTwoFactor(userID int, secret string, step int64, recoveryCodeHashes []string) error {
+	if userID == 1000 {
+		return errors.New("cannot enable two-factor authentication")
+	}
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user
+func (tr *testDBRepo) DisableTwoFactor(userID int) error {
+	if userID == 1000 {
+		return errors.New("cannot disable two-factor authentication")
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of a code a user logged in with
+func (tr *testDBRepo) UseTOTPStep(userID int, step int64) error {
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user
+func (tr *testDBRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	if userID == 1000 {
+		return errors.New("cannot replace recovery codes")
+	}
+	return nil
+}
+
+// UseRecoveryCode uses a recovery code; the manager has the code "abcde-fghij"
+func (tr *testDBRepo) UseRecoveryCode(userID int, codeHash string) error {
+	if userID == 4 && codeHash == helpers.HashToken("abcdefghij") {
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (tr *testDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	if userID == 1000 {
+		return 0, errors.New("cannot count recovery codes")
+	}
+	return 10, nil
+}
+
+// GetLoginThrottle returns the failed logins in a scope. Logins with "blocked@fsbnb.com" and
+// from 192.0.2.66 are blocked, and the housekeeping account is locked out.
+func (tr *testDBRepo) GetLoginThrottle(scope, subject string) (models.LoginThrottle, error) {
+	if subject == "fail@fsbnb.com" {
+		return models.LoginThrottle{}, errors.New("cannot get login throttle")
+	}
+	t := models.LoginThrottle{Scope: scope, Subject: subject}
+	if subject == "blocked@fsbnb.com" || subject == "192.0.2.66" {
+		t.Failures = 3
+		t.BlockedUntil = time.Now().Add(time.Minute)
+	}
+	if subject == "housekeeping@fsbnb.com" {
+		t.Failures = lockout.Account.MaxAttempts
+		t.BlockedUntil = time.Now().Add(lockout.Account.Lockout)
+		t.LockedAt = time.Now()
+	}
+	return t, nil
+}
 
-	return reservations, nil
+// RecordLoginFailure counts a failed login; a failure with "admin@fsbnb.com" locks it out
+func (tr *testDBRepo) RecordLoginFailure(scope, subject string, since time.Time) (int, error) {
+	if subject == "admin@fsbnb.com" {
+		return lockout.Account.MaxAttempts, nil
+	}
+	return 1, nil
 }
 
-// AllNewReservations returns a slice of all the reservations
-func (tr *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	var reservations []models.Reservation
+// BlockLogins refuses logins in a scope until a time
+func (tr *testDBRepo) BlockLogins(scope, subject string, until time.Time, locked bool) error {
+	return nil
+}
 
-	return reservations, nil
+// ClearLoginFailures forgets the failed logins in a scope
+func (tr *testDBRepo) ClearLoginFailures(scope, subject string) error {
+	return nil
+}
+
+// LockedAccounts returns the housekeeping user, locked out
+func (tr *testDBRepo) LockedAccounts() ([]models.LoginThrottle, error) {
+	user := testUsers()[5]
+	return []models.LoginThrottle{{
+		ID:            1,
+		Scope:         models.ThrottleAccount,
+		Subject:       user.Email,
+		Failures:      lockout.Account.MaxAttempts,
+		LastFailureAt: time.Now(),
+		BlockedUntil:  time.Now().Add(lockout.Account.Lockout),
+		LockedAt:      time.Now(),
+		User:          user,
+	}}, nil
+}
+
+// testUserToken returns a used token. Whatever the purpose, the token "valid-token" is for user
+// 3, the unverified guest, and "failing-token" for user 1000.
+func testUserToken(purpose, tokenHash string) (models.UserToken, error) {
+	t := models.UserToken{Purpose: purpose, TokenHash: tokenHash, UsedAt: time.Now()}
+	switch tokenHash {
+	case helpers.HashToken("valid-token"):
+		t.UserID = 3
+	case helpers.HashToken("failing-token"):
+		t.UserID = 1000
+	default:
+		return t, sql.ErrNoRows
+	}
+	return t, nil
 }
 
 // GetReservationByID returns one reservation by ID
 func (tr *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 	var res models.Reservation
+	res.ID = id
+	if id == 1 {
+		res.GuestID = 1
+	}
+	// Reservation 3 was released when its payment hold expired
+	if id == 3 {
+		res.CancelledAt = time.Now().Add(-time.Minute)
+	}
+	// Reservation 5 is paid for with a payment the gateway cannot refund
+	if id == 5 {
+		res.TotalAmount = 10000
+		res.PaidAmount = 10000
+		res.StartDate = time.Now().AddDate(0, 2, 0)
+		res.EndDate = res.StartDate.AddDate(0, 0, 1)
+	}
 
 	return res, nil
 }
 
+// GetReservationByAccessToken returns one reservation by the token given to the guest
+func (tr *testDBRepo) GetReservationByAccessToken(token string) (models.Reservation, error) {
+	var res models.Reservation
+	if token != "valid-token" {
+		return res, errors.New("reservation not found")
+	}
+
+	res.ID = 1
+	res.RoomID = 1
+	res.TotalAmount = 50000
+	res.PaidAmount = 10000
+	res.AccessToken = token
+	res.Room.ID = 1
+	res.Room.CancellationPolicyID = 1
+	res.StartDate = time.Now().AddDate(0, 2, 0)
+	res.EndDate = res.StartDate.AddDate(0, 0, 2)
+
+	return res, nil
+}
+
+// CancelReservation records the cancellation of a reservation and releases its room
+func (tr *testDBRepo) CancelReservation(res models.Reservation) error {
+	if res.ID == 1000 {
+		return errors.New("cancel reservation failed")
+	}
+	if res.ID == 2 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ConfirmReservation confirms a reservation holding its room until it is paid for
+func (tr *testDBRepo) ConfirmReservation(id int) (bool, error) {
+	if id == 2 {
+		return false, sql.ErrNoRows
+	}
+	if id == 1000 {
+		return false, errors.New("confirm reservation failed")
+	}
+	return true, nil
+}
+
+// ExpireHolds cancels the reservations whose hold ran out before they were paid for
+func (tr *testDBRepo) ExpireHolds(now time.Time) (int, error) {
+	if now.Year() == 2060 {
+		return 0, errors.New("expire holds failed")
+	}
+	return 1, nil
+}
+
 // UpdateReservation updates a reservation in the database
 func (tr *testDBRepo) UpdateReservation(r models.Reservation) error {
 	return nil
@@ -165,6 +473,14 @@ func (tr *testDBRepo) DeleteReservation(id int) error {
 	if id == 1000 {
 		return errors.New("error while deleting reservation")
 	}
+	// Reservation 2 is not cancelled
+	if id == 2 {
+		return sql.ErrNoRows
+	}
+	// Reservation 5 has been paid for
+	if id == 5 {
+		return repository.ErrReservationHasPayments
+	}
 	return nil
 }
 
@@ -192,3 +508,714 @@ func (tr *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
 func (tr *testDBRepo) DeleteBlockByID(id int) error {
 	return nil
 }
+
+// AllICalSources returns a slice of all external calendars
+func (tr *testDBRepo) AllICalSources() ([]models.ICalSource, error) {
+	sources := []models.ICalSource{
+		{
+			ID:     1,
+			RoomID: 1,
+			Name:   "Partner site",
+			URL:    "https://example.com/calendar.ics",
+			Room: models.Room{
+				ID:       1,
+				RoomName: "General's Quarters",
+			},
+			Conflicts: []models.Reservation{
+				{ID: 1, FirstName: "John", LastName: "Smith", StartDate: time.Now().AddDate(0, 0, 7), EndDate: time.Now().AddDate(0, 0, 9)},
+			},
+		},
+	}
+	return sources, nil
+}
+
+// GetICalSourceByID returns one external calendar by ID
+func (tr *testDBRepo) GetICalSourceByID(id int) (models.ICalSource, error) {
+	var s models.ICalSource
+	if id == 1000 {
+		return s, errors.New("external calendar not found")
+	}
+
+	s.ID = id
+	s.RoomID = 1
+	s.URL = "/non-existent/calendar.ics"
+
+	return s, nil
+}
+
+// InsertICalSource inserts an external calendar into the database
+func (tr *testDBRepo) InsertICalSource(s models.ICalSource) (int, error) {
+	if s.RoomID == 1000 {
+		return 0, errors.New("insert external calendar failed")
+	}
+	return 1, nil
+}
+
+// DeleteICalSource deletes an external calendar and the blocks imported from it
+func (tr *testDBRepo) DeleteICalSource(id int) error {
+	if id == 1000 {
+		return errors.New("delete external calendar failed")
+	}
+	return nil
+}
+
+// UpdateICalSourceStatus records the outcome of the last sync of an external calendar
+func (tr *testDBRepo) UpdateICalSourceStatus(id int, syncedAt time.Time, lastError string) error {
+	return nil
+}
+
+// SyncSourceBlocks replaces the blocks imported from an external calendar in one transaction
+func (tr *testDBRepo) SyncSourceBlocks(sourceID int, plan func([]models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, []models.RoomRestriction)) error {
+	plan(nil)
+	return nil
+}
+
+// LockReservationPayments runs fn while holding a lock on paying for a reservation
+func (tr *testDBRepo) LockReservationPayments(reservationID int, fn func() error) error {
+	return fn()
+}
+
+// InsertPayment inserts a payment into the database
+func (tr *testDBRepo) InsertPayment(p models.Payment) (int, error) {
+	if p.ReservationID == 1000 {
+		return 0, errors.New("insert payment failed")
+	}
+	return 1, nil
+}
+
+// GetPaymentsByReservationID returns the payments made against a reservation
+func (tr *testDBRepo) GetPaymentsByReservationID(reservationID int) ([]models.Payment, error) {
+	var payments []models.Payment
+	// Reservation 4 has an authorization the gateway does not know about
+	if reservationID == 4 {
+		payments = append(payments, models.Payment{ID: 4, ReservationID: 4, Reference: "unknown", Amount: 10000, Status: "authorized"})
+	}
+	// Reservation 5 has a captured payment the gateway does not know about
+	if reservationID == 5 {
+		payments = append(payments, models.Payment{ID: 5, ReservationID: 5, Reference: "unknown", Amount: 10000, Status: "captured"})
+	}
+
+	return payments, nil
+}
+
+// GetPaymentByID returns one payment by ID
+func (tr *testDBRepo) GetPaymentByID(id int) (models.Payment, error) {
+	var p models.Payment
+	if id == 1000 {
+		return p, errors.New("payment not found")
+	}
+
+	p.ID = id
+	p.ReservationID = 1
+	p.Reference = "unknown"
+	p.Amount = 10000
+	p.Status = "captured"
+
+	return p, nil
+}
+
+// GetPaymentByReference returns one payment by its gateway reference
+func (tr *testDBRepo) GetPaymentByReference(reference string) (models.Payment, error) {
+	var p models.Payment
+	if reference == "unknown" {
+		return p, errors.New("payment not found")
+	}
+
+	p.ID = 1
+	p.ReservationID = 1
+	p.Reference = reference
+	p.Amount = 10000
+	p.Status = "captured"
+	// txn_authorized is waiting to be captured
+	if reference == "txn_authorized" {
+		p.Status = "authorized"
+	}
+
+	return p, nil
+}
+
+// UpdatePayment updates the amounts and status of a payment
+func (tr *testDBRepo) UpdatePayment(p models.Payment) error {
+	return nil
+}
+
+// GetScheduleByReservationID returns the payment schedule of a reservation
+func (tr *testDBRepo) GetScheduleByReservationID(reservationID int) ([]models.ScheduledPayment, error) {
+	var schedule []models.ScheduledPayment
+	if reservationID == 1000 {
+		return schedule, errors.New("schedule not found")
+	}
+
+	return schedule, nil
+}
+
+// BalancesDue returns the balance installments of reservations that are not yet paid in full
+func (tr *testDBRepo) BalancesDue() ([]models.ScheduledPayment, error) {
+	var balances []models.ScheduledPayment
+
+	return balances, nil
+}
+
+// MarkReminderSent records when the balance reminder for an installment was sent
+func (tr *testDBRepo) MarkReminderSent(id int, sentAt time.Time) error {
+	return nil
+}
+
+// AllCancellationPolicies returns all cancellation policies
+func (tr *testDBRepo) AllCancellationPolicies() ([]models.CancellationPolicy, error) {
+	var policies []models.CancellationPolicy
+
+	return policies, nil
+}
+
+// GetCancellationPolicyByID returns one cancellation policy by ID
+func (tr *testDBRepo) GetCancellationPolicyByID(id int) (models.CancellationPolicy, error) {
+	var cp models.CancellationPolicy
+	if id == 1000 {
+		return cp, errors.New("cancellation policy not found")
+	}
+
+	cp.ID = id
+	cp.Name = "Moderate"
+	cp.Rules = "30:100, 7:50"
+
+	return cp, nil
+}
+
+// InsertCancellationPolicy inserts a cancellation policy into the database
+func (tr *testDBRepo) InsertCancellationPolicy(cp models.CancellationPolicy) (int, error) {
+	if cp.Name == "fail" {
+		return 0, errors.New("insert cancellation policy failed")
+	}
+	return 1, nil
+}
+
+// DeleteCancellationPolicy deletes a cancellation policy
+func (tr *testDBRepo) DeleteCancellationPolicy(id int) error {
+	if id == 1000 {
+		return errors.New("delete cancellation policy failed")
+	}
+	return nil
+}
+
+// AllPromotions returns all promotions with their usage statistics
+func (tr *testDBRepo) AllPromotions() ([]models.Promotion, error) {
+	var promotions []models.Promotion
+
+	return promotions, nil
+}
+
+// GetPromotionByCode returns one promotion by its code
+func (tr *testDBRepo) GetPromotionByCode(code string) (models.Promotion, error) {
+	var p models.Promotion
+
+	switch code {
+	case "WINTER10":
+		p.ID = 1
+		p.DiscountType = "percent"
+		p.DiscountValue = 10
+	case "EXPIRED":
+		p.ID = 2
+		p.DiscountType = "fixed"
+		p.DiscountValue = 1000
+		p.ValidUntil = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	case "LASTONE":
+		p.ID = 3
+		p.DiscountType = "percent"
+		p.DiscountValue = 10
+		p.MaxUses = 1
+	case "USEDUP":
+		p.ID = 1000
+		p.DiscountType = "percent"
+		p.DiscountValue = 10
+		p.MaxUses = 1
+	default:
+		return p, errors.New("promotion not found")
+	}
+
+	p.Code = code
+	p.Active = true
+
+	return p, nil
+}
+
+// PromotionUsage returns how many reservations used a promotion, overall and with the given email
+func (tr *testDBRepo) PromotionUsage(promotionID int, email string) (int, int, error) {
+	if promotionID == 1000 {
+		return 1, 0, nil
+	}
+	return 0, 0, nil
+}
+
+// InsertPromotion inserts a promotion and the rooms it applies to
+func (tr *testDBRepo) InsertPromotion(p models.Promotion) (int, error) {
+	if p.Code == "FAIL" {
+		return 0, errors.New("insert promotion failed")
+	}
+	return 1, nil
+}
+
+// UpdatePromotionActive activates or deactivates a promotion
+func (tr *testDBRepo) UpdatePromotionActive(id int, active bool) error {
+	if id == 1000 {
+		return errors.New("update promotion failed")
+	}
+	return nil
+}
+
+// DeletePromotion deletes a promotion
+func (tr *testDBRepo) DeletePromotion(id int) error {
+	if id == 1000 {
+		return errors.New("delete promotion failed")
+	}
+	return nil
+}
+
+// GetInvoiceByReservationID returns the invoice issued for a reservation
+func (tr *testDBRepo) GetInvoiceByReservationID(reservationID int) (models.Invoice, error) {
+	var inv models.Invoice
+	if reservationID == 1000 {
+		return inv, errors.New("cannot load invoice")
+	}
+	// Reservation 2 has not been paid for, so it has no invoice
+	if reservationID == 2 {
+		return inv, sql.ErrNoRows
+	}
+
+	inv.ID = 1
+	inv.ReservationID = reservationID
+	inv.Number = 42
+	inv.IssuedAt = time.Now()
+
+	return inv, nil
+}
+
+// IssueInvoice issues the invoice of a reservation with the next invoice number
+func (tr *testDBRepo) IssueInvoice(reservationID int) (models.Invoice, error) {
+	var inv models.Invoice
+	if reservationID == 1000 {
+		return inv, errors.New("cannot issue invoice")
+	}
+
+	inv.ID = 1
+	inv.ReservationID = reservationID
+	inv.Number = 42
+	inv.IssuedAt = time.Now()
+
+	return inv, nil
+}
+
+// AllFees returns all taxes and fees in the order they were added
+func (tr *testDBRepo) AllFees() ([]models.Fee, error) {
+	fees := []models.Fee{
+		{ID: 1, Name: "Cleaning fee", Kind: "per_stay", Amount: 5000, Active: true},
+		{ID: 2, Name: "City tax", Kind: "per_guest_night", Amount: 250, IsTax: true, Active: true},
+	}
+
+	return fees, nil
+}
+
+// InsertFee inserts a tax or fee
+func (tr *testDBRepo) InsertFee(f models.Fee) (int, error) {
+	if f.Name == "fail" {
+		return 0, errors.New("insert fee failed")
+	}
+	return 1, nil
+}
+
+// UpdateFeeActive starts or stops charging a tax or fee on new bookings
+func (tr *testDBRepo) UpdateFeeActive(id int, active bool) error {
+	if id == 1000 {
+		return errors.New("update fee failed")
+	}
+	return nil
+}
+
+// DeleteFee deletes a tax or fee
+func (tr *testDBRepo) DeleteFee(id int) error {
+	if id == 1000 {
+		return errors.New("delete fee failed")
+	}
+	return nil
+}
+
+// FeeTotalsByMonth returns the taxes and fees charged on live reservations starting in each month of a year
+func (tr *testDBRepo) FeeTotalsByMonth(year int) ([]models.FeeTotal, error) {
+	var totals []models.FeeTotal
+	if year == 1000 {
+		return totals, errors.New("cannot total fees")
+	}
+
+	totals = append(totals, models.FeeTotal{
+		Month:        time.Date(year, time.March, 1, 0, 0, 0, 0, time.UTC),
+		Kind:         "tax",
+		Name:         "City tax",
+		Reservations: 2,
+		Amount:       3000,
+	})
+
+	return totals, nil
+}
+
+// AllExchangeRates returns the exchange rates from the base currency, by currency code
+func (tr *testDBRepo) AllExchangeRates() ([]models.ExchangeRate, error) {
+	rates := []models.ExchangeRate{
+		{ID: 1, Currency: "EUR", Rate: 0.9},
+	}
+
+	return rates, nil
+}
+
+// SaveExchangeRates adds or updates exchange rates, all or none
+func (tr *testDBRepo) SaveExchangeRates(rates []models.ExchangeRate) error {
+	for _, er := range rates {
+		if er.Currency == "XXX" {
+			return errors.New("cannot save exchange rates")
+		}
+	}
+	return nil
+}
+
+// DeleteExchangeRate deletes an exchange rate
+func (tr *testDBRepo) DeleteExchangeRate(id int) error {
+	if id == 1000 {
+		return errors.New("delete exchange rate failed")
+	}
+	return nil
+}
+
+// StaysByDate returns the reservations with nights between start and end
+func (tr *testDBRepo) StaysByDate(start, end time.Time) ([]models.Stay, error) {
+	var stays []models.Stay
+	if start.Year() == 1000 {
+		return stays, errors.New("cannot load stays")
+	}
+
+	stays = append(stays, models.Stay{
+		ReservationID: 1,
+		RoomID:        1,
+		StartDate:     start,
+		EndDate:       start.AddDate(0, 0, 2),
+		BookedAt:      start.AddDate(0, 0, -10),
+		RoomRevenue:   20000,
+	})
+
+	return stays, nil
+}
+
+// BlocksByDate returns the room restrictions other than reservations with nights between start and end
+func (tr *testDBRepo) BlocksByDate(start, end time.Time) ([]models.RoomRestriction, error) {
+	var blocks []models.RoomRestriction
+	if start.Year() == 1001 {
+		return blocks, errors.New("cannot load blocks")
+	}
+
+	blocks = append(blocks, models.RoomRestriction{
+		ID:            1,
+		RoomID:        1,
+		RestrictionID: 2,
+		StartDate:     start.AddDate(0, 0, 5),
+		EndDate:       start.AddDate(0, 0, 6),
+	})
+
+	return blocks, nil
+}
+
+// testReservations are the reservations listed, searched and exported by the test repository
+func testReservations(filter models.ReservationFilter) []models.Reservation {
+	reservations := []models.Reservation{
+		{
+			ID:          1,
+			FirstName:   "John",
+			LastName:    "Smith",
+			Email:       "john@smith.com",
+			StartDate:   time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:     time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+			RoomID:      1,
+			Room:        models.Room{ID: 1, RoomName: "General's Quarters"},
+			TotalAmount: 20000,
+			PaidAmount:  5000,
+			GuestID:     1,
+			AccessToken: "valid-token",
+			ConfirmedAt: time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			ID:          2,
+			FirstName:   "Jane",
+			LastName:    "Doe",
+			Email:       "jane@doe.com",
+			StartDate:   time.Date(2050, 2, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:     time.Date(2050, 2, 2, 0, 0, 0, 0, time.UTC),
+			RoomID:      1,
+			Room:        models.Room{ID: 1, RoomName: "General's Quarters"},
+			CancelledAt: time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC),
+			ConfirmedAt: time.Date(2049, 11, 1, 0, 0, 0, 0, time.UTC),
+			GuestID:     2,
+		},
+	}
+
+	var matching []models.Reservation
+	for _, res := range reservations {
+		if filter.Status == models.StatusPending && (res.Cancelled() || res.Confirmed()) {
+			continue
+		}
+		if filter.Status == models.StatusCancelled && !res.Cancelled() {
+			continue
+		}
+		if filter.Status == models.StatusActive && res.Cancelled() {
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(strings.ToLower(res.FirstName+" "+res.LastName+" "+res.Email), strings.ToLower(filter.Query)) {
+			continue
+		}
+		if filter.GuestID > 0 && res.GuestID != filter.GuestID {
+			continue
+		}
+		// John Smith has guest account 2
+		if filter.UserID > 0 && (filter.UserID != 2 || res.GuestID != 1) {
+			continue
+		}
+		matching = append(matching, res)
+	}
+	return matching
+}
+
+// EachReservation calls fn with each reservation matching the filter
+func (tr *testDBRepo) EachReservation(filter models.ReservationFilter, fn func(models.Reservation) error) error {
+	if filter.RoomID == 1000 {
+		return errors.New("cannot load reservations")
+	}
+
+	for _, res := range testReservations(filter) {
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SearchReservations returns a page of the reservations matching the filter. The cursor of
+// the second page is "2".
+func (tr *testDBRepo) SearchReservations(filter models.ReservationFilter) (models.ReservationPage, error) {
+	var page models.ReservationPage
+	if filter.RoomID == 1000 {
+		return page, errors.New("cannot search reservations")
+	}
+
+	reservations := testReservations(filter)
+	switch filter.After {
+	case "":
+	case "2":
+		if len(reservations) > 1 {
+			reservations = reservations[1:]
+		} else {
+			reservations = nil
+		}
+	default:
+		return page, repository.ErrInvalidCursor
+	}
+
+	if filter.Limit > 0 && len(reservations) > filter.Limit {
+		reservations = reservations[:filter.Limit]
+		page.Next = strconv.Itoa(reservations[filter.Limit-1].ID + 1)
+	}
+	page.Reservations = reservations
+
+	return page, nil
+}
+
+// Search finds up to limit reservations, guests and rooms each containing the query
+func (tr *testDBRepo) Search(query string, limit int) (models.SearchResults, error) {
+	var results models.SearchResults
+	if query == "fail" {
+		return results, errors.New("cannot search")
+	}
+
+	for _, res := range testReservations(models.ReservationFilter{Query: query}) {
+		if len(results.Reservations) < limit {
+			results.Reservations = append(results.Reservations, res)
+		}
+	}
+	page, _ := tr.SearchGuests(models.GuestFilter{Query: query, Limit: limit})
+	results.Guests = page.Guests
+
+	rooms, _ := tr.AllRooms()
+	for _, rm := range rooms {
+		if strings.Contains(strings.ToLower(rm.RoomName), strings.ToLower(query)) && len(results.Rooms) < limit {
+			results.Rooms = append(results.Rooms, rm)
+		}
+	}
+
+	return results, nil
+}
+
+// testGuests are the guests of testReservations
+func testGuests() []models.Guest {
+	return []models.Guest{
+		{
+			ID:               2,
+			FirstName:        "Jane",
+			LastName:         "Doe",
+			Email:            "jane@doe.com",
+			Tags:             []string{models.TagDoNotBook},
+			ReservationCount: 1,
+		},
+		{
+			ID:               1,
+			FirstName:        "John",
+			LastName:         "Smith",
+			Email:            "john@smith.com",
+			Notes:            "Prefers a quiet room",
+			Tags:             []string{models.TagVIP},
+			ReservationCount: 1,
+			TotalSpent:       5000,
+		},
+	}
+}
+
+// SearchGuests returns a page of the guests matching a filter, in order of name
+func (tr *testDBRepo) SearchGuests(filter models.GuestFilter) (models.GuestPage, error) {
+	var page models.GuestPage
+	if filter.Query == "fail" {
+		return page, errors.New("cannot search guests")
+	}
+
+	after := filter.After == ""
+	for _, g := range testGuests() {
+		if !after {
+			if filter.After == strconv.Itoa(g.ID) {
+				after = true
+			}
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(strings.ToLower(g.FirstName+" "+g.LastName+" "+g.Email), strings.ToLower(filter.Query)) {
+			continue
+		}
+		if filter.Tag != "" && !g.HasTag(filter.Tag) {
+			continue
+		}
+		if filter.Limit > 0 && len(page.Guests) == filter.Limit {
+			page.Next = strconv.Itoa(page.Guests[filter.Limit-1].ID)
+			break
+		}
+		page.Guests = append(page.Guests, g)
+	}
+	if !after {
+		return page, repository.ErrInvalidCursor
+	}
+
+	return page, nil
+}
+
+// GetGuestByID returns one guest by ID
+func (tr *testDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	for _, g := range testGuests() {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return models.Guest{}, errors.New("guest not found")
+}
+
+// UpdateGuest updates the notes and tags of a guest
+func (tr *testDBRepo) UpdateGuest(g models.Guest) error {
+	if g.ID == 2 {
+		return errors.New("cannot update guest")
+	}
+	return nil
+}
+
+// ImportReservations inserts reservations with their room restrictions, all or none
+func (tr *testDBRepo) ImportReservations(reservations []models.Reservation) error {
+	for _, res := range reservations {
+		if res.LastName == "Fail" {
+			return errors.New("import failed")
+		}
+	}
+	return nil
+}
+
+// testOutboxMessages are the messages in the test outbox: 1 pending, 2 dead and 3 sent, with
+// a private link that was cleared
+func testOutboxMessages() []models.OutboxMessage {
+	now := time.Now()
+	return []models.OutboxMessage{
+		{ID: 1, Mail: models.MailData{To: "john@smith.com", From: "manager@fsbnb.com", Subject: "Reservation Confirmation",
+			Content: "<strong>Reservation Confirmation</strong>"}, Status: models.OutboxPending, Attempts: 2,
+			NextAttemptAt: now.Add(time.Minute), LastError: "dial tcp: connection refused"},
+		{ID: 2, Mail: models.MailData{To: "jane@doe.com", From: "manager@fsbnb.com", Subject: "Balance Reminder",
+			Content: "<strong>Balance Reminder</strong>", Attachments: []models.MailAttachment{{Name: "reservation.ics"}}},
+			Status: models.OutboxDead, Attempts: 8, NextAttemptAt: now, LastError: "550 mailbox unavailable"},
+		{ID: 3, Mail: models.MailData{To: "admin@fsbnb.com", From: "manager@fsbnb.com", Subject: "Reset your password",
+			Sensitive: true}, Status: models.OutboxSent, Attempts: 1, SentAt: now},
+	}
+}
+
+// QueueMail queues an email message in the outbox
+func (tr *testDBRepo) QueueMail(msg models.MailData) error {
+	return nil
+}
+
+// ClaimOutboxMessage finds no message due in the test outbox
+func (tr *testDBRepo) ClaimOutboxMessage(lease time.Duration) (models.OutboxMessage, error) {
+	return models.OutboxMessage{}, sql.ErrNoRows
+}
+
+// MarkOutboxSent records that an outbox message was sent
+func (tr *testDBRepo) MarkOutboxSent(id int) error {
+	return nil
+}
+
+// MarkOutboxFailed records why sending an outbox message failed
+func (tr *testDBRepo) MarkOutboxFailed(id int, lastError string, retryAt time.Time, dead bool) error {
+	return nil
+}
+
+// AllOutboxMessages returns the test outbox messages with a status, or all of them; the status
+// "fail" fails
+func (tr *testDBRepo) AllOutboxMessages(status string) ([]models.OutboxMessage, error) {
+	if status == "fail" {
+		return nil, errors.New("cannot get outbox messages")
+	}
+
+	var messages []models.OutboxMessage
+	for _, m := range testOutboxMessages() {
+		if status == "" || m.Status == status {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+// GetOutboxMessage returns a test outbox message by id; message 4 is pending too, but cannot be
+// changed
+func (tr *testDBRepo) GetOutboxMessage(id int) (models.OutboxMessage, error) {
+	if id == 4 {
+		m := testOutboxMessages()[0]
+		m.ID = 4
+		return m, nil
+	}
+	for _, m := range testOutboxMessages() {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return models.OutboxMessage{}, sql.ErrNoRows
+}
+
+// ResendOutboxMessage queues an outbox message to be sent again; it fails for message 4
+func (tr *testDBRepo) ResendOutboxMessage(id int) error {
+	if id == 4 {
+		return errors.New("cannot resend outbox message")
+	}
+	return nil
+}
+
+// DiscardOutboxMessage gives up on sending an outbox message; it fails for message 4
+func (tr *testDBRepo) DiscardOutboxMessage(id int) error {
+	if id == 4 {
+		return errors.New("cannot discard outbox message")
+	}
+	return nil
+}
@@ -1,32 +1,135 @@
 package repository
 
 import (
+	"errors"
 	"time"
 
 	"github.com/tanishqv/bnb-bookings/internal/models"
 )
 
+// ErrInvalidCursor is returned when a page cursor was not returned by a search
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// ErrPromotionUsedUp is returned when saving a reservation would use a promotion more often
+// than it allows, overall or with the guest's email address
+var ErrPromotionUsedUp = errors.New("promotion used up")
+
+// ErrReservationHasPayments is returned when deleting a reservation that has payments or an
+// invoice, which are kept for the accounts
+var ErrReservationHasPayments = errors.New("reservation has payments or an invoice")
+
 type DatabaseRepo interface {
-	AllUsers() bool
+	AllUsers() ([]models.User, error)
 
 	InsertReservation(models.Reservation) (int, error)
 	InsertRoomRestriction(models.RoomRestriction) error
+	ImportReservations([]models.Reservation) error
 	SearchAvailabilityByDatesByRoomID(time.Time, time.Time, int) (bool, error)
 	SearchAvailabilityForAllRoomsByDates(time.Time, time.Time) ([]models.Room, error)
 	AllRooms() ([]models.Room, error)
 	GetRoomByID(int) (models.Room, error)
+	UpdateRoomDepositPolicy(models.Room) error
+	UpdateRoomCancellationPolicy(roomID, policyID int) error
 
 	GetUserByID(int) (models.User, error)
+	GetUserByEmail(string) (models.User, error)
+	InsertUser(models.User) (int, error)
 	UpdateUser(models.User) error
+	UpdateUserPassword(userID int, passwordHash string) error
+	DeactivateUser(userID int) error
+	ReactivateUser(userID int) error
 	Authenticate(email, testPassword string) (int, string, error)
+	VerifyUserEmail(userID int) error
+
+	InsertUserToken(models.UserToken) error
+	GetUserToken(purpose, tokenHash string) (models.UserToken, error)
+	UseUserToken(purpose, tokenHash string) (models.UserToken, error)
+	SetPasswordWithToken(purpose, tokenHash, passwordHash string) (int, error)
+
+	EnableTwoFactor(userID int, secret string, step int64, recoveryCodeHashes []string) error
+	DisableTwoFactor(userID int) error
+	UseTOTPStep(userID int, step int64) error
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	UseRecoveryCode(userID int, codeHash string) error
+	CountRecoveryCodes(userID int) (int, error)
 
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
+	GetLoginThrottle(scope, subject string) (models.LoginThrottle, error)
+	RecordLoginFailure(scope, subject string, since time.Time) (int, error)
+	BlockLogins(scope, subject string, until time.Time, locked bool) error
+	ClearLoginFailures(scope, subject string) error
+	LockedAccounts() ([]models.LoginThrottle, error)
+
+	QueueMail(models.MailData) error
+	ClaimOutboxMessage(lease time.Duration) (models.OutboxMessage, error)
+	MarkOutboxSent(id int) error
+	MarkOutboxFailed(id int, lastError string, retryAt time.Time, dead bool) error
+	AllOutboxMessages(status string) ([]models.OutboxMessage, error)
+	GetOutboxMessage(id int) (models.OutboxMessage, error)
+	ResendOutboxMessage(id int) error
+	DiscardOutboxMessage(id int) error
+
+	EachReservation(models.ReservationFilter, func(models.Reservation) error) error
+	SearchReservations(models.ReservationFilter) (models.ReservationPage, error)
+	Search(query string, limit int) (models.SearchResults, error)
 	GetReservationByID(int) (models.Reservation, error)
+	GetReservationByAccessToken(string) (models.Reservation, error)
 	UpdateReservation(models.Reservation) error
 	DeleteReservation(int) error
+	CancelReservation(models.Reservation) error
+	ConfirmReservation(int) (bool, error)
+	ExpireHolds(now time.Time) (int, error)
 	UpdateProcessedForReservation(int, int) error
 	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
 	InsertBlockForRoom(int, time.Time) error
 	DeleteBlockByID(int) error
+
+	SearchGuests(models.GuestFilter) (models.GuestPage, error)
+	GetGuestByID(int) (models.Guest, error)
+	UpdateGuest(models.Guest) error
+
+	AllICalSources() ([]models.ICalSource, error)
+	GetICalSourceByID(int) (models.ICalSource, error)
+	InsertICalSource(models.ICalSource) (int, error)
+	DeleteICalSource(int) error
+	UpdateICalSourceStatus(id int, syncedAt time.Time, lastError string) error
+	SyncSourceBlocks(sourceID int, plan func([]models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, []models.RoomRestriction)) error
+
+	LockReservationPayments(reservationID int, fn func() error) error
+	InsertPayment(models.Payment) (int, error)
+	GetPaymentsByReservationID(int) ([]models.Payment, error)
+	GetPaymentByID(int) (models.Payment, error)
+	GetPaymentByReference(string) (models.Payment, error)
+	UpdatePayment(models.Payment) error
+
+	GetScheduleByReservationID(int) ([]models.ScheduledPayment, error)
+	BalancesDue() ([]models.ScheduledPayment, error)
+	MarkReminderSent(id int, sentAt time.Time) error
+
+	AllCancellationPolicies() ([]models.CancellationPolicy, error)
+	GetCancellationPolicyByID(int) (models.CancellationPolicy, error)
+	InsertCancellationPolicy(models.CancellationPolicy) (int, error)
+	DeleteCancellationPolicy(int) error
+
+	AllPromotions() ([]models.Promotion, error)
+	GetPromotionByCode(string) (models.Promotion, error)
+	PromotionUsage(promotionID int, email string) (int, int, error)
+	InsertPromotion(models.Promotion) (int, error)
+	UpdatePromotionActive(id int, active bool) error
+	DeletePromotion(int) error
+
+	GetInvoiceByReservationID(reservationID int) (models.Invoice, error)
+	IssueInvoice(reservationID int) (models.Invoice, error)
+
+	AllFees() ([]models.Fee, error)
+	InsertFee(models.Fee) (int, error)
+	UpdateFeeActive(id int, active bool) error
+	DeleteFee(int) error
+	FeeTotalsByMonth(year int) ([]models.FeeTotal, error)
+
+	AllExchangeRates() ([]models.ExchangeRate, error)
+	SaveExchangeRates([]models.ExchangeRate) error
+	DeleteExchangeRate(int) error
+
+	StaysByDate(start, end time.Time) ([]models.Stay, error)
+	BlocksByDate(start, end time.Time) ([]models.RoomRestriction, error)
 }
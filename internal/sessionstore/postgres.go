@@ -0,0 +1,136 @@
+package sessionstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Postgres keeps sessions in the sessions table, so they survive restarts and are shared by
+// every instance of the application
+type Postgres struct {
+	DB *sql.DB
+
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+}
+
+// NewPostgres creates a new session store in the sessions table
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{DB: db}
+}
+
+// Find returns the data of a session, if it exists and has not expired
+func (p *Postgres) Find(token string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var b []byte
+	query := `select data from sessions where token = $1 and expiry > $2`
+	err := p.DB.QueryRowContext(ctx, query, token, time.Now()).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// Commit saves the data of a session with its expiry, replacing any saved before
+func (p *Postgres) Commit(token string, b []byte, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		insert into sessions (token, data, expiry) values ($1, $2, $3)
+		on conflict (token) do update set data = excluded.data, expiry = excluded.expiry`
+	_, err := p.DB.ExecContext(ctx, query, token, b, expiry)
+	return err
+}
+
+// Delete removes a session; removing one that does not exist is not an error
+func (p *Postgres) Delete(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := p.DB.ExecContext(ctx, `delete from sessions where token = $1`, token)
+	return err
+}
+
+// All returns the data of every session that has not expired, by token
+func (p *Postgres) All() (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := p.DB.QueryContext(ctx, `select token, data from sessions where expiry > $1`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[string][]byte)
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		sessions[token] = b
+	}
+
+	return sessions, rows.Err()
+}
+
+// DeleteExpired removes the sessions that expired before now and returns how many there were
+func (p *Postgres) DeleteExpired(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := p.DB.ExecContext(ctx, `delete from sessions where expiry <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartCleanup removes the expired sessions every interval in the background until
+// StopCleanup is called; an interval of zero turns the cleanup off
+func (p *Postgres) StartCleanup(interval time.Duration, errorLog *log.Logger) {
+	if interval <= 0 {
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stopCleanup, p.cleanupDone = stop, done
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+
+			if _, err := p.DeleteExpired(time.Now()); err != nil {
+				errorLog.Println("cannot delete expired sessions:", err)
+			}
+		}
+	}()
+}
+
+// StopCleanup stops the background cleanup and waits for the run in progress, if any, to
+// finish, so the database can be closed
+func (p *Postgres) StopCleanup() {
+	if p.stopCleanup == nil {
+		return
+	}
+
+	close(p.stopCleanup)
+	<-p.cleanupDone
+	p.stopCleanup = nil
+}
@@ -0,0 +1,40 @@
+package sessionstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+)
+
+// Store is a session store that can list its sessions, so users can see and end theirs
+type Store interface {
+	scs.Store
+	scs.IterableStore
+
+	// StopCleanup stops removing expired sessions in the background
+	StopCleanup()
+}
+
+// New returns the session store of a kind, memory or postgres, removing expired sessions every
+// cleanup interval until StopCleanup is called. Sessions in memory are lost on restart and not
+// shared between instances.
+func New(kind string, db *sql.DB, cleanup time.Duration, errorLog *log.Logger) (Store, error) {
+	switch kind {
+	case "memory":
+		return memstore.NewWithCleanupInterval(cleanup), nil
+	case "postgres":
+		if db == nil {
+			return nil, errors.New("the postgres session store needs a database")
+		}
+		p := NewPostgres(db)
+		p.StartCleanup(cleanup, errorLog)
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown session store %q", kind)
+	}
+}
@@ -0,0 +1,52 @@
+package sessionstore
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2/memstore"
+)
+
+func TestNew(t *testing.T) {
+	store, err := New("memory", nil, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*memstore.MemStore); !ok {
+		t.Errorf("expected a memory store, got %T", store)
+	}
+
+	if _, err := New("postgres", nil, time.Minute, nil); err == nil {
+		t.Error("expected an error for the postgres store without a database")
+	}
+
+	if _, err := New("redis", nil, time.Minute, nil); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
+
+func TestPostgres_StopCleanup(t *testing.T) {
+	p := NewPostgres(nil)
+
+	// Stopping a cleanup that was never started does nothing
+	p.StopCleanup()
+
+	p.StartCleanup(time.Hour, log.New(io.Discard, "", 0))
+
+	stopped := make(chan struct{})
+	go func() {
+		p.StopCleanup()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cleanup to stop")
+	}
+
+	// Stopping it twice does nothing either
+	p.StopCleanup()
+}
@@ -0,0 +1,92 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The last six digits of the eight digit codes in RFC 6238 appendix B
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != e.expected {
+			t.Errorf("at %d: expected %s, got %s", e.unix, e.expected, code)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := Validate(rfcSecret, "050471", now)
+	if !ok || step != Step(now) {
+		t.Errorf("expected the current code to be valid in step %d, got %d %t", Step(now), step, ok)
+	}
+
+	// 1111111109 is the step before
+	if step, ok = Validate(rfcSecret, "081804", now); !ok || step != Step(now)-1 {
+		t.Errorf("expected the previous code to be valid in step %d, got %d %t", Step(now)-1, step, ok)
+	}
+
+	for _, code := range []string{"", "12345", "000000", "0504711"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("expected %q to be invalid", code)
+		}
+	}
+
+	if _, ok := Validate(rfcSecret, "050471", now.Add(2*Period)); ok {
+		t.Error("expected an old code to be invalid")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("expected 32 characters, got %d", len(secret))
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("expected a usable secret: %v", err)
+	}
+
+	other, _ := NewSecret()
+	if other == secret {
+		t.Error("expected secrets to differ")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Fort Smythe BnB", "admin@fsbnb.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/Fort%20Smythe%20BnB:admin@fsbnb.com?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, e := range []string{"secret=ABC", "issuer=Fort+Smythe+BnB", "digits=6", "period=30"} {
+		if !strings.Contains(uri, e) {
+			t.Errorf("expected %s in %s", e, uri)
+		}
+	}
+}
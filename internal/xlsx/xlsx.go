@@ -0,0 +1,111 @@
+package xlsx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Decimal is a number shown with a fixed number of decimal places, such as an amount of money
+type Decimal float64
+
+// Writer writes a workbook with one sheet a row at a time through excelize's stream writer,
+// so large sheets are not held in memory as cells
+type Writer struct {
+	w      io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	rows   int
+
+	dateStyle    int
+	decimalStyle int
+	headerStyle  int
+}
+
+// NewWriter starts a workbook with one sheet called sheetName, in which Decimals are shown
+// with places decimal places
+func NewWriter(w io.Writer, sheetName string, places int) (*Writer, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName(f.GetSheetName(0), sheetName); err != nil {
+		return nil, err
+	}
+
+	xw := &Writer{w: w, file: f}
+	var err error
+	if xw.dateStyle, err = f.NewStyle(&excelize.Style{NumFmt: 14}); err != nil {
+		return nil, err
+	}
+	if xw.decimalStyle, err = f.NewStyle(&excelize.Style{CustomNumFmt: decimalFormat(places)}); err != nil {
+		return nil, err
+	}
+	if xw.headerStyle, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err != nil {
+		return nil, err
+	}
+
+	if xw.stream, err = f.NewStreamWriter(sheetName); err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+// decimalFormat returns the number format with places decimal places, such as 0.00
+func decimalFormat(places int) *string {
+	format := "0"
+	if places > 0 {
+		format += "." + strings.Repeat("0", places)
+	}
+	return &format
+}
+
+// WriteHeader writes a row of bold column headings
+func (w *Writer) WriteHeader(headings []string) error {
+	cells := make([]interface{}, len(headings))
+	for i, h := range headings {
+		cells[i] = excelize.Cell{StyleID: w.headerStyle, Value: h}
+	}
+	return w.setRow(cells)
+}
+
+// WriteRow writes a row of cells. Values may be strings, ints, float64s, Decimals, bools
+// or times, which are written as dates; a zero time or nil leaves the cell empty.
+func (w *Writer) WriteRow(values []interface{}) error {
+	cells := make([]interface{}, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil, string, int, float64, bool:
+			cells[i] = v
+		case Decimal:
+			cells[i] = excelize.Cell{StyleID: w.decimalStyle, Value: float64(v)}
+		case time.Time:
+			if v.IsZero() {
+				continue
+			}
+			day := time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)
+			cells[i] = excelize.Cell{StyleID: w.dateStyle, Value: day}
+		default:
+			return fmt.Errorf("xlsx: cannot write a value of type %T", v)
+		}
+	}
+	return w.setRow(cells)
+}
+
+func (w *Writer) setRow(cells []interface{}) error {
+	w.rows++
+	cell, err := excelize.CoordinatesToCellName(1, w.rows)
+	if err != nil {
+		return err
+	}
+	return w.stream.SetRow(cell, cells)
+}
+
+// Close finishes the sheet and writes the workbook. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	defer w.file.Close()
+	if err := w.stream.Flush(); err != nil {
+		return err
+	}
+	return w.file.Write(w.w)
+}
@@ -0,0 +1,102 @@
+package xlsx
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "Reservations & more", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = w.WriteHeader([]string{"Name", "Arrival", "Nights", "Total", "Processed"})
+	err = w.WriteRow([]interface{}{"Smith <Jr>", time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), 2, Decimal(200.5), true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.WriteRow([]interface{}{"", time.Time{}, nil, 1.25, false})
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if sheets := f.GetSheetList(); len(sheets) != 1 || sheets[0] != "Reservations & more" {
+		t.Fatalf("expected one sheet called Reservations & more, got %v", sheets)
+	}
+	sheet := "Reservations & more"
+
+	expected := map[string]string{
+		"A1": "Name",
+		"A2": "Smith <Jr>",
+		"B2": "01-01-50",
+		"C2": "2",
+		"D2": "200.50",
+		"E2": "TRUE",
+		"A3": "",
+		"B3": "",
+		"D3": "1.25",
+		"E3": "FALSE",
+	}
+	for cell, e := range expected {
+		got, err := f.GetCellValue(sheet, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != e {
+			t.Errorf("%s: expected %q, got %q", cell, e, got)
+		}
+	}
+
+	raw, _ := f.GetCellValue(sheet, "B2", excelize.Options{RawCellValue: true})
+	if raw != "54789" {
+		t.Errorf("expected the arrival to be stored as day 54789, got %s", raw)
+	}
+
+	style, _ := f.GetCellStyle(sheet, "A1")
+	s, err := f.GetStyle(style)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Font == nil || !s.Font.Bold {
+		t.Error("expected the header to be bold")
+	}
+}
+
+func TestWriter_Places(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, "Sheet1", 0)
+	_ = w.WriteRow([]interface{}{Decimal(1500)})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got, _ := f.GetCellValue("Sheet1", "A1"); got != "1500" {
+		t.Errorf("expected 1500 with no decimal places, got %s", got)
+	}
+}
+
+func TestWriter_UnsupportedType(t *testing.T) {
+	w, _ := NewWriter(io.Discard, "Sheet1", 2)
+	if err := w.WriteRow([]interface{}{struct{}{}}); err == nil {
+		t.Error("expected an error for an unsupported value")
+	}
+}
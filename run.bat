@@ -1,2 +1,2 @@
 go build -o bookings.exe cmd/web/.
-bookings.exe -dbname=bookings -dbuser=postgres -dbpwd=postgres -cache=false -production=false
\ No newline at end of file
+bookings.exe -dbname=bookings -dbuser=postgres -dbpwd=postgres -cache=false -production=false -paymentgateway=fake -paymentsecret=dev-webhook-secret
\ No newline at end of file
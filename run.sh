@@ -1,4 +1,4 @@
 #!/bin/bash
 
 go build -o bookings cmd/web/*.go
-./bookings -dbname=bookings -dbuser=postgres -dbpwd=postgres -cache=false -production=false
\ No newline at end of file
+./bookings -dbname=bookings -dbuser=postgres -dbpwd=postgres -cache=false -production=false -paymentgateway=fake -paymentsecret=dev-webhook-secret
\ No newline at end of file
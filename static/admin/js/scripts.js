@@ -20,4 +20,128 @@ window.onload = function() {
             tag.classList.remove('active')
         }
     })
-};
\ No newline at end of file
+};
+// Global search: suggestions are fetched as you type. Up and down move through them, enter
+// opens the selected one or the full results page, escape closes them and / jumps to the box.
+(function() {
+    const form = document.getElementById("admin-search")
+    if (!form) {
+        return
+    }
+    const input = document.getElementById("admin-search-input")
+    const menu = document.getElementById("admin-search-results")
+    let timer = null
+    let selected = -1
+
+    function items() {
+        return Array.from(menu.querySelectorAll(".dropdown-item"))
+    }
+
+    function close() {
+        menu.classList.remove("show")
+        input.setAttribute("aria-expanded", "false")
+        selected = -1
+    }
+
+    function select(i) {
+        const links = items()
+        links.forEach((a, j) => {
+            a.classList.toggle("active", i === j)
+            a.setAttribute("aria-selected", i === j ? "true" : "false")
+        })
+        selected = i
+    }
+
+    function show(data) {
+        menu.replaceChildren()
+        data.groups.forEach((group) => {
+            const header = document.createElement("h6")
+            header.className = "dropdown-header"
+            header.textContent = group.name
+            menu.appendChild(header)
+
+            group.results.forEach((result) => {
+                const a = document.createElement("a")
+                a.className = "dropdown-item"
+                a.href = result.url
+                a.setAttribute("role", "option")
+
+                const title = document.createElement("div")
+                title.textContent = result.title
+                const detail = document.createElement("div")
+                detail.className = "small text-muted"
+                detail.textContent = result.detail
+                a.append(title, detail)
+                menu.appendChild(a)
+            })
+        })
+
+        if (data.groups.length === 0) {
+            const empty = document.createElement("span")
+            empty.className = "dropdown-item-text text-muted"
+            empty.textContent = "No matches"
+            menu.appendChild(empty)
+        }
+
+        selected = -1
+        menu.classList.add("show")
+        input.setAttribute("aria-expanded", "true")
+    }
+
+    input.addEventListener("input", () => {
+        clearTimeout(timer)
+        const q = input.value.trim()
+        if (q.length < 2) {
+            close()
+            return
+        }
+        timer = setTimeout(() => {
+            fetch("/admin/search-json?q=" + encodeURIComponent(q))
+                .then((response) => response.ok ? response.json() : Promise.reject(response))
+                .then((data) => {
+                    if (data.query === input.value.trim()) {
+                        show(data)
+                    }
+                })
+                .catch(() => close())
+        }, 200)
+    })
+
+    input.addEventListener("keydown", (e) => {
+        const links = items()
+        switch (e.key) {
+            case "ArrowDown":
+                if (links.length > 0) {
+                    e.preventDefault()
+                    select((selected + 1) % links.length)
+                }
+                break
+            case "ArrowUp":
+                if (links.length > 0) {
+                    e.preventDefault()
+                    select(selected <= 0 ? links.length - 1 : selected - 1)
+                }
+                break
+            case "Enter":
+                if (selected >= 0 && menu.classList.contains("show")) {
+                    e.preventDefault()
+                    location.href = links[selected].href
+                }
+                break
+            case "Escape":
+                close()
+                break
+        }
+    })
+
+    input.addEventListener("blur", () => setTimeout(close, 150))
+
+    document.addEventListener("keydown", (e) => {
+        const tag = document.activeElement.tagName
+        if (e.key === "/" && tag !== "INPUT" && tag !== "TEXTAREA" && tag !== "SELECT") {
+            e.preventDefault()
+            input.focus()
+            input.select()
+        }
+    })
+})();